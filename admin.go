@@ -0,0 +1,230 @@
+package integram
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// adminCommandName is the command available in all bots for the users listed in the INTEGRAM_ADMIN_IDS. It isn't shown in the /help and in the Telegram's commands menu
+const adminCommandName = "admin"
+
+// adminCommands are the subcommands of /admin, e.g. /admin stats week
+var adminCommands []Command
+
+var errAdminCommandUsage = errors.New("wrong arguments, send /admin to see the usage")
+
+func init() {
+	// initialized here because /admin lists the adminCommands
+	adminCommands = []Command{
+		{Name: "stats", Description: "Stats summary for today or the week: /admin stats [week]", Handler: statsCommandHandler},
+		{Name: "blacklist", Description: "Stop sending messages to the chat: /admin blacklist <chat_id>", Handler: blacklistCommandHandler},
+		{Name: "unblacklist", Description: "Remove the chat from the blacklist: /admin unblacklist <chat_id>", Handler: unblacklistCommandHandler},
+		{Name: "ratelimit", Description: "Toggle the webhooks rate limit for the chat: /admin ratelimit <chat_id> on|off", Handler: rateLimitCommandHandler},
+		{Name: "chat", Description: "Show chat's hooks, settings and protected data: /admin chat <chat_id>", Handler: chatInfoCommandHandler},
+		{Name: "resetoauth", Description: "Reset user's OAuth token for this service: /admin resetoauth <user_id>", Handler: resetOAuthCommandHandler},
+		{Name: "queue", Description: "Jobs queue status", Handler: queueCommandHandler},
+		{Name: "health", Description: "Instance health", Handler: healthCommandHandler},
+	}
+}
+
+func adminCommandByName(name string) *Command {
+	for i := range adminCommands {
+		if adminCommands[i].Name == name {
+			return &adminCommands[i]
+		}
+	}
+	return nil
+}
+
+// adminCommandAllowedIn returns true for the private chats and the INTEGRAM_ADMIN_CHAT_ID. Admin commands reveal the protected data so they are rejected in other chats
+func adminCommandAllowedIn(chat Chat) bool {
+	return chat.IsPrivate() || Config.AdminChatID != 0 && chat.ID == Config.AdminChatID
+}
+
+// handleAdminCommand routes /admin <subcommand> [args]
+func (c *Context) handleAdminCommand(args string) error {
+	if !adminCommandAllowedIn(c.Chat) {
+		return c.NewMessage().SetText("Admin commands are available only in the private chat with the bot or in the admin chat").Send()
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if fields[0] == "" {
+		return adminHelpCommandHandler(c, "")
+	}
+
+	cmd := adminCommandByName(strings.ToLower(fields[0]))
+	if cmd == nil {
+		return adminReply(c, "", errAdminCommandUsage)
+	}
+
+	args = ""
+	if len(fields) > 1 {
+		args = fields[1]
+	}
+	return cmd.Handler(c, args)
+}
+
+// adminTokenValid checks the "Authorization: Bearer <INTEGRAM_ADMIN_TOKEN>" header. Always false if the token is not set
+func adminTokenValid(c *gin.Context) bool {
+	if Config.AdminToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(Config.AdminToken)) == 1
+}
+
+// adminReply sends the command's result. Errors are sent to the admin instead of being only logged
+func adminReply(c *Context, text string, err error) error {
+	if err != nil {
+		text = "Error: " + html.EscapeString(err.Error())
+	}
+	return c.NewMessage().SetText(text).EnableHTML().Send()
+}
+
+func parseAdminID(args string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil || id == 0 {
+		return 0, errAdminCommandUsage
+	}
+	return id, nil
+}
+
+func adminHelpCommandHandler(c *Context, args string) error {
+	text := "Admin commands:\n"
+	for _, cmd := range adminCommands {
+		text += "/" + adminCommandName + " " + cmd.Name + " – " + html.EscapeString(cmd.Description) + "\n"
+	}
+	return adminReply(c, text, nil)
+}
+
+func blacklistCommandHandler(c *Context, args string) error {
+	chatID, err := parseAdminID(args)
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	_, err = c.Storage().C("chats").UpsertId(chatID, bson.M{"$set": bson.M{"blacklisted": true}})
+	return adminReply(c, fmt.Sprintf("Chat %d blacklisted. Messages to it will be dropped", chatID), err)
+}
+
+func unblacklistCommandHandler(c *Context, args string) error {
+	chatID, err := parseAdminID(args)
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	err = c.Storage().C("chats").UpdateId(chatID, bson.M{"$unset": bson.M{"blacklisted": ""}})
+	return adminReply(c, fmt.Sprintf("Chat %d removed from the blacklist", chatID), err)
+}
+
+func rateLimitCommandHandler(c *Context, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) != 2 || fields[1] != "on" && fields[1] != "off" {
+		return adminReply(c, "", errAdminCommandUsage)
+	}
+
+	chatID, err := parseAdminID(fields[0])
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	if fields[1] == "off" {
+		err = c.Storage().C("chats").UpdateId(chatID, bson.M{"$set": bson.M{"ignoreratelimit": true}})
+		return adminReply(c, fmt.Sprintf("Webhooks rate limit disabled for chat %d", chatID), err)
+	}
+
+	err = c.Storage().C("chats").UpdateId(chatID, bson.M{"$unset": bson.M{"ignoreratelimit": ""}})
+	return adminReply(c, fmt.Sprintf("Webhooks rate limit enabled for chat %d", chatID), err)
+}
+
+func chatInfoCommandHandler(c *Context, args string) error {
+	chatID, err := parseAdminID(args)
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	info := bson.M{}
+	err = c.Storage().C("chats").FindId(chatID).Select(bson.M{"keyboardperbot": 0, "membersids": 0}).One(&info)
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	return adminReply(c, "<pre>"+html.EscapeString(string(data))+"</pre>", nil)
+}
+
+func resetOAuthCommandHandler(c *Context, args string) error {
+	userID, err := parseAdminID(args)
+	if err != nil {
+		return adminReply(c, "", err)
+	}
+
+	ctx := *c
+	ctx.User = User{ID: userID, ctx: &ctx}
+
+	err = ctx.User.ResetOAuthToken()
+	return adminReply(c, fmt.Sprintf("OAuth token of user %d reset for %s", userID, c.ServiceName), err)
+}
+
+func queueCommandHandler(c *Context, args string) error {
+	pools := jobBackend.Pools()
+	if len(pools) == 0 {
+		return adminReply(c, "No job pools on this instance", nil)
+	}
+
+	keys := make([]string, 0, len(pools))
+	for key := range pools {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	text := "Jobs queue:\n"
+	for _, key := range keys {
+		n, err := pools[key].QueueLen()
+		if err != nil {
+			text += fmt.Sprintf("%s: error %s\n", key, html.EscapeString(err.Error()))
+			continue
+		}
+		text += fmt.Sprintf("%s: %d\n", key, n)
+	}
+	return adminReply(c, text, nil)
+}
+
+func healthCommandHandler(c *Context, args string) error {
+	status := "OK"
+	if err := healthCheck(c.Storage()); err != nil {
+		status = html.EscapeString(err.Error())
+	}
+
+	var names []string
+	serviceMapMutex.RLock()
+	for name := range services {
+		names = append(names, name)
+	}
+	serviceMapMutex.RUnlock()
+	sort.Strings(names)
+
+	text := fmt.Sprintf("Health: %s\nUptime: %s\nInstance mode: %s\nJobs backend: %s\nServices: %s",
+		status,
+		time.Since(startedAt).Truncate(time.Second),
+		Config.InstanceMode,
+		Config.JobsBackend,
+		html.EscapeString(strings.Join(names, ", ")))
+
+	return adminReply(c, text, nil)
+}
@@ -0,0 +1,66 @@
+package integram
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestContext_HandleAdminCommand(t *testing.T) {
+	service := &Service{Name: "servicewithadmin"}
+	newTestBot(t, service, "admin_bot")
+
+	defer func(ids []int64, chatID int64) { Config.AdminIDs, Config.AdminChatID = ids, chatID }(Config.AdminIDs, Config.AdminChatID)
+	Config.AdminIDs = []int64{1}
+	Config.AdminChatID = -10
+
+	var sent []string
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error {
+		sent = append(sent, m.Text)
+		return nil
+	}}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	db := NewMemoryStorage()
+	db.C("chats").Insert(bson.M{"_id": int64(-5), "hooks": []bson.M{{"token": "c123"}}})
+
+	tests := []struct {
+		chat    Chat
+		userID  int64
+		text    string
+		handled bool
+		sent    string
+		query   bson.M
+	}{
+		{Chat{ID: 2, Type: "private"}, 2, "/admin blacklist -5", false, "", nil},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin", true, "/admin blacklist", nil},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin blacklist", true, "Error: " + errAdminCommandUsage.Error(), nil},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin unknown", true, "Error: " + errAdminCommandUsage.Error(), nil},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin blacklist -5", true, "Chat -5 blacklisted", bson.M{"_id": int64(-5), "blacklisted": true}},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin unblacklist -5", true, "Chat -5 removed from the blacklist", bson.M{"_id": int64(-5), "blacklisted": bson.M{"$exists": false}}},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin ratelimit -5 off", true, "Webhooks rate limit disabled for chat -5", bson.M{"_id": int64(-5), "ignoreratelimit": true}},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin ratelimit -5 on", true, "Webhooks rate limit enabled for chat -5", bson.M{"_id": int64(-5), "ignoreratelimit": bson.M{"$exists": false}}},
+		{Chat{ID: 1, Type: "private"}, 1, "/admin chat -5", true, "c123", nil},
+		{Chat{ID: -10, Type: "group"}, 1, "/admin chat -5", true, "c123", nil},
+		{Chat{ID: -11, Type: "group"}, 1, "/admin chat -5", true, "only in the private chat", nil},
+		{Chat{ID: 1, Type: "private"}, 1, "/chat -5", false, "", nil},
+	}
+	for _, tt := range tests {
+		sent = nil
+		ctx := &Context{ServiceName: service.Name, Chat: tt.chat, User: User{ID: tt.userID}, Message: &IncomingMessage{Message: Message{Text: tt.text}}}
+		ctx.SetStorage(db)
+
+		if handled := ctx.handleCommand(); handled != tt.handled {
+			t.Errorf("%q. handleCommand() = %v, want %v", tt.text, handled, tt.handled)
+		}
+		if tt.sent == "" && len(sent) > 0 || tt.sent != "" && (len(sent) != 1 || !strings.Contains(sent[0], tt.sent)) {
+			t.Errorf("%q. handleCommand() sent %v, want %q", tt.text, sent, tt.sent)
+		}
+		if tt.query != nil {
+			if n, _ := db.C("chats").Find(tt.query).Count(); n != 1 {
+				t.Errorf("%q. chat not found by %v", tt.text, tt.query)
+			}
+		}
+	}
+}
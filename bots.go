@@ -4,7 +4,9 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -16,10 +18,8 @@ import (
 	"crypto/md5"
 	"github.com/kennygrant/sanitize"
 
-	"github.com/requilence/jobs"
 	tg "github.com/requilence/telegram-bot-api"
 	log "github.com/sirupsen/logrus"
-	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -46,7 +46,7 @@ type Bot struct {
 	services []*Service
 
 	// Used to store long-pulling updates channel and survive panics
-	updatesChan <-chan tg.Update
+	updatesChan <-chan tgUpdate
 	API         *tg.BotAPI
 }
 
@@ -123,23 +123,33 @@ type IncomingMessage struct {
 // OutgoingMessage specispecifiesfy data of performing or performed outgoing message
 type OutgoingMessage struct {
 	Message              `bson:",inline"`
-	KeyboardHide         bool           `bson:",omitempty"`
-	ResizeKeyboard       bool           `bson:",omitempty"`
-	KeyboardMarkup       Keyboard       `bson:"-"`
-	InlineKeyboardMarkup InlineKeyboard `bson:",omitempty"`
-	Keyboard             bool           `bson:",omitempty"`
-	ParseMode            string         `bson:",omitempty"`
-	OneTimeKeyboard      bool           `bson:",omitempty"`
-	Selective            bool           `bson:",omitempty"`
-	ForceReply           bool           `bson:",omitempty"` // in the private dialog assume user's message as the reply for the last message sent by the bot if bot's message has Reply handler and ForceReply set
-	WebPreview           bool           `bson:",omitempty"`
-	Silent               bool           `bson:",omitempty"`
-	FilePath             string         `bson:",omitempty"`
-	FileName             string         `bson:",omitempty"`
-	FileType             string         `bson:",omitempty"`
-	FileRemoveAfter      bool           `bson:",omitempty"`
-	SendAfter            *time.Time     `bson:",omitempty"`
+	KeyboardHide         bool             `bson:",omitempty"`
+	ResizeKeyboard       bool             `bson:",omitempty"`
+	KeyboardMarkup       Keyboard         `bson:"-"`
+	InlineKeyboardMarkup InlineKeyboard   `bson:",omitempty"`
+	Keyboard             bool             `bson:",omitempty"`
+	ParseMode            string           `bson:",omitempty"`
+	OneTimeKeyboard      bool             `bson:",omitempty"`
+	Selective            bool             `bson:",omitempty"`
+	ForceReply           bool             `bson:",omitempty"` // in the private dialog assume user's message as the reply for the last message sent by the bot if bot's message has Reply handler and ForceReply set
+	WebPreview           bool             `bson:",omitempty"`
+	Silent               bool             `bson:",omitempty"`
+	Urgent               bool             `bson:",omitempty"` // bypasses the chat's quiet hours
+	FilePath             string           `bson:",omitempty"`
+	FileName             string           `bson:",omitempty"`
+	FileType             string           `bson:",omitempty"`
+	FileRemoveAfter      bool             `bson:",omitempty"`
+	FileURL              string           `bson:",omitempty"` // remote file that Telegram downloads by itself
+	FileID               string           `bson:",omitempty"` // file already uploaded to Telegram
+	TextParts            []string         `bson:",omitempty"` // follow-up parts of the long text, sent one by one after this message
+	MediaGroup           []MediaGroupItem `bson:",omitempty"` // album of photos, videos or documents. Each item is stored as a separate message with the same EventID
+	Venue                *Venue           `bson:",omitempty"`
+	Contact              *Contact         `bson:",omitempty"`
+	Poll                 *Poll            `bson:",omitempty"`
+	SendAfter            *time.Time       `bson:",omitempty"`
+	RateLimitSlot        *time.Time       `bson:"-"` // slot reserved within the outgoing rate limits for the rescheduled message
 	processed            bool
+	fileReader           io.Reader // saved into the spool dir on Send
 	ctx                  *Context
 }
 
@@ -220,6 +230,45 @@ func (c *Bot) webhookURL() *url.URL {
 	return url
 }
 
+// webhookSecretToken returns the token Telegram sends in X-Telegram-Bot-Api-Secret-Token header of webhook requests
+func (c *Bot) webhookSecretToken() string {
+	return compactHash("webhook:" + c.tgToken())
+}
+
+// setWebhook asks Telegram to deliver bot's updates to the webhookURL instead of long polling
+func (c *Bot) setWebhook() error {
+	_, err := c.API.MakeRequest("setWebhook", url.Values{
+		"url":          {c.webhookURL().String()},
+		"secret_token": {c.webhookSecretToken()},
+	})
+
+	return err
+}
+
+// removeWebhook removes previously set webhook, otherwise Telegram will refuse to return updates via long polling
+func (c *Bot) removeWebhook() error {
+	info, err := c.API.GetWebhookInfo()
+	if err != nil {
+		return err
+	}
+
+	if info.URL == "" {
+		return nil
+	}
+
+	_, err = c.API.RemoveWebhook()
+	if err != nil {
+		return err
+	}
+
+	log.WithField("botID", c.ID).Infof("Webhook %s removed, switching back to the long polling", info.URL)
+
+	return nil
+}
+
+// TGHTTPClient is used for the Bot API requests. Replace it before the Register, e.g. to use the fake Bot API server from tgtest package
+var TGHTTPClient = &http.Client{}
+
 func (service *Service) registerBot(fullTokenWithID string) error {
 
 	s := botTokenRE.FindStringSubmatch(fullTokenWithID)
@@ -238,7 +287,7 @@ func (service *Service) registerBot(fullTokenWithID string) error {
 		botPerID[id] = &bot
 
 		token := bot.tgToken()
-		bot.API, err = tg.NewBotAPI(token)
+		bot.API, err = tg.NewBotAPIWithClient(token, TGHTTPClient)
 		if err != nil {
 			log.WithError(err).WithField("token", token).Error("NewBotAPI returned error")
 			return err
@@ -594,10 +643,10 @@ func (c *Context) FindMessageByEventID(id string) (*Message, error) {
 	if c.Bot() == nil {
 		return nil, errors.New("Bot not set for the service")
 	}
-	return findMessageByEventID(c.db, c.Chat.ID, c.Bot().ID, id)
+	return findMessageByEventID(c.Storage(), c.Chat.ID, c.Bot().ID, id)
 }
 
-func findMessageByEventID(db *mgo.Database, chatID int64, botID int64, eventID string) (*Message, error) {
+func findMessageByEventID(db Storage, chatID int64, botID int64, eventID string) (*Message, error) {
 	msg := OutgoingMessage{}
 
 	err := db.C("messages").Find(bson.M{"chatid": chatID, "botid": botID, "eventid": eventID}).Sort("-_id").One(&msg)
@@ -608,7 +657,7 @@ func findMessageByEventID(db *mgo.Database, chatID int64, botID int64, eventID s
 	return &msg.Message, nil
 }
 
-func findMessageByBsonID(db *mgo.Database, id bson.ObjectId) (*Message, error) {
+func findMessageByBsonID(db Storage, id bson.ObjectId) (*Message, error) {
 	if !id.Valid() {
 		return nil, errors.New("BSON ObjectId is not valid")
 	}
@@ -621,7 +670,7 @@ func findMessageByBsonID(db *mgo.Database, id bson.ObjectId) (*Message, error) {
 	return &msg.Message, nil
 }
 
-func findMessage(db *mgo.Database, chatID int64, botID int64, msgID int) (*Message, error) {
+func findMessage(db Storage, chatID int64, botID int64, msgID int) (*Message, error) {
 	msg := OutgoingMessage{}
 	err := db.C("messages").Find(bson.M{"chatid": chatID, "botid": botID, "msgid": msgID}).One(&msg)
 	if err != nil {
@@ -631,7 +680,7 @@ func findMessage(db *mgo.Database, chatID int64, botID int64, msgID int) (*Messa
 	return &msg.Message, nil
 }
 
-func findInlineMessage(db *mgo.Database, botID int64, inlineMsgID string) (*Message, error) {
+func findInlineMessage(db Storage, botID int64, inlineMsgID string) (*Message, error) {
 	msg := OutgoingMessage{}
 	err := db.C("messages").Find(bson.M{"botid": botID, "inlinemsgid": inlineMsgID}).One(&msg)
 	if err != nil {
@@ -641,7 +690,7 @@ func findInlineMessage(db *mgo.Database, botID int64, inlineMsgID string) (*Mess
 	return &msg.Message, nil
 }
 
-func findLastOutgoingMessageInChat(db *mgo.Database, botID int64, chatID int64) (*Message, error) {
+func findLastOutgoingMessageInChat(db Storage, botID int64, chatID int64) (*Message, error) {
 
 	msg := OutgoingMessage{}
 	err := db.C("messages").Find(bson.M{"chatid": chatID, "botid": botID, "fromid": botID}).Sort("-msgid").One(&msg)
@@ -652,7 +701,7 @@ func findLastOutgoingMessageInChat(db *mgo.Database, botID int64, chatID int64)
 	return &msg.Message, nil
 }
 
-func findLastMessageInChat(db *mgo.Database, botID int64, chatID int64) (*Message, error) {
+func findLastMessageInChat(db Storage, botID int64, chatID int64) (*Message, error) {
 
 	msg := OutgoingMessage{}
 	err := db.C("messages").Find(bson.M{"chatid": chatID, "botid": botID}).Sort("-msgid").One(&msg)
@@ -724,6 +773,12 @@ func (m *OutgoingMessage) SetSilent(b bool) *OutgoingMessage {
 	return m
 }
 
+// SetUrgent makes the notification bypass the chat's quiet hours
+func (m *OutgoingMessage) SetUrgent(b bool) *OutgoingMessage {
+	m.Urgent = b
+	return m
+}
+
 // SetOneTimeKeyboard sets the Onetime mode for keyboard. Keyboard will be hided after 1st use
 func (m *OutgoingMessage) SetOneTimeKeyboard(b bool) *OutgoingMessage {
 	m.OneTimeKeyboard = b
@@ -906,8 +961,8 @@ func (t scheduleMessageSender) Send(m *OutgoingMessage) error {
 	}
 
 	if m.AntiFlood {
-		db := mongoSession.Clone().DB(mongo.Database)
-		defer db.Session.Close()
+		db := cloneStorage()
+		defer db.Close()
 		msg, _ := findLastOutgoingMessageInChat(db, m.BotID, m.ChatID)
 		if msg != nil && msg.om.TextHash == m.GetTextHash() && time.Now().Sub(msg.Date).Seconds() < antiFloodSameMessageTimeout {
 			//log.Errorf("flood. mins %v", time.Now().Sub(msg.Date).Minutes())
@@ -927,24 +982,28 @@ func (t scheduleMessageSender) Send(m *OutgoingMessage) error {
 	}
 
 	if m.ParseMode == "HTML" {
-		text := ""
-		var err error
-		if m.FilePath == "" {
-			text, err = sanitize.HTMLAllowing(m.Text, []string{"a", "b", "strong", "i", "em", "a", "code", "pre"}, []string{"href"})
-		} else {
-			// formatiing is not supported for file captions
-			text = sanitize.HTML(m.Text)
-		}
+		// captions of files are formatted the same way as texts
+		text, err := sanitize.HTMLAllowing(m.Text, tgHTMLTags, tgHTMLAttributes)
 
 		if err == nil && text != "" {
 			m.Text = text
 		}
-	} else {
+	} else if m.ParseMode == "" {
+		// Markdown texts are sent as is, sanitizing would strip the quotes and line breaks
 		text := sanitize.HTML(m.Text)
 		if text != "" {
 			m.Text = text
 		}
 	}
+
+	// media group captions are formatted the same way as texts
+	for i := range m.MediaGroup {
+		m.MediaGroup[i].Caption = sanitizeCaption(m.MediaGroup[i].Caption, m.ParseMode)
+	}
+
+	m.splitLongText()
+	m.checkQuietHours()
+
 	var sendAfter time.Time
 	if m.SendAfter != nil {
 		sendAfter = *m.SendAfter
@@ -961,6 +1020,26 @@ func (t scheduleMessageSender) Send(m *OutgoingMessage) error {
 	return err
 }
 
+// sanitizeCaption removes the tags that Telegram doesn't support from the HTML caption and all tags from the plain one. Markdown captions are kept as is
+func sanitizeCaption(caption string, parseMode string) string {
+	var text string
+	var err error
+
+	switch parseMode {
+	case "HTML":
+		text, err = sanitize.HTMLAllowing(caption, tgHTMLTags, tgHTMLAttributes)
+	case "":
+		text = sanitize.HTML(caption)
+	default:
+		return caption
+	}
+
+	if err != nil || text == "" {
+		return caption
+	}
+	return text
+}
+
 // Send put the message to the jobs queue
 func (m *OutgoingMessage) Send() error {
 	if m.ChatID == 0 {
@@ -971,8 +1050,24 @@ func (m *OutgoingMessage) Send() error {
 		return errors.New("BotID is empty")
 	}
 
-	if m.Text == "" && m.FilePath == "" && m.Location == nil {
-		return errors.New("Text, FilePath and Location are empty")
+	if m.Text == "" && !m.hasFile() && m.Location == nil && len(m.MediaGroup) == 0 && m.Venue == nil && m.Contact == nil && m.Poll == nil {
+		return errors.New("Text, file, Location, MediaGroup, Venue, Contact and Poll are empty")
+	}
+
+	if len(m.MediaGroup) > 0 {
+		if err := m.validateMediaGroup(); err != nil {
+			return err
+		}
+	}
+
+	if m.Poll != nil {
+		if err := m.validatePoll(); err != nil {
+			return err
+		}
+	}
+
+	if err := m.spoolFileReader(); err != nil {
+		return err
 	}
 
 	if m.ctx != nil && m.ctx.messageAnsweredAt == nil {
@@ -980,7 +1075,11 @@ func (m *OutgoingMessage) Send() error {
 		m.ctx.messageAnsweredAt = &n
 	}
 
-	return activeMessageSender.Send(m)
+	err := activeMessageSender.Send(m)
+	if err != nil {
+		m.removeSpooledFile()
+	}
+	return err
 }
 
 // SetSendAfter set the time to send the message
@@ -1039,12 +1138,23 @@ func (m *OutgoingMessage) EnableHTML() *OutgoingMessage {
 	return m
 }
 
-// SetParseMode sets parseMode: 'HTML' and 'markdown' supporting for now
+// EnableMarkdownV2 sets parseMode to MarkdownV2
+func (m *OutgoingMessage) EnableMarkdownV2() *OutgoingMessage {
+	m.ParseMode = ParseModeMarkdownV2
+	return m
+}
+
+// SetParseMode sets parseMode: 'HTML', 'Markdown' or 'MarkdownV2'
 func (m *OutgoingMessage) SetParseMode(s string) *OutgoingMessage {
 	m.ParseMode = s
 	return m
 }
 
+// RichText returns the formatter matching the message's parseMode, so the text can be built regardless of it
+func (m *OutgoingMessage) RichText() RichText {
+	return NewRichText(m.ParseMode)
+}
+
 // SetReplyToMsgID sets parseMode: 'HTML' and 'markdown' supporting for now
 func (m *OutgoingMessage) SetReplyToMsgID(id int) *OutgoingMessage {
 	m.ReplyToMsgID = id
@@ -1060,7 +1170,7 @@ func (m *Message) GetTextHash() string {
 }
 
 // UpdateEventsID sets the event id and update it in DB
-func (m *Message) UpdateEventsID(db *mgo.Database, eventID ...string) error {
+func (m *Message) UpdateEventsID(db Storage, eventID ...string) error {
 	m.EventID = append(m.EventID, eventID...)
 	f := bson.M{"botid": m.BotID}
 	if m.InlineMsgID != "" {
@@ -1073,7 +1183,7 @@ func (m *Message) UpdateEventsID(db *mgo.Database, eventID ...string) error {
 }
 
 // Update will update existing message in DB
-func (m *Message) Update(db *mgo.Database) error {
+func (m *Message) Update(db Storage) error {
 
 	if m.ID.Valid() {
 		return db.C("messages").UpdateId(m.ID, bson.M{"$set": m})
@@ -1089,32 +1199,34 @@ func initBots() error {
 	}
 
 	gob.Register(&OutgoingMessage{})
+	gob.Register(&messageEdit{})
 
-	var tgPool *jobs.Pool
+	var tgPool JobPool
 	if Config.IsMainInstance() || Config.IsSingleProcessInstance() {
 
-		tgPool, err = jobs.NewPool(&jobs.PoolConfig{
-			Key:        "_telegram",
-			NumWorkers: Config.TGPool,
-			BatchSize:  Config.TGPoolBatchSize,
-		})
+		tgPool, err = jobBackend.NewPool("_telegram", Config.TGPool, Config.TGPoolBatchSize)
 
 		if err != nil {
 			return err
 		}
 
 		tgPool.SetMiddleware(beforeJob)
-		tgPool.SetAfterFunc(afterJob)
+		tgPool.SetAfterFunc(afterJobInPool("_telegram"))
 
 		log.Infof("Job pool %v[%d] is ready", "_telegram", Config.TGPool)
 	}
 	// 23 retries mean maximum of 8 hours deferment (fibonacci sequence)
-	sendMessageJob, err = jobs.RegisterTypeWithPoolKey("sendMessage", "_telegram", 23, sendMessage)
+	sendMessageJob, err = jobBackend.RegisterType("sendMessage", "_telegram", 23, JobRetryFibonacci, sendMessage)
 	if err != nil {
 		log.WithError(err).Panic("RegisterTypeWithPoolKey sendMessage failed")
 	}
 
-	ensureStandAloneServiceJob, err = jobs.RegisterTypeWithPoolKey("ensureStandAloneService", "_telegram", 1, ensureStandAloneService)
+	editMessageJob, err = jobBackend.RegisterType("editMessage", "_telegram", editMessageJobRetries, JobRetryFibonacci, editMessage)
+	if err != nil {
+		log.WithError(err).Panic("RegisterTypeWithPoolKey editMessage failed")
+	}
+
+	ensureStandAloneServiceJob, err = jobBackend.RegisterType("ensureStandAloneService", "_telegram", 1, JobRetryFibonacci, ensureStandAloneService)
 
 	if err != nil {
 		log.WithError(err).Panic("RegisterTypeWithPoolKey ensureService failed")
@@ -1128,13 +1240,23 @@ func initBots() error {
 				continue
 			}
 			if !service.UseWebhookInsteadOfLongPolling {
+				err := bot.removeWebhook()
+				if err != nil {
+					log.WithError(err).WithField("botID", bot.ID).Error("Error on removing the webhook")
+				}
 				bot.listen()
 			} else {
-				_, err := bot.API.SetWebhook(tg.WebhookConfig{URL: bot.webhookURL()})
+				err := bot.setWebhook()
 				if err != nil {
 					log.WithError(err).WithField("botID", bot.ID).Error("Error on initial SetWebhook")
 				}
 			}
+
+			err := bot.setCommands()
+			if err != nil {
+				log.WithError(err).WithField("botID", bot.ID).Error("Error on setMyCommands")
+			}
+
 			log.Infof("%v is performing on behalf of @%v", service.Name, bot.Username)
 		}
 	}
@@ -1150,7 +1272,7 @@ func initBots() error {
 	return nil
 }
 
-var sendMessageJob, ensureStandAloneServiceJob *jobs.Type
+var sendMessageJob, ensureStandAloneServiceJob JobType
 
 func (m *Message) findUsernames() []string {
 	r, _ := regexp.Compile("@([a-zA-Z0-9_]{5,})") // according to TG docs minimum username length is 5
@@ -1413,7 +1535,7 @@ func (m *IncomingMessage) GetFile(c *Context, allowedTypes []FileType, maxSize i
 	return
 }
 
-func detectTargetUsersID(db *mgo.Database, m *Message) []int64 {
+func detectTargetUsersID(db Storage, m *Message) []int64 {
 	if m.ChatID > 0 {
 		return []int64{m.ChatID}
 	}
@@ -1456,10 +1578,11 @@ func sendMessage(m *OutgoingMessage) error {
 	//log.Infof("sendMessage chat=%d ts=%d text=%s",m.ChatID, m.ID.Time().UnixNano(), m.Text)
 	msg := tg.MessageConfig{Text: m.Text, BaseChat: tg.BaseChat{ChatID: m.ChatID}}
 
-	db := mongoSession.Clone().DB(mongo.Database)
-	defer db.Session.Close()
+	db := cloneStorage()
+	defer db.Close()
 	if blacklisted, _ := db.C("chats").Find(bson.M{"_id": m.ChatID, "blacklisted": true}).Count(); blacklisted > 0 {
 		log.Errorf("TG MSG not sent: chat %d blacklisted", m.ChatID)
+		m.removeSpooledFile()
 		return nil
 	}
 
@@ -1472,39 +1595,53 @@ func sendMessage(m *OutgoingMessage) error {
 	if bot == nil {
 		return fmt.Errorf("Can't send TG message: Unknown bot id=%d", m.BotID)
 	}
+
+	if delay := checkTGRateLimit(db, m); delay > 0 {
+		_, err := sendMessageJob.Schedule(0, time.Now().Add(delay), &m)
+		return err
+	}
+
 	var err error
 	var tgMsg tg.Message
+	var tgMsgs []tg.Message
 	var rescheduled bool
 
 	startedAt := time.Now()
-	if m.FilePath != "" {
-		if _, err := os.Stat(m.FilePath); os.IsNotExist(err) {
-			log.Errorf("Can't send message with attachment, file not exists: %s", m.FilePath)
-			return nil
-		}
-
-		if m.FileType == "image" {
-
-			msg := tg.NewPhotoUpload(m.ChatID, m.FilePath)
-			msg.FileName = m.FileName
-			msg.Caption = m.Text
-			if m.ReplyToMsgID != 0 {
-				msg.BaseChat.ReplyToMessageID = m.ReplyToMsgID
-			}
-			tgMsg, err = bot.API.Send(msg)
-
-		} else {
-			msg := tg.NewDocumentUpload(m.ChatID, m.FilePath)
-			msg.FileName = m.FileName
-			msg.Caption = m.Text
-			if m.ReplyToMsgID != 0 {
-				msg.BaseChat.ReplyToMessageID = m.ReplyToMsgID
+	if len(m.MediaGroup) > 0 {
+		var paths []string
+		for _, item := range m.MediaGroup {
+			if _, err := os.Stat(item.FilePath); os.IsNotExist(err) {
+				log.Errorf("Can't send media group, file not exists: %s", item.FilePath)
+				return nil
 			}
-			tgMsg, err = bot.API.Send(msg)
+			paths = append(paths, item.FilePath)
+		}
 
+		tgMsgs, err = sendMediaGroup(bot.API, m)
+		if len(tgMsgs) > 0 {
+			tgMsg = tgMsgs[0]
 		}
 
 		if m.FileRemoveAfter {
+			defer func() {
+				if err == nil && !rescheduled {
+					for _, path := range paths {
+						if err2 := os.Remove(path); err2 != nil {
+							log.WithError(err2).WithField("path", path).Error("Error removing message's file")
+						}
+					}
+				}
+			}()
+		}
+	} else if m.FilePath != "" || m.FileURL != "" || m.FileID != "" {
+		if _, err := os.Stat(m.FilePath); m.FilePath != "" && os.IsNotExist(err) {
+			log.Errorf("Can't send message with attachment, file not exists: %s", m.FilePath)
+			return nil
+		}
+
+		tgMsg, err = sendFile(db, bot.API, m)
+
+		if m.FileRemoveAfter && m.FilePath != "" {
 			defer func() {
 				// message not rescheduled
 				if err == nil && !rescheduled {
@@ -1518,23 +1655,10 @@ func sendMessage(m *OutgoingMessage) error {
 
 	} else if m.Location != nil {
 		tgMsg, err = bot.API.Send(tg.LocationConfig{BaseChat: msg.BaseChat, Latitude: m.Location.Latitude, Longitude: m.Location.Longitude})
+	} else if m.Venue != nil || m.Contact != nil || m.Poll != nil {
+		tgMsg, err = sendMedia(bot.API, m)
 	} else {
-
-		if m.KeyboardHide {
-			msg.ReplyMarkup = tg.ReplyKeyboardRemove{RemoveKeyboard: true, Selective: m.Selective}
-		}
-
-		if m.ForceReply {
-			msg.ReplyMarkup = tg.ForceReply{ForceReply: true, Selective: m.Selective}
-		}
-		// Keyboard will overridde HideKeyboard
-		if m.KeyboardMarkup != nil && len(m.KeyboardMarkup) > 0 {
-			msg.ReplyMarkup = tg.ReplyKeyboardMarkup{Keyboard: m.KeyboardMarkup.tg(), OneTimeKeyboard: m.OneTimeKeyboard, Selective: m.Selective, ResizeKeyboard: m.ResizeKeyboard}
-		}
-
-		if len(m.InlineKeyboardMarkup.Buttons) > 0 {
-			msg.ReplyMarkup = tg.InlineKeyboardMarkup{InlineKeyboard: m.InlineKeyboardMarkup.tg()}
-		}
+		msg.ReplyMarkup = m.tgReplyMarkup()
 
 		msg.DisableWebPagePreview = !m.WebPreview
 
@@ -1551,12 +1675,22 @@ func sendMessage(m *OutgoingMessage) error {
 		tgMsg, err = bot.API.Send(msg)
 	}
 
+	metricTGSend.observe(time.Since(startedAt).Seconds(), tgErrorKind(err))
+
 	if err == nil {
 
 		log.Debugf("TG MSG sent, id = %v %.2f secs spent", tgMsg.MessageID, time.Now().Sub(startedAt).Seconds())
 		m.MsgID = tgMsg.MessageID
 		m.Date = time.Now()
 
+		if len(m.TextParts) > 0 {
+			next := m.nextTextPart()
+			_, err := sendMessageJob.Schedule(0, time.Now(), &next)
+			if err != nil {
+				log.WithField("chat", m.ChatID).WithError(err).Error("Can't schedule sendMessageJob for the next part of the text")
+			}
+		}
+
 		err = saveKeyboard(m, db)
 		if err != nil {
 			log.WithError(err).Error("Error processing keyboard")
@@ -1565,6 +1699,10 @@ func sendMessage(m *OutgoingMessage) error {
 		m.TextHash = m.GetTextHash()
 		m.Text = ""
 
+		if len(tgMsgs) > 1 {
+			saveMediaGroupMessages(db, m, tgMsgs)
+		}
+
 		err = db.C("messages").Insert(&m)
 		if err != nil {
 			log.WithError(err).Error("Error outgoing inserting message in db")
@@ -1598,8 +1736,8 @@ func sendMessage(m *OutgoingMessage) error {
 			// looks like the the chat we trying to send the message is migrated to supergroup
 			log.Warnf("sendMessage error: Migrated to %v", tgErr.Parameters.MigrateToChatID)
 
-			db := mongoSession.Clone().DB(mongo.Database)
-			defer db.Session.Close()
+			db := cloneStorage()
+			defer db.Close()
 			migrateToSuperGroup(db, m.ChatID, tgErr.Parameters.MigrateToChatID)
 
 			// todo: in rare case this can produce duplicate messages for incoming webhooks
@@ -1613,8 +1751,8 @@ func sendMessage(m *OutgoingMessage) error {
 		} else if tgErr.BotStoppedForUser() {
 
 			// Todo: Problems can appear when we rely on this user message (e.g. not webhook msg)
-			db := mongoSession.Clone().DB(mongo.Database)
-			defer db.Session.Close()
+			db := cloneStorage()
+			defer db.Close()
 
 			serviceName := bot.services[0].Name
 
@@ -1626,8 +1764,8 @@ func sendMessage(m *OutgoingMessage) error {
 				if m.BackupChatID != m.ChatID {
 					// if this fall from private messages - add the mention and selective to grace notifications and protect the keyboard
 					if m.ChatID > 0 && m.BackupChatID < 0 {
-						db := mongoSession.Clone().DB(mongo.Database)
-						defer db.Session.Close()
+						db := cloneStorage()
+						defer db.Close()
 						username := findUsernameByID(db, m.ChatID)
 						if username != "" {
 							m.Text = "@" + username + " " + m.Text
@@ -1651,8 +1789,8 @@ func sendMessage(m *OutgoingMessage) error {
 				if m.BackupChatID != m.ChatID {
 					// if this fall from private messages - add the mention and selective to grace notifications and protect the keyboard
 					if m.ChatID > 0 && m.BackupChatID < 0 {
-						db := mongoSession.Clone().DB(mongo.Database)
-						defer db.Session.Close()
+						db := cloneStorage()
+						defer db.Close()
 						username := findUsernameByID(db, m.ChatID)
 						if username != "" {
 							m.Text = "@" + username + " " + m.Text
@@ -1670,8 +1808,8 @@ func sendMessage(m *OutgoingMessage) error {
 			return nil
 		} else if tgErr.BotKicked() {
 
-			db := mongoSession.Clone().DB(mongo.Database)
-			defer db.Session.Close()
+			db := cloneStorage()
+			defer db.Close()
 			serviceName := bot.services[0].Name
 			if len(bot.services) == 1 {
 				removeHooksForChat(db, serviceName, m.ChatID)
@@ -1684,8 +1822,8 @@ func sendMessage(m *OutgoingMessage) error {
 
 			return nil
 		} else if tgErr.ChatDiactivated() {
-			db := mongoSession.Clone().DB(mongo.Database)
-			defer db.Session.Close()
+			db := cloneStorage()
+			defer db.Close()
 			bot := botByID(m.BotID)
 
 			if len(bot.services) == 1 {
@@ -1711,19 +1849,9 @@ func sendMessage(m *OutgoingMessage) error {
 
 			if offset := tgErr.ParseErrorOffset(); offset > -1 {
 
-				var escapedSymbol = ""
-				if m.ParseMode == "Markdown" {
-					log.WithError(tgErr.Err).WithField("chat", m.ChatID).WithField("bot", m.BotID).Error("Bad Markdown in the text")
-
-					mrk := MarkdownRichText{}
-					escapedSymbol = mrk.Esc(m.Text[offset:offset+1])
-				} else {
-					log.WithError(tgErr.Err).WithField("chat", m.ChatID).WithField("bot", m.BotID).Error("Bad HTML in the text")
-
-					mrk := HTMLRichText{}
-					escapedSymbol = mrk.EncodeEntities(m.Text[offset:offset+1])
-				}
+				log.WithError(tgErr.Err).WithField("chat", m.ChatID).WithField("bot", m.BotID).Errorf("Bad %s in the text", m.ParseMode)
 
+				escapedSymbol := m.RichText().Esc(m.Text[offset : offset+1])
 				m.SetText(m.Text[0:offset] + escapedSymbol + m.Text[offset+1:])
 
 				rescheduled = true
@@ -1,12 +1,14 @@
 package integram
 
 import (
+	"encoding/gob"
 	"github.com/requilence/url"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/requilence/integram/tgtest"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	tg "github.com/requilence/telegram-bot-api"
@@ -15,9 +17,11 @@ import (
 	"image/draw"
 	"image/png"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 func TestBot_PMURL(t *testing.T) {
@@ -26,7 +30,7 @@ func TestBot_PMURL(t *testing.T) {
 		Username    string
 		token       string
 		services    []*Service
-		updatesChan <-chan tg.Update
+		updatesChan <-chan tgUpdate
 		API         *tg.BotAPI
 	}
 	type args struct {
@@ -1777,6 +1781,67 @@ func (fms fakeMessageSender) Send(m *OutgoingMessage) error {
 	return fms.sendFunc(m)
 }
 
+var lastTestBotID int64 = 9999999000
+
+// newTestBot registers the service with a fresh bot on the fake Bot API server. Bot, service and the server are removed when the test ends
+func newTestBot(t *testing.T, service *Service, username string) (*tgtest.Server, string) {
+	server := tgtest.NewServer()
+
+	id := atomic.AddInt64(&lastTestBotID, 1)
+	token := strconv.FormatInt(id, 10) + ":fakeToken"
+	server.AddBot(token, username)
+
+	TGHTTPClient = server.Client()
+	services[service.Name] = service
+
+	t.Cleanup(func() {
+		delete(botPerID, id)
+		delete(botPerService, service.Name)
+		delete(services, service.Name)
+		TGHTTPClient = &http.Client{}
+		server.Close()
+	})
+
+	err := service.registerBot(token)
+	if err != nil {
+		t.Fatalf("registerBot() error = %v", err)
+	}
+
+	return server, token
+}
+
+// newTestSendQueue switches to the empty memory storage, disables the outgoing rate limits and executes sendMessage jobs
+// within the started in-process pool. The backend is returned to register other job types. Everything is restored when the test ends
+func newTestSendQueue(t *testing.T) (Storage, JobBackend) {
+	storage, jobType := memoryStorageInstance, sendMessageJob
+	perSecond, private, group := Config.TGRateLimitPerSecond, Config.TGRateLimitPrivatePerSecond, Config.TGRateLimitGroupPerMinute
+
+	memoryStorageInstance = NewMemoryStorage()
+	Config.TGRateLimitPerSecond, Config.TGRateLimitPrivatePerSecond, Config.TGRateLimitGroupPerMinute = 0, 0, 0
+
+	gob.Register(&OutgoingMessage{})
+
+	b := NewInProcessJobBackend("")
+	pool, _ := b.NewPool("_telegram", 1, 10)
+
+	t.Cleanup(func() {
+		pool.Close()
+		sendMessageJob = jobType
+		Config.TGRateLimitPerSecond, Config.TGRateLimitPrivatePerSecond, Config.TGRateLimitGroupPerMinute = perSecond, private, group
+		memoryStorageInstance = storage
+	})
+
+	var err error
+	sendMessageJob, err = b.RegisterType("sendMessage", "_telegram", 23, JobRetryFibonacci, sendMessage)
+	if err != nil {
+		t.Fatalf("RegisterType() error = %v", err)
+	}
+
+	pool.Start()
+
+	return memoryStorageInstance, b
+}
+
 func TestOutgoingMessage_Send(t *testing.T) {
 	chatID, _ := strconv.ParseInt(os.Getenv("INTEGRAM_TEST_USER"), 10, 64)
 
@@ -2338,7 +2403,7 @@ func TestMessage_UpdateEventsID(t *testing.T) {
 	botID, _ := strconv.ParseInt(bt[0], 10, 64)
 
 	type args struct {
-		db      *mgo.Database
+		db      Storage
 		eventID []string
 	}
 	tests := []struct {
@@ -2348,9 +2413,9 @@ func TestMessage_UpdateEventsID(t *testing.T) {
 		wantErr bool
 		want    Message
 	}{
-		{"add first event 1", Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2734"), MsgID: 1234, ChatID: 123, BotID: botID}, args{db, []string{"neweventval"}}, false, Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2734"), EventID: []string{"neweventval"}, MsgID: 1234, ChatID: 123, BotID: botID}},
-		{"add more event", Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2735"), EventID: []string{"eventval"}, MsgID: 1234, ChatID: 123, BotID: botID}, args{db, []string{"neweventval"}}, false, Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2735"), EventID: []string{"eventval", "neweventval"}, MsgID: 1234, ChatID: 123, BotID: botID}},
-		{"add more events", Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2736"), EventID: []string{"eventval", "eventotherval"}, MsgID: 1234, ChatID: 123, BotID: botID}, args{db, []string{"neweventval", "neweventval2"}}, false, Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2736"), EventID: []string{"eventval", "eventotherval", "neweventval", "neweventval2"}, MsgID: 1234, ChatID: 123, BotID: botID}},
+		{"add first event 1", Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2734"), MsgID: 1234, ChatID: 123, BotID: botID}, args{NewMongoStorage(db), []string{"neweventval"}}, false, Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2734"), EventID: []string{"neweventval"}, MsgID: 1234, ChatID: 123, BotID: botID}},
+		{"add more event", Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2735"), EventID: []string{"eventval"}, MsgID: 1234, ChatID: 123, BotID: botID}, args{NewMongoStorage(db), []string{"neweventval"}}, false, Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2735"), EventID: []string{"eventval", "neweventval"}, MsgID: 1234, ChatID: 123, BotID: botID}},
+		{"add more events", Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2736"), EventID: []string{"eventval", "eventotherval"}, MsgID: 1234, ChatID: 123, BotID: botID}, args{NewMongoStorage(db), []string{"neweventval", "neweventval2"}}, false, Message{ID: bson.ObjectIdHex("55b63650ac136a250a5a2736"), EventID: []string{"eventval", "eventotherval", "neweventval", "neweventval2"}, MsgID: 1234, ChatID: 123, BotID: botID}},
 	}
 	for _, tt := range tests {
 		db.C("messages").Insert(tt.m)
@@ -2392,7 +2457,7 @@ func TestMessage_Update(t *testing.T) {
 		om               *OutgoingMessage
 	}
 	type args struct {
-		db *mgo.Database
+		db Storage
 	}
 	tests := []struct {
 		name    string
@@ -2428,3 +2493,58 @@ func TestMessage_Update(t *testing.T) {
 		}
 	}
 }
+
+func TestSendMessage_FakeBotAPI(t *testing.T) {
+	service := &Service{Name: "servicewithfakebot"}
+	server, _ := newTestBot(t, service, "fake_bot")
+
+	// messages limited by the bot's rate limit are rescheduled instead of being sent right away
+	defer func(perSecond int) { Config.TGRateLimitPerSecond = perSecond }(Config.TGRateLimitPerSecond)
+	Config.TGRateLimitPerSecond = 0
+
+	bot := service.Bot()
+	if bot.Username != "fake_bot" {
+		t.Errorf("registerBot() username = %q, want %q", bot.Username, "fake_bot")
+	}
+
+	s := cloneStorage()
+	defer s.Close()
+
+	defer s.C("chats").RemoveAll(bson.M{"_id": bson.M{"$in": []int64{9999999991, -9999999991, -1009999999991}}})
+	defer s.C("messages").RemoveAll(bson.M{"botid": bot.ID})
+
+	s.C("chats").Insert(bson.M{"_id": 9999999991}, bson.M{"_id": -9999999991, "type": "group"})
+
+	m := &OutgoingMessage{Message: Message{BotID: bot.ID, ChatID: 9999999990, Text: "text"}}
+	m.InlineKeyboardMarkup = InlineButtons{{Text: "Yes", Data: "yes"}}.Keyboard()
+
+	err := sendMessage(m)
+	if err != nil {
+		t.Errorf("sendMessage() error = %v", err)
+	}
+
+	sent := server.Messages(9999999990)
+	if len(sent) != 1 || sent[0].Text != "text" || len(sent[0].InlineKeyboard()) != 1 || sent[0].InlineKeyboard()[0][0].Text != "Yes" {
+		t.Errorf("sendMessage() sent %+v, want 'text' with [[Yes]] keyboard", sent)
+	}
+
+	server.BlockBot(9999999991)
+	err = sendMessage(&OutgoingMessage{Message: Message{BotID: bot.ID, ChatID: 9999999991, Text: "text"}})
+	if err != nil {
+		t.Errorf("sendMessage() to blocked chat error = %v", err)
+	}
+
+	if n, _ := s.C("chats").Find(bson.M{"_id": 9999999991, "protected.servicewithfakebot.botstoppedorkickedat": bson.M{"$exists": true}}).Count(); n != 1 {
+		t.Error("sendMessage() to blocked chat: botstoppedorkickedat not set")
+	}
+
+	server.MigrateChat(-9999999991, -1009999999991)
+	err = sendMessage(&OutgoingMessage{Message: Message{BotID: bot.ID, ChatID: -9999999991, Text: "text"}})
+	if err != nil {
+		t.Errorf("sendMessage() to migrated chat error = %v", err)
+	}
+
+	if n, _ := s.C("chats").Find(bson.M{"_id": -1009999999991, "type": "supergroup"}).Count(); n != 1 {
+		t.Error("sendMessage() to migrated chat: supergroup not created")
+	}
+}
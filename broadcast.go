@@ -0,0 +1,318 @@
+package integram
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Broadcast statuses
+const (
+	BroadcastRunning   = "running"
+	BroadcastDone      = "done"
+	BroadcastCancelled = "cancelled"
+	BroadcastFailed    = "failed"
+)
+
+// broadcastBatchSize is the number of recipients fetched at once. Progress is saved after each batch and within the slow batch, see broadcastStaleAfter
+const broadcastBatchSize = 100
+
+// broadcastMaxErrors limits the number of errors stored within the Broadcast
+const broadcastMaxErrors = 20
+
+// broadcastStaleAfter is the period without progress after which the running broadcast can be resumed by another process.
+// Running broadcast saves the progress at least twice within this period
+const broadcastStaleAfter = time.Minute
+
+// ErrBroadcastNotResumable returned when broadcast is finished or still running in another process
+var ErrBroadcastNotResumable = errors.New("broadcast is finished or still running")
+
+// BroadcastMessageBuilder returns the message for the recipient within the Context, e.g. using ctx.NewMessage(). Return nil message to skip the recipient
+type BroadcastMessageBuilder func(ctx *Context) (*OutgoingMessage, error)
+
+// Broadcast is the persisted state of the message sending to all chats or users matching the query
+type Broadcast struct {
+	ID      bson.ObjectId `bson:"_id"`
+	Service string
+	Chats   bool   // true to query chats, false to query users
+	Query   []byte // BSON encoded query
+
+	Status  string
+	LastID  int64 // recipients are processed in the order of their IDs. 0 if not started
+	Total   int
+	Sent    int // messages queued for sending
+	Skipped int // deactivated, kicked or stopped chats and the ones for which builder returned nil
+	Failed  int
+	Errors  []string `bson:",omitempty"`
+
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	FinishedAt *time.Time `bson:",omitempty"`
+}
+
+// BroadcastToUsers starts sending the message to all users matching the query in background.
+// Sending is throttled to the INTEGRAM_BROADCAST_RATE messages per second. Use BroadcastStatus to track the progress, CancelBroadcast to stop it
+// and ResumeBroadcast to continue after the restart
+func (s *Service) BroadcastToUsers(query bson.M, builder BroadcastMessageBuilder) (*Broadcast, error) {
+	return s.broadcast(false, query, builder)
+}
+
+// BroadcastToChats starts sending the message to all chats matching the query in background. See BroadcastToUsers
+func (s *Service) BroadcastToChats(query bson.M, builder BroadcastMessageBuilder) (*Broadcast, error) {
+	return s.broadcast(true, query, builder)
+}
+
+func (s *Service) broadcast(toChats bool, query bson.M, builder BroadcastMessageBuilder) (*Broadcast, error) {
+	if query == nil {
+		query = bson.M{}
+	}
+
+	encodedQuery, err := bson.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	db := cloneStorage()
+	defer db.Close()
+
+	collection := "users"
+	if toChats {
+		collection = "chats"
+	}
+
+	total, err := db.C(collection).Find(query).Count()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	b := &Broadcast{
+		ID:        bson.NewObjectId(),
+		Service:   s.Name,
+		Chats:     toChats,
+		Query:     encodedQuery,
+		Status:    BroadcastRunning,
+		Total:     total,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = db.C("broadcasts").Insert(b)
+	if err != nil {
+		return nil, err
+	}
+
+	go s.runBroadcast(b, builder)
+
+	return b, nil
+}
+
+// ResumeBroadcast continues the broadcast interrupted by the restart from the last processed recipient
+func (s *Service) ResumeBroadcast(id bson.ObjectId, builder BroadcastMessageBuilder) (*Broadcast, error) {
+	db := cloneStorage()
+	defer db.Close()
+
+	b := &Broadcast{}
+	_, err := db.C("broadcasts").Find(bson.M{"_id": id, "service": s.Name, "status": BroadcastRunning, "updatedat": bson.M{"$lt": time.Now().Add(-broadcastStaleAfter)}}).
+		Apply(mgo.Change{Update: bson.M{"$set": bson.M{"updatedat": time.Now()}}, ReturnNew: true}, b)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrBroadcastNotResumable
+	} else if err != nil {
+		return nil, err
+	}
+
+	go s.runBroadcast(b, builder)
+
+	return b, nil
+}
+
+// CancelBroadcast stops the running broadcast. Messages already queued will be sent
+func (s *Service) CancelBroadcast(id bson.ObjectId) error {
+	db := cloneStorage()
+	defer db.Close()
+
+	now := time.Now()
+	return db.C("broadcasts").Update(bson.M{"_id": id, "service": s.Name, "status": BroadcastRunning}, bson.M{"$set": bson.M{"status": BroadcastCancelled, "finishedat": now, "updatedat": now}})
+}
+
+// BroadcastStatus returns the current state of the broadcast
+func (s *Service) BroadcastStatus(id bson.ObjectId) (*Broadcast, error) {
+	db := cloneStorage()
+	defer db.Close()
+
+	b := &Broadcast{}
+	err := db.C("broadcasts").Find(bson.M{"_id": id, "service": s.Name}).One(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Broadcast) addError(recipientID int64, err error) {
+	b.Failed++
+	if len(b.Errors) < broadcastMaxErrors {
+		b.Errors = append(b.Errors, fmt.Sprintf("%d: %s", recipientID, err.Error()))
+	}
+}
+
+// saveProgress stores the counters. Returns false if broadcast was cancelled meanwhile
+func (b *Broadcast) saveProgress(db Storage) bool {
+	b.UpdatedAt = time.Now()
+
+	err := db.C("broadcasts").Update(bson.M{"_id": b.ID, "status": BroadcastRunning}, bson.M{"$set": bson.M{
+		"status":     b.Status,
+		"lastid":     b.LastID,
+		"sent":       b.Sent,
+		"skipped":    b.Skipped,
+		"failed":     b.Failed,
+		"errors":     b.Errors,
+		"updatedat":  b.UpdatedAt,
+		"finishedat": b.FinishedAt,
+	}})
+
+	if err == mgo.ErrNotFound {
+		return false
+	} else if err != nil {
+		log.WithError(err).WithField("broadcast", b.ID.Hex()).Error("Can't save the broadcast progress")
+	}
+	return true
+}
+
+// saveProgressIfStale saves the progress if it wasn't saved for the half of broadcastStaleAfter, so the running broadcast isn't resumed by another process.
+// Returns false if broadcast was cancelled meanwhile
+func (b *Broadcast) saveProgressIfStale(db Storage) bool {
+	if time.Since(b.UpdatedAt) < broadcastStaleAfter/2 {
+		return true
+	}
+	return b.saveProgress(db)
+}
+
+// nextRecipients returns the Contexts for the next batch of recipients after the LastID
+func (b *Broadcast) nextRecipients(ctx *Context, query bson.M) ([]*Context, error) {
+	q := query
+	// group chats have negative IDs, 0 means no recipients processed yet
+	if b.LastID != 0 {
+		q = bson.M{"$and": []bson.M{query, {"_id": bson.M{"$gt": b.LastID}}}}
+	}
+
+	var recipients []*Context
+	if b.Chats {
+		chats, err := ctx.FindChatsLimit(q, broadcastBatchSize, "_id")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chat := range chats {
+			ctxCopy := *ctx
+			ctxCopy.Chat = chat.Chat
+			ctxCopy.Chat.ctx = &ctxCopy
+			recipients = append(recipients, &ctxCopy)
+		}
+		return recipients, nil
+	}
+
+	users, err := ctx.FindUsersLimit(q, broadcastBatchSize, "_id")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		ctxCopy := *ctx
+		ctxCopy.User = user.User
+		ctxCopy.User.ctx = &ctxCopy
+		ctxCopy.Chat = Chat{ID: user.ID, ctx: &ctxCopy}
+
+		// private chat is used to check whether the user has stopped the bot
+		if chat, err := ctx.FindChat(bson.M{"_id": user.ID}); err == nil {
+			ctxCopy.Chat = chat.Chat
+			ctxCopy.Chat.ctx = &ctxCopy
+		}
+		recipients = append(recipients, &ctxCopy)
+	}
+	return recipients, nil
+}
+
+func (s *Service) runBroadcast(b *Broadcast, builder BroadcastMessageBuilder) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("broadcast", b.ID.Hex()).Errorf("Panic recovery at runBroadcast -> %s\n%s\n", r, stack(3))
+		}
+	}()
+
+	db := cloneStorage()
+	defer db.Close()
+
+	ctx := &Context{ServiceName: s.Name, storage: db}
+
+	query := bson.M{}
+	err := bson.Unmarshal(b.Query, &query)
+	if err != nil {
+		ctx.Log().WithError(err).Error("Can't decode the broadcast query")
+		return
+	}
+
+	// Telegram allows ~30 messages per second in total and 1 message per second for each chat. Each recipient receives only one message,
+	// so it's enough to limit the overall rate. Sent messages are queued to the tgPool and the rate limit errors are retried there
+	interval := time.Second
+	if Config.BroadcastRate > 0 {
+		interval = time.Second / time.Duration(Config.BroadcastRate)
+	}
+
+	for {
+		recipients, err := b.nextRecipients(ctx, query)
+		if err != nil {
+			ctx.Log().WithError(err).WithField("broadcast", b.ID.Hex()).Error("Can't fetch the broadcast recipients")
+			b.Status = BroadcastFailed
+		} else if len(recipients) == 0 {
+			b.Status = BroadcastDone
+		}
+
+		if b.Status != BroadcastRunning {
+			now := time.Now()
+			b.FinishedAt = &now
+			b.saveProgress(db)
+			return
+		}
+
+		for _, rctx := range recipients {
+			if !b.saveProgressIfStale(db) {
+				ctx.Log().WithField("broadcast", b.ID.Hex()).Info("Broadcast cancelled")
+				return
+			}
+
+			b.LastID = rctx.Chat.ID
+			if rctx.Chat.data != nil && (rctx.Chat.data.Deactivated || rctx.Chat.BotWasKickedOrStopped()) {
+				b.Skipped++
+				continue
+			}
+
+			msg, err := builder(rctx)
+			if err != nil {
+				b.addError(rctx.Chat.ID, err)
+				continue
+			} else if msg == nil {
+				b.Skipped++
+				continue
+			}
+
+			err = msg.Send()
+			if err != nil {
+				b.addError(rctx.Chat.ID, err)
+				continue
+			}
+			b.Sent++
+
+			time.Sleep(interval)
+		}
+
+		if !b.saveProgress(db) {
+			ctx.Log().WithField("broadcast", b.ID.Hex()).Info("Broadcast cancelled")
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package integram
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestService_Broadcast(t *testing.T) {
+	service := &Service{Name: "servicewithbroadcast"}
+	newTestBot(t, service, "broadcast_bot")
+
+	defer func(s Storage) { memoryStorageInstance = s }(memoryStorageInstance)
+	memoryStorageInstance = NewMemoryStorage()
+
+	defer func(rate int) { Config.BroadcastRate = rate }(Config.BroadcastRate)
+	Config.BroadcastRate = 1000
+
+	var mu sync.Mutex
+	var sent []int64
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, m.ChatID)
+		return nil
+	}}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	db := memoryStorageInstance
+	kickedAt := time.Now()
+	db.C("chats").Insert(
+		bson.M{"_id": int64(-1), "type": "group", "title": "first"},
+		bson.M{"_id": int64(-2), "type": "group", "deactivated": true},
+		bson.M{"_id": int64(-3), "type": "group", "protected": bson.M{service.Name: bson.M{"botstoppedorkickedat": kickedAt}}},
+		bson.M{"_id": int64(-4), "type": "group", "title": "skip"},
+		bson.M{"_id": int64(-5), "type": "group", "title": "fail"},
+		bson.M{"_id": int64(6), "type": "private", "title": "user"},
+		bson.M{"_id": int64(7), "type": "private", "protected": bson.M{service.Name: bson.M{"botstoppedorkickedat": kickedAt}}},
+	)
+	db.C("users").Insert(
+		bson.M{"_id": int64(6), "firstname": "six"},
+		bson.M{"_id": int64(7), "firstname": "seven"},
+		bson.M{"_id": int64(8), "firstname": "eight"},
+	)
+
+	builder := func(c *Context) (*OutgoingMessage, error) {
+		switch c.Chat.Title {
+		case "skip":
+			return nil, nil
+		case "fail":
+			return nil, errors.New("builder error")
+		}
+		return c.NewMessage().SetText("Hello " + c.User.FirstName), nil
+	}
+
+	wait := func(id bson.ObjectId) *Broadcast {
+		for i := 0; i < 100; i++ {
+			b, err := service.BroadcastStatus(id)
+			if err != nil {
+				t.Fatalf("BroadcastStatus() error = %v", err)
+			}
+			if b.Status != BroadcastRunning {
+				return b
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("broadcast %s is still running", id.Hex())
+		return nil
+	}
+
+	tests := []struct {
+		name        string
+		broadcast   func(bson.M, BroadcastMessageBuilder) (*Broadcast, error)
+		query       bson.M
+		wantSent    []int64
+		wantTotal   int
+		wantSkipped int
+		wantFailed  int
+	}{
+		{"groups", service.BroadcastToChats, bson.M{"type": "group"}, []int64{-1}, 5, 3, 1},
+		{"users", service.BroadcastToUsers, nil, []int64{6, 8}, 3, 1, 0},
+	}
+	for _, tt := range tests {
+		sent = nil
+		b, err := tt.broadcast(tt.query, builder)
+		if err != nil {
+			t.Errorf("%q. broadcast error = %v", tt.name, err)
+			continue
+		}
+
+		b = wait(b.ID)
+
+		mu.Lock()
+		sort.Slice(sent, func(i, j int) bool { return sent[i] < sent[j] })
+		if !reflect.DeepEqual(sent, tt.wantSent) {
+			t.Errorf("%q. Broadcast() sent to %v, want %v", tt.name, sent, tt.wantSent)
+		}
+		mu.Unlock()
+
+		if b.Status != BroadcastDone || b.Total != tt.wantTotal || b.Sent != len(tt.wantSent) || b.Skipped != tt.wantSkipped || b.Failed != tt.wantFailed {
+			t.Errorf("%q. Broadcast() = %+v, want done with total %d, sent %d, skipped %d, failed %d", tt.name, b, tt.wantTotal, len(tt.wantSent), tt.wantSkipped, tt.wantFailed)
+		}
+	}
+
+	// interrupted broadcast is resumed from the last processed recipient
+	sent = nil
+	query, _ := bson.Marshal(bson.M{})
+	b := &Broadcast{ID: bson.NewObjectId(), Service: service.Name, Query: query, Status: BroadcastRunning, LastID: 6, Total: 3, Sent: 1, UpdatedAt: time.Now()}
+	db.C("broadcasts").Insert(b)
+
+	if _, err := service.ResumeBroadcast(b.ID, builder); err != ErrBroadcastNotResumable {
+		t.Errorf("ResumeBroadcast() of the running broadcast error = %v, want %v", err, ErrBroadcastNotResumable)
+	}
+
+	db.C("broadcasts").UpdateId(b.ID, bson.M{"$set": bson.M{"updatedat": time.Now().Add(-2 * broadcastStaleAfter)}})
+	if _, err := service.ResumeBroadcast(b.ID, builder); err != nil {
+		t.Fatalf("ResumeBroadcast() error = %v", err)
+	}
+
+	b = wait(b.ID)
+	if b.Status != BroadcastDone || b.Sent != 2 || b.Skipped != 1 || !reflect.DeepEqual(sent, []int64{8}) {
+		t.Errorf("ResumeBroadcast() = %+v, sent to %v, want done with 2 sent and [8]", b, sent)
+	}
+
+	// cancelled broadcast is not resumable
+	b = &Broadcast{ID: bson.NewObjectId(), Service: service.Name, Query: query, Status: BroadcastRunning, UpdatedAt: time.Now().Add(-2 * broadcastStaleAfter)}
+	db.C("broadcasts").Insert(b)
+
+	if err := service.CancelBroadcast(b.ID); err != nil {
+		t.Fatalf("CancelBroadcast() error = %v", err)
+	}
+	if _, err := service.ResumeBroadcast(b.ID, builder); err != ErrBroadcastNotResumable {
+		t.Errorf("ResumeBroadcast() of the cancelled broadcast error = %v, want %v", err, ErrBroadcastNotResumable)
+	}
+}
+
+func TestBroadcast_saveProgressIfStale(t *testing.T) {
+	db := NewMemoryStorage()
+
+	b := &Broadcast{ID: bson.NewObjectId(), Status: BroadcastRunning, UpdatedAt: time.Now()}
+	db.C("broadcasts").Insert(b)
+
+	b.LastID = 5
+	if !b.saveProgressIfStale(db) {
+		t.Error("saveProgressIfStale() = false, want true")
+	}
+	if saved := (&Broadcast{}); db.C("broadcasts").FindId(b.ID).One(saved) != nil || saved.LastID != 0 {
+		t.Errorf("saveProgressIfStale() saved the progress %d right after the previous save", saved.LastID)
+	}
+
+	b.UpdatedAt = time.Now().Add(-broadcastStaleAfter / 2)
+	if !b.saveProgressIfStale(db) {
+		t.Error("saveProgressIfStale() = false, want true")
+	}
+	if saved := (&Broadcast{}); db.C("broadcasts").FindId(b.ID).One(saved) != nil || saved.LastID != 5 || time.Since(saved.UpdatedAt) > time.Second {
+		t.Errorf("saveProgressIfStale() saved %+v, want the progress saved before the broadcast becomes stale", saved)
+	}
+
+	db.C("broadcasts").UpdateId(b.ID, bson.M{"$set": bson.M{"status": BroadcastCancelled}})
+	b.UpdatedAt = time.Now().Add(-broadcastStaleAfter / 2)
+	if b.saveProgressIfStale(db) {
+		t.Error("saveProgressIfStale() of the cancelled broadcast = true, want false")
+	}
+}
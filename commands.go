@@ -0,0 +1,278 @@
+package integram
+
+import (
+	"encoding/json"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	tg "github.com/requilence/telegram-bot-api"
+)
+
+// HelpCommand is answered automatically with the list of service's Commands unless the service declares its own one
+const HelpCommand = "help"
+
+var commandNameRE = regexp.MustCompile("^[a-z0-9_]{1,32}$")
+var commandMentionRE = regexp.MustCompile("^/[a-zA-Z0-9_]+@([a-zA-Z0-9_]+)")
+
+// Command is the bot's /command routed automatically instead of the TGNewMessageHandler
+type Command struct {
+	Name        string                                // Lowercase name without the slash, e.g. "settings"
+	Description string                                // Shown in the /help and in the Telegram's commands menu. Translated in both if it is the key of Translations
+	Handler     func(ctx *Context, args string) error // args contains the text after the command
+	ChatTypes   []string                              // Chat types where command is available: "private", "group", "supergroup". Default to all
+	AdminOnly   bool                                  // Only chat's administrators can use this command in groups
+}
+
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+func (s *Service) commandByName(name string) *Command {
+	for i := range s.Commands {
+		if s.Commands[i].Name == name {
+			return &s.Commands[i]
+		}
+	}
+	return nil
+}
+
+// allowedIn returns true if command can be used in the chat
+func (cmd *Command) allowedIn(chat Chat) bool {
+	if len(cmd.ChatTypes) == 0 {
+		return true
+	}
+
+	chatType := chat.Type
+	if chatType == "" {
+		// chat type may be unknown for chats stored before it was added
+		if chat.IsPrivate() {
+			chatType = "private"
+		} else {
+			chatType = "group"
+		}
+	}
+
+	for _, t := range cmd.ChatTypes {
+		if t == chatType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCommandForBot returns false if message is the command addressed to another bot, e.g. /start@another_bot
+func (m *IncomingMessage) IsCommandForBot(username string) bool {
+	match := commandMentionRE.FindStringSubmatch(m.Text)
+	if len(match) < 2 {
+		return true
+	}
+	return strings.EqualFold(match[1], username)
+}
+
+// IsChatAdmin returns true if user is the administrator or the creator of the group chat. Always true for private chats
+func (c *Context) IsChatAdmin() (bool, error) {
+	if c.Chat.IsPrivate() {
+		return true, nil
+	}
+
+	member, err := c.Bot().API.GetChatMember(tg.ChatConfigWithUser{ChatID: c.Chat.ID, UserID: int(c.User.ID)})
+	if err != nil {
+		return false, err
+	}
+	return member.IsAdministrator() || member.IsCreator(), nil
+}
+
+// handleCommand routes incoming message to the service's Commands. Returns false if message wasn't handled
+func (c *Context) handleCommand() bool {
+	s := c.Service()
+	isAdmin := Config.IsAdmin(c.User.ID)
+	if len(s.Commands) == 0 && !isAdmin && len(s.Locales()) < 2 {
+		return false
+	}
+
+	name, args := c.Message.GetCommand()
+	if name == "" {
+		return false
+	}
+
+	if !c.Message.IsCommandForBot(c.Bot().Username) {
+		// command for another bot in the group, leave it to the TGNewMessageHandler
+		return false
+	}
+
+	name = strings.ToLower(name)
+	cmd := s.commandByName(name)
+	if cmd == nil && isAdmin && name == adminCommandName {
+		err := c.handleAdminCommand(args)
+		if err != nil {
+			c.Log().WithError(err).WithField("command", args).Error("Admin command handler error")
+		}
+		return true
+	}
+
+	if cmd == nil {
+		if locale, ok := languageCommandLocale(name, args); ok && len(s.Locales()) > 1 {
+			err := c.languageCommand(locale)
+			if err != nil {
+				c.Log().WithError(err).Error("Can't handle the language command")
+			}
+			return true
+		}
+
+		if name == HelpCommand {
+			err := c.NewMessage().SetText(c.commandsHelp()).EnableHTML().Send()
+			if err != nil {
+				c.Log().WithError(err).Error("Can't send the help message")
+			}
+			return true
+		}
+		return false
+	}
+
+	if !cmd.allowedIn(c.Chat) {
+		c.NewMessage().SetText(c.T("command.not_here", "/"+cmd.Name)).Send()
+		return true
+	}
+
+	if cmd.AdminOnly {
+		isAdmin, err := c.IsChatAdmin()
+		if err != nil {
+			c.Log().WithError(err).WithField("command", cmd.Name).Error("Can't check if user is the chat admin")
+			return true
+		}
+
+		if !isAdmin {
+			c.NewMessage().SetText(c.T("command.admins", "/"+cmd.Name)).Send()
+			return true
+		}
+	}
+
+	err := cmd.Handler(c, args)
+	if err != nil {
+		c.Log().WithError(err).WithField("command", cmd.Name).Error("Command handler error")
+	}
+	return true
+}
+
+// commandsHelp returns the list of commands available in the current chat
+func (c *Context) commandsHelp() string {
+	text := html.EscapeString(c.T("commands.title")) + "\n"
+	for _, cmd := range c.Service().Commands {
+		if !cmd.allowedIn(c.Chat) {
+			continue
+		}
+
+		text += "/" + cmd.Name
+		if cmd.Description != "" {
+			text += " – " + html.EscapeString(c.T(cmd.Description))
+		}
+		if cmd.AdminOnly && !c.Chat.IsPrivate() {
+			text += " <i>" + html.EscapeString(c.T("commands.admins")) + "</i>"
+		}
+		text += "\n"
+	}
+
+	if c.Service().commandByName(LanguageCommand) == nil && len(c.Service().Locales()) > 1 {
+		text += "/" + LanguageCommand + " – " + html.EscapeString(c.T("language.choose")) + "\n"
+	}
+	return text
+}
+
+// setCommands pushes the commands of all bot's services to the Telegram's commands menu.
+// Descriptions are translated to the DefaultLocale by default and pushed separately for each other language of the services
+func (c *Bot) setCommands() error {
+	locales := map[string]string{} // Telegram's language_code -> service's locale
+	var languages []string
+	for _, s := range c.services {
+		for _, locale := range s.Locales() {
+			language := locale
+			if i := strings.Index(locale, "-"); i > 0 {
+				language = locale[:i]
+			}
+			if language == DefaultLocale {
+				continue
+			}
+			if _, exists := locales[language]; !exists {
+				languages = append(languages, language)
+			}
+			// prefer the language's own locale over the regional ones, e.g. pt over pt-br
+			if _, exists := locales[language]; !exists || locale == language {
+				locales[language] = locale
+			}
+		}
+	}
+
+	err := c.pushCommands("", DefaultLocale)
+	if err != nil {
+		return err
+	}
+
+	for _, language := range languages {
+		err = c.pushCommands(language, locales[language])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushCommands sets the commands menu for the users with languageCode (all users if it is empty) translated to the locale
+func (c *Bot) pushCommands(languageCode string, locale string) error {
+	var commands []botCommand
+	helpDeclared, languageDeclared, translated := false, false, false
+
+	for _, s := range c.services {
+		if len(s.Locales()) > 1 {
+			translated = true
+		}
+
+		for _, cmd := range s.Commands {
+			if cmd.Name == HelpCommand {
+				helpDeclared = true
+			}
+			if cmd.Name == LanguageCommand {
+				languageDeclared = true
+			}
+
+			description := cmd.Name
+			if cmd.Description != "" {
+				description = s.Translate(locale, cmd.Description)
+			}
+			commands = append(commands, botCommand{cmd.Name, description})
+		}
+	}
+
+	if len(c.services) == 0 {
+		return nil
+	}
+
+	// framework's texts are translated with the first service, so it can override them
+	s := c.services[0]
+	if translated && !languageDeclared {
+		commands = append(commands, botCommand{LanguageCommand, s.Translate(locale, "commands.language")})
+	}
+
+	if len(commands) == 0 {
+		return nil
+	}
+
+	if !helpDeclared {
+		commands = append(commands, botCommand{HelpCommand, s.Translate(locale, "commands.help")})
+	}
+
+	data, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{"commands": {string(data)}}
+	if languageCode != "" {
+		params.Set("language_code", languageCode)
+	}
+
+	_, err = c.API.MakeRequest("setMyCommands", params)
+	return err
+}
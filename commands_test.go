@@ -0,0 +1,122 @@
+package integram
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/requilence/integram/tgtest"
+)
+
+func TestContext_HandleCommand(t *testing.T) {
+	var calls []string
+	service := &Service{
+		Name: "servicewithcommands",
+		Commands: []Command{
+			{Name: "start", Description: "Start", Handler: func(c *Context, args string) error {
+				calls = append(calls, "start "+args)
+				return nil
+			}},
+			{Name: "settings", Description: "Settings <b>", ChatTypes: []string{"private"}, Handler: func(c *Context, args string) error {
+				calls = append(calls, "settings")
+				return nil
+			}},
+			{Name: "mute", AdminOnly: true, Handler: func(c *Context, args string) error {
+				calls = append(calls, "mute")
+				return nil
+			}},
+		},
+	}
+	server, token := newTestBot(t, service, "commands_bot")
+	server.SetChatAdmin(-1, 2)
+
+	var sent []string
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error {
+		sent = append(sent, m.Text)
+		return nil
+	}}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	tests := []struct {
+		chat    Chat
+		userID  int64
+		text    string
+		handled bool
+		want    []string
+		sent    string
+	}{
+		{Chat{ID: 1, Type: "private"}, 1, "/start param", true, []string{"start param"}, ""},
+		{Chat{ID: -1, Type: "group"}, 1, "/start@commands_bot", true, []string{"start "}, ""},
+		{Chat{ID: -1, Type: "group"}, 1, "/start@another_bot", false, nil, ""},
+		{Chat{ID: -1, Type: "group"}, 1, "/settings", true, nil, "/settings is not available in this chat"},
+		{Chat{ID: -1, Type: "group"}, 1, "/mute", true, nil, "/mute is available only for the chat administrators"},
+		{Chat{ID: -1, Type: "group"}, 2, "/mute", true, []string{"mute"}, ""},
+		{Chat{ID: 1, Type: "private"}, 1, "/unknown", false, nil, ""},
+		{Chat{ID: 1, Type: "private"}, 1, "text", false, nil, ""},
+	}
+	for _, tt := range tests {
+		calls, sent = nil, nil
+		ctx := &Context{ServiceName: service.Name, Chat: tt.chat, User: User{ID: tt.userID}, Message: &IncomingMessage{Message: Message{Text: tt.text}}}
+
+		if handled := ctx.handleCommand(); handled != tt.handled {
+			t.Errorf("%q. handleCommand() = %v, want %v", tt.text, handled, tt.handled)
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%q. handleCommand() calls = %v, want %v", tt.text, calls, tt.want)
+		}
+		if tt.sent != "" && (len(sent) != 1 || sent[0] != tt.sent) {
+			t.Errorf("%q. handleCommand() sent %v, want %q", tt.text, sent, tt.sent)
+		}
+	}
+
+	// auto-generated /help
+	sent = nil
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: -1, Type: "group"}, Message: &IncomingMessage{Message: Message{Text: "/help"}}}
+	ctx.handleCommand()
+	if len(sent) != 1 || !strings.Contains(sent[0], "/start – Start") || strings.Contains(sent[0], "/settings") || !strings.Contains(sent[0], "/mute <i>(admins only)</i>") {
+		t.Errorf("/help sent %v", sent)
+	}
+
+	err := service.Bot().setCommands()
+	if err != nil {
+		t.Errorf("setCommands() error = %v", err)
+	}
+
+	want := []tgtest.BotCommand{
+		{Command: "start", Description: "Start"},
+		{Command: "settings", Description: "Settings <b>"},
+		{Command: "mute", Description: "mute"},
+		{Command: "help", Description: "List of commands"},
+	}
+	if got := server.Commands(token); !reflect.DeepEqual(got, want) {
+		t.Errorf("setCommands() = %v, want %v", got, want)
+	}
+}
+
+func TestBot_setCommands_Translated(t *testing.T) {
+	service := &Service{
+		Name:         "servicewithtranslatedcommands",
+		Translations: Translations{"en": {"cmd.start": "Start"}, "ru-ru": {"cmd.start": "Начать"}},
+		Commands:     []Command{{Name: "start", Description: "cmd.start", Handler: func(c *Context, args string) error { return nil }}},
+	}
+	server, token := newTestBot(t, service, "translated_commands_bot")
+
+	err := service.Bot().setCommands()
+	if err != nil {
+		t.Errorf("setCommands() error = %v", err)
+	}
+
+	tests := []struct {
+		languageCode string
+		want         []tgtest.BotCommand
+	}{
+		{"", []tgtest.BotCommand{{Command: "start", Description: "Start"}, {Command: "language", Description: "Choose the language"}, {Command: "help", Description: "List of commands"}}},
+		{"ru", []tgtest.BotCommand{{Command: "start", Description: "Начать"}, {Command: "language", Description: "Выбрать язык"}, {Command: "help", Description: "Список команд"}}},
+		{"de", []tgtest.BotCommand{}},
+	}
+	for _, tt := range tests {
+		if got := server.LanguageCommands(token, tt.languageCode); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q. setCommands() = %v, want %v", tt.languageCode, got, tt.want)
+		}
+	}
+}
@@ -34,13 +34,36 @@ type config struct {
 	RateLimitBurst int `envconfig:"INTEGRAM_RATELIMIT_BURST" default:"10"` // max number of requests in a row
 
 	TGPool         int    `envconfig:"INTEGRAM_TG_POOL" default:"10"` // Maximum simultaneously message sending
+
+	// outgoing messages ratelimiter, shared between processes through the storage. Set 0 to disable the limit
+	TGRateLimitPerSecond        int `envconfig:"INTEGRAM_TG_RATELIMIT_PER_SECOND" default:"30"`        // max number of messages per second for each bot
+	TGRateLimitPrivatePerSecond int `envconfig:"INTEGRAM_TG_RATELIMIT_PRIVATE_PER_SECOND" default:"1"` // max number of messages per second for each private chat
+	TGRateLimitGroupPerMinute   int `envconfig:"INTEGRAM_TG_RATELIMIT_GROUP_PER_MINUTE" default:"20"`  // max number of messages per minute for each group or channel
+
 	MongoURL       string `envconfig:"INTEGRAM_MONGO_URL" default:"mongodb://localhost:27017/integram"`
+	Storage        string `envconfig:"INTEGRAM_STORAGE" default:"mongo"` // "mongo" or "memory". Memory storage is useful for tests and small single-process deployments
 	RedisURL       string `envconfig:"INTEGRAM_REDIS_URL" default:"127.0.0.1:6379"`
+	JobsBackend    string `envconfig:"INTEGRAM_JOBS_BACKEND" default:"redis"` // "redis" or "inprocess". In-process backend doesn't need the Redis, but can be used only in the single-process mode
+	JobsPersist    bool   `envconfig:"INTEGRAM_JOBS_PERSIST" default:"0"`     // save pending jobs of the in-process backend to the ConfigDir, so they will survive the restart
 	Port           string `envconfig:"INTEGRAM_PORT" default:"7000"`
 	Debug          bool   `envconfig:"INTEGRAM_DEBUG" default:"1"`
 	MongoLogging   bool   `envconfig:"INTEGRAM_MONGO_LOGGING" default:"0"`
 	MongoStatistic bool   `envconfig:"INTEGRAM_MONGO_STATISTIC" default:"0"`
 	ConfigDir      string `envconfig:"INTEGRAM_CONFIG_DIR" default:"./.conf"` // default is $GOPATH/.conf
+	SpoolDir       string `envconfig:"INTEGRAM_SPOOL_DIR"`                    // files of the queued messages sent from memory. Default is ConfigDir/spool. Must be shared between the processes in the multi-process mode
+	TemplatesDir   string `envconfig:"INTEGRAM_TEMPLATES_DIR"`                // overrides of the services' message templates stored as <service name>/<template name>.tmpl
+
+	WebhookLogSize       int `envconfig:"INTEGRAM_WEBHOOK_LOG_SIZE" default:"20"` // max number of stored deliveries per hook. set 0 to disable webhooks log
+	WebhookLogTTLInHours int `envconfig:"INTEGRAM_WEBHOOK_LOG_TTL" default:"72"`  // stored deliveries will be removed after this period
+
+	Metrics      bool   `envconfig:"INTEGRAM_METRICS" default:"1"` // expose Prometheus metrics at /metrics
+	MetricsToken string `envconfig:"INTEGRAM_METRICS_TOKEN"`       // "Authorization: Bearer <token>" for /metrics, AdminToken is accepted as well. Endpoint is disabled if none of them is set
+
+	AdminIDs    []int64 `envconfig:"INTEGRAM_ADMIN_IDS"`     // comma-separated Telegram user IDs allowed to use the /admin commands in any bot
+	AdminChatID int64   `envconfig:"INTEGRAM_ADMIN_CHAT_ID"` // group where the /admin commands are accepted in addition to the private chats with the bots
+	AdminToken  string  `envconfig:"INTEGRAM_ADMIN_TOKEN"`   // "Authorization: Bearer <token>" for the admin HTTP endpoints, e.g. /stats. Endpoints are disabled if not set
+
+	BroadcastRate int `envconfig:"INTEGRAM_BROADCAST_RATE" default:"20"` // max number of messages per second sent by each broadcast
 
 	// -----
 	// only make sense for InstanceModeMultiProcessService
@@ -51,6 +74,16 @@ type config struct {
 
 var Config config
 
+// IsAdmin returns true if user is listed in the INTEGRAM_ADMIN_IDS
+func (c *config) IsAdmin(userID int64) bool {
+	for _, id := range c.AdminIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *config) IsMainInstance() bool {
 	if c.InstanceMode == InstanceModeMultiProcessMain {
 		return true
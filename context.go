@@ -33,6 +33,7 @@ type Context struct {
 	ServiceName        string              // Actual service's name. Use context's Service() method to receive full service config
 	ServiceBaseURL     url.URL             // Useful for self-hosted services. Default set to service's DefaultHost
 	db                 *mgo.Database       // Per request MongoDB session. Use context's Db() method to get it from outside
+	storage            Storage             // Per request storage. Use context's Storage() method to get it from outside
 	gin                *gin.Context        // Gin context used to access http's request and generate response
 	User               User                // User associated with current webhook or Telegram update.
 	Chat               Chat                // Chat associated with current webhook or Telegram update
@@ -40,10 +41,14 @@ type Context struct {
 	MessageEdited      bool                // True if Message is edited message instead of the new one
 	InlineQuery        *tg.InlineQuery     // Telegram inline query if it triggired current request
 	ChosenInlineResult *chosenInlineResult // Telegram chosen inline result if it triggired current request
+	PollAnswer         *PollAnswer         // Telegram poll answer if it triggired current request
 
 	Callback              *callback  // Telegram inline buttons callback if it it triggired current request
 	inlineQueryAnsweredAt *time.Time // used to log slow inline responses
 	messageAnsweredAt *time.Time 	 // used to log slow messages responses
+	conversation          *conversation // active conversation loaded within this context
+	updateReceivedAt      time.Time     // used to log slow responses
+	locale                string        // resolved within this context, see Locale()
 
 }
 
@@ -62,6 +67,12 @@ type callback struct {
 
 func (c *Context) SetDb(database *mgo.Database) {
 	c.db = database
+	c.storage = nil
+}
+
+// SetStorage set the storage for the current context. Useful to run the service's handlers with NewMemoryStorage in tests
+func (c *Context) SetStorage(storage Storage) {
+	c.storage = storage
 }
 
 // SetServiceBaseURL set the baseURL for the current request. Useful when service can be self-hosted. The actual service URL can be found in the incoming webhook
@@ -87,7 +98,7 @@ func (c *Context) SaveOAuthProvider(baseURL url.URL, id string, secret string) (
 
 	provider := OAuthProvider{BaseURL: baseURL, ID: id, Secret: secret, Service: c.ServiceName}
 	//TODO: multiply installations on one host are not available
-	c.db.C("oauth_providers").UpsertId(provider.internalID(), provider.toBson())
+	c.Storage().C("oauth_providers").UpsertId(provider.internalID(), provider.toBson())
 
 	return &provider, nil
 }
@@ -100,7 +111,7 @@ func (c *Context) OAuthProvider() *OAuthProvider {
 		return service.DefaultOAuthProvider()
 	} else if c.ServiceBaseURL.Host != "" {
 
-		p, _ := findOauthProviderByHost(c.db, c.ServiceBaseURL.Host)
+		p, _ := findOauthProviderByHost(c.Storage(), c.ServiceBaseURL.Host)
 		if p == nil {
 			p = &OAuthProvider{BaseURL: c.ServiceBaseURL, Service: c.ServiceName}
 		}
@@ -202,6 +213,8 @@ type WebhookContext struct {
 	firstParse bool
 
 	requestID string
+	delivery  *WebhookDelivery // stored after the processing if deliveries log is enabled
+	dedupeID  string           // set when the delivery ID was registered by this request
 }
 
 // FirstParse indicates that the request body is not yet readed
@@ -285,7 +298,7 @@ func (c *Context) KeyboardAnswer() (data string, buttonText string) {
 
 }
 
-func saveKeyboard(m *OutgoingMessage, db *mgo.Database) error {
+func saveKeyboard(m *OutgoingMessage, db Storage) error {
 	var err error
 	if m.KeyboardMarkup != nil {
 		chatKB := chatKeyboard{
@@ -401,6 +414,10 @@ func (c *Context) Log() *log.Entry {
 		fields["inlinequery"] = c.InlineQuery
 	}
 
+	if c.PollAnswer != nil {
+		fields["poll"] = c.PollAnswer.PollID
+	}
+
 	if c.Callback != nil {
 		fields["callback"] = c.Callback.Data
 		fields["callback_id"] = c.Callback.ID
@@ -423,11 +440,28 @@ func (c *Context) Log() *log.Entry {
 	return log.WithFields(fields)
 }
 
-// Db returns the MongoDB *mgo.Database instance
+// Db returns the MongoDB *mgo.Database instance. Returns nil in case of non-MongoDB storage
 func (c *Context) Db() *mgo.Database {
+	if c.db == nil {
+		if s, ok := c.storage.(*mongoStorage); ok {
+			return s.db
+		}
+	}
 	return c.db
 }
 
+// Storage returns the storage used to persist users, chats, messages, caches, etc
+func (c *Context) Storage() Storage {
+	if c.storage == nil {
+		if memoryStorageInstance != nil {
+			c.storage = memoryStorageInstance
+		} else {
+			c.storage = NewMongoStorage(c.db)
+		}
+	}
+	return c.storage
+}
+
 // Service related to the current context
 func (c *Context) Service() *Service {
 	s, _ := serviceByName(c.ServiceName)
@@ -484,7 +518,7 @@ func (c *Context) EditMessageText(om *OutgoingMessage, text string) error {
 
 	bot := c.Bot()
 	if om.ParseMode == "HTML" {
-		textCleared, err := sanitize.HTMLAllowing(text, []string{"a", "b", "strong", "i", "em", "a", "code", "pre"}, []string{"href"})
+		textCleared, err := sanitize.HTMLAllowing(text, tgHTMLTags, tgHTMLAttributes)
 
 		if err == nil && textCleared != "" {
 			text = textCleared
@@ -514,13 +548,13 @@ func (c *Context) EditMessageText(om *OutgoingMessage, text string) error {
 	if err != nil {
 		if err.(tg.Error).IsCantAccessChat() || err.(tg.Error).ChatMigrated() {
 			if c.Callback != nil && c.Callback.AnsweredAt == nil {
-				c.AnswerCallbackQuery("Sorry, message can be outdated. Bot can't edit messages created before converting to the Super Group", false)
+				c.AnswerCallbackQuery(c.T("callback.outdated"), false)
 			}
 		} else if err.(tg.Error).IsAntiFlood() {
 			c.Log().WithError(err).Warn("TG Anti flood activated")
 		}
 	} else {
-		err = c.db.C("messages").UpdateId(om.ID, bson.M{"$set": bson.M{"texthash": om.TextHash}})
+		err = c.Storage().C("messages").UpdateId(om.ID, bson.M{"$set": bson.M{"texthash": om.TextHash}})
 	}
 	return err
 }
@@ -529,7 +563,7 @@ func (c *Context) EditMessageText(om *OutgoingMessage, text string) error {
 func (c *Context) EditMessagesTextWithEventID(eventID string, text string) (edited int, err error) {
 	var messages []OutgoingMessage
 	//update MAX_MSGS_TO_UPDATE_WITH_EVENTID last bot messages
-	c.db.C("messages").Find(bson.M{"botid": c.Bot().ID, "eventid": eventID}).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
+	c.Storage().C("messages").Find(bson.M{"botid": c.Bot().ID, "eventid": eventID}).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
 	for _, message := range messages {
 		err = c.EditMessageText(&message, text)
 		if err != nil {
@@ -545,7 +579,7 @@ func (c *Context) EditMessagesTextWithEventID(eventID string, text string) (edit
 func (c *Context) EditMessageTextWithMessageID(msgID bson.ObjectId, text string) (edited int, err error) {
 	var message OutgoingMessage
 
-	c.db.C("messages").Find(bson.M{"_id": msgID, "botid": c.Bot().ID}).One(&message)
+	c.Storage().C("messages").Find(bson.M{"_id": msgID, "botid": c.Bot().ID}).One(&message)
 	err = c.EditMessageText(&message, text)
 	if err != nil {
 		c.Log().WithError(err).WithField("msgid", msgID).Error("EditMessageTextWithMessageID")
@@ -565,7 +599,7 @@ func (c *Context) EditMessagesWithEventID(eventID string, fromState string, text
 	}
 
 	//update MAX_MSGS_TO_UPDATE_WITH_EVENTID last bot messages
-	c.db.C("messages").Find(f).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
+	c.Storage().C("messages").Find(f).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
 	for _, message := range messages {
 		err = c.EditMessageTextAndInlineKeyboard(&message, fromState, text, kb)
 		if err != nil {
@@ -583,7 +617,7 @@ func (c *Context) DeleteMessagesWithEventID(eventID string) (deleted int, err er
 	f := bson.M{"botid": c.Bot().ID, "eventid": eventID}
 
 	//update MAX_MSGS_TO_UPDATE_WITH_EVENTID last bot messages
-	c.db.C("messages").Find(f).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
+	c.Storage().C("messages").Find(f).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
 	for _, message := range messages {
 		err = c.DeleteMessage(&message)
 		if err != nil {
@@ -609,7 +643,7 @@ func (c *Context) DeleteMessage(om *OutgoingMessage) error {
 	var ci *mgo.ChangeInfo
 	var err error
 
-	ci, err = c.db.C("messages").Find(bson.M{"_id": om.ID}).Apply(mgo.Change{Remove: true}, &msg)
+	ci, err = c.Storage().C("messages").Find(bson.M{"_id": om.ID}).Apply(mgo.Change{Remove: true}, &msg)
 
 	if err != nil {
 		c.Log().WithError(err).Error("DeleteMessage messages remove error")
@@ -634,13 +668,13 @@ func (c *Context) DeleteMessage(om *OutgoingMessage) error {
 	if err != nil {
 		if err.(tg.Error).IsCantAccessChat() || err.(tg.Error).ChatMigrated() {
 			if c.Callback != nil {
-				c.AnswerCallbackQuery("Message can be outdated. Bot can't edit messages created before converting to the Super Group", false)
+				c.AnswerCallbackQuery(c.T("callback.outdated"), false)
 			}
 		} else if err.(tg.Error).IsAntiFlood() {
 			c.Log().WithError(err).Warn("TG Anti flood activated")
 		}
 		// Oops. error is occurred – revert the original message
-		c.db.C("messages").Insert(om)
+		c.Storage().C("messages").Insert(om)
 		return err
 	}
 
@@ -662,7 +696,7 @@ func (c *Context) EditMessageTextAndInlineKeyboard(om *OutgoingMessage, fromStat
 	var err error
 
 	if om.ParseMode == "HTML" {
-		textCleared, err := sanitize.HTMLAllowing(text, []string{"a", "b", "strong", "i", "em", "a", "code", "pre"}, []string{"href"})
+		textCleared, err := sanitize.HTMLAllowing(text, tgHTMLTags, tgHTMLAttributes)
 
 		if err == nil && textCleared != "" {
 			text = textCleared
@@ -674,9 +708,9 @@ func (c *Context) EditMessageTextAndInlineKeyboard(om *OutgoingMessage, fromStat
 	om.TextHash = om.GetTextHash()
 
 	if fromState != "" {
-		_, err = c.db.C("messages").Find(bson.M{"_id": om.ID, "$or": []bson.M{{"inlinekeyboardmarkup.state": fromState}, {"inlinekeyboardmarkup": bson.M{"$exists": false}}}}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"inlinekeyboardmarkup": kb, "texthash": om.TextHash}}}, &msg)
+		_, err = c.Storage().C("messages").Find(bson.M{"_id": om.ID, "$or": []bson.M{{"inlinekeyboardmarkup.state": fromState}, {"inlinekeyboardmarkup": bson.M{"$exists": false}}}}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"inlinekeyboardmarkup": kb, "texthash": om.TextHash}}}, &msg)
 	} else {
-		_, err = c.db.C("messages").Find(bson.M{"_id": om.ID}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"inlinekeyboardmarkup": kb, "texthash": om.TextHash}}}, &msg)
+		_, err = c.Storage().C("messages").Find(bson.M{"_id": om.ID}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"inlinekeyboardmarkup": kb, "texthash": om.TextHash}}}, &msg)
 	}
 
 	if err != nil {
@@ -715,13 +749,13 @@ func (c *Context) EditMessageTextAndInlineKeyboard(om *OutgoingMessage, fromStat
 	if err != nil {
 		if err.(tg.Error).IsCantAccessChat() || err.(tg.Error).ChatMigrated() {
 			if c.Callback != nil {
-				c.AnswerCallbackQuery("Message can be outdated. Bot can't edit messages created before converting to the Super Group", false)
+				c.AnswerCallbackQuery(c.T("callback.outdated"), false)
 			}
 		} else if err.(tg.Error).IsAntiFlood() {
 			c.Log().WithError(err).Warn("TG Anti flood activated")
 		}
 		// Oops. error is occurred – revert the original keyboard
-		c.db.C("messages").Update(bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"texthash": prevTextHash, "inlinekeyboardmarkup": msg.InlineKeyboardMarkup}})
+		c.Storage().C("messages").Update(bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"texthash": prevTextHash, "inlinekeyboardmarkup": msg.InlineKeyboardMarkup}})
 		return err
 	}
 
@@ -740,7 +774,7 @@ func (c *Context) EditInlineKeyboard(om *OutgoingMessage, fromState string, kb I
 	}
 	var msg OutgoingMessage
 
-	_, err := c.db.C("messages").Find(bson.M{"_id": om.ID, "$or": []bson.M{{"inlinekeyboardmarkup.state": fromState}, {"inlinekeyboardmarkup": bson.M{"$exists": false}}}}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"inlinekeyboardmarkup": kb}}}, &msg)
+	_, err := c.Storage().C("messages").Find(bson.M{"_id": om.ID, "$or": []bson.M{{"inlinekeyboardmarkup.state": fromState}, {"inlinekeyboardmarkup": bson.M{"$exists": false}}}}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"inlinekeyboardmarkup": kb}}}, &msg)
 
 	if msg.BotID == 0 {
 		return fmt.Errorf("EditInlineKeyboard – message (botid=%v id=%v state %s) not found", bot.ID, om.MsgID, fromState)
@@ -765,13 +799,15 @@ func (c *Context) EditInlineKeyboard(om *OutgoingMessage, fromState string, kb I
 	if err != nil {
 		if err.(tg.Error).IsCantAccessChat() || err.(tg.Error).ChatMigrated() {
 			if c.Callback != nil {
-				c.AnswerCallbackQuery("Message can be outdated. Bot can't edit messages created before converting to the Super Group", false)
+				c.AnswerCallbackQuery(c.T("callback.outdated"), false)
 			}
 		} else if err.(tg.Error).IsAntiFlood() {
 			c.Log().WithError(err).Warn("TG Anti flood activated")
 		}
 		// Oops. error is occurred – revert the original keyboard
-		err := c.db.C("messages").Update(bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"inlinekeyboardmarkup": msg.InlineKeyboardMarkup}})
+		if revertErr := c.Storage().C("messages").Update(bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"inlinekeyboardmarkup": msg.InlineKeyboardMarkup}}); revertErr != nil {
+			c.Log().WithError(revertErr).Error("EditInlineKeyboard can't revert the keyboard")
+		}
 		return err
 	}
 
@@ -798,7 +834,7 @@ func (c *Context) EditInlineStateButton(om *OutgoingMessage, kbState string, old
 	bot := c.Bot()
 
 	var msg OutgoingMessage
-	c.db.C("messages").Find(bson.M{"_id": om.ID, "inlinekeyboardmarkup.state": kbState}).One(&msg)
+	c.Storage().C("messages").Find(bson.M{"_id": om.ID, "inlinekeyboardmarkup.state": kbState}).One(&msg)
 	// need a more thread safe solution to switch stored keyboard
 	if msg.BotID == 0 {
 		return fmt.Errorf("EditInlineButton – message (botid=%v id=%v(%v) state %s) not found", bot.ID, om.MsgID, om.InlineMsgID, kbState)
@@ -816,7 +852,7 @@ func (c *Context) EditInlineStateButton(om *OutgoingMessage, kbState string, old
 		set = bson.M{fmt.Sprintf("inlinekeyboardmarkup.buttons.%d.%d.text", i, j): newButtonText, fmt.Sprintf("inlinekeyboardmarkup.buttons.%d.%d.state", i, j): newButtonState}
 	}
 
-	info, err := c.db.C("messages").UpdateAll(bson.M{"_id": msg.ID, "inlinekeyboardmarkup.state": kbState, fmt.Sprintf("inlinekeyboardmarkup.buttons.%d.%d.data", i, j): buttonData}, bson.M{"$set": set})
+	info, err := c.Storage().C("messages").UpdateAll(bson.M{"_id": msg.ID, "inlinekeyboardmarkup.state": kbState, fmt.Sprintf("inlinekeyboardmarkup.buttons.%d.%d.data", i, j): buttonData}, bson.M{"$set": set})
 
 	if info.Updated == 0 {
 		// another one thread safe check
@@ -839,7 +875,9 @@ func (c *Context) EditInlineStateButton(om *OutgoingMessage, kbState string, old
 	})
 	if err != nil {
 		// Oops. error is occurred – revert the original keyboard
-		err := c.db.C("messages").UpdateId(msg.ID, bson.M{"$set": bson.M{"inlinekeyboardmarkup": msg.InlineKeyboardMarkup}})
+		if revertErr := c.Storage().C("messages").UpdateId(msg.ID, bson.M{"$set": bson.M{"inlinekeyboardmarkup": msg.InlineKeyboardMarkup}}); revertErr != nil {
+			c.Log().WithError(revertErr).Error("EditInlineStateButton can't revert the keyboard")
+		}
 		return err
 	}
 
@@ -571,7 +571,7 @@ var msgWithEventID *Message
 
 func sendMessageWithInlineKB(t *testing.T) *Message {
 	if msgWithInlineKB != nil {
-		msgWithInlineKB, _ = findMessageByBsonID(db, msgWithInlineKB.ID)
+		msgWithInlineKB, _ = findMessageByBsonID(NewMongoStorage(db), msgWithInlineKB.ID)
 
 		return msgWithInlineKB
 	}
@@ -586,7 +586,7 @@ func sendMessageWithInlineKB(t *testing.T) *Message {
 	time.Sleep(time.Second * 2)
 	var err error
 
-	msgWithInlineKB, err = findMessageByBsonID(db, m.ID)
+	msgWithInlineKB, err = findMessageByBsonID(NewMongoStorage(db), m.ID)
 
 	if err != nil {
 		t.Errorf("sendMessageWithInlineKB error on msg sent = %v", err)
@@ -596,7 +596,7 @@ func sendMessageWithInlineKB(t *testing.T) *Message {
 
 func sendMessageWithEventID(t *testing.T, eventID string) *Message {
 	if msgWithEventID != nil {
-		msgWithEventID, _ = findMessageByBsonID(db, msgWithEventID.ID)
+		msgWithEventID, _ = findMessageByBsonID(NewMongoStorage(db), msgWithEventID.ID)
 
 		return msgWithEventID
 	}
@@ -611,7 +611,7 @@ func sendMessageWithEventID(t *testing.T, eventID string) *Message {
 	time.Sleep(time.Second * 2)
 	var err error
 
-	msgWithEventID, err = findMessageByBsonID(db, m.ID)
+	msgWithEventID, err = findMessageByBsonID(NewMongoStorage(db), m.ID)
 
 	if err != nil {
 		t.Errorf("sendMessageWithInlineKB error on msg sent = %v", err)
@@ -666,7 +666,7 @@ func TestContext_EditPressedMessageText(t *testing.T) {
 		}
 		time.Sleep(time.Millisecond * 1000)
 
-		msg, _ := findMessageByBsonID(db, msg.ID)
+		msg, _ := findMessageByBsonID(NewMongoStorage(db), msg.ID)
 		textHash:=fmt.Sprintf(fmt.Sprintf("%x", md5.Sum([]byte(tt.args.text))))
 		if msg.om.TextHash != textHash {
 			t.Errorf("%q. Context.EditPressedMessageText() db check got text hash = %s, want %s", tt.name, msg.om.TextHash, textHash)
@@ -721,7 +721,7 @@ func TestContext_EditPressedMessageTextAndInlineKeyboard(t *testing.T) {
 			t.Errorf("%q. Context.EditPressedMessageTextAndInlineKeyboard() error = %v, wantErr %v", tt.name, err, tt.wantErr)
 		}
 
-		msg, _ := findMessageByBsonID(db, msg.ID)
+		msg, _ := findMessageByBsonID(NewMongoStorage(db), msg.ID)
 
 		textHash := fmt.Sprintf("%x", md5.Sum([]byte(tt.args.text)))
 		if msg.om.TextHash != textHash {
@@ -780,7 +780,7 @@ func TestContext_EditPressedInlineKeyboard(t *testing.T) {
 			t.Errorf("%q. Context.EditPressedInlineKeyboard() error = %v, wantErr %v", tt.name, err, tt.wantErr)
 		}
 
-		msg, _ := findMessageByBsonID(db, msg.ID)
+		msg, _ := findMessageByBsonID(NewMongoStorage(db), msg.ID)
 
 		if !reflect.DeepEqual(msg.om.InlineKeyboardMarkup, tt.args.kb) {
 			t.Errorf("%q. Context.EditPressedInlineKeyboard() db check got kb = %v, want %v", tt.name, msg.om.InlineKeyboardMarkup, tt.args.kb)
@@ -835,7 +835,7 @@ func TestContext_EditPressedInlineButton(t *testing.T) {
 			t.Errorf("%q. Context.EditPressedInlineButton() error = %v, wantErr %v", tt.name, err, tt.wantErr)
 		}
 
-		msg, _ := findMessageByBsonID(db, msg.ID)
+		msg, _ := findMessageByBsonID(NewMongoStorage(db), msg.ID)
 		_, _, but := msg.om.InlineKeyboardMarkup.Find(tt.fields.Callback.Data)
 
 		if but.Text != tt.args.newText {
@@ -895,7 +895,7 @@ func TestContext_EditMessageText(t *testing.T) {
 			t.Errorf("%q. Context.EditMessageText() error = %v, wantErr %v", tt.name, err, tt.wantErr)
 		}
 		time.Sleep(time.Millisecond * 100)
-		msg, _ := findMessageByBsonID(db, msg.ID)
+		msg, _ := findMessageByBsonID(NewMongoStorage(db), msg.ID)
 		textHash:=fmt.Sprintf(fmt.Sprintf("%x", md5.Sum([]byte(tt.args.text))))
 
 		if msg.om.TextHash !=  textHash {
@@ -0,0 +1,311 @@
+package integram
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultConversationTimeout is used when Conversation's Timeout is not set
+const DefaultConversationTimeout = time.Hour
+
+// ConversationCancelCommand cancels the active conversation
+const ConversationCancelCommand = "cancel"
+
+// ErrNoActiveConversation returned when there is no active conversation within the Context
+var ErrNoActiveConversation = errors.New("no active conversation")
+
+// Conversation describes the multi-step dialog, e.g. "connect a board, then pick lists, then pick events"
+type Conversation struct {
+	Name    string              // Unique name within the service
+	States  []ConversationState // First state is the initial one
+	Timeout time.Duration       // Inactivity timeout after which conversation is dropped. Default to DefaultConversationTimeout
+	PerChat bool                // Conversation is shared by all chat members instead of one per user+chat
+
+	// Called on /cancel command or CancelConversation. If not set "Cancelled" message will be sent
+	OnCancel func(ctx *Context) error
+}
+
+// ConversationState is the single step of the Conversation
+type ConversationState struct {
+	Name string
+
+	// Called when conversation enters this state. Useful to ask the question
+	Enter func(ctx *Context) error
+
+	// Called on every incoming message while conversation is in this state. Use SetConversationState to move to the next one
+	// If not set message will be passed to the TGNewMessageHandler
+	Handler func(ctx *Context) error
+}
+
+type conversation struct {
+	Service   string
+	ChatID    int64
+	UserID    int64 // 0 for PerChat conversations
+	Name      string
+	State     string
+	Data      map[string]bson.Raw `bson:",omitempty"`
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (s *Service) conversationByName(name string) *Conversation {
+	for i := range s.Conversations {
+		if s.Conversations[i].Name == name {
+			return &s.Conversations[i]
+		}
+	}
+	return nil
+}
+
+func (cv *Conversation) state(name string) *ConversationState {
+	for i := range cv.States {
+		if cv.States[i].Name == name {
+			return &cv.States[i]
+		}
+	}
+	return nil
+}
+
+func (cv *Conversation) timeout() time.Duration {
+	if cv.Timeout > 0 {
+		return cv.Timeout
+	}
+	return DefaultConversationTimeout
+}
+
+func (c *Context) conversationSelector(cv *Conversation) bson.M {
+	userID := c.User.ID
+	if cv.PerChat {
+		userID = 0
+	}
+	return bson.M{"service": c.ServiceName, "chatid": c.Chat.ID, "userid": userID}
+}
+
+// activeConversation returns the user's conversation within the chat or, if not exists, the chat's one
+func (c *Context) activeConversation() (*conversation, *Conversation) {
+	if c.conversation != nil {
+		return c.conversation, c.Service().conversationByName(c.conversation.Name)
+	}
+
+	// user's conversation has a priority over the chat's one
+	record := conversation{}
+	err := c.Storage().C("conversations").Find(bson.M{"service": c.ServiceName, "chatid": c.Chat.ID, "userid": bson.M{"$in": []int64{c.User.ID, 0}}, "expiresat": bson.M{"$gt": time.Now()}}).Sort("-userid").One(&record)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			c.Log().WithError(err).Error("Can't get active conversation")
+		}
+		return nil, nil
+	}
+
+	cv := c.Service().conversationByName(record.Name)
+	if cv == nil {
+		c.Log().WithField("conversation", record.Name).Warn("Conversation not registered for service")
+		return nil, nil
+	}
+
+	c.conversation = &record
+	return c.conversation, cv
+}
+
+// StartConversation starts the Service's Conversation with specific name from the first state. Previous conversation will be replaced
+func (c *Context) StartConversation(name string) error {
+	cv := c.Service().conversationByName(name)
+	if cv == nil {
+		return fmt.Errorf("conversation '%s' not registered for %s", name, c.ServiceName)
+	}
+	if len(cv.States) == 0 {
+		return fmt.Errorf("conversation '%s' of %s has no states", name, c.ServiceName)
+	}
+
+	c.conversation = nil
+
+	now := time.Now()
+	selector := c.conversationSelector(cv)
+	record := conversation{
+		Service:   c.ServiceName,
+		ChatID:    selector["chatid"].(int64),
+		UserID:    selector["userid"].(int64),
+		Name:      cv.Name,
+		State:     cv.States[0].Name,
+		StartedAt: now,
+		ExpiresAt: now.Add(cv.timeout()),
+	}
+
+	_, err := c.Storage().C("conversations").Upsert(selector, record)
+	if err != nil {
+		return err
+	}
+
+	c.conversation = &record
+
+	if cv.States[0].Enter != nil {
+		return cv.States[0].Enter(c)
+	}
+	return nil
+}
+
+// ConversationState returns the name and the current state of the active conversation. Empty strings returned if there is no one
+func (c *Context) ConversationState() (name string, state string) {
+	record, cv := c.activeConversation()
+	if cv == nil {
+		return "", ""
+	}
+	return record.Name, record.State
+}
+
+// SetConversationState moves the active conversation to the state with specific name and calls its Enter func
+func (c *Context) SetConversationState(state string) error {
+	record, cv := c.activeConversation()
+	if cv == nil {
+		return ErrNoActiveConversation
+	}
+
+	s := cv.state(state)
+	if s == nil {
+		return fmt.Errorf("conversation '%s' has no state '%s'", cv.Name, state)
+	}
+
+	expiresAt := time.Now().Add(cv.timeout())
+	err := c.Storage().C("conversations").Update(c.conversationSelector(cv), bson.M{"$set": bson.M{"state": state, "expiresat": expiresAt}})
+	if err != nil {
+		return err
+	}
+
+	record.State = state
+	record.ExpiresAt = expiresAt
+
+	if s.Enter != nil {
+		return s.Enter(c)
+	}
+	return nil
+}
+
+// SetConversationData stores the value within the active conversation. Data will be removed when conversation ends
+func (c *Context) SetConversationData(key string, val interface{}) error {
+	record, cv := c.activeConversation()
+	if cv == nil {
+		return ErrNoActiveConversation
+	}
+
+	key = strings.ToLower(key)
+	data, err := bson.Marshal(bson.M{"v": val})
+	if err != nil {
+		return err
+	}
+
+	var raw struct{ V bson.Raw }
+	err = bson.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	err = c.Storage().C("conversations").Update(c.conversationSelector(cv), bson.M{"$set": bson.M{"data." + key: val}})
+	if err != nil {
+		return err
+	}
+
+	if record.Data == nil {
+		record.Data = make(map[string]bson.Raw)
+	}
+	record.Data[key] = raw.V
+	return nil
+}
+
+// ConversationData returns if the value with specific key exists within the active conversation and try to bind it to res
+func (c *Context) ConversationData(key string, res interface{}) (exists bool) {
+	record, cv := c.activeConversation()
+	if cv == nil {
+		return false
+	}
+
+	raw, exists := record.Data[strings.ToLower(key)]
+	if !exists {
+		return false
+	}
+
+	err := raw.Unmarshal(res)
+	if err != nil {
+		c.Log().WithError(err).WithField("key", key).Error("Can't unmarshal conversation data")
+		return false
+	}
+	return true
+}
+
+// EndConversation finishes the active conversation and removes its data
+func (c *Context) EndConversation() error {
+	_, cv := c.activeConversation()
+	if cv == nil {
+		return nil
+	}
+
+	c.conversation = nil
+	err := c.Storage().C("conversations").Remove(c.conversationSelector(cv))
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// CancelConversation finishes the active conversation and calls its OnCancel func
+func (c *Context) CancelConversation() error {
+	_, cv := c.activeConversation()
+	if cv == nil {
+		return ErrNoActiveConversation
+	}
+
+	err := c.EndConversation()
+	if err != nil {
+		return err
+	}
+
+	if cv.OnCancel != nil {
+		return cv.OnCancel(c)
+	}
+	return c.NewMessage().SetText(c.T("conversation.stop")).HideKeyboard().Send()
+}
+
+// handleConversation passes incoming message to the active conversation. Returns false if message wasn't handled
+func (c *Context) handleConversation() bool {
+	record, cv := c.activeConversation()
+	if cv == nil {
+		return false
+	}
+
+	if cmd, _ := c.Message.GetCommand(); cmd == ConversationCancelCommand {
+		err := c.CancelConversation()
+		if err != nil {
+			c.Log().WithError(err).WithField("conversation", cv.Name).Error("Can't cancel conversation")
+		}
+		return true
+	}
+
+	state := cv.state(record.State)
+	if state == nil {
+		c.Log().WithField("conversation", cv.Name).WithField("state", record.State).Error("Conversation state not found")
+		c.EndConversation()
+		return false
+	}
+
+	if state.Handler == nil {
+		return false
+	}
+
+	// prolong the timeout
+	expiresAt := time.Now().Add(cv.timeout())
+	err := c.Storage().C("conversations").Update(c.conversationSelector(cv), bson.M{"$set": bson.M{"expiresat": expiresAt}})
+	if err != nil {
+		c.Log().WithError(err).WithField("conversation", cv.Name).Error("Can't prolong conversation")
+	}
+	record.ExpiresAt = expiresAt
+
+	err = state.Handler(c)
+	if err != nil {
+		c.Log().WithError(err).WithField("conversation", cv.Name).WithField("state", record.State).Error("Conversation handler error")
+	}
+	return true
+}
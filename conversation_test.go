@@ -0,0 +1,137 @@
+package integram
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestContext_Conversation(t *testing.T) {
+	var calls []string
+	services["conversationtest"] = &Service{
+		Name: "conversationtest",
+		Conversations: []Conversation{
+			{
+				Name: "connect",
+				States: []ConversationState{
+					{
+						Name:  "board",
+						Enter: func(c *Context) error { calls = append(calls, "enter board"); return nil },
+						Handler: func(c *Context) error {
+							calls = append(calls, "board "+c.Message.Text)
+							c.SetConversationData("board", c.Message.Text)
+							return c.SetConversationState("lists")
+						},
+					},
+					{
+						Name:  "lists",
+						Enter: func(c *Context) error { calls = append(calls, "enter lists"); return nil },
+						Handler: func(c *Context) error {
+							var board string
+							c.ConversationData("board", &board)
+							calls = append(calls, "lists "+board+" "+c.Message.Text)
+							return c.EndConversation()
+						},
+					},
+				},
+				OnCancel: func(c *Context) error { calls = append(calls, "cancel"); return nil },
+			},
+			{
+				Name:    "poll",
+				PerChat: true,
+				Timeout: time.Millisecond * 100,
+				States:  []ConversationState{{Name: "question"}},
+			},
+		},
+	}
+	defer delete(services, "conversationtest")
+
+	storage := NewMemoryStorage()
+	ensureIndexes(storage)
+
+	newContext := func(userID int64, text string) *Context {
+		ctx := &Context{ServiceName: "conversationtest", User: User{ID: userID}, Chat: Chat{ID: -1}}
+		ctx.SetStorage(storage)
+		ctx.User.ctx = ctx
+		ctx.Chat.ctx = ctx
+		ctx.Message = &IncomingMessage{Message: Message{Text: text}}
+		return ctx
+	}
+
+	ctx := newContext(1, "")
+	if err := ctx.StartConversation("unknown"); err == nil {
+		t.Error("StartConversation() with unknown name must return an error")
+	}
+
+	if err := ctx.StartConversation("connect"); err != nil {
+		t.Fatalf("StartConversation() error = %v", err)
+	}
+
+	tests := []struct {
+		userID    int64
+		text      string
+		handled   bool
+		wantState string
+	}{
+		{2, "hi", false, ""},
+		{1, "trello", true, "lists"},
+		{1, "todo", true, ""},
+		{1, "again", false, ""},
+	}
+	for _, tt := range tests {
+		ctx := newContext(tt.userID, tt.text)
+		if handled := ctx.handleConversation(); handled != tt.handled {
+			t.Errorf("%d %q. handleConversation() = %v, want %v", tt.userID, tt.text, handled, tt.handled)
+		}
+		if _, state := newContext(tt.userID, "").ConversationState(); state != tt.wantState {
+			t.Errorf("%d %q. ConversationState() = %q, want %q", tt.userID, tt.text, state, tt.wantState)
+		}
+	}
+
+	want := []string{"enter board", "board trello", "enter lists", "lists trello todo"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+
+	// cancel
+	calls = nil
+	newContext(1, "").StartConversation("connect")
+	if !newContext(1, "/cancel").handleConversation() {
+		t.Error("handleConversation() with /cancel = false, want true")
+	}
+	if name, _ := newContext(1, "").ConversationState(); name != "" || !reflect.DeepEqual(calls, []string{"enter board", "cancel"}) {
+		t.Errorf("after /cancel conversation = %q, calls = %v", name, calls)
+	}
+
+	// per chat conversation with timeout, state without handler passes message through
+	newContext(1, "").StartConversation("poll")
+	if name, _ := newContext(2, "").ConversationState(); name != "poll" {
+		t.Errorf("ConversationState() for another chat member = %q, want %q", name, "poll")
+	}
+	if newContext(2, "answer").handleConversation() {
+		t.Error("handleConversation() for state without Handler = true, want false")
+	}
+
+	time.Sleep(time.Millisecond * 150)
+	if name, _ := newContext(2, "").ConversationState(); name != "" {
+		t.Errorf("ConversationState() after timeout = %q, want none", name)
+	}
+}
+
+func TestContext_StartConversation_NoStates(t *testing.T) {
+	services["conversationnostates"] = &Service{
+		Name:          "conversationnostates",
+		Conversations: []Conversation{{Name: "empty"}},
+	}
+	defer delete(services, "conversationnostates")
+
+	ctx := &Context{ServiceName: "conversationnostates", User: User{ID: 1}, Chat: Chat{ID: 1}}
+	ctx.SetStorage(NewMemoryStorage())
+
+	if err := ctx.StartConversation("empty"); err == nil {
+		t.Error("StartConversation() for the conversation without states must return an error")
+	}
+	if name, _ := ctx.ConversationState(); name != "" {
+		t.Errorf("ConversationState() = %q, want no active conversation", name)
+	}
+}
@@ -26,14 +26,14 @@ func ObjectIdHex(s string) bson.ObjectId {
 	return bson.ObjectIdHex(s)
 }
 
-func ensureIndexes() {
-	db := mongoSession.DB(mongo.Database)
+func ensureIndexes(db Storage) {
 	db.C("messages").DropIndex("chatid", "botid", "msgid")
 
 	db.C("messages").EnsureIndex(mgo.Index{Key: []string{"botid", "eventid"}})
 	db.C("messages").EnsureIndex(mgo.Index{Key: []string{"chatid", "botid", "msgid", "inlinemsgid"}, Unique: true})
 	db.C("messages").EnsureIndex(mgo.Index{Key: []string{"chatid", "botid", "fromid"}})
 	db.C("messages").EnsureIndex(mgo.Index{Key: []string{"chatid", "botid", "eventid"}}) //todo: test eventID uniqueness
+	db.C("messages").EnsureIndex(mgo.Index{Key: []string{"botid", "poll.id"}, Sparse: true})
 
 	db.C("previews").EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true, Sparse: true})
 
@@ -54,6 +54,21 @@ func ensureIndexes() {
 	db.C("chats_cache").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
 	db.C("chats_cache").EnsureIndex(mgo.Index{Key: []string{"key", "chatid", "service"}, Unique: true})
 
+	db.C("conversations").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+	db.C("conversations").EnsureIndex(mgo.Index{Key: []string{"service", "chatid", "userid"}, Unique: true})
+
+	db.C("webhook_deliveries").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+	db.C("webhook_deliveries").EnsureIndex(mgo.Index{Key: []string{"service", "hooktoken", "receivedat"}})
+	db.C("webhook_deliveries").EnsureIndex(mgo.Index{Key: []string{"service", "chats", "receivedat"}})
+
+	db.C("webhook_dedupe").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+
+	db.C("tg_ratelimit").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+
+	db.C("message_edits").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+
+	db.C("tg_files").EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+
 	db.C("stats").EnsureIndex(mgo.Index{Key: []string{"s", "k", "d"}, Unique: true})
 
 	db.C("stats_unique").EnsureIndex(mgo.Index{Key: []string{"exp"}, ExpireAfter: time.Second})
@@ -63,6 +78,13 @@ func ensureIndexes() {
 }
 
 func dbConnect() {
+	if Config.Storage == StorageMemory {
+		memoryStorageInstance = NewMemoryStorage()
+		log.Warn("In-memory storage is used. All the data will be lost on restart")
+
+		ensureIndexes(memoryStorageInstance)
+		return
+	}
 
 	var err error
 	mongo, err = mgo.ParseURL(Config.MongoURL)
@@ -78,7 +100,7 @@ func dbConnect() {
 	mongoSession.SetSafe(&mgo.Safe{})
 	log.Infof("MongoDB connected: %s", Config.MongoURL)
 
-	ensureIndexes()
+	ensureIndexes(NewMongoStorage(mongoSession.DB(mongo.Database)))
 }
 
 func bindInterfaceToInterface(in interface{}, out interface{}, path ...string) error {
@@ -131,7 +153,7 @@ func bindInterfaceToInterface(in interface{}, out interface{}, path ...string) e
 	return nil
 }
 
-func findUsernameByID(db *mgo.Database, id int64) string {
+func findUsernameByID(db Storage, id int64) string {
 	d := struct{ Username string }{}
 	db.C("chats").FindId(id).Select(bson.M{"username": 1}).One(&d)
 	return d.Username
@@ -140,7 +162,7 @@ func (c *Context) FindChat(query interface{}) (chatData, error) {
 	chat := chatData{}
 	serviceID := c.getServiceID()
 
-	err := c.db.C("chats").Find(query).Select(bson.M{"type": 1, "firstname": 1, "lastname": 1, "username": 1, "title": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperbot": 1, "tz": 1, "deactivated": 1, "hooks": 1}).One(&chat)
+	err := c.Storage().C("chats").Find(query).Select(bson.M{"type": 1, "firstname": 1, "lastname": 1, "username": 1, "title": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperbot": 1, "tz": 1, "deactivated": 1, "ignoreratelimit": 1, "hooks": 1}).One(&chat)
 	if err != nil {
 		//c.Log().WithError(err).WithField("query", query).Error("Can't find chat")
 		return chat, err
@@ -155,7 +177,7 @@ func (c *Context) FindChats(query interface{}) ([]chatData, error) {
 	chats := []chatData{}
 	serviceID := c.getServiceID()
 
-	err := c.db.C("chats").Find(query).Select(bson.M{"type": 1, "firstname": 1, "lastname": 1, "username": 1, "title": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperbot": 1, "tz": 1, "deactivated": 1, "hooks": 1}).All(&chats)
+	err := c.Storage().C("chats").Find(query).Select(bson.M{"type": 1, "firstname": 1, "lastname": 1, "username": 1, "title": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperbot": 1, "tz": 1, "deactivated": 1, "hooks": 1}).All(&chats)
 	if err != nil {
 		//c.Log().WithError(err).WithField("query", query).Error("Can't find chat")
 		return chats, err
@@ -172,7 +194,7 @@ func (c *Context) FindChatsLimit(query interface{}, limit int, sort ...string) (
 	chats := []chatData{}
 	serviceID := c.getServiceID()
 
-	err := c.db.C("chats").Find(query).Limit(limit).Sort(sort...).Select(bson.M{"type": 1, "firstname": 1, "lastname": 1, "username": 1, "title": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperbot": 1, "tz": 1, "deactivated": 1, "hooks": 1}).All(&chats)
+	err := c.Storage().C("chats").Find(query).Limit(limit).Sort(sort...).Select(bson.M{"type": 1, "firstname": 1, "lastname": 1, "username": 1, "title": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperbot": 1, "tz": 1, "deactivated": 1, "hooks": 1}).All(&chats)
 	if err != nil {
 		//c.Log().WithError(err).WithField("query", query).Error("Can't find chat")
 		return chats, err
@@ -190,9 +212,9 @@ func (c *Context) FindUser(query interface{}) (userData, error) {
 	serviceID := c.getServiceID()
 	var err error
 	if serviceID != "" {
-		err = c.db.C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).One(&user) // TODO: IS it ok to lean on c.Chat.ID here?
+		err = c.Storage().C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).One(&user) // TODO: IS it ok to lean on c.Chat.ID here?
 	} else {
-		err = c.db.C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings": 1, "protected": 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).One(&user) // TODO: IS it ok to lean on c.Chat.ID here?
+		err = c.Storage().C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings": 1, "protected": 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).One(&user) // TODO: IS it ok to lean on c.Chat.ID here?
 	}
 	user.ctx = c
 
@@ -208,9 +230,9 @@ func (c *Context) FindUsers(query interface{}) ([]userData, error) {
 	serviceID := c.getServiceID()
 	var err error
 	if serviceID != "" {
-		err = c.db.C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
+		err = c.Storage().C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
 	} else {
-		err = c.db.C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings": 1, "protected": 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
+		err = c.Storage().C("users").Find(query).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings": 1, "protected": 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
 	}
 
 	if err != nil {
@@ -229,9 +251,9 @@ func (c *Context) FindUsersLimit(query interface{}, limit int, sort ...string) (
 	serviceID := c.getServiceID()
 	var err error
 	if serviceID != "" {
-		err = c.db.C("users").Find(query).Limit(limit).Sort(sort...).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
+		err = c.Storage().C("users").Find(query).Limit(limit).Sort(sort...).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings." + serviceID: 1, "protected." + serviceID: 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
 	} else {
-		err = c.db.C("users").Find(query).Limit(limit).Sort(sort...).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings": 1, "protected": 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
+		err = c.Storage().C("users").Find(query).Limit(limit).Sort(sort...).Select(bson.M{"firstname": 1, "lastname": 1, "username": 1, "settings": 1, "protected": 1, "keyboardperchat": bson.M{"$elemMatch": bson.M{"chatid": c.Chat.ID}}, "tz": 1, "hooks": 1}).All(&users) // TODO: IS it ok to lean on c.Chat.ID here?
 	}
 
 	if err != nil {
@@ -263,11 +285,11 @@ func (c *Context) updateCacheVal(cacheType string, key string, update interface{
 	var err error
 	//var info *mgo.ChangeInfo
 	if cacheType == "user" {
-		_, err = c.db.C("users_cache").Find(bson.M{"userid": c.User.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).Limit(1).Apply(mgo.Change{Update: update, ReturnNew: true, Upsert: true}, mi)
+		_, err = c.Storage().C("users_cache").Find(bson.M{"userid": c.User.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).Limit(1).Apply(mgo.Change{Update: update, ReturnNew: true, Upsert: true}, mi)
 	} else if cacheType == "chat" {
-		_, err = c.db.C("chats_cache").Find(bson.M{"chatid": c.Chat.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).Limit(1).Apply(mgo.Change{Update: update, ReturnNew: true, Upsert: true}, mi)
+		_, err = c.Storage().C("chats_cache").Find(bson.M{"chatid": c.Chat.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).Limit(1).Apply(mgo.Change{Update: update, ReturnNew: true, Upsert: true}, mi)
 	} else if cacheType == "service" {
-		_, err = c.db.C("services_cache").Find(bson.M{"service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).Limit(1).Apply(mgo.Change{Update: update, ReturnNew: true, Upsert: true}, mi)
+		_, err = c.Storage().C("services_cache").Find(bson.M{"service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).Limit(1).Apply(mgo.Change{Update: update, ReturnNew: true, Upsert: true}, mi)
 	} else {
 		panic("updateCacheVal, type " + cacheType + " not exists")
 	}
@@ -325,11 +347,11 @@ func (c *Context) getCacheVal(cacheType string, key string, res interface{}) (ex
 	mi := reflect.MakeMap(reflect.MapOf(KeyType, ElemType)).Interface()
 	var err error
 	if cacheType == "user" {
-		err = c.db.C("users_cache").Find(bson.M{"userid": c.User.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).One(mi)
+		err = c.Storage().C("users_cache").Find(bson.M{"userid": c.User.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).One(mi)
 	} else if cacheType == "chat" {
-		err = c.db.C("chats_cache").Find(bson.M{"chatid": c.Chat.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).One(mi)
+		err = c.Storage().C("chats_cache").Find(bson.M{"chatid": c.Chat.ID, "service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).One(mi)
 	} else if cacheType == "service" {
-		err = c.db.C("services_cache").Find(bson.M{"service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).One(mi)
+		err = c.Storage().C("services_cache").Find(bson.M{"service": serviceID, "key": strings.ToLower(key)}).Select(bson.M{"_id": 0, "val": 1}).One(mi)
 	} else {
 		c.Log().Panic("getCacheVal, type " + cacheType + " not exists")
 		return false
@@ -388,7 +410,7 @@ func (user *User) Chat() Chat {
 
 // IsPrivateStarted indicates if user started the private dialog with a bot (e.g. pressed the start button)
 func (user *User) IsPrivateStarted() bool {
-	err := user.ctx.Db().C("messages").Find(bson.M{"chatid": user.ID, "botid": user.ctx.Bot().ID, "fromid": user.ID}).Select(bson.M{"_id": 1}).One(nil)
+	err := user.ctx.Storage().C("messages").Find(bson.M{"chatid": user.ID, "botid": user.ctx.Bot().ID, "fromid": user.ID}).Select(bson.M{"_id": 1}).One(nil)
 	if err == nil {
 		return true
 	}
@@ -403,14 +425,14 @@ func (user *User) SetCache(key string, val interface{}, ttl time.Duration) error
 	key = strings.ToLower(key)
 
 	if val == nil {
-		err := user.ctx.db.C("users_cache").Remove(bson.M{"userid": user.ID, "service": serviceID, "key": key})
+		err := user.ctx.Storage().C("users_cache").Remove(bson.M{"userid": user.ID, "service": serviceID, "key": key})
 		return err
 	}
-	_, err := user.ctx.db.C("users_cache").Upsert(bson.M{"userid": user.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
+	_, err := user.ctx.Storage().C("users_cache").Upsert(bson.M{"userid": user.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
 	if err != nil {
 		// workaround for WiredTiger bug: https://jira.mongodb.org/browse/SERVER-14322
 		if mgo.IsDup(err) {
-			return user.ctx.db.C("users_cache").Update(bson.M{"userid": user.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
+			return user.ctx.Storage().C("users_cache").Update(bson.M{"userid": user.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
 		}
 		log.WithError(err).WithField("key", key).Error("Can't set user cache value")
 	}
@@ -420,7 +442,7 @@ func (user *User) SetCache(key string, val interface{}, ttl time.Duration) error
 // ClearAllCacheKeys removes all User's cache keys
 func (user *User) ClearAllCacheKeys() error {
 	serviceID := user.ctx.getServiceID()
-	_, err := user.ctx.db.C("users_cache").RemoveAll(bson.M{"userid": user.ID, "service": serviceID})
+	_, err := user.ctx.Storage().C("users_cache").RemoveAll(bson.M{"userid": user.ID, "service": serviceID})
 	return err
 }
 
@@ -442,14 +464,14 @@ func (chat *Chat) SetCache(key string, val interface{}, ttl time.Duration) error
 	key = strings.ToLower(key)
 
 	if val == nil {
-		err := chat.ctx.db.C("chats_cache").Remove(bson.M{"chatid": chat.ID, "service": serviceID, "key": key})
+		err := chat.ctx.Storage().C("chats_cache").Remove(bson.M{"chatid": chat.ID, "service": serviceID, "key": key})
 		return err
 	}
-	_, err := chat.ctx.db.C("chats_cache").Upsert(bson.M{"chatid": chat.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
+	_, err := chat.ctx.Storage().C("chats_cache").Upsert(bson.M{"chatid": chat.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
 	if err != nil {
 		// workaround for WiredTiger bug: https://jira.mongodb.org/browse/SERVER-14322
 		if mgo.IsDup(err) {
-			return chat.ctx.db.C("chats_cache").Update(bson.M{"chatid": chat.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
+			return chat.ctx.Storage().C("chats_cache").Update(bson.M{"chatid": chat.ID, "service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
 		}
 		log.WithError(err).WithField("key", key).Error("Can't set user cache value")
 	}
@@ -459,7 +481,7 @@ func (chat *Chat) SetCache(key string, val interface{}, ttl time.Duration) error
 // ClearAllCacheKeys removes all Chat's cache keys
 func (chat *Chat) ClearAllCacheKeys() error {
 	serviceID := chat.ctx.getServiceID()
-	_, err := chat.ctx.db.C("chats_cache").RemoveAll(bson.M{"chatid": chat.ID, "service": serviceID})
+	_, err := chat.ctx.Storage().C("chats_cache").RemoveAll(bson.M{"chatid": chat.ID, "service": serviceID})
 	return err
 }
 
@@ -481,15 +503,15 @@ func (c *Context) SetServiceCache(key string, val interface{}, ttl time.Duration
 	key = strings.ToLower(key)
 
 	if val == nil {
-		err := c.db.C("services_cache").Remove(bson.M{"service": serviceID, "key": key})
+		err := c.Storage().C("services_cache").Remove(bson.M{"service": serviceID, "key": key})
 		return err
 	}
 
-	_, err := c.db.C("services_cache").Upsert(bson.M{"service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
+	_, err := c.Storage().C("services_cache").Upsert(bson.M{"service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
 	if err != nil {
 		// workaround for WiredTiger bug: https://jira.mongodb.org/browse/SERVER-14322
 		if mgo.IsDup(err) {
-			return c.db.C("services_cache").Update(bson.M{"service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
+			return c.Storage().C("services_cache").Update(bson.M{"service": serviceID, "key": key}, bson.M{"$set": bson.M{"val": val, "expiresat": expiresAt}})
 		}
 		log.WithError(err).WithField("key", key).Error("Can't set sevices cache value")
 	}
@@ -508,14 +530,14 @@ func (c *Context) UpdateServiceCache(key string, update interface{}, res interfa
 }
 
 func (user *User) updateData() error {
-	_, err := user.ctx.db.C("users").UpsertId(user.ID, bson.M{"$set": user, "$setOnInsert": bson.M{"createdat": time.Now()}})
+	_, err := user.ctx.Storage().C("users").UpsertId(user.ID, bson.M{"$set": user, "$setOnInsert": bson.M{"createdat": time.Now()}})
 	user.data.User = *user
 
 	return err
 }
 
 func (chat *Chat) updateData() error {
-	_, err := chat.ctx.db.C("chats").UpsertId(chat.ID, bson.M{"$set": chat, "$setOnInsert": bson.M{"createdat": time.Now()}})
+	_, err := chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$set": chat, "$setOnInsert": bson.M{"createdat": time.Now()}})
 	chat.data.Chat = *chat
 	return err
 }
@@ -531,6 +553,9 @@ func (chat *Chat) getData() (*chatData, error) {
 	}
 	cdata, _ := chat.ctx.FindChat(bson.M{"_id": chat.ID})
 	chat.data = &cdata
+	if chat.Tz == "" {
+		chat.Tz = cdata.Tz
+	}
 
 	var err error
 	if cdata.Type == "" {
@@ -720,7 +745,7 @@ func (chat *Chat) SaveSettings(allSettings interface{}) error {
 
 	serviceID := chat.ctx.getServiceID()
 
-	_, err := chat.ctx.db.C("chats").UpsertId(chat.ID, bson.M{"$set": bson.M{"settings." + serviceID: allSettings}, "$setOnInsert": bson.M{"createdat": time.Now()}})
+	_, err := chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$set": bson.M{"settings." + serviceID: allSettings}, "$setOnInsert": bson.M{"createdat": time.Now()}})
 
 	if chat.data == nil {
 		chat.data = &chatData{}
@@ -740,7 +765,7 @@ func (user *User) SaveSettings(allSettings interface{}) error {
 
 	serviceID := user.ctx.getServiceID()
 
-	_, err := user.ctx.db.C("users").UpsertId(user.ID, bson.M{"$set": bson.M{"settings." + serviceID: allSettings}, "$setOnInsert": bson.M{"createdat": time.Now()}})
+	_, err := user.ctx.Storage().C("users").UpsertId(user.ID, bson.M{"$set": bson.M{"settings." + serviceID: allSettings}, "$setOnInsert": bson.M{"createdat": time.Now()}})
 
 	if user.data == nil {
 		user.data = &userData{}
@@ -754,14 +779,14 @@ func (user *User) SaveSettings(allSettings interface{}) error {
 }
 
 func (user *User) addHook(hook serviceHook) error {
-	_, err := user.ctx.db.C("users").UpsertId(user.ID, bson.M{"$push": bson.M{"hooks": hook}})
+	_, err := user.ctx.Storage().C("users").UpsertId(user.ID, bson.M{"$push": bson.M{"hooks": hook}})
 	user.data.Hooks = append(user.data.Hooks, hook)
 
 	return err
 }
 
 func (chat *Chat) addHook(hook serviceHook) error {
-	_, err := chat.ctx.db.C("chats").UpsertId(chat.ID, bson.M{"$push": bson.M{"hooks": hook}})
+	_, err := chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$push": bson.M{"hooks": hook}})
 	chat.data.Hooks = append(chat.data.Hooks, hook)
 
 	return err
@@ -782,10 +807,33 @@ func (user *User) ServiceHookToken() string {
 	user.addHook(serviceHook{
 		Token:    token,
 		Services: []string{user.ctx.ServiceName},
+		Secret:   rndStr.Get(20),
 	})
 	return token
 }
 
+// ServiceHookSecret returns User's hook secret to sign the webhooks. Show it to the user along with the ServiceHookURL
+func (user *User) ServiceHookSecret() string {
+	token := user.ServiceHookToken()
+
+	for i, hook := range user.data.Hooks {
+		if hook.Token != token {
+			continue
+		}
+
+		if hook.Secret == "" {
+			// hook created before the secrets were introduced
+			user.data.Hooks[i].Secret = rndStr.Get(20)
+			err := user.ctx.Storage().C("users").Update(bson.M{"_id": user.ID, "hooks.token": token}, bson.M{"$set": bson.M{"hooks.$.secret": user.data.Hooks[i].Secret}})
+			if err != nil {
+				user.ctx.Log().WithError(err).Error("Can't save the hook secret")
+			}
+		}
+		return user.data.Hooks[i].Secret
+	}
+	return ""
+}
+
 // ServiceHookToken returns Chats's hook token to use in webhook handling
 func (chat *Chat) ServiceHookToken() string {
 	data, _ := chat.getData()
@@ -801,10 +849,33 @@ func (chat *Chat) ServiceHookToken() string {
 	chat.addHook(serviceHook{
 		Token:    token,
 		Services: []string{chat.ctx.ServiceName},
+		Secret:   rndStr.Get(20),
 	})
 	return token
 }
 
+// ServiceHookSecret returns Chat's hook secret to sign the webhooks. Show it to the user along with the ServiceHookURL
+func (chat *Chat) ServiceHookSecret() string {
+	token := chat.ServiceHookToken()
+
+	for i, hook := range chat.data.Hooks {
+		if hook.Token != token {
+			continue
+		}
+
+		if hook.Secret == "" {
+			// hook created before the secrets were introduced
+			chat.data.Hooks[i].Secret = rndStr.Get(20)
+			err := chat.ctx.Storage().C("chats").Update(bson.M{"_id": chat.ID, "hooks.token": token}, bson.M{"$set": bson.M{"hooks.$.secret": chat.data.Hooks[i].Secret}})
+			if err != nil {
+				chat.ctx.Log().WithError(err).Error("Can't save the hook secret")
+			}
+		}
+		return chat.data.Hooks[i].Secret
+	}
+	return ""
+}
+
 // ServiceHookURL returns User's webhook URL for service to use in webhook handling
 // Used in case when incoming webhooks despatching on the user behalf to chats
 func (user *User) ServiceHookURL() string {
@@ -832,7 +903,7 @@ func (user *User) AddChatToHook(chatID int64) error {
 						}
 					}
 					data.Hooks[i].Chats = append(data.Hooks[i].Chats, chatID)
-					err := user.ctx.db.C("users").Update(bson.M{"_id": user.ID, "hooks.services": service}, bson.M{"$addToSet": bson.M{"hooks.$.chats": chatID}})
+					err := user.ctx.Storage().C("users").Update(bson.M{"_id": user.ID, "hooks.services": service}, bson.M{"$addToSet": bson.M{"hooks.$.chats": chatID}})
 
 					return err
 				}
@@ -856,7 +927,7 @@ func (user *User) saveProtectedSettings() error {
 	}
 
 	serviceID := user.ctx.getServiceID()
-	_, err := user.ctx.db.C("users").UpsertId(user.ID, bson.M{"$set": bson.M{"protected." + serviceID: user.data.Protected[serviceID]}, "$setOnInsert": bson.M{"createdat": time.Now()}})
+	_, err := user.ctx.Storage().C("users").UpsertId(user.ID, bson.M{"$set": bson.M{"protected." + serviceID: user.data.Protected[serviceID]}, "$setOnInsert": bson.M{"createdat": time.Now()}})
 
 	return err
 }
@@ -890,7 +961,7 @@ func (user *User) saveProtectedSetting(key string, value interface{}) error {
 		return errors.New("protected setting with key " + key + " not exists")
 	}
 
-	_, err := user.ctx.db.C("users").UpsertId(user.ID, bson.M{"$set": bson.M{"protected." + serviceID + "." + strings.ToLower(key): value}})
+	_, err := user.ctx.Storage().C("users").UpsertId(user.ID, bson.M{"$set": bson.M{"protected." + serviceID + "." + strings.ToLower(key): value}})
 
 	return err
 }
@@ -901,7 +972,7 @@ func (chat *Chat) SaveSetting(key string, value interface{}) error {
 	key = strings.ToLower(key)
 	serviceID := chat.ctx.getServiceID()
 	var cd chatData
-	_, err := chat.ctx.db.C("chats").FindId(chat.ID).Select(bson.M{"settings." + serviceID: 1}).
+	_, err := chat.ctx.Storage().C("chats").FindId(chat.ID).Select(bson.M{"settings." + serviceID: 1}).
 		Apply(
 			mgo.Change{
 				Update: bson.M{
@@ -931,7 +1002,7 @@ func (user *User) SaveSetting(key string, value interface{}) error {
 	serviceID := user.ctx.getServiceID()
 
 	var ud userData
-	_, err := user.ctx.db.C("users").FindId(user.ID).Select(bson.M{"settings." + serviceID: 1}).
+	_, err := user.ctx.Storage().C("users").FindId(user.ID).Select(bson.M{"settings." + serviceID: 1}).
 		Apply(
 			mgo.Change{
 				Update: bson.M{
@@ -1009,17 +1080,17 @@ func (c *Context) WebPreview(title string, headline string, text string, service
 	wp.Hash = wp.CalculateHash()
 
 	var wpExists webPreview
-	c.db.C("previews").Find(bson.M{"hash": wp.Hash}).One(&wpExists)
+	c.Storage().C("previews").Find(bson.M{"hash": wp.Hash}).One(&wpExists)
 
 	if wpExists.Token != "" {
 		wp = wpExists
 	} else {
-		err := c.db.C("previews").Insert(wp)
+		err := c.Storage().C("previews").Insert(wp)
 
 		if err != nil {
 			// Wow! So jackpot! Much collision
 			wp.Token = rndStr.Get(10)
-			err = c.db.C("previews").Insert(wp)
+			err = c.Storage().C("previews").Insert(wp)
 			c.Log().WithError(err).Error("Can't add webpreview")
 
 		}
@@ -2,6 +2,8 @@ package integram
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -29,8 +31,6 @@ import (
 	"golang.org/x/oauth2"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-
-	"github.com/requilence/jobs"
 )
 
 var startedAt time.Time
@@ -71,11 +71,11 @@ func init() {
 }
 
 func cloneMiddleware(c *gin.Context) {
-	s := mongoSession.Clone()
+	s := cloneStorage()
 
 	defer s.Close()
 
-	c.Set("db", s.DB(mongo.Database))
+	c.Set("storage", s)
 	c.Next()
 }
 
@@ -125,7 +125,7 @@ func gracefulShutdownJobPools() {
 	go func() {
 		sig := <-sigs
 		fmt.Printf("Got '%s' signal\n", sig.String())
-		for name, pool := range jobs.Pools {
+		for name, pool := range jobBackend.Pools() {
 			fmt.Printf("Shutdown '%s' jobs pool...\n", name)
 			pool.Close()
 			err := pool.Wait()
@@ -166,6 +166,8 @@ func Run() {
 	time.Sleep(time.Second * 1)
 	initBots()
 
+	go sweepSpoolDirPeriodically()
+
 	for _, s := range services {
 		if Config.IsStandAloneServiceInstance() {
 			// save the service info as a job to Redis. The MAIN instance will process it
@@ -287,7 +289,7 @@ func Run() {
 }
 
 func webPreviewHandler(c *gin.Context, token string) {
-	db := c.MustGet("db").(*mgo.Database)
+	db := c.MustGet("storage").(Storage)
 	wp := webPreview{}
 
 	err := db.C("previews").Find(bson.M{"_id": token}).One(&wp)
@@ -314,6 +316,55 @@ func webPreviewHandler(c *gin.Context, token string) {
 
 }
 
+func telegramWebhookHandler(c *gin.Context, botID string, tokenHash string) {
+	id, _ := strconv.ParseInt(botID, 10, 64)
+	bot, exists := botPerID[id]
+
+	if !exists || tokenHash != compactHash(bot.token) {
+		c.String(http.StatusNotFound, "Bot not found")
+		return
+	}
+
+	// in case of multi-process mode redirect from the main process to the service that owns the bot
+	if Config.IsMainInstance() {
+		var proxy *httputil.ReverseProxy
+		if len(bot.services) > 0 {
+			proxy = reverseProxyForService(bot.services[0].Name)
+		}
+
+		if proxy == nil {
+			c.String(http.StatusNotFound, "Service not found")
+			return
+		}
+
+		proxy.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	secretToken := c.Request.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secretToken), []byte(bot.webhookSecretToken())) != 1 {
+		c.String(http.StatusUnauthorized, "Wrong secret token")
+		return
+	}
+
+	u := tgUpdate{}
+	err := json.NewDecoder(c.Request.Body).Decode(&u)
+
+	if err != nil {
+		log.WithError(err).WithField("bot", bot.ID).Error("Can't decode Telegram webhook update")
+		c.String(http.StatusBadRequest, "Can't decode the update")
+		return
+	}
+
+	if u.PollAnswer != nil {
+		go pollAnswerRoutine(bot, u.PollAnswer)
+	} else {
+		go updateRoutine(bot, &u.Update)
+	}
+
+	c.Status(http.StatusOK)
+}
+
 // TriggerEventHandler perform search query and trigger EventHandler in context of each chat/user
 func (s *Service) TriggerEventHandler(queryChat bool, bsonQuery map[string]interface{}, data interface{}) error {
 
@@ -325,10 +376,10 @@ func (s *Service) TriggerEventHandler(queryChat bool, bsonQuery map[string]inter
 		return nil
 	}
 
-	db := mongoSession.Clone().DB(mongo.Database)
-	defer db.Session.Close()
+	db := cloneStorage()
+	defer db.Close()
 
-	ctx := &Context{db: db, ServiceName: s.Name}
+	ctx := &Context{storage: db, ServiceName: s.Name}
 	atLeastOneWasHandled := false
 
 	if queryChat {
@@ -403,6 +454,10 @@ func reverseProxyForService(service string) *httputil.ReverseProxy {
 
 	buf := new(bytes.Buffer)
 	rp.ErrorLog = stdlog.New(buf, "reverseProxy ", stdlog.LUTC)
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		metricReverseProxyErrors.inc(service)
+		w.WriteHeader(http.StatusBadGateway)
+	}
 
 	reverseProxiesMap[service] = rp
 
@@ -443,6 +498,27 @@ func serviceHookHandler(c *gin.Context) {
 	p3 := c.Param("param3")
 
 	switch p1 {
+	// telegram updates for bots with UseWebhookInsteadOfLongPolling
+	//
+	// /tg/bot_id/token_hash
+	case "tg":
+		telegramWebhookHandler(c, p2, p3)
+		return
+
+	// /metrics
+	case "metrics":
+		if !Config.Metrics {
+			c.String(http.StatusNotFound, "Metrics are disabled")
+			return
+		}
+		metricsHandler(c)
+		return
+
+	// /stats/service_name
+	case "stats":
+		statsHandler(c, p2)
+		return
+
 	// webpreview handler
 	case "a":
 		webPreviewHandler(c, p2)
@@ -506,7 +582,7 @@ func serviceHookHandler(c *gin.Context) {
 		return
 	}
 
-	db := c.MustGet("db").(*mgo.Database)
+	db := c.MustGet("storage").(Storage)
 
 	if p1 == "healthcheck" || p2 == "healthcheck" {
 		err := healthCheck(db)
@@ -519,12 +595,14 @@ func serviceHookHandler(c *gin.Context) {
 		return
 	}
 
-	ctx := &Context{db: db, gin: c}
+	ctx := &Context{storage: db, gin: c}
 
 	if s != nil {
 		ctx.ServiceName = s.Name
 	}
 
+	defer func() { metricWebhookResponses.inc(ctx.ServiceName, strconv.Itoa(c.Writer.Status())) }()
+
 	var hooks []serviceHook
 
 	wctx := &WebhookContext{gin: c, requestID: rndStr.Get(10)}
@@ -537,6 +615,18 @@ func serviceHookHandler(c *gin.Context) {
 			return
 		}
 
+		if !verifyWebhook(ctx, wctx, s.WebhookSecret) {
+			return
+		}
+
+		delivery := startWebhookDelivery(c, wctx, webhookToken)
+		defer func() { delivery.save(ctx, c.Writer.Status()) }()
+
+		if isDuplicateWebhook(ctx, wctx, webhookToken) {
+			return
+		}
+		defer func() { releaseWebhookDeliveryID(ctx, wctx, c.Writer.Status()) }()
+
 		queryChat, query, err := s.TokenHandler(ctx, wctx)
 
 		if err != nil {
@@ -569,6 +659,7 @@ func serviceHookHandler(c *gin.Context) {
 				ctxCopy.Chat = chat.Chat
 				ctxCopy.Chat.ctx = &ctxCopy
 				err := s.WebhookHandler(&ctxCopy, wctx)
+				delivery.addResult(chat.ID, ctxCopy.messageAnsweredAt != nil, err)
 
 				if err != nil {
 					ctxCopy.StatIncChat(StatWebhookProcessingError)
@@ -604,6 +695,7 @@ func serviceHookHandler(c *gin.Context) {
 				ctxCopy.User.ctx = &ctxCopy
 				ctxCopy.Chat = Chat{ID: user.ID, ctx: &ctxCopy}
 				err := s.WebhookHandler(&ctxCopy, wctx)
+				delivery.addResult(user.ID, ctxCopy.messageAnsweredAt != nil, err)
 
 				if err != nil {
 					ctxCopy.StatIncUser(StatWebhookProcessingError)
@@ -722,6 +814,10 @@ func serviceHookHandler(c *gin.Context) {
 		c.String(http.StatusNotFound, "Unknown token format")
 		return
 	}
+	// delivery is logged only after the request passed the verification
+	var delivery *WebhookDelivery
+	defer func() { delivery.save(ctx, c.Writer.Status()) }()
+
 	atLeastOneChatProcessedWithoutErrors := false
 
 	for _, hook := range hooks {
@@ -770,6 +866,16 @@ func serviceHookHandler(c *gin.Context) {
 
 			ctx.ServiceName = serviceName
 
+			if !verifyWebhook(ctx, wctx, hook.Secret) {
+				return
+			}
+			delivery = startWebhookDelivery(c, wctx, webhookToken)
+
+			if isDuplicateWebhook(ctx, wctx, webhookToken) {
+				return
+			}
+			defer func() { releaseWebhookDeliveryID(ctx, wctx, c.Writer.Status()) }()
+
 			if len(hook.Chats) == 0 {
 				if ctx.Chat.ID != 0 {
 					hook.Chats = []int64{ctx.Chat.ID}
@@ -795,6 +901,7 @@ func serviceHookHandler(c *gin.Context) {
 					continue
 				}
 				err := s.WebhookHandler(&ctxCopy, wctx)
+				delivery.addResult(chatID, ctxCopy.messageAnsweredAt != nil, err)
 
 				if err != nil {
 					if err == ErrorFlood {
@@ -847,7 +954,7 @@ func oAuthInitRedirect(c *gin.Context, service string, authTempID string) {
 		}
 	}
 
-	db := c.MustGet("db").(*mgo.Database)
+	db := c.MustGet("storage").(Storage)
 
 	val := oAuthIDCache{}
 
@@ -909,7 +1016,7 @@ func oAuthInitRedirect(c *gin.Context, service string, authTempID string) {
 
 func oAuthCallback(c *gin.Context, oauthProviderID string) {
 
-	db := c.MustGet("db").(*mgo.Database)
+	db := c.MustGet("storage").(Storage)
 
 	authTempID := c.Query("u")
 
@@ -936,7 +1043,7 @@ func oAuthCallback(c *gin.Context, oauthProviderID string) {
 		return
 	}
 
-	ctx := &Context{ServiceBaseURL: oap.BaseURL, ServiceName: oap.Service, db: db, gin: c}
+	ctx := &Context{ServiceBaseURL: oap.BaseURL, ServiceName: oap.Service, storage: db, gin: c}
 
 	userData, _ := ctx.FindUser(bson.M{"_id": val.UserID})
 	s := ctx.Service()
@@ -0,0 +1,73 @@
+package integram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTelegramWebhookHandler(t *testing.T) {
+	received := make(chan string, 1)
+	service := &Service{Name: "servicewithtgwebhook", UseWebhookInsteadOfLongPolling: true, TGNewMessageHandler: func(c *Context) error {
+		received <- c.Message.Text
+		return nil
+	}}
+	newTestBot(t, service, "webhook_bot")
+	bot := service.Bot()
+
+	defer func(s Storage) { memoryStorageInstance = s }(memoryStorageInstance)
+	memoryStorageInstance = NewMemoryStorage()
+
+	router := gin.New()
+	router.POST("/:param1/:param2/:param3", serviceHookHandler)
+
+	update := `{"update_id": 1, "message": {"message_id": 1, "date": 1, "text": "hello", "from": {"id": 7, "first_name": "Jo"}, "chat": {"id": 7, "type": "private", "first_name": "Jo"}}}`
+	path := "/tg/" + strconv.FormatInt(bot.ID, 10) + "/" + compactHash(bot.token)
+
+	tests := []struct {
+		name        string
+		path        string
+		secretToken string
+		body        string
+		wantStatus  int
+	}{
+		{"unknown bot", "/tg/1/" + compactHash(bot.token), bot.webhookSecretToken(), update, http.StatusNotFound},
+		{"wrong token hash", "/tg/" + strconv.FormatInt(bot.ID, 10) + "/wrong", bot.webhookSecretToken(), update, http.StatusNotFound},
+		{"no secret token", path, "", update, http.StatusUnauthorized},
+		{"wrong secret token", path, "wrong", update, http.StatusUnauthorized},
+		{"bad update", path, bot.webhookSecretToken(), "{", http.StatusBadRequest},
+		{"update", path, bot.webhookSecretToken(), update, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		if tt.secretToken != "" {
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", tt.secretToken)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q. status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+	}
+
+	select {
+	case text := <-received:
+		if text != "hello" {
+			t.Errorf("TGNewMessageHandler received %q, want %q", text, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("TGNewMessageHandler wasn't called for the update")
+	}
+
+	select {
+	case text := <-received:
+		t.Errorf("TGNewMessageHandler received %q from the rejected request", text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,355 @@
+package integram
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultLocale is used when the locale of user is unknown or there is no translation for it
+var DefaultLocale = "en"
+
+// LanguageCommand is answered automatically with the list of service's locales unless the service declares its own one.
+// Locale is chosen with /language_<locale> command, e.g. /language_pt_br
+const LanguageCommand = "language"
+
+// Translations of the texts by locale and key, e.g. {"en": {"issues.open": "%d issues opened by %s"}}
+// Plural forms are set with the CLDR category suffix: "issues.open:one", "issues.open:few", "issues.open:many", "issues.open:other".
+// The form is chosen with the first integer argument of the Context's T
+type Translations map[string]map[string]string
+
+// frameworkTranslations are used for the texts generated by the framework. Services and modules can override them
+var frameworkTranslations = Translations{
+	"en": {
+		"language.name":          "English",
+		"language.choose":        "Choose the language:",
+		"language.changed":       "Language changed",
+		"language.unknown":       "Unknown language: %s",
+		"commands.title":         "Available commands:",
+		"commands.admins":        "(admins only)",
+		"commands.language":      "Choose the language",
+		"commands.help":          "List of commands",
+		"command.not_here":       "%s is not available in this chat",
+		"command.admins":         "%s is available only for the chat administrators",
+		"conversation.stop":      "Cancelled",
+		"callback.outdated":      "Message can be outdated. Bot can't edit messages created before converting to the Super Group",
+		"callback.failed":        "Oops! Please try again",
+		"quiet.off":              "Quiet hours are off",
+		"quiet.silent":           "Quiet hours: %s (%s). Notifications are sent silently",
+		"quiet.defer":            "Quiet hours: %s (%s). Notifications are delivered when they end",
+		"quiet.unknown_tz":       "Unknown time zone: %s",
+		"quiet.usage":            "/%[1]s 23:00-08:00 [silent|defer] [time zone, e.g. Europe/Berlin] – set the quiet hours\n/%[1]s off – turn them off",
+		"webhooks.empty":         "No webhook deliveries yet",
+		"webhooks.title":         "Recent webhook deliveries:",
+		"webhooks.replay":        "To run one again: /%s replay <id>",
+		"webhooks.replayed":      "Delivery replayed with %d status code",
+		"webhooks.replay_failed": "Can't replay the delivery: %s",
+	},
+	"ru": {
+		"language.name":          "Русский",
+		"language.choose":        "Выберите язык:",
+		"language.changed":       "Язык изменён",
+		"language.unknown":       "Неизвестный язык: %s",
+		"commands.title":         "Доступные команды:",
+		"commands.admins":        "(только для администраторов)",
+		"commands.language":      "Выбрать язык",
+		"commands.help":          "Список команд",
+		"command.not_here":       "%s недоступна в этом чате",
+		"command.admins":         "%s доступна только администраторам чата",
+		"conversation.stop":      "Отменено",
+		"callback.outdated":      "Сообщение могло устареть. Бот не может редактировать сообщения, отправленные до преобразования в супергруппу",
+		"callback.failed":        "Упс! Попробуйте ещё раз",
+		"quiet.off":              "Тихие часы выключены",
+		"quiet.silent":           "Тихие часы: %s (%s). Уведомления отправляются без звука",
+		"quiet.defer":            "Тихие часы: %s (%s). Уведомления доставляются после их окончания",
+		"quiet.unknown_tz":       "Неизвестный часовой пояс: %s",
+		"quiet.usage":            "/%[1]s 23:00-08:00 [silent|defer] [часовой пояс, например Europe/Moscow] – задать тихие часы\n/%[1]s off – выключить их",
+		"webhooks.empty":         "Вебхуков пока не было",
+		"webhooks.title":         "Последние вебхуки:",
+		"webhooks.replay":        "Чтобы повторить: /%s replay <id>",
+		"webhooks.replayed":      "Вебхук повторён с кодом ответа %d",
+		"webhooks.replay_failed": "Не удалось повторить вебхук: %s",
+	},
+}
+
+// normalizeLocale converts the Telegram's language code or the user's input to the lowercase locale, e.g. pt_BR -> pt-br
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// localeFallbacks returns the locales to look for the translation, e.g. pt-br -> pt-br, pt, en
+func localeFallbacks(locale string) []string {
+	locales := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		locales = append(locales, locale[:i])
+	}
+	if locale != DefaultLocale {
+		locales = append(locales, DefaultLocale)
+	}
+	return locales
+}
+
+// pluralCategory returns the CLDR plural category of the cardinal number n for the locale's language
+func pluralCategory(locale string, n int64) string {
+	if n < 0 {
+		n = -n
+	}
+
+	lang := locale
+	if i := strings.Index(locale, "-"); i > 0 {
+		lang = locale[:i]
+	}
+
+	switch lang {
+	case "ru", "uk", "be":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return "one"
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return "few"
+		}
+		return "many"
+	case "pl":
+		switch {
+		case n == 1:
+			return "one"
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return "few"
+		}
+		return "many"
+	case "cs", "sk":
+		switch {
+		case n == 1:
+			return "one"
+		case n >= 2 && n <= 4:
+			return "few"
+		}
+		return "other"
+	case "fr":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+		return "other"
+	case "ja", "zh", "ko", "vi", "th", "id", "ms":
+		return "other"
+	}
+
+	if n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+// pluralNumber returns the first arg if it is an integer
+func pluralNumber(args []interface{}) (int64, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	v := reflect.ValueOf(args[0])
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), true
+	}
+	return 0, false
+}
+
+// translations returns the service's bundles in the lookup order: service, modules and the framework
+func (s *Service) translations() []Translations {
+	bundles := []Translations{s.Translations}
+	for _, module := range s.Modules {
+		bundles = append(bundles, module.Translations)
+	}
+	return append(bundles, frameworkTranslations)
+}
+
+// translate returns the text for the exact locale
+func (s *Service) translate(locale string, key string, args ...interface{}) (string, bool) {
+	keys := []string{key}
+	if n, ok := pluralNumber(args); ok {
+		keys = []string{key + ":" + pluralCategory(locale, n), key + ":other", key}
+	}
+
+	for _, bundle := range s.translations() {
+		for _, k := range keys {
+			text, exists := bundle[locale][k]
+			if !exists {
+				continue
+			}
+
+			if len(args) > 0 && strings.Contains(text, "%") {
+				return fmt.Sprintf(text, args...), true
+			}
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// Translate returns the text for the locale falling back to its language and the DefaultLocale. Key is returned if there is no translation
+// Args are interpolated with fmt's verbs, use explicit indexes (e.g. %[2]s) to reorder them
+func (s *Service) Translate(locale string, key string, args ...interface{}) string {
+	for _, l := range localeFallbacks(normalizeLocale(locale)) {
+		if text, ok := s.translate(l, key, args...); ok {
+			return text
+		}
+	}
+	return key
+}
+
+// Locales returns the locales the service and its modules are translated to. DefaultLocale is always included
+func (s *Service) Locales() []string {
+	unique := map[string]struct{}{DefaultLocale: {}}
+	bundles := s.translations()
+	// framework's locales are not counted, because the service's texts are not translated to them
+	for _, bundle := range bundles[:len(bundles)-1] {
+		for locale := range bundle {
+			unique[normalizeLocale(locale)] = struct{}{}
+		}
+	}
+
+	var locales []string
+	for locale := range unique {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// matchLocale returns the service's locale used for the locale, e.g. en-us -> en
+func (s *Service) matchLocale(locale string) string {
+	locales := s.Locales()
+	for _, l := range localeFallbacks(normalizeLocale(locale)) {
+		if SliceContainsString(locales, l) {
+			return l
+		}
+	}
+	return DefaultLocale
+}
+
+// Locale returns the locale chosen with /language for the group chat or for the user. Falls back to the user's Telegram language and the DefaultLocale
+func (c *Context) Locale() string {
+	if c.locale != "" {
+		return c.locale
+	}
+
+	var locale string
+	if c.Chat.ID != 0 && c.Chat.ctx != nil && !c.Chat.IsPrivate() {
+		if ps, _ := c.Chat.protectedSettings(); ps != nil {
+			locale = ps.Locale
+		}
+	}
+
+	if locale == "" && c.User.ID != 0 && c.User.ctx != nil {
+		if ps, _ := c.User.protectedSettings(); ps != nil {
+			locale = ps.Locale
+		}
+	}
+
+	if locale == "" {
+		locale = c.User.Lang
+	}
+
+	if locale == "" {
+		locale = DefaultLocale
+	}
+
+	c.locale = normalizeLocale(locale)
+	return c.locale
+}
+
+// T returns the text translated to the context's Locale, see Translations
+func (c *Context) T(key string, args ...interface{}) string {
+	s := c.Service()
+	if s == nil {
+		s = &Service{}
+	}
+	return s.Translate(c.Locale(), key, args...)
+}
+
+// SetLocale saves the user's locale for the service. Empty locale resets it to the Telegram's language
+func (user *User) SetLocale(locale string) error {
+	if _, err := user.protectedSettings(); err != nil {
+		return err
+	}
+
+	err := user.saveProtectedSetting("Locale", normalizeLocale(locale))
+	user.ctx.locale = ""
+	return err
+}
+
+// SetLocale saves the chat's locale for the service. It overrides the locales of users in the group chat
+func (chat *Chat) SetLocale(locale string) error {
+	ps, err := chat.protectedSettings()
+	if err != nil {
+		return err
+	}
+
+	ps.Locale = normalizeLocale(locale)
+	serviceID := chat.ctx.getServiceID()
+	_, err = chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$set": bson.M{"protected." + serviceID + ".locale": ps.Locale}})
+	chat.ctx.locale = ""
+	return err
+}
+
+// languageCommandLocale parses /language, /language pt_br or /language_pt_br command
+func languageCommandLocale(name string, args string) (string, bool) {
+	if name == LanguageCommand {
+		return strings.TrimSpace(args), true
+	}
+
+	if strings.HasPrefix(name, LanguageCommand+"_") {
+		return name[len(LanguageCommand)+1:], true
+	}
+	return "", false
+}
+
+// languageCommand lists the service's locales or sets the one specified
+func (c *Context) languageCommand(locale string) error {
+	s := c.Service()
+
+	if locale == "" {
+		current := s.matchLocale(c.Locale())
+		text := c.T("language.choose") + "\n"
+		for _, l := range s.Locales() {
+			text += "/" + LanguageCommand + "_" + strings.Replace(l, "-", "_", -1) + " – " + s.Translate(l, "language.name")
+			if l == current {
+				text += " ✓"
+			}
+			text += "\n"
+		}
+		return c.NewMessage().SetText(text).Send()
+	}
+
+	locale = normalizeLocale(locale)
+	if !SliceContainsString(s.Locales(), locale) {
+		return c.NewMessage().SetText(c.T("language.unknown", locale)).Send()
+	}
+
+	var err error
+	if c.Chat.IsPrivate() {
+		err = c.User.SetLocale(locale)
+	} else {
+		var isAdmin bool
+		isAdmin, err = c.IsChatAdmin()
+		if err != nil {
+			return err
+		}
+
+		if !isAdmin {
+			return c.NewMessage().SetText(c.T("command.admins", "/"+LanguageCommand)).Send()
+		}
+		err = c.Chat.SetLocale(locale)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.NewMessage().SetText(c.T("language.changed")).Send()
+}
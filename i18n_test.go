@@ -0,0 +1,156 @@
+package integram
+
+import (
+	"testing"
+)
+
+func Test_pluralCategory(t *testing.T) {
+	tests := []struct {
+		locale string
+		n      int64
+		want   string
+	}{
+		{"en", 1, "one"},
+		{"en", 0, "other"},
+		{"en", 21, "other"},
+		{"ru", 1, "one"},
+		{"ru", 21, "one"},
+		{"ru", 11, "many"},
+		{"ru", 3, "few"},
+		{"ru", 13, "many"},
+		{"ru", 25, "many"},
+		{"uk-ua", 22, "few"},
+		{"pl", 21, "many"},
+		{"pl", 22, "few"},
+		{"cs", 4, "few"},
+		{"cs", 5, "other"},
+		{"fr", 0, "one"},
+		{"ja", 1, "other"},
+	}
+	for _, tt := range tests {
+		if got := pluralCategory(tt.locale, tt.n); got != tt.want {
+			t.Errorf("pluralCategory(%q, %d) = %v, want %v", tt.locale, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestService_Translate(t *testing.T) {
+	service := &Service{
+		Name: "servicewithtranslations",
+		Translations: Translations{
+			"en": {
+				"issues":        "%d issues by %s",
+				"issues:one":    "%d issue by %s",
+				"hello":         "Hello",
+				"language.name": "English (US)",
+			},
+			"ru": {
+				"issues:one":  "%d задача от %s",
+				"issues:few":  "%d задачи от %s",
+				"issues:many": "%d задач от %s",
+			},
+			"pt": {
+				"hello": "Olá",
+			},
+		},
+		Modules: []Module{{Translations: Translations{"en": {"hello": "Hi", "module": "%[2]s, %[1]s"}}}},
+	}
+
+	tests := []struct {
+		name   string
+		locale string
+		key    string
+		args   []interface{}
+		want   string
+	}{
+		{"plural one", "en", "issues", []interface{}{1, "jo"}, "1 issue by jo"},
+		{"plural fallback", "en", "issues", []interface{}{5, "jo"}, "5 issues by jo"},
+		{"plural few", "ru", "issues", []interface{}{22, "jo"}, "22 задачи от jo"},
+		{"plural many", "ru", "issues", []interface{}{uint(11), "jo"}, "11 задач от jo"},
+		{"language fallback", "pt_BR", "hello", nil, "Olá"},
+		{"default locale fallback", "de", "hello", nil, "Hello"},
+		{"module", "en", "module", []interface{}{"a", "b"}, "b, a"},
+		{"framework", "ru", "conversation.stop", nil, "Отменено"},
+		{"framework overridden", "en", "language.name", nil, "English (US)"},
+		{"missing", "en", "missing.key", nil, "missing.key"},
+	}
+	for _, tt := range tests {
+		if got := service.Translate(tt.locale, tt.key, tt.args...); got != tt.want {
+			t.Errorf("%q. Service.Translate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got, want := service.Locales(), []string{"en", "pt", "ru"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Service.Locales() = %v, want %v", got, want)
+	}
+}
+
+func TestContext_LanguageCommand(t *testing.T) {
+	service := &Service{
+		Name: "servicewithlanguages",
+		Translations: Translations{
+			"en": {"hello": "Hello"},
+			"ru": {"hello": "Привет"},
+		},
+	}
+	server, _ := newTestBot(t, service, "language_bot")
+	server.SetChatAdmin(-89, 2)
+
+	defer func(s Storage) { memoryStorageInstance = s }(memoryStorageInstance)
+	memoryStorageInstance = NewMemoryStorage()
+
+	var sent []string
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error {
+		sent = append(sent, m.Text)
+		return nil
+	}}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	newContext := func(chat Chat, user User, text string) *Context {
+		ctx := &Context{ServiceName: service.Name, Chat: chat, User: user, Message: &IncomingMessage{Message: Message{Text: text}}}
+		ctx.SetStorage(memoryStorageInstance)
+		ctx.User.ctx = ctx
+		ctx.Chat.ctx = ctx
+		return ctx
+	}
+
+	private := Chat{ID: 1, Type: "private", FirstName: "Jo"}
+	group := Chat{ID: -89, Type: "group", FirstName: "Group"}
+	user := User{ID: 1, FirstName: "Jo", Lang: "en-US"}
+	admin := User{ID: 2, FirstName: "Admin", Lang: "en"}
+
+	tests := []struct {
+		name       string
+		chat       Chat
+		user       User
+		text       string
+		sent       string
+		wantUser   string // locale of the user in the private chat after the command
+		wantMember string // locale of the user in the group chat after the command
+	}{
+		{"list", private, user, "/language", "Choose the language:\n/language_en – English ✓\n/language_ru – Русский\n", "en-us", "en-us"},
+		{"unknown", private, user, "/language_de", "Unknown language: de", "en-us", "en-us"},
+		{"private", private, user, "/language_ru", "Язык изменён", "ru", "ru"},
+		{"not admin", group, user, "/language en", "/language доступна только администраторам чата", "ru", "ru"},
+		{"admin", group, admin, "/language_en", "Language changed", "ru", "en"},
+	}
+	for _, tt := range tests {
+		sent = nil
+		if !newContext(tt.chat, tt.user, tt.text).handleCommand() {
+			t.Errorf("%q. handleCommand() = false, want true", tt.name)
+		}
+		if len(sent) != 1 || sent[0] != tt.sent {
+			t.Errorf("%q. handleCommand() sent %q, want %q", tt.name, sent, tt.sent)
+		}
+		if got := newContext(private, user, "").Locale(); got != tt.wantUser {
+			t.Errorf("%q. Context.Locale() in the private chat = %v, want %v", tt.name, got, tt.wantUser)
+		}
+		if got := newContext(group, user, "").Locale(); got != tt.wantMember {
+			t.Errorf("%q. Context.Locale() in the group chat = %v, want %v", tt.name, got, tt.wantMember)
+		}
+	}
+
+	if got := newContext(private, user, "").T("hello"); got != "Привет" {
+		t.Errorf("Context.T() = %v, want %v", got, "Привет")
+	}
+}
@@ -0,0 +1,198 @@
+package integram
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/requilence/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	JobsBackendRedis     = "redis"     // Redis-backed queue, default one. Required for the multi-process mode
+	JobsBackendInProcess = "inprocess" // in-process queue for the single-process mode. Pending jobs can be persisted to the ConfigDir with INTEGRAM_JOBS_PERSIST
+)
+
+// JobBackend is used to create the job pools and to register the job types within them
+type JobBackend interface {
+	// NewPool creates the pool with specific key. Jobs scheduled for this key will be executed by the pool's workers
+	NewPool(key string, numWorkers int, batchSize int) (JobPool, error)
+
+	// RegisterType registers the handler for the jobs with specific name within the pool with poolKey
+	// retryType is JobRetryLinear or JobRetryFibonacci
+	RegisterType(name string, poolKey string, retries uint, retryType int, handler interface{}) (JobType, error)
+
+	// Ping checks if the backend is available
+	Ping() error
+
+	// Pools returns all the pools created with NewPool by their keys
+	Pools() map[string]JobPool
+}
+
+// JobPool executes the scheduled jobs
+type JobPool interface {
+	// SetMiddleware sets the func to run before each job. It must send to the chan to start the job and then wait for the job to finish by receiving from it
+	SetMiddleware(f func(chan bool, ScheduledJob, *[]reflect.Value))
+
+	// SetAfterFunc sets the func to run after each job's attempt
+	SetAfterFunc(f func(ScheduledJob))
+
+	// QueueLen returns the number of jobs waiting for the execution, including the delayed ones
+	QueueLen() (int, error)
+
+	Start() error
+	Close()
+	Wait() error
+}
+
+// JobType is the registered job handler
+type JobType interface {
+	// Schedule queues the job to run at specific time. Jobs with a higher priority will be executed first
+	Schedule(priority int, time time.Time, data ...interface{}) (ScheduledJob, error)
+}
+
+// ScheduledJob is a single job queued within the JobPool
+type ScheduledJob interface {
+	Id() string
+	TypeName() string
+	PoolId() string
+	Status() string
+	Time() int64 // UnixNano time of the next execution
+	Retries() uint
+	Error() error
+	Duration() time.Duration
+
+	Refresh() error
+	Destroy() error
+}
+
+var jobBackend JobBackend
+
+// SetJobBackend overrides the backend chosen with INTEGRAM_JOBS_BACKEND. Must be called before the Register
+func SetJobBackend(backend JobBackend) {
+	jobBackend = backend
+}
+
+func defaultJobBackend() JobBackend {
+	if Config.JobsBackend != JobsBackendInProcess {
+		return NewRedisJobBackend(Config.RedisURL)
+	}
+
+	if !Config.IsSingleProcessInstance() {
+		log.Panicf("INTEGRAM_JOBS_BACKEND=%s can be used only with the %s instance mode", JobsBackendInProcess, InstanceModeSingleProcess)
+	}
+
+	persistDir := ""
+	if Config.JobsPersist {
+		persistDir = Config.ConfigDir
+	}
+
+	return NewInProcessJobBackend(persistDir)
+}
+
+// NewRedisJobBackend returns the JobBackend that stores jobs in the Redis
+func NewRedisJobBackend(redisURL string) JobBackend {
+	jobs.Config.Db.Address = redisURL
+	return &redisJobBackend{pools: make(map[string]JobPool)}
+}
+
+type redisJobBackend struct {
+	mu    sync.Mutex
+	pools map[string]JobPool
+}
+
+func (b *redisJobBackend) NewPool(key string, numWorkers int, batchSize int) (JobPool, error) {
+	pool, err := jobs.NewPool(&jobs.PoolConfig{
+		Key:        key,
+		NumWorkers: numWorkers,
+		BatchSize:  batchSize,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pools[key] = &redisJobPool{pool, key}
+
+	return b.pools[key], nil
+}
+
+// RegisterType ignores retryType, Redis backend always uses fibonacci sequence for delays
+func (b *redisJobBackend) RegisterType(name string, poolKey string, retries uint, retryType int, handler interface{}) (JobType, error) {
+	if retryType != JobRetryFibonacci {
+		log.WithField("job", name).Warnf("Redis jobs backend supports JobRetryFibonacci only, retry type %d is replaced with it", retryType)
+	}
+
+	jobType, err := jobs.RegisterTypeWithPoolKey(name, poolKey, retries, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisJobType{jobType}, nil
+}
+
+func (b *redisJobBackend) Ping() error {
+	_, err := jobs.FindById("fake")
+	if err != nil {
+		if _, isThisNotFoundError := err.(jobs.ErrorJobNotFound); !isThisNotFoundError {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *redisJobBackend) Pools() map[string]JobPool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pools := make(map[string]JobPool, len(b.pools))
+	for key, pool := range b.pools {
+		pools[key] = pool
+	}
+	return pools
+}
+
+type redisJobPool struct {
+	*jobs.Pool
+	key string
+}
+
+func (p *redisJobPool) SetMiddleware(f func(chan bool, ScheduledJob, *[]reflect.Value)) {
+	p.Pool.SetMiddleware(func(ch chan bool, job *jobs.Job, args *[]reflect.Value) {
+		f(ch, redisJob{job}, args)
+	})
+}
+
+func (p *redisJobPool) SetAfterFunc(f func(ScheduledJob)) {
+	p.Pool.SetAfterFunc(func(job *jobs.Job) {
+		f(redisJob{job})
+	})
+}
+
+// QueueLen uses the sorted set of the queued jobs that the Redis backend keeps per pool key
+func (p *redisJobPool) QueueLen() (int, error) {
+	return jobs.Status(string(jobs.StatusQueued) + p.key).Count()
+}
+
+type redisJobType struct {
+	*jobs.Type
+}
+
+func (t *redisJobType) Schedule(priority int, time time.Time, data ...interface{}) (ScheduledJob, error) {
+	job, err := t.Type.Schedule(priority, time, data...)
+	if err != nil {
+		return nil, err
+	}
+	return redisJob{job}, nil
+}
+
+type redisJob struct {
+	*jobs.Job
+}
+
+func (j redisJob) Status() string {
+	return string(j.Job.Status())
+}
@@ -0,0 +1,650 @@
+package integram
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	jobStatusQueued    = "queued"
+	jobStatusExecuting = "executing"
+	jobStatusFinished  = "finished"
+	jobStatusFailed    = "failed"
+	jobStatusDestroyed = "destroyed"
+)
+
+// inProcessJobsFlushInterval is how often the pending jobs are saved to disk when the persistence is enabled
+const inProcessJobsFlushInterval = time.Second
+
+// NewInProcessJobBackend returns the JobBackend that keeps jobs in memory and executes them within the current process.
+// If persistDir is not empty pending jobs are saved there and restored when the pool is started
+func NewInProcessJobBackend(persistDir string) JobBackend {
+	return &inProcessJobBackend{
+		persistDir: persistDir,
+		pools:      make(map[string]*inProcessJobPool),
+		types:      make(map[string]*inProcessJobType),
+	}
+}
+
+type inProcessJobBackend struct {
+	persistDir string
+
+	mu    sync.Mutex
+	pools map[string]*inProcessJobPool
+	types map[string]*inProcessJobType
+}
+
+// pool returns the pool with specific key, creating it if needed. Jobs may be scheduled before the pool is created with NewPool, e.g. by the service instance
+func (b *inProcessJobBackend) pool(key string) *inProcessJobPool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p, exists := b.pools[key]; exists {
+		return p
+	}
+
+	p := &inProcessJobPool{
+		key:        key,
+		backend:    b,
+		numWorkers: 1,
+		wake:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+	}
+
+	if b.persistDir != "" {
+		p.persistPath = filepath.Join(b.persistDir, "jobs"+key+".gob")
+	}
+
+	b.pools[key] = p
+	return p
+}
+
+func (b *inProcessJobBackend) NewPool(key string, numWorkers int, batchSize int) (JobPool, error) {
+	p := b.pool(key)
+
+	if numWorkers > 0 {
+		p.numWorkers = numWorkers
+	}
+
+	return p, nil
+}
+
+func (b *inProcessJobBackend) RegisterType(name string, poolKey string, retries uint, retryType int, handler interface{}) (JobType, error) {
+	handlerType := reflect.TypeOf(handler)
+	if handlerType == nil || handlerType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("handler must be a function. Got %T", handler)
+	}
+
+	if handlerType.NumOut() != 1 || !typeIsError(handlerType.Out(0)) {
+		return nil, fmt.Errorf("handler must have exactly one return value of error type")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.types[name]; exists {
+		return nil, fmt.Errorf("job type '%s' is already registered", name)
+	}
+
+	t := &inProcessJobType{
+		name:      name,
+		poolKey:   poolKey,
+		retries:   retries,
+		retryType: retryType,
+		handler:   reflect.ValueOf(handler),
+		backend:   b,
+	}
+
+	b.types[name] = t
+	return t, nil
+}
+
+func (b *inProcessJobBackend) Ping() error {
+	return nil
+}
+
+func (b *inProcessJobBackend) Pools() map[string]JobPool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pools := make(map[string]JobPool, len(b.pools))
+	for key, pool := range b.pools {
+		pools[key] = pool
+	}
+	return pools
+}
+
+func (b *inProcessJobBackend) jobType(name string) *inProcessJobType {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.types[name]
+}
+
+type inProcessJobType struct {
+	name      string
+	poolKey   string
+	retries   uint
+	retryType int
+	handler   reflect.Value
+	backend   *inProcessJobBackend
+}
+
+// Schedule encodes the data with gob the same way as Redis backend does, so the job gets its own copy of the args
+func (t *inProcessJobType) Schedule(priority int, time time.Time, data ...interface{}) (ScheduledJob, error) {
+	handlerType := t.handler.Type()
+	if len(data) != handlerType.NumIn() {
+		return nil, fmt.Errorf("%s handler have %d args, got %d instead", t.name, handlerType.NumIn(), len(data))
+	}
+
+	for i, arg := range data {
+		// pointer to the arg is accepted as well, the same way as Redis backend does
+		if argType := reflect.TypeOf(arg); argType == nil || !argType.AssignableTo(handlerType.In(i)) && argType != reflect.PtrTo(handlerType.In(i)) {
+			return nil, fmt.Errorf("%s handler args[%d] was not of the correct type. Expected %s, but got %v", t.name, i, handlerType.In(i).String(), argType)
+		}
+	}
+
+	encodedData, err := encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %s job's data: %s", t.name, err.Error())
+	}
+
+	job := &inProcessJob{
+		id:       rndStr.Get(20),
+		typ:      t,
+		data:     encodedData,
+		priority: priority,
+		time:     time.UnixNano(),
+		retries:  t.retries,
+		status:   jobStatusQueued,
+		pool:     t.backend.pool(t.poolKey),
+	}
+
+	job.pool.enqueue(job)
+	return job, nil
+}
+
+// retryDelay returns the delay before the attempt after specific number of failures
+func (t *inProcessJobType) retryDelay(failures uint) time.Duration {
+	if t.retryType == JobRetryFibonacci {
+		a, b := 0, 1
+		for i := uint(0); i < failures; i++ {
+			a, b = b, a+b
+		}
+		return time.Duration(a) * time.Second
+	}
+
+	return time.Duration(failures) * time.Second
+}
+
+type inProcessJob struct {
+	id       string
+	typ      *inProcessJobType
+	data     []byte
+	priority int
+	time     int64
+	retries  uint
+	failures uint
+	status   string
+	err      error
+	duration time.Duration
+	pool     *inProcessJobPool
+}
+
+func (j *inProcessJob) Id() string {
+	return j.id
+}
+
+func (j *inProcessJob) TypeName() string {
+	return j.typ.name
+}
+
+func (j *inProcessJob) PoolId() string {
+	return j.typ.poolKey
+}
+
+func (j *inProcessJob) Status() string {
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+
+	return j.status
+}
+
+func (j *inProcessJob) Time() int64 {
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+
+	return j.time
+}
+
+func (j *inProcessJob) Retries() uint {
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+
+	return j.retries
+}
+
+func (j *inProcessJob) Error() error {
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+
+	return j.err
+}
+
+func (j *inProcessJob) Duration() time.Duration {
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+
+	return j.duration
+}
+
+// Refresh does nothing because the in-process job is always up to date
+func (j *inProcessJob) Refresh() error {
+	return nil
+}
+
+// Destroy removes the queued job. The job that is currently being executed will still be retried in case of failure
+func (j *inProcessJob) Destroy() error {
+	j.pool.mu.Lock()
+	defer j.pool.mu.Unlock()
+
+	if j.status == jobStatusExecuting {
+		return nil
+	}
+
+	j.pool.remove(j)
+	j.status = jobStatusDestroyed
+	return nil
+}
+
+type inProcessJobPool struct {
+	key         string
+	backend     *inProcessJobBackend
+	numWorkers  int
+	persistPath string
+
+	middleware func(chan bool, ScheduledJob, *[]reflect.Value)
+	afterFunc  func(ScheduledJob)
+
+	mu        sync.Mutex
+	queue     []*inProcessJob
+	executing map[*inProcessJob]struct{}
+	dirty     bool
+	started   bool
+	closeOnce sync.Once
+
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// inProcessJobRecord is used to save the pending job on disk
+type inProcessJobRecord struct {
+	ID       string
+	TypeName string
+	Data     []byte
+	Priority int
+	Time     int64
+	Retries  uint
+	Failures uint
+}
+
+func (p *inProcessJobPool) SetMiddleware(f func(chan bool, ScheduledJob, *[]reflect.Value)) {
+	p.middleware = f
+}
+
+func (p *inProcessJobPool) SetAfterFunc(f func(ScheduledJob)) {
+	p.afterFunc = f
+}
+
+func (p *inProcessJobPool) Start() error {
+	p.mu.Lock()
+	if p.started {
+		p.mu.Unlock()
+		return errors.New("pool is already started")
+	}
+	p.started = true
+	p.executing = make(map[*inProcessJob]struct{})
+	p.mu.Unlock()
+
+	if p.persistPath != "" {
+		err := p.load()
+		if err != nil {
+			return err
+		}
+
+		p.wg.Add(1)
+		go p.flushLoop()
+	}
+
+	for i := 0; i < p.numWorkers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	return nil
+}
+
+// Close stops the workers after they finish the current jobs
+func (p *inProcessJobPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+	})
+}
+
+// Wait waits for the workers to stop and saves pending jobs
+func (p *inProcessJobPool) Wait() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	started := p.started
+	p.mu.Unlock()
+
+	// jobs saved on the previous run are not loaded until the pool is started, so don't overwrite them
+	if p.persistPath != "" && started {
+		return p.save()
+	}
+	return nil
+}
+
+func (p *inProcessJobPool) QueueLen() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.queue), nil
+}
+
+func (p *inProcessJobPool) enqueue(job *inProcessJob) {
+	p.mu.Lock()
+	p.queue = append(p.queue, job)
+	p.dirty = true
+	p.mu.Unlock()
+
+	p.signal()
+}
+
+func (p *inProcessJobPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove must be called with p.mu locked
+func (p *inProcessJobPool) remove(job *inProcessJob) {
+	for i, queued := range p.queue {
+		if queued == job {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			p.dirty = true
+			return
+		}
+	}
+}
+
+// next pops the due job with the highest priority. Otherwise it returns the time to wait for the nearest one
+func (p *inProcessJobPool) next() (*inProcessJob, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	wait := time.Minute
+	best := -1
+
+	for i, job := range p.queue {
+		if job.time > now {
+			if d := time.Duration(job.time - now); d < wait {
+				wait = d
+			}
+			continue
+		}
+
+		if best == -1 || job.priority > p.queue[best].priority || job.priority == p.queue[best].priority && job.time < p.queue[best].time {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return nil, wait
+	}
+
+	job := p.queue[best]
+	p.queue = append(p.queue[:best], p.queue[best+1:]...)
+	p.executing[job] = struct{}{}
+	job.status = jobStatusExecuting
+
+	return job, 0
+}
+
+func (p *inProcessJobPool) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+
+		job, wait := p.next()
+		if job != nil {
+			// let the other idle worker check the rest of the queue
+			p.signal()
+			p.do(job)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-p.quit:
+			timer.Stop()
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// do executes the job the same way as the Redis pool's worker does: middleware, handler, afterFunc
+func (p *inProcessJobPool) do(job *inProcessJob) {
+	startedAt := time.Now()
+
+	handlerType := job.typ.handler.Type()
+	handlerArgs := make([]reflect.Value, handlerType.NumIn())
+
+	err := func() (err error) {
+		if len(handlerArgs) > 0 {
+			handlerArgsInterfaces := make([]interface{}, handlerType.NumIn())
+			for i := range handlerArgsInterfaces {
+				handlerArgsInterfaces[i] = reflect.Zero(handlerType.In(i)).Interface()
+			}
+
+			err = decode(job.data, &handlerArgsInterfaces)
+			if err != nil {
+				return err
+			}
+
+			for i := range handlerArgsInterfaces {
+				handlerArgs[i] = reflect.ValueOf(handlerArgsInterfaces[i])
+			}
+		}
+
+		if p.middleware != nil {
+			ch := make(chan bool)
+			go p.middleware(ch, job, &handlerArgs)
+			<-ch
+			defer func() {
+				ch <- true
+			}()
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		returnVals := job.typ.handler.Call(handlerArgs)
+		if !returnVals[0].IsNil() {
+			return returnVals[0].Interface().(error)
+		}
+		return nil
+	}()
+
+	p.mu.Lock()
+	job.err = err
+	job.duration = time.Since(startedAt)
+	retry := err != nil && job.retries > 0
+	if retry {
+		job.time = time.Now().Add(job.typ.retryDelay(job.failures + 1)).UnixNano()
+	}
+	p.mu.Unlock()
+
+	if p.afterFunc != nil {
+		p.afterFunc(job)
+	}
+
+	p.mu.Lock()
+	delete(p.executing, job)
+	p.dirty = true
+
+	switch {
+	case retry:
+		job.retries--
+		job.failures++
+		job.status = jobStatusQueued
+	case err != nil:
+		job.status = jobStatusFailed
+	default:
+		job.status = jobStatusFinished
+	}
+	p.mu.Unlock()
+
+	if retry {
+		p.enqueue(job)
+	}
+}
+
+func (p *inProcessJobPool) flushLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(inProcessJobsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			dirty := p.dirty
+			p.mu.Unlock()
+
+			if !dirty {
+				continue
+			}
+
+			err := p.save()
+			if err != nil {
+				log.WithError(err).WithField("pool", p.key).Error("Can't save pending jobs")
+			}
+		}
+	}
+}
+
+// save writes queued and executing jobs to the persistPath. Executing jobs will be started again after restart
+func (p *inProcessJobPool) save() error {
+	p.mu.Lock()
+	records := make([]inProcessJobRecord, 0, len(p.queue)+len(p.executing))
+	for _, job := range p.queue {
+		records = append(records, job.record())
+	}
+	for job := range p.executing {
+		records = append(records, job.record())
+	}
+	p.dirty = false
+	p.mu.Unlock()
+
+	tmpPath := p.persistPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(records)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, p.persistPath)
+}
+
+// load restores the jobs saved on the previous run. Job types must be registered before the pool is started
+func (p *inProcessJobPool) load() error {
+	f, err := os.Open(p.persistPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var records []inProcessJobRecord
+	err = gob.NewDecoder(f).Decode(&records)
+	if err != nil {
+		return fmt.Errorf("can't decode %s: %s", p.persistPath, err.Error())
+	}
+
+	restored := 0
+	for _, record := range records {
+		jobType := p.backend.jobType(record.TypeName)
+		if jobType == nil {
+			log.WithField("pool", p.key).Errorf("Can't restore the job: type '%s' not registered", record.TypeName)
+			continue
+		}
+
+		p.enqueue(&inProcessJob{
+			id:       record.ID,
+			typ:      jobType,
+			data:     record.Data,
+			priority: record.Priority,
+			time:     record.Time,
+			retries:  record.Retries,
+			failures: record.Failures,
+			status:   jobStatusQueued,
+			pool:     p,
+		})
+		restored++
+	}
+
+	if restored > 0 {
+		log.Infof("%d jobs restored for pool %s", restored, p.key)
+	}
+
+	return nil
+}
+
+// record must be called with p.mu locked
+func (j *inProcessJob) record() inProcessJobRecord {
+	return inProcessJobRecord{
+		ID:       j.id,
+		TypeName: j.typ.name,
+		Data:     j.data,
+		Priority: j.priority,
+		Time:     j.time,
+		Retries:  j.retries,
+		Failures: j.failures,
+	}
+}
@@ -0,0 +1,192 @@
+package integram
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type inProcessJobTestRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *inProcessJobTestRecorder) add(s string) {
+	r.mu.Lock()
+	r.calls = append(r.calls, s)
+	r.mu.Unlock()
+}
+
+func (r *inProcessJobTestRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+func waitForJobStatus(job ScheduledJob, status string, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if job.Status() == status {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInProcessJobPool_Order(t *testing.T) {
+	b := NewInProcessJobBackend("")
+	pool, _ := b.NewPool("_test", 1, 10)
+
+	r := &inProcessJobTestRecorder{}
+	jobType, err := b.RegisterType("record", "_test", 0, JobRetryLinear, func(s string) error {
+		r.add(s)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterType() error = %v", err)
+	}
+
+	jobType.Schedule(0, time.Now().Add(time.Millisecond*300), "delayed")
+	jobType.Schedule(0, time.Now(), "low")
+	last, _ := jobType.Schedule(10, time.Now(), "high")
+
+	pool.Start()
+	defer pool.Close()
+
+	if !waitForJobStatus(last, jobStatusFinished, time.Second) {
+		t.Fatalf("job status = %s, want %s", last.Status(), jobStatusFinished)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if got := r.get(); !reflect.DeepEqual(got, []string{"high", "low"}) {
+		t.Errorf("executed before the delay = %v, want [high low]", got)
+	}
+
+	time.Sleep(time.Millisecond * 400)
+	if got := r.get(); !reflect.DeepEqual(got, []string{"high", "low", "delayed"}) {
+		t.Errorf("executed = %v, want [high low delayed]", got)
+	}
+
+	if _, err := jobType.Schedule(0, time.Now(), 1); err == nil {
+		t.Error("Schedule() with wrong arg type must return an error")
+	}
+
+	arg := "pointer"
+	job, err := jobType.Schedule(0, time.Now(), &arg)
+	if err != nil || !waitForJobStatus(job, jobStatusFinished, time.Second) {
+		t.Errorf("Schedule() with the pointer to arg error = %v, want the job finished", err)
+	}
+}
+
+func TestInProcessJobPool_RetriesAndMiddleware(t *testing.T) {
+	b := NewInProcessJobBackend("")
+	pool, _ := b.NewPool("_test", 2, 10)
+
+	r := &inProcessJobTestRecorder{}
+	pool.SetMiddleware(func(ch chan bool, job ScheduledJob, args *[]reflect.Value) {
+		r.add("before")
+		ch <- true
+		<-ch
+		r.add("middleware done")
+	})
+	pool.SetAfterFunc(func(job ScheduledJob) {
+		r.add("after")
+		job.Destroy()
+	})
+
+	jobType, _ := b.RegisterType("fail", "_test", 2, JobRetryFibonacci, func(s string) error {
+		r.add(s)
+		return errors.New("failed")
+	})
+
+	pool.Start()
+	defer pool.Close()
+
+	job, _ := jobType.Schedule(0, time.Now(), "run")
+	scheduledAt := job.Time()
+
+	if !waitForJobStatus(job, jobStatusFailed, time.Second*4) {
+		t.Fatalf("job status = %s, want %s", job.Status(), jobStatusFailed)
+	}
+
+	// fibonacci: 1s, 1s
+	if elapsed := time.Duration(job.Time() - scheduledAt); elapsed < time.Second*2 {
+		t.Errorf("last attempt was %v after the first one, want at least 2s", elapsed)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	want := []string{}
+	for i := 0; i < 3; i++ {
+		want = append(want, "before", "run", "middleware done", "after")
+	}
+
+	// middleware finishes concurrently with the afterFunc
+	got := r.get()
+	if len(got) != len(want) {
+		t.Fatalf("calls = %v, want %v", got, want)
+	}
+	for i := 0; i < len(got); i += 4 {
+		if got[i] != "before" || got[i+1] != "run" {
+			t.Errorf("calls = %v, want %v", got, want)
+			break
+		}
+	}
+
+	if job.Error() == nil || job.Retries() != 0 {
+		t.Errorf("job error = %v, retries = %d, want error and 0 retries", job.Error(), job.Retries())
+	}
+}
+
+func TestInProcessJobPool_Persist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "integram-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gob.Register(&OutgoingMessage{})
+
+	b := NewInProcessJobBackend(dir)
+	pool, _ := b.NewPool("_test", 1, 10)
+	jobType, _ := b.RegisterType("persisted", "_test", 0, JobRetryLinear, func(m *OutgoingMessage) error {
+		return nil
+	})
+	pool.Start()
+
+	m := &OutgoingMessage{}
+	m.Text = "text"
+	jobType.Schedule(0, time.Now().Add(time.Hour), m)
+
+	pool.Close()
+	pool.Wait()
+
+	// restart
+	r := &inProcessJobTestRecorder{}
+	b = NewInProcessJobBackend(dir)
+	pool, _ = b.NewPool("_test", 1, 10)
+	b.RegisterType("persisted", "_test", 0, JobRetryLinear, func(m *OutgoingMessage) error {
+		r.add(m.Text)
+		return nil
+	})
+	pool.Start()
+	defer pool.Close()
+
+	restored := b.(*inProcessJobBackend).pool("_test")
+	restored.mu.Lock()
+	if len(restored.queue) != 1 {
+		t.Errorf("restored %d jobs, want 1", len(restored.queue))
+	} else {
+		restored.queue[0].time = time.Now().UnixNano()
+	}
+	restored.mu.Unlock()
+	restored.signal()
+
+	time.Sleep(time.Millisecond * 100)
+	if got := r.get(); !reflect.DeepEqual(got, []string{"text"}) {
+		t.Errorf("executed = %v, want [text]", got)
+	}
+}
@@ -0,0 +1,21 @@
+package integram
+
+import "testing"
+
+func TestRedisJobBackend_RegisterType(t *testing.T) {
+	b := NewRedisJobBackend(Config.RedisURL)
+
+	tests := []struct {
+		name      string
+		retryType int
+	}{
+		{"redisjobwithlinearretries", JobRetryLinear},
+		{"redisjobwithfibonacciretries", JobRetryFibonacci},
+	}
+	for _, tt := range tests {
+		jobType, err := b.RegisterType(tt.name, "_redistest", 3, tt.retryType, dumbFuncWithParam)
+		if err != nil || jobType == nil {
+			t.Errorf("%q. RegisterType() = %v, %v, want the job type", tt.name, jobType, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package integram
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	tg "github.com/requilence/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Telegram's limits for the number of items within the media group
+const (
+	mediaGroupMinItems = 2
+	mediaGroupMaxItems = 10
+)
+
+// MediaGroupItem is the photo, video or document within the album
+type MediaGroupItem struct {
+	Type     string // "photo", "video" or "document"
+	FilePath string
+	FileName string `bson:",omitempty"`
+	Caption  string `bson:",omitempty"`
+}
+
+type inputMedia struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"`
+	Caption   string `json:"caption,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+// AddMediaGroupPhoto adds the image file located at localPath to the album. Message's Text is not sent with the album, use the caption instead.
+// Captions are formatted according to the message's ParseMode
+func (m *OutgoingMessage) AddMediaGroupPhoto(localPath string, fileName string, caption string) *OutgoingMessage {
+	m.MediaGroup = append(m.MediaGroup, MediaGroupItem{Type: "photo", FilePath: localPath, FileName: fileName, Caption: caption})
+	return m
+}
+
+// AddMediaGroupVideo adds the video file located at localPath to the album
+func (m *OutgoingMessage) AddMediaGroupVideo(localPath string, fileName string, caption string) *OutgoingMessage {
+	m.MediaGroup = append(m.MediaGroup, MediaGroupItem{Type: "video", FilePath: localPath, FileName: fileName, Caption: caption})
+	return m
+}
+
+// AddMediaGroupDocument adds the file located at localPath to the album. Documents can't be mixed with photos and videos
+func (m *OutgoingMessage) AddMediaGroupDocument(localPath string, fileName string, caption string) *OutgoingMessage {
+	m.MediaGroup = append(m.MediaGroup, MediaGroupItem{Type: "document", FilePath: localPath, FileName: fileName, Caption: caption})
+	return m
+}
+
+// validateMediaGroup checks the Telegram's restrictions for albums
+func (m *OutgoingMessage) validateMediaGroup() error {
+	if len(m.MediaGroup) < mediaGroupMinItems || len(m.MediaGroup) > mediaGroupMaxItems {
+		return fmt.Errorf("media group must contain %d-%d items, got %d", mediaGroupMinItems, mediaGroupMaxItems, len(m.MediaGroup))
+	}
+
+	if m.FilePath != "" || m.Location != nil || m.Keyboard || len(m.InlineKeyboardMarkup.Buttons) > 0 {
+		return errors.New("media group can't be combined with the file, location or keyboard")
+	}
+
+	documents := 0
+	for _, item := range m.MediaGroup {
+		switch item.Type {
+		case "photo", "video":
+		case "document":
+			documents++
+		default:
+			return fmt.Errorf("unsupported media group item type: %s", item.Type)
+		}
+	}
+
+	if documents > 0 && documents < len(m.MediaGroup) {
+		return errors.New("documents can't be mixed with photos and videos within the media group")
+	}
+	return nil
+}
+
+// writeMediaGroup writes the sendMediaGroup multipart request. Files are attached as file0, file1, ...
+func writeMediaGroup(w *multipart.Writer, m *OutgoingMessage) error {
+	media := make([]inputMedia, len(m.MediaGroup))
+	for i, item := range m.MediaGroup {
+		field := fmt.Sprintf("file%d", i)
+		media[i] = inputMedia{Type: item.Type, Media: "attach://" + field, Caption: item.Caption}
+		if item.Caption != "" {
+			media[i].ParseMode = m.ParseMode
+		}
+
+		fileName := item.FileName
+		if fileName == "" {
+			fileName = filepath.Base(item.FilePath)
+		}
+
+		f, err := os.Open(item.FilePath)
+		if err != nil {
+			return err
+		}
+
+		part, err := w.CreateFormFile(field, fileName)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	mediaJSON, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+
+	w.WriteField("chat_id", strconv.FormatInt(m.ChatID, 10))
+	w.WriteField("media", string(mediaJSON))
+
+	if m.Silent {
+		w.WriteField("disable_notification", "true")
+	}
+
+	if m.ReplyToMsgID != 0 {
+		w.WriteField("reply_to_message_id", strconv.Itoa(m.ReplyToMsgID))
+	}
+
+	return w.Close()
+}
+
+// sendMediaGroup uploads the album. Errors are returned as tg.Error, so they can be handled the same way as for other messages
+func sendMediaGroup(api *tg.BotAPI, m *OutgoingMessage) ([]tg.Message, error) {
+	// stream the files instead of loading them all into the memory
+	r, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMediaGroup(w, m))
+	}()
+
+	resp, err := api.Client.Post(fmt.Sprintf(tg.APIEndpoint, api.Token, "sendMediaGroup"), w.FormDataContentType(), r)
+	r.Close()
+	if err != nil {
+		code := 0
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		return nil, tg.Error{Code: code, Err: err}
+	}
+	defer resp.Body.Close()
+
+	var apiResp tg.APIResponse
+	err = json.NewDecoder(resp.Body).Decode(&apiResp)
+	if err != nil {
+		return nil, tg.Error{Code: resp.StatusCode, Err: err}
+	}
+
+	if !apiResp.Ok {
+		return nil, tg.Error{Code: apiResp.ErrorCode, Err: errors.New(apiResp.Description), Description: apiResp.Description, Parameters: apiResp.Parameters}
+	}
+
+	var msgs []tg.Message
+	err = json.Unmarshal(apiResp.Result, &msgs)
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// saveMediaGroupMessages stores the rest of the album's messages with the same EventID, so they can be found and deleted together with the first one
+func saveMediaGroupMessages(db Storage, m *OutgoingMessage, msgs []tg.Message) {
+	for i, tgMsg := range msgs {
+		if i == 0 || i >= len(m.MediaGroup) {
+			continue
+		}
+
+		msg := *m
+		msg.ID = bson.NewObjectId()
+		msg.MsgID = tgMsg.MessageID
+		msg.MediaGroup = []MediaGroupItem{m.MediaGroup[i]}
+
+		err := db.C("messages").Insert(&msg)
+		if err != nil {
+			log.WithError(err).Error("Error outgoing inserting media group message in db")
+		}
+	}
+
+	// the first message represents the first item
+	m.MediaGroup = m.MediaGroup[:1]
+}
@@ -0,0 +1,93 @@
+package integram
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOutgoingMessage_validateMediaGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       *OutgoingMessage
+		wantErr bool
+	}{
+		{"photos", (&OutgoingMessage{}).AddMediaGroupPhoto("1.jpg", "", "").AddMediaGroupPhoto("2.jpg", "", ""), false},
+		{"photo and video", (&OutgoingMessage{}).AddMediaGroupPhoto("1.jpg", "", "").AddMediaGroupVideo("2.mp4", "", ""), false},
+		{"documents", (&OutgoingMessage{}).AddMediaGroupDocument("1.txt", "", "").AddMediaGroupDocument("2.txt", "", ""), false},
+		{"single item", (&OutgoingMessage{}).AddMediaGroupPhoto("1.jpg", "", ""), true},
+		{"document and photo", (&OutgoingMessage{}).AddMediaGroupPhoto("1.jpg", "", "").AddMediaGroupDocument("2.txt", "", ""), true},
+		{"with keyboard", (&OutgoingMessage{InlineKeyboardMarkup: InlineKeyboard{Buttons: []InlineButtons{{{Text: "a", Data: "a"}}}}}).AddMediaGroupPhoto("1.jpg", "", "").AddMediaGroupPhoto("2.jpg", "", ""), true},
+	}
+	for _, tt := range tests {
+		if err := tt.m.validateMediaGroup(); (err != nil) != tt.wantErr {
+			t.Errorf("%q. validateMediaGroup() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSendMessage_MediaGroup(t *testing.T) {
+	service := &Service{Name: "servicewithalbums"}
+	server, _ := newTestBot(t, service, "album_bot")
+
+	db, _ := newTestSendQueue(t)
+
+	dir, err := ioutil.TempDir("", "album")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, name := range []string{"1.jpg", "2.jpg", "3.mp4"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(name), 0644)
+		paths = append(paths, path)
+	}
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 200}}
+	ctx.SetStorage(db)
+
+	m := ctx.NewMessage().
+		AddMediaGroupPhoto(paths[0], "", "<b>first</b> <font>caption</font>").
+		AddMediaGroupPhoto(paths[1], "", "").
+		AddMediaGroupVideo(paths[2], "video.mp4", "video").
+		AddEventID("build-1").
+		EnableHTML()
+
+	if err := m.validateMediaGroup(); err != nil {
+		t.Fatalf("validateMediaGroup() error = %v", err)
+	}
+
+	m.MediaGroup[0].Caption = sanitizeCaption(m.MediaGroup[0].Caption, m.ParseMode)
+
+	if err := sendMessage(m); err != nil {
+		t.Fatalf("sendMessage() error = %v", err)
+	}
+
+	msgs := server.Messages(200)
+	if len(msgs) != 3 {
+		t.Fatalf("sendMessage() sent %d messages, want 3", len(msgs))
+	}
+	if msgs[0].Photo == nil || string(msgs[0].Photo.Data) != "1.jpg" || msgs[0].Text != "<b>first</b> caption" || msgs[0].ParseMode != "HTML" || msgs[2].Video == nil || msgs[2].Video.Name != "video.mp4" {
+		t.Errorf("sendMessage() sent %+v, want 2 photos and video with captions", msgs)
+	}
+	if msgs[0].MediaGroupID == "" || msgs[0].MediaGroupID != msgs[2].MediaGroupID {
+		t.Errorf("sendMessage() sent messages not within the same media group")
+	}
+
+	if n, _ := db.C("messages").Find(bson.M{"eventid": "build-1", "botid": service.Bot().ID}).Count(); n != 3 {
+		t.Errorf("%d messages stored with the EventID, want 3", n)
+	}
+
+	deleted, err := ctx.DeleteMessagesWithEventID("build-1")
+	if err != nil || deleted != 3 {
+		t.Errorf("DeleteMessagesWithEventID() = %d, %v, want 3 deleted", deleted, err)
+	}
+	if msgs := server.Messages(200); len(msgs) != 0 {
+		t.Errorf("album messages are not deleted: %+v", msgs)
+	}
+}
@@ -0,0 +1,336 @@
+package integram
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	tg "github.com/requilence/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// editMessageJobRetries is the same as for the sendMessage: maximum of 8 hours deferment (fibonacci sequence)
+const editMessageJobRetries = 23
+
+// messageEditTTL is the period while the result of the queued edit can be awaited
+const messageEditTTL = 24 * time.Hour
+
+// messageEditWaitCheckInterval is the interval to check the result while waiting for it
+const messageEditWaitCheckInterval = 200 * time.Millisecond
+
+const (
+	messageEditText            = "text"
+	messageEditTextAndKeyboard = "text_kb"
+	messageEditKeyboard        = "kb"
+	messageEditButton          = "button"
+	messageEditDelete          = "delete"
+)
+
+const (
+	messageEditStatusQueued = "queued"
+	messageEditStatusDone   = "done"
+	messageEditStatusFailed = "failed"
+)
+
+var (
+	// ErrMessageEditTimeout returned by MessageEditHandle.Wait when the edit is still queued
+	ErrMessageEditTimeout = errors.New("message edit is still queued")
+
+	// ErrMessageEditNotFound returned by MessageEditHandle when the result is expired
+	ErrMessageEditNotFound = errors.New("message edit not found")
+)
+
+var editMessageJob JobType
+
+// messageEdit is the argument of the editMessageJob
+type messageEdit struct {
+	ID             bson.ObjectId
+	ServiceName    string
+	Op             string
+	Message        *OutgoingMessage
+	FromState      string
+	Text           string
+	Keyboard       InlineKeyboard
+	ButtonData     string
+	OldButtonState int
+	NewButtonState int
+}
+
+// messageEditResult is stored to be awaited with the MessageEditHandle, possibly from another process
+type messageEditResult struct {
+	ID        bson.ObjectId `bson:"_id"`
+	Status    string
+	Error     string `bson:",omitempty"`
+	Attempts  int
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// MessageEditHandle is returned by the async edit and delete methods
+type MessageEditHandle struct {
+	ID bson.ObjectId
+}
+
+// Result returns true if the edit is finished and the error if it was failed
+func (h *MessageEditHandle) Result() (done bool, err error) {
+	db := cloneStorage()
+	defer db.Close()
+
+	res := messageEditResult{}
+	err = db.C("message_edits").FindId(h.ID).One(&res)
+	if err == mgo.ErrNotFound {
+		return false, ErrMessageEditNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	switch res.Status {
+	case messageEditStatusDone:
+		return true, nil
+	case messageEditStatusFailed:
+		return true, errors.New(res.Error)
+	}
+	return false, nil
+}
+
+// Wait blocks until the edit is finished and returns its error. Returns ErrMessageEditTimeout if it's still queued after the timeout
+func (h *MessageEditHandle) Wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := h.Result()
+		if done || err != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return ErrMessageEditTimeout
+		}
+		time.Sleep(messageEditWaitCheckInterval)
+	}
+}
+
+// scheduleMessageEdit puts the edit to the _telegram pool
+func (c *Context) scheduleMessageEdit(e *messageEdit) (*MessageEditHandle, error) {
+	if e.Message == nil {
+		return nil, errors.New("Empty message provided")
+	}
+
+	e.ID = bson.NewObjectId()
+	now := time.Now()
+	err := c.Storage().C("message_edits").Insert(messageEditResult{ID: e.ID, Status: messageEditStatusQueued, UpdatedAt: now, ExpiresAt: now.Add(messageEditTTL)})
+	if err != nil {
+		return nil, err
+	}
+
+	e.ServiceName = c.ServiceName
+
+	_, err = editMessageJob.Schedule(0, now, e)
+	if err != nil {
+		c.Log().WithError(err).Error("Can't schedule editMessageJob")
+		return nil, err
+	}
+
+	return &MessageEditHandle{ID: e.ID}, nil
+}
+
+func (e *messageEdit) apply(c *Context) error {
+	switch e.Op {
+	case messageEditText:
+		return c.EditMessageText(e.Message, e.Text)
+	case messageEditTextAndKeyboard:
+		return c.EditMessageTextAndInlineKeyboard(e.Message, e.FromState, e.Text, e.Keyboard)
+	case messageEditKeyboard:
+		return c.EditInlineKeyboard(e.Message, e.FromState, e.Keyboard)
+	case messageEditButton:
+		return c.EditInlineStateButton(e.Message, e.FromState, e.OldButtonState, e.ButtonData, e.NewButtonState, e.Text)
+	case messageEditDelete:
+		return c.DeleteMessage(e.Message)
+	}
+	return errors.New("unknown message edit operation: " + e.Op)
+}
+
+func (e *messageEdit) finish(db Storage, err error) {
+	set := bson.M{"status": messageEditStatusDone, "updatedat": time.Now()}
+	if err != nil {
+		set["status"] = messageEditStatusFailed
+		set["error"] = err.Error()
+	}
+
+	if err := db.C("message_edits").UpdateId(e.ID, bson.M{"$set": set}); err != nil && err != mgo.ErrNotFound {
+		log.WithError(err).Error("Can't save the message edit result")
+	}
+}
+
+// editMessage is the editMessageJob handler. It classifies the errors the same way as the sendMessage:
+// network and TG server errors are retried by the job, TooManyRequests reschedules the edit and the rest of errors are permanent
+func editMessage(e *messageEdit) error {
+	db := cloneStorage()
+	defer db.Close()
+
+	// callback is outdated at the moment of the job execution, so context contains only the service
+	c := &Context{ServiceName: e.ServiceName, storage: db}
+
+	res := messageEditResult{}
+	_, err := db.C("message_edits").FindId(e.ID).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"attempts": 1}}, ReturnNew: true}, &res)
+	if err != nil && err != mgo.ErrNotFound {
+		log.WithError(err).Error("Can't update the message edit attempts")
+	}
+
+	if delay := checkTGRateLimit(db, e.Message); delay > 0 {
+		_, err := editMessageJob.Schedule(0, time.Now().Add(delay), e)
+		return err
+	}
+
+	// apply updates the message's text and hash before the request, so the rescheduled edit must start from the original message
+	original := *e.Message
+
+	err = e.apply(c)
+	if err == nil {
+		e.finish(db, nil)
+		return nil
+	}
+
+	fields := log.Fields{"chat": e.Message.ChatID, "msgid": e.Message.MsgID, "op": e.Op}
+
+	tgErr, ok := err.(tg.Error)
+	if !ok {
+		c.Log().WithError(err).WithFields(fields).Error("editMessage error")
+		e.finish(db, err)
+		return nil
+	}
+
+	if tgErr.Code == 0 || tgErr.Code >= 500 {
+		if res.Attempts > editMessageJobRetries {
+			e.finish(db, err)
+			return nil
+		}
+		c.Log().WithError(err).WithFields(fields).Warn("Network error while editing a message")
+		// pass through the error so the job will be rescheduled
+		return err
+	} else if tgErr.TooManyRequests() {
+		c.Log().WithFields(fields).Warn("editMessage error: TooManyRequests")
+
+		delay := 60
+		if tgErr.Parameters != nil && tgErr.Parameters.RetryAfter > 0 {
+			delay = tgErr.Parameters.RetryAfter
+		}
+
+		retry := *e
+		retry.Message = &original
+
+		_, err := editMessageJob.Schedule(0, time.Now().Add(time.Duration(delay+rand.Intn(10))*time.Second), &retry)
+		return err
+	} else if strings.Contains(strings.ToLower(tgErr.Description), "message is not modified") {
+		e.finish(db, nil)
+		return nil
+	} else if tgErr.IsMessageNotFound() || tgErr.IsCantAccessChat() || tgErr.ChatMigrated() {
+		c.Log().WithError(err).WithFields(fields).Warn("editMessage error: message is no longer accessible")
+	} else {
+		c.Log().WithError(err).WithFields(fields).Error("editMessage error")
+	}
+
+	e.finish(db, err)
+	return nil
+}
+
+// EditMessageTextAsync queues the EditMessageText. Network and rate limit errors will be retried
+func (c *Context) EditMessageTextAsync(om *OutgoingMessage, text string) (*MessageEditHandle, error) {
+	return c.scheduleMessageEdit(&messageEdit{Op: messageEditText, Message: om, Text: text})
+}
+
+// EditMessageTextAndInlineKeyboardAsync queues the EditMessageTextAndInlineKeyboard. Network and rate limit errors will be retried
+func (c *Context) EditMessageTextAndInlineKeyboardAsync(om *OutgoingMessage, fromState string, text string, kb InlineKeyboard) (*MessageEditHandle, error) {
+	return c.scheduleMessageEdit(&messageEdit{Op: messageEditTextAndKeyboard, Message: om, FromState: fromState, Text: text, Keyboard: kb})
+}
+
+// EditInlineKeyboardAsync queues the EditInlineKeyboard. Network and rate limit errors will be retried
+func (c *Context) EditInlineKeyboardAsync(om *OutgoingMessage, fromState string, kb InlineKeyboard) (*MessageEditHandle, error) {
+	return c.scheduleMessageEdit(&messageEdit{Op: messageEditKeyboard, Message: om, FromState: fromState, Keyboard: kb})
+}
+
+// EditInlineButtonAsync queues the EditInlineButton. Network and rate limit errors will be retried
+func (c *Context) EditInlineButtonAsync(om *OutgoingMessage, kbState string, buttonData string, newButtonText string) (*MessageEditHandle, error) {
+	return c.EditInlineStateButtonAsync(om, kbState, 0, buttonData, 0, newButtonText)
+}
+
+// EditInlineStateButtonAsync queues the EditInlineStateButton. Network and rate limit errors will be retried
+func (c *Context) EditInlineStateButtonAsync(om *OutgoingMessage, kbState string, oldButtonState int, buttonData string, newButtonState int, newButtonText string) (*MessageEditHandle, error) {
+	return c.scheduleMessageEdit(&messageEdit{Op: messageEditButton, Message: om, FromState: kbState, OldButtonState: oldButtonState, ButtonData: buttonData, NewButtonState: newButtonState, Text: newButtonText})
+}
+
+// DeleteMessageAsync queues the DeleteMessage. Network and rate limit errors will be retried
+func (c *Context) DeleteMessageAsync(om *OutgoingMessage) (*MessageEditHandle, error) {
+	return c.scheduleMessageEdit(&messageEdit{Op: messageEditDelete, Message: om})
+}
+
+// EditMessageTextWithMessageIDAsync queues the text edit of the message with BSON ID
+func (c *Context) EditMessageTextWithMessageIDAsync(msgID bson.ObjectId, text string) (*MessageEditHandle, error) {
+	var message OutgoingMessage
+	err := c.Storage().C("messages").Find(bson.M{"_id": msgID, "botid": c.Bot().ID}).One(&message)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.EditMessageTextAsync(&message, text)
+}
+
+// messagesWithEventID returns the last MaxMsgsToUpdateWithEventID bot's messages with the eventID
+func (c *Context) messagesWithEventID(eventID string, fromState string) ([]OutgoingMessage, error) {
+	var messages []OutgoingMessage
+	f := bson.M{"botid": c.Bot().ID, "eventid": eventID}
+	if fromState != "" {
+		f["inlinekeyboardmarkup.state"] = fromState
+	}
+
+	err := c.Storage().C("messages").Find(f).Sort("-_id").Limit(MaxMsgsToUpdateWithEventID).All(&messages)
+	return messages, err
+}
+
+// scheduleMessagesEdit queues the edit for each message. Returns handles for the scheduled edits and the last scheduling error
+func (c *Context) scheduleMessagesEdit(messages []OutgoingMessage, edit messageEdit) (handles []*MessageEditHandle, err error) {
+	for i := range messages {
+		e := edit
+		e.Message = &messages[i]
+
+		h, scheduleErr := c.scheduleMessageEdit(&e)
+		if scheduleErr != nil {
+			err = scheduleErr
+			continue
+		}
+		handles = append(handles, h)
+	}
+	return handles, err
+}
+
+// EditMessagesTextWithEventIDAsync queues the EditMessagesTextWithEventID. Network and rate limit errors will be retried
+func (c *Context) EditMessagesTextWithEventIDAsync(eventID string, text string) ([]*MessageEditHandle, error) {
+	messages, err := c.messagesWithEventID(eventID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scheduleMessagesEdit(messages, messageEdit{Op: messageEditText, Text: text})
+}
+
+// EditMessagesWithEventIDAsync queues the EditMessagesWithEventID. Network and rate limit errors will be retried
+func (c *Context) EditMessagesWithEventIDAsync(eventID string, fromState string, text string, kb InlineKeyboard) ([]*MessageEditHandle, error) {
+	messages, err := c.messagesWithEventID(eventID, fromState)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scheduleMessagesEdit(messages, messageEdit{Op: messageEditTextAndKeyboard, FromState: fromState, Text: text, Keyboard: kb})
+}
+
+// DeleteMessagesWithEventIDAsync queues the DeleteMessagesWithEventID. Network and rate limit errors will be retried
+func (c *Context) DeleteMessagesWithEventIDAsync(eventID string) ([]*MessageEditHandle, error) {
+	messages, err := c.messagesWithEventID(eventID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scheduleMessagesEdit(messages, messageEdit{Op: messageEditDelete})
+}
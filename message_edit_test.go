@@ -0,0 +1,124 @@
+package integram
+
+import (
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/requilence/integram/tgtest"
+	tg "github.com/requilence/telegram-bot-api"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestContext_EditMessageTextAsync(t *testing.T) {
+	service := &Service{Name: "servicewithedits"}
+	server, _ := newTestBot(t, service, "edit_bot")
+
+	db, b := newTestSendQueue(t)
+
+	gob.Register(&messageEdit{})
+
+	// rescheduled edits are captured to run them without waiting for the delay
+	var rescheduled []*messageEdit
+	defer func(jobType JobType) { editMessageJob = jobType }(editMessageJob)
+	editMessageJob = jobTypeFunc(func(data ...interface{}) (ScheduledJob, error) {
+		rescheduled = append(rescheduled, data[0].(*messageEdit))
+		return nil, nil
+	})
+
+	ctx := &Context{ServiceName: service.Name}
+	ctx.SetStorage(db)
+
+	chatID := int64(100)
+	sent, err := service.Bot().API.Send(tg.NewMessage(chatID, "original"))
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	om := &OutgoingMessage{Message: Message{ID: bson.NewObjectId(), BotID: service.Bot().ID, ChatID: chatID, MsgID: sent.MessageID, Text: "original"}}
+	db.C("messages").Insert(om)
+
+	// 429 reschedules the edit without finishing it
+	server.RetryAfter(chatID, 1)
+	e := &messageEdit{ID: bson.NewObjectId(), ServiceName: service.Name, Op: messageEditText, Message: om, Text: "rate limited"}
+	db.C("message_edits").Insert(messageEditResult{ID: e.ID, Status: messageEditStatusQueued, ExpiresAt: time.Now().Add(time.Hour)})
+
+	if err := editMessage(e); err != nil {
+		t.Errorf("editMessage() with TooManyRequests error = %v, want nil", err)
+	}
+	if len(rescheduled) != 1 {
+		t.Fatalf("editMessage() with TooManyRequests rescheduled %d jobs, want 1", len(rescheduled))
+	}
+	if done, err := (&MessageEditHandle{ID: e.ID}).Result(); done || err != nil {
+		t.Errorf("Result() after TooManyRequests = %v, %v, want not done", done, err)
+	}
+
+	if err := editMessage(rescheduled[0]); err != nil {
+		t.Errorf("rescheduled editMessage() error = %v, want nil", err)
+	}
+	if msgs := server.Messages(chatID); len(msgs) != 1 || msgs[0].Text != "rate limited" {
+		t.Errorf("message after the rescheduled edit = %v, want %q", msgs, "rate limited")
+	}
+	if done, err := (&MessageEditHandle{ID: e.ID}).Result(); !done || err != nil {
+		t.Errorf("Result() after the rescheduled edit = %v, %v, want done", done, err)
+	}
+	om.TextHash = rescheduled[0].Message.TextHash
+
+	editMessageJob, _ = b.RegisterType("editMessage", "_telegram", editMessageJobRetries, JobRetryFibonacci, editMessage)
+
+	tests := []struct {
+		name     string
+		msgID    int
+		text     string
+		failNext *tgtest.APIError
+		wantErr  bool
+	}{
+		{"edit", sent.MessageID, "edited", nil, false},
+		{"network error retried", sent.MessageID, "edited again", &tgtest.APIError{Code: 502, Description: "Bad Gateway"}, false},
+		{"message not found", sent.MessageID + 100, "never", nil, true},
+	}
+	for _, tt := range tests {
+		if tt.failNext != nil {
+			server.FailNext(chatID, *tt.failNext)
+		}
+
+		msg := *om
+		msg.MsgID = tt.msgID
+		h, err := ctx.EditMessageTextAsync(&msg, tt.text)
+		if err != nil {
+			t.Errorf("%q. EditMessageTextAsync() error = %v", tt.name, err)
+			continue
+		}
+
+		err = h.Wait(5 * time.Second)
+		if err == ErrMessageEditTimeout || (err != nil) != tt.wantErr {
+			t.Errorf("%q. Wait() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+
+		if !tt.wantErr {
+			if msgs := server.Messages(chatID); len(msgs) != 1 || msgs[0].Text != tt.text {
+				t.Errorf("%q. message after edit = %v, want %q", tt.name, msgs, tt.text)
+			}
+			om.TextHash = msg.TextHash
+		}
+	}
+
+	h, err := ctx.DeleteMessageAsync(om)
+	if err != nil {
+		t.Fatalf("DeleteMessageAsync() error = %v", err)
+	}
+	if err := h.Wait(5 * time.Second); err != nil {
+		t.Errorf("DeleteMessageAsync() Wait() error = %v", err)
+	}
+	if msgs := server.Messages(chatID); len(msgs) != 0 {
+		t.Errorf("message not deleted: %v", msgs)
+	}
+}
+
+// jobTypeFunc calls the func instead of queueing the job
+type jobTypeFunc func(data ...interface{}) (ScheduledJob, error)
+
+func (f jobTypeFunc) Schedule(priority int, time time.Time, data ...interface{}) (ScheduledJob, error) {
+	return f(data...)
+}
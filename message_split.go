@@ -0,0 +1,313 @@
+package integram
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Telegram's limits of the message's text and file's caption
+const (
+	tgMaxTextLength    = 4096
+	tgMaxCaptionLength = 1024
+)
+
+// textToken is the part of the formatted text that can't be divided. Text is split between the tokens
+type textToken struct {
+	s      string
+	open   string // not empty if the token starts the entity. Used to reopen the entity within the next part
+	close  string // closes the entity started by the token
+	closes bool   // token closes the innermost entity
+}
+
+// textLength returns the length of text in UTF-16 code units, the same way as Telegram counts it
+func textLength(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// tokenizeHTML splits the text into tags, entities and runes
+func tokenizeHTML(s string) []textToken {
+	var tokens []textToken
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '<':
+			if j := strings.IndexByte(s[i:], '>'); j > 0 {
+				tag := s[i : i+j+1]
+				i += j + 1
+
+				if strings.HasPrefix(tag, "</") {
+					tokens = append(tokens, textToken{s: tag, closes: true})
+					continue
+				}
+
+				name := tag[1:strings.IndexAny(tag, " \t\n/>")]
+				tokens = append(tokens, textToken{s: tag, open: tag, close: "</" + name + ">"})
+				continue
+			}
+		case '&':
+			if j := strings.IndexByte(s[i:], ';'); j > 1 && j < 10 {
+				tokens = append(tokens, textToken{s: s[i : i+j+1]})
+				i += j + 1
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		tokens = append(tokens, textToken{s: s[i : i+size]})
+		i += size
+	}
+	return tokens
+}
+
+// markdownLinkEnd returns the length of the [text](url) at the beginning of s or 0
+func markdownLinkEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ']':
+			if i+1 >= len(s) || s[i+1] != '(' {
+				return 0
+			}
+			for j := i + 2; j < len(s); j++ {
+				switch s[j] {
+				case '\\':
+					j++
+				case ')':
+					return j + 1
+				}
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// tokenizeMarkdown splits the text into entities' markers, links, escaped symbols and runes
+func tokenizeMarkdown(s string, v2 bool) []textToken {
+	markers := []string{"```", "`", "*", "_"}
+	if v2 {
+		markers = []string{"```", "`", "||", "__", "*", "_", "~"}
+	}
+
+	var tokens []textToken
+	var stack []string
+
+	for i := 0; i < len(s); {
+		var top string
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		inCode := top == "`" || top == "```"
+
+		if s[i] == '\\' && i+1 < len(s) && (v2 || !inCode) {
+			_, size := utf8.DecodeRuneInString(s[i+1:])
+			tokens = append(tokens, textToken{s: s[i : i+1+size]})
+			i += 1 + size
+			continue
+		}
+
+		var marker string
+		if inCode {
+			if strings.HasPrefix(s[i:], top) {
+				marker = top
+			}
+		} else {
+			for _, mk := range markers {
+				if strings.HasPrefix(s[i:], mk) {
+					marker = mk
+					break
+				}
+			}
+		}
+
+		switch {
+		case marker != "" && marker == top:
+			tokens = append(tokens, textToken{s: marker, closes: true})
+			stack = stack[:len(stack)-1]
+			i += len(marker)
+			continue
+		case marker == "```":
+			// language is specified only for the first part
+			tokens = append(tokens, textToken{s: marker, open: "```\n", close: "```"})
+			stack = append(stack, marker)
+			i += len(marker)
+			continue
+		case marker != "":
+			tokens = append(tokens, textToken{s: marker, open: marker, close: marker})
+			stack = append(stack, marker)
+			i += len(marker)
+			continue
+		case !inCode && s[i] == '[':
+			if j := markdownLinkEnd(s[i:]); j > 0 {
+				tokens = append(tokens, textToken{s: s[i : i+j]})
+				i += j
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		tokens = append(tokens, textToken{s: s[i : i+size]})
+		i += size
+	}
+	return tokens
+}
+
+// splitText splits the text into parts of no more than limit length. Entities crossing the boundary are closed and opened again within the next part
+// Parts are cut at paragraphs, lines or spaces if possible
+func splitText(text string, parseMode string, limit int) []string {
+	if textLength(text) <= limit {
+		return []string{text}
+	}
+
+	var tokens []textToken
+	switch parseMode {
+	case ParseModeHTML:
+		tokens = tokenizeHTML(text)
+	case ParseModeMarkdown:
+		tokens = tokenizeMarkdown(text, false)
+	case ParseModeMarkdownV2:
+		tokens = tokenizeMarkdown(text, true)
+	default:
+		for _, r := range text {
+			tokens = append(tokens, textToken{s: string(r)})
+		}
+	}
+
+	// cut is the position to end the part at
+	type cut struct {
+		token int
+		bytes int
+		stack []textToken
+	}
+
+	closing := func(stack []textToken) string {
+		var s string
+		for i := len(stack) - 1; i >= 0; i-- {
+			s += stack[i].close
+		}
+		return s
+	}
+
+	var parts []string
+	var stack []textToken
+
+	for i := 0; i < len(tokens); {
+		var b []byte
+		for _, t := range stack {
+			b = append(b, t.open...)
+		}
+		size := textLength(string(b))
+
+		// best cuts at the space, line and paragraph
+		var cuts [3]*cut
+
+		for start := i; i < len(tokens); i++ {
+			t := tokens[i]
+
+			newStack := stack
+			if t.closes && len(stack) > 0 {
+				newStack = stack[:len(stack)-1]
+			} else if t.close != "" {
+				newStack = append(stack[:len(stack):len(stack)], t)
+			}
+
+			tSize := textLength(t.s)
+			if size+tSize+textLength(closing(newStack)) > limit && i > start {
+				break
+			}
+
+			b = append(b, t.s...)
+			size += tSize
+			stack = newStack
+
+			var priority = -1
+			switch {
+			case t.s == "\n" && len(b) > 1 && b[len(b)-2] == '\n':
+				priority = 2
+			case t.s == "\n":
+				priority = 1
+			case t.s == " ":
+				priority = 0
+			}
+			if priority > -1 && size >= limit/2 {
+				cuts[priority] = &cut{token: i + 1, bytes: len(b), stack: stack}
+			}
+		}
+
+		if i < len(tokens) {
+			for priority := len(cuts) - 1; priority >= 0; priority-- {
+				if c := cuts[priority]; c != nil {
+					i, b, stack = c.token, b[:c.bytes], c.stack
+					break
+				}
+			}
+		}
+
+		parts = append(parts, string(b)+closing(stack))
+	}
+
+	return parts
+}
+
+// splitLongText moves the text that doesn't fit the Telegram's limits into the follow-up parts.
+// Long caption of the file or the album item is moved into the follow-up text entirely
+func (m *OutgoingMessage) splitLongText() {
+	if m.Location != nil || m.Venue != nil || m.Contact != nil || m.Poll != nil {
+		return
+	}
+
+	if len(m.MediaGroup) > 0 {
+		// captions that don't fit are sent after the album
+		for i, item := range m.MediaGroup {
+			if textLength(item.Caption) > tgMaxCaptionLength {
+				m.TextParts = append(m.TextParts, splitText(item.Caption, m.ParseMode, tgMaxTextLength)...)
+				m.MediaGroup[i].Caption = ""
+			}
+		}
+		return
+	}
+
+	if m.hasFile() {
+		if textLength(m.Text) > tgMaxCaptionLength {
+			m.TextParts = splitText(m.Text, m.ParseMode, tgMaxTextLength)
+			m.Text = ""
+		}
+		return
+	}
+
+	parts := splitText(m.Text, m.ParseMode, tgMaxTextLength)
+	m.Text = parts[0]
+	m.TextParts = parts[1:]
+}
+
+// nextTextPart returns the message with the next part of the long text. The keyboard is moved to the last part
+func (m *OutgoingMessage) nextTextPart() *OutgoingMessage {
+	next := *m
+	next.ID = bson.NewObjectId()
+	next.MsgID = 0
+	next.Text = m.TextParts[0]
+	next.TextParts = m.TextParts[1:]
+	next.ReplyToMsgID = 0
+	next.resetFile()
+	next.FileType = ""
+	next.FileRemoveAfter = false
+	next.MediaGroup = nil
+
+	m.TextParts = nil
+	m.KeyboardHide = false
+	m.ForceReply = false
+	m.KeyboardMarkup = nil
+	m.InlineKeyboardMarkup = InlineKeyboard{}
+
+	return &next
+}
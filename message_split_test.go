@@ -0,0 +1,113 @@
+package integram
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/requilence/integram/tgtest"
+)
+
+func Test_splitText(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		parseMode string
+		limit     int
+		want      []string
+	}{
+		{"short", "text", "", 10, []string{"text"}},
+		{"spaces", "aaaa bbbb cccc", "", 10, []string{"aaaa bbbb ", "cccc"}},
+		{"paragraph", "aaa\n\nbbb ccc dd", "", 10, []string{"aaa\n\n", "bbb ccc dd"}},
+		{"no spaces", "aaaaaaaaaaaa", "", 5, []string{"aaaaa", "aaaaa", "aa"}},
+		{"html", "<b>aaaa bbbb</b> cc", "HTML", 16, []string{"<b>aaaa </b>", "<b>bbbb</b> cc"}},
+		{"html link", `<a href="u">aaaa bbbb</a>`, "HTML", 21, []string{`<a href="u">aaaa </a>`, `<a href="u">bbbb</a>`}},
+		{"html entity", "aaaaaaa &amp;", "HTML", 10, []string{"aaaaaaa ", "&amp;"}},
+		{"markdownV2", "*aaaa bbbb* \\*cc", "MarkdownV2", 10, []string{"*aaaa *", "*bbbb* ", "\\*cc"}},
+		{"markdown pre", "```\naaaa\nbbbb\n```", "Markdown", 12, []string{"```\naaaa\n```", "```\nbbbb\n```"}},
+		{"markdown link", "aa [bbbb](u) cc", "Markdown", 8, []string{"aa ", "[bbbb](u)", " cc"}},
+		{"markdownV2 link", "aa [bb](u) cc", "MarkdownV2", 10, []string{"aa [bb](u)", " cc"}},
+	}
+	for _, tt := range tests {
+		got := splitText(tt.text, tt.parseMode, tt.limit)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q. splitText() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendMessage_LongText(t *testing.T) {
+	service := &Service{Name: "servicewithlongtexts"}
+	server, _ := newTestBot(t, service, "long_bot")
+
+	db, _ := newTestSendQueue(t)
+
+	waitMessages := func(chatID int64, n int) []tgtest.Message {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if msgs := server.Messages(chatID); len(msgs) >= n {
+				return msgs
+			}
+		}
+		return server.Messages(chatID)
+	}
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 600}}
+	ctx.SetStorage(db)
+
+	// paragraphs don't fit the message by two
+	paragraph := "<b>" + strings.Repeat("word ", 500) + "</b>\n\n"
+	kb := InlineKeyboard{Buttons: []InlineButtons{{{Text: "ok", Data: "ok"}}}}
+
+	err := ctx.NewMessage().EnableHTML().SetText(strings.Repeat(paragraph, 3)).SetInlineKeyboard(kb).AddEventID("long").Send()
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	msgs := waitMessages(600, 3)
+	if len(msgs) != 3 {
+		t.Fatalf("Send() sent %d messages, want 3", len(msgs))
+	}
+	for i, msg := range msgs {
+		if len(msg.Text) > tgMaxTextLength || !strings.HasPrefix(msg.Text, "<b>") || !strings.HasSuffix(strings.TrimSpace(msg.Text), "</b>") {
+			t.Errorf("part %d = %q..., want the text within the limit and with the closed tags", i, msg.Text[:10])
+		}
+		if hasKeyboard := msg.ReplyMarkup != ""; hasKeyboard != (i == len(msgs)-1) {
+			t.Errorf("part %d has keyboard = %v, want only the last one", i, hasKeyboard)
+		}
+	}
+
+	// the last part is stored after it was sent
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := db.C("messages").Find(map[string]interface{}{"eventid": "long"}).Count(); n != 3 {
+		t.Errorf("stored %d messages with the event ID, want 3", n)
+	}
+
+	// long caption is moved into the follow-up text
+	err = ctx.NewMessage().SetFileBytes("image", []byte("img"), "img.png").SetText(strings.Repeat("a", tgMaxCaptionLength+1)).Send()
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	msgs = waitMessages(600, 5)
+	if len(msgs) != 5 || msgs[3].Photo == nil || msgs[3].Text != "" || msgs[4].Text != strings.Repeat("a", tgMaxCaptionLength+1) {
+		t.Errorf("Send() with the long caption sent %d messages, want the photo and the text", len(msgs)-3)
+	}
+}
+
+func TestOutgoingMessage_splitLongText_MediaGroup(t *testing.T) {
+	long := strings.Repeat("a", tgMaxCaptionLength+1)
+	m := (&OutgoingMessage{}).AddMediaGroupPhoto("1.jpg", "", "short").AddMediaGroupPhoto("2.jpg", "", long)
+
+	m.splitLongText()
+
+	if m.MediaGroup[0].Caption != "short" || m.MediaGroup[1].Caption != "" {
+		t.Errorf("splitLongText() captions = %q, %q, want the long one moved", m.MediaGroup[0].Caption, m.MediaGroup[1].Caption)
+	}
+	if !reflect.DeepEqual(m.TextParts, []string{long}) {
+		t.Errorf("splitLongText() TextParts = %v, want the long caption", m.TextParts)
+	}
+	if next := m.nextTextPart(); next.Text != long || len(next.MediaGroup) != 0 {
+		t.Errorf("nextTextPart() = %q with %d album items, want the long caption without the album", next.Text, len(next.MediaGroup))
+	}
+}
@@ -0,0 +1,261 @@
+package integram
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// templateEscaperFunc is appended to every action of the message template
+const templateEscaperFunc = "_esc"
+
+// templateSafe is the markup produced by the template's helpers, it is not escaped again
+type templateSafe string
+
+func templateString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case templateSafe:
+		return string(s)
+	case string:
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// templateFuncs returns the helpers available within the templates for the parse mode
+func templateFuncs(rt RichText) template.FuncMap {
+	safe := func(f func(string) string) func(interface{}) templateSafe {
+		return func(v interface{}) templateSafe {
+			return templateSafe(f(templateString(v)))
+		}
+	}
+
+	return template.FuncMap{
+		templateEscaperFunc: func(v interface{}) string {
+			if s, ok := v.(templateSafe); ok {
+				return string(s)
+			}
+			return rt.Esc(templateString(v))
+		},
+		"bold":      safe(rt.Bold),
+		"italic":    safe(rt.Italic),
+		"underline": safe(rt.Underline),
+		"strike":    safe(rt.Strikethrough),
+		"spoiler":   safe(rt.Spoiler),
+		"quote":     safe(rt.Blockquote),
+		"code":      safe(rt.Fixed),
+		"pre":       safe(rt.Pre),
+		"link": func(text interface{}, url string) templateSafe {
+			return templateSafe(rt.URL(templateString(text), url))
+		},
+		"mention": func(v interface{}) (templateSafe, error) {
+			var u *User
+			switch user := v.(type) {
+			case *User:
+				u = user
+			case User:
+				u = &user
+			}
+			if u == nil {
+				return "", fmt.Errorf("mention: expected User, got %T", v)
+			}
+
+			// users without username are mentioned with the link to their ID
+			if _, plain := rt.(PlainRichText); plain || u.UserName != "" || u.ID == 0 {
+				return templateSafe(rt.Esc(u.Mention())), nil
+			}
+			return templateSafe(rt.URL(u.Mention(), fmt.Sprintf("tg://user?id=%d", u.ID))), nil
+		},
+		"reltime": func(t time.Time) string {
+			return relativeTime(t, time.Now())
+		},
+	}
+}
+
+// relativeTime returns the human-readable distance between t and now, e.g. "5 minutes ago" or "in 2 days"
+func relativeTime(t time.Time, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	var n int
+	var unit string
+
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int(d/(365*24*time.Hour)), "year"
+	}
+
+	if n > 1 {
+		unit += "s"
+	}
+
+	if future {
+		return fmt.Sprintf("in %d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
+
+// escapeTemplateNode pipes the output of every action through the escaper
+func escapeTemplateNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeTemplateNode(tree, child)
+		}
+	case *parse.ActionNode:
+		// variable declarations and assignments have no output
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier(templateEscaperFunc).SetTree(tree).SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		escapeTemplateNode(tree, n.List)
+		escapeTemplateNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		escapeTemplateNode(tree, n.List)
+		escapeTemplateNode(tree, n.ElseList)
+	case *parse.WithNode:
+		escapeTemplateNode(tree, n.List)
+		escapeTemplateNode(tree, n.ElseList)
+	}
+}
+
+var serviceTemplates = struct {
+	sync.Mutex
+	m map[string]*template.Template // service name + parse mode
+}{m: make(map[string]*template.Template)}
+
+// templateSources returns the service's templates with the ones from Config.TemplatesDir/<service name>/<template name>.tmpl on top
+func (s *Service) templateSources() (map[string]string, error) {
+	sources := make(map[string]string)
+	for name, text := range s.Templates {
+		sources[name] = text
+	}
+
+	if Config.TemplatesDir == "" {
+		return sources, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(Config.TemplatesDir, s.Name, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sources[strings.TrimSuffix(filepath.Base(file), ".tmpl")] = string(b)
+	}
+
+	return sources, nil
+}
+
+// templates returns the service's templates escaping for the parse mode. They are parsed once, so the changes take effect after the restart
+func (s *Service) templates(parseMode string) (*template.Template, error) {
+	rt := NewRichText(parseMode)
+	if rt.ParseMode() != parseMode {
+		return nil, fmt.Errorf("templates: unsupported parse mode %q", parseMode)
+	}
+
+	serviceTemplates.Lock()
+	defer serviceTemplates.Unlock()
+
+	key := s.Name + "\xff" + parseMode
+	if t, exists := serviceTemplates.m[key]; exists {
+		return t, nil
+	}
+
+	sources, err := s.templateSources()
+	if err != nil {
+		return nil, err
+	}
+
+	root := template.New(s.Name).Funcs(templateFuncs(rt))
+	for name, text := range sources {
+		_, err := root.New(name).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, t := range root.Templates() {
+		if t.Tree != nil {
+			escapeTemplateNode(t.Tree, t.Tree.Root)
+		}
+	}
+
+	serviceTemplates.m[key] = root
+	return root, nil
+}
+
+// RenderTemplate executes the service's template with data. Values are escaped for the parse mode: "HTML", "Markdown", "MarkdownV2" or "" for the plain text
+// Use helpers to format them: bold, italic, underline, strike, spoiler, quote, code, pre, link "text" "url", mention .User, reltime .Time
+func (s *Service) RenderTemplate(name string, parseMode string, data interface{}) (string, error) {
+	root, err := s.templates(parseMode)
+	if err != nil {
+		return "", err
+	}
+
+	t := root.Lookup(name)
+	if t == nil {
+		return "", fmt.Errorf("template %q not found for the %s service", name, s.Name)
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// SetTemplate sets the text rendered from the service's template. Values are escaped according to the message's ParseMode, so set it before
+func (m *OutgoingMessage) SetTemplate(name string, data interface{}) (*OutgoingMessage, error) {
+	if m.ctx == nil || m.ctx.Service() == nil {
+		return m, errors.New("SetTemplate: message must be created with the Context's NewMessage")
+	}
+
+	text, err := m.ctx.Service().RenderTemplate(name, m.ParseMode, data)
+	if err != nil {
+		return m, err
+	}
+
+	return m.SetText(text), nil
+}
+
+// NewTemplateMessage returns the HTML message with the text rendered from the service's template
+func (c *Context) NewTemplateMessage(name string, data interface{}) (*OutgoingMessage, error) {
+	return c.NewMessage().EnableHTML().SetTemplate(name, data)
+}
@@ -0,0 +1,91 @@
+package integram
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestService_RenderTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(templatesDir string) { Config.TemplatesDir = templatesDir }(Config.TemplatesDir)
+	Config.TemplatesDir = dir
+
+	service := &Service{Name: "servicewithtemplates", Templates: map[string]string{
+		"issue":    `{{bold .Title}} by {{mention .User}}: {{.Body}}{{if .URL}} {{link "open" .URL}}{{end}}`,
+		"list":     `{{range $i, $s := .}}{{$n := $i}}{{$n}}. {{code $s}} {{end}}`,
+		"nested":   `{{template "issue" .}}`,
+		"override": `default`,
+	}}
+
+	os.MkdirAll(filepath.Join(dir, service.Name), 0700)
+	ioutil.WriteFile(filepath.Join(dir, service.Name, "override.tmpl"), []byte(`{{italic .}}`), 0644)
+
+	issue := map[string]interface{}{
+		"Title": "<b>Fix</b> *it*",
+		"User":  &User{ID: 10, FirstName: "Jo & Co"},
+		"Body":  "a < b_c",
+		"URL":   "https://example.com/?a=1&b=2",
+	}
+
+	tests := []struct {
+		name      string
+		template  string
+		parseMode string
+		data      interface{}
+		want      string
+		wantErr   bool
+	}{
+		{"html", "issue", "HTML", issue, `<b>&lt;b&gt;Fix&lt;/b&gt; *it*</b> by <a href="tg://user?id=10">Jo & Co</a>: a &lt; b_c <a href="https://example.com/?a=1&b=2">open</a>`, false},
+		{"markdown", "issue", "Markdown", issue, `*<b>Fix</b> ∗it∗* by [Jo & Co](tg://user?id=10): a < b\_c [open](https://example.com/?a=1&b=2)`, false},
+		{"markdownV2", "issue", "MarkdownV2", issue, `*<b\>Fix</b\> \*it\** by [Jo & Co](tg://user?id=10): a < b\_c [open](https://example.com/?a=1&b=2)`, false},
+		{"plain", "issue", "", issue, `<b>Fix</b> *it* by Jo & Co: a < b_c open (https://example.com/?a=1&b=2)`, false},
+		{"username", "issue", "HTML", map[string]interface{}{"Title": "t", "User": User{UserName: "jo_co"}, "Body": "b"}, `<b>t</b> by @jo_co: b`, false},
+		{"declarations", "list", "HTML", []string{"<a>", "b"}, `0. <code>&lt;a&gt;</code> 1. <code>b</code> `, false},
+		{"nested template", "nested", "HTML", issue, `<b>&lt;b&gt;Fix&lt;/b&gt; *it*</b> by <a href="tg://user?id=10">Jo & Co</a>: a &lt; b_c <a href="https://example.com/?a=1&b=2">open</a>`, false},
+		{"override", "override", "HTML", "<x>", `<i>&lt;x&gt;</i>`, false},
+		{"not found", "missing", "HTML", nil, "", true},
+		{"unsupported parse mode", "issue", "MarkdownV3", issue, "", true},
+		{"mention of non-user", "issue", "HTML", map[string]interface{}{"User": "jo"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := service.RenderTemplate(tt.template, tt.parseMode, tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q. Service.RenderTemplate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q. Service.RenderTemplate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_relativeTime(t *testing.T) {
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want string
+	}{
+		{"now", now.Add(-30 * time.Second), "just now"},
+		{"minute", now.Add(-time.Minute), "1 minute ago"},
+		{"hours", now.Add(-5 * time.Hour), "5 hours ago"},
+		{"days", now.Add(-49 * time.Hour), "2 days ago"},
+		{"months", now.Add(-65 * 24 * time.Hour), "2 months ago"},
+		{"years", now.Add(-800 * 24 * time.Hour), "2 years ago"},
+		{"future", now.Add(3 * time.Hour), "in 3 hours"},
+	}
+	for _, tt := range tests {
+		if got := relativeTime(tt.t, now); got != tt.want {
+			t.Errorf("%q. relativeTime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
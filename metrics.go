@@ -0,0 +1,315 @@
+package integram
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tg "github.com/requilence/telegram-bot-api"
+)
+
+var defaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	metricStats              = newCounterVec("integram_stat_total", "StatKey counters", "service", "key")
+	metricJobs               = newCounterVec("integram_jobs_total", "Jobs executed by result: success, retry or failed", "pool", "result")
+	metricTGRateLimited      = newCounterVec("integram_tg_ratelimited_total", "Outgoing messages delayed by the rate limiter by limit: bot, private or group", "limit")
+	metricTGSend             = newHistogramVec("integram_tg_send_duration_seconds", "Telegram sendMessage latency by result", defaultLatencyBuckets, "result")
+	metricUpdates            = newHistogramVec("integram_update_duration_seconds", "Telegram update processing latency by update type", defaultLatencyBuckets, "service", "type")
+	metricWebhookResponses   = newCounterVec("integram_webhook_responses_total", "Webhook responses by HTTP status code", "service", "code")
+	metricReverseProxyErrors = newCounterVec("integram_reverse_proxy_errors_total", "Errors while proxying requests to the service instances in the multi-process mode", "service")
+)
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// counterVec is the Prometheus counter with labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+}
+
+func (v *counterVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	cv, exists := v.values[key]
+	if !exists {
+		cv = &counterValue{labels: labelValues}
+		v.values[key] = cv
+	}
+	cv.value += delta
+}
+
+func (v *counterVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+func (v *counterVec) write(buf *bytes.Buffer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		cv := v.values[key]
+		fmt.Fprintf(buf, "%s%s %s\n", v.name, formatLabels(v.labels, cv.labels), formatFloat(cv.value))
+	}
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is the Prometheus histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogramValue)}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	hv, exists := v.values[key]
+	if !exists {
+		hv = &histogramValue{labels: labelValues, counts: make([]uint64, len(v.buckets))}
+		v.values[key] = hv
+	}
+
+	for i, upperBound := range v.buckets {
+		if value <= upperBound {
+			hv.counts[i]++
+			break
+		}
+	}
+	hv.sum += value
+	hv.count++
+}
+
+func (v *histogramVec) write(buf *bytes.Buffer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hv := v.values[key]
+		labelNames := append(append([]string{}, v.labels...), "le")
+
+		var cumulative uint64
+		for i, upperBound := range v.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, formatLabels(labelNames, append(append([]string{}, hv.labels...), formatFloat(upperBound))), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", v.name, formatLabels(labelNames, append(append([]string{}, hv.labels...), "+Inf")), hv.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", v.name, formatLabels(v.labels, hv.labels), formatFloat(hv.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", v.name, formatLabels(v.labels, hv.labels), hv.count)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelValueReplacer.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// tgErrorKind classifies the Telegram API error for the metrics
+func tgErrorKind(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	tgErr, ok := err.(tg.Error)
+	if !ok {
+		return "other"
+	}
+
+	switch {
+	case tgErr.Code == 0:
+		return "network"
+	case tgErr.Code >= 500:
+		return "server"
+	case tgErr.TooManyRequests() || tgErr.IsAntiFlood():
+		return "flood"
+	case tgErr.ChatMigrated():
+		return "chat_migrated"
+	case tgErr.BotStoppedForUser():
+		return "bot_blocked"
+	case tgErr.BotKicked():
+		return "bot_kicked"
+	case tgErr.ChatNotFound():
+		return "chat_not_found"
+	case tgErr.ChatDiactivated():
+		return "chat_deactivated"
+	case tgErr.IsMessageNotFound():
+		return "message_not_found"
+	case tgErr.IsParseError():
+		return "parse_error"
+	case tgErr.IsCantAccessChat():
+		return "cant_access_chat"
+	case tgErr.Code == 400:
+		return "bad_request"
+	case tgErr.Code == 403:
+		return "forbidden"
+	}
+	return "other"
+}
+
+// updateType returns the kind of Telegram update within the Context
+func (c *Context) updateType() string {
+	switch {
+	case c.Callback != nil:
+		return "callback_query"
+	case c.Message != nil && c.MessageEdited:
+		return "edited_message"
+	case c.Message != nil:
+		return "message"
+	case c.InlineQuery != nil:
+		return "inline_query"
+	case c.ChosenInlineResult != nil:
+		return "chosen_inline_result"
+	case c.PollAnswer != nil:
+		return "poll_answer"
+	}
+	return "other"
+}
+
+// metricsMiddleware observes the update processing latency since it was received
+func metricsMiddleware(ctx *Context, next UpdateHandler) error {
+	err := next(ctx)
+
+	receivedAt := ctx.updateReceivedAt
+	if receivedAt.IsZero() {
+		return err
+	}
+
+	metricUpdates.observe(time.Since(receivedAt).Seconds(), ctx.ServiceName, ctx.updateType())
+	return err
+}
+
+// observeJob counts the job's attempt result
+func observeJob(poolKey string, job ScheduledJob) {
+	result := "success"
+	if job.Error() != nil {
+		if job.Retries() > 0 {
+			result = "retry"
+		} else {
+			result = "failed"
+		}
+	}
+	metricJobs.inc(poolKey, result)
+}
+
+func writeJobQueueMetrics(buf *bytes.Buffer) {
+	if jobBackend == nil {
+		return
+	}
+
+	pools := jobBackend.Pools()
+	keys := make([]string, 0, len(pools))
+	for key := range pools {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString("# HELP integram_job_queue_depth Jobs waiting in the pool's queue, including the delayed ones\n# TYPE integram_job_queue_depth gauge\n")
+	for _, key := range keys {
+		n, err := pools[key].QueueLen()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(buf, "integram_job_queue_depth%s %d\n", formatLabels([]string{"pool"}, []string{key}), n)
+	}
+}
+
+// metricsHandler exposes the metrics in the Prometheus text format. Requires "Authorization: Bearer <token>" with INTEGRAM_METRICS_TOKEN or INTEGRAM_ADMIN_TOKEN.
+// Endpoint is disabled if none of them is set
+func metricsHandler(c *gin.Context) {
+	if Config.MetricsToken == "" && Config.AdminToken == "" {
+		c.String(http.StatusNotFound, "Metrics token is not set")
+		return
+	}
+
+	token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if !tokenMatches(token, Config.MetricsToken) && !tokenMatches(token, Config.AdminToken) {
+		c.String(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	buf := &bytes.Buffer{}
+
+	metricStats.write(buf)
+	metricJobs.write(buf)
+	writeJobQueueMetrics(buf)
+	metricTGRateLimited.write(buf)
+	metricTGSend.write(buf)
+	metricUpdates.write(buf)
+	metricWebhookResponses.write(buf)
+	metricReverseProxyErrors.write(buf)
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+func tokenMatches(token string, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
@@ -0,0 +1,96 @@
+package integram
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	tg "github.com/requilence/telegram-bot-api"
+)
+
+func TestTGErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "ok"},
+		{errors.New("some error"), "other"},
+		{tg.Error{Code: 0}, "network"},
+		{tg.Error{Code: 502}, "server"},
+		{tg.Error{Code: 429, Description: "Too Many Requests: retry after 5"}, "flood"},
+		{tg.Error{Code: 403, Description: "Forbidden: bot was blocked by the user"}, "bot_blocked"},
+		{tg.Error{Code: 403, Description: "Forbidden: bot was kicked from the group chat"}, "bot_kicked"},
+		{tg.Error{Code: 400, Description: "chat not found"}, "chat_not_found"},
+		{tg.Error{Code: 400, Description: "Bad Request: can't parse entities: unexpected end tag"}, "parse_error"},
+		{tg.Error{Code: 400, Description: "Bad Request: group chat was upgraded to a supergroup chat", Parameters: &tg.ResponseParameters{MigrateToChatID: -100}}, "chat_migrated"},
+		{tg.Error{Code: 400, Description: "Bad Request: message text is empty"}, "bad_request"},
+	}
+	for _, tt := range tests {
+		if got := tgErrorKind(tt.err); got != tt.want {
+			t.Errorf("tgErrorKind(%#v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer func(token, adminToken string) { Config.MetricsToken, Config.AdminToken = token, adminToken }(Config.MetricsToken, Config.AdminToken)
+	Config.MetricsToken, Config.AdminToken = "", ""
+
+	// messages sent by other tests are observed by the same histogram
+	defer func(h *histogramVec) { metricTGSend = h }(metricTGSend)
+	metricTGSend = newHistogramVec("integram_tg_send_duration_seconds", "Telegram sendMessage latency by result", defaultLatencyBuckets, "result")
+
+	ctx := &Context{ServiceName: "servicewithmetrics"}
+	ctx.StatIncBy(StatWebhookHandled, 0, 2)
+	metricTGSend.observe(0.2, "ok")
+	metricTGSend.observe(3, "ok")
+
+	router := gin.New()
+	router.GET("/:param1", serviceHookHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("metrics without the tokens set status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	Config.MetricsToken, Config.AdminToken = "secret", "admin"
+
+	tests := []struct {
+		auth       string
+		wantStatus int
+		want       []string
+	}{
+		{"", http.StatusUnauthorized, nil},
+		{"Bearer wrong", http.StatusUnauthorized, nil},
+		{"Bearer admin", http.StatusOK, nil},
+		{"Bearer secret", http.StatusOK, []string{
+			`integram_stat_total{service="servicewithmetrics",key="wh_handled"} 2`,
+			`integram_tg_send_duration_seconds_bucket{result="ok",le="0.25"} 1`,
+			`integram_tg_send_duration_seconds_bucket{result="ok",le="5"} 2`,
+			`integram_tg_send_duration_seconds_bucket{result="ok",le="+Inf"} 2`,
+			`integram_tg_send_duration_seconds_count{result="ok"} 2`,
+			"# TYPE integram_job_queue_depth gauge",
+		}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q. status = %d, want %d", tt.auth, w.Code, tt.wantStatus)
+		}
+		for _, line := range tt.want {
+			if !strings.Contains(w.Body.String(), line+"\n") {
+				t.Errorf("%q. metrics do not contain %q:\n%s", tt.auth, line, w.Body.String())
+			}
+		}
+	}
+}
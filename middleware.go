@@ -0,0 +1,81 @@
+package integram
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// UpdateHandler handles the Telegram update within the Context
+type UpdateHandler func(ctx *Context) error
+
+// Middleware wraps the Telegram update handling, e.g. to check auth, limit users or select the locale.
+// Call next to continue the chain. Return without calling it to short-circuit. Context can be modified before the next call
+type Middleware func(ctx *Context, next UpdateHandler) error
+
+// errUpdateHandlerNotSet returned by the dispatchUpdate when service has no handler for this kind of update
+var errUpdateHandlerNotSet = errors.New("update handler not set")
+
+// globalMiddlewares are applied to all services before the service's own Middlewares
+var globalMiddlewares = []Middleware{metricsMiddleware, statsMiddleware}
+
+// Use adds the middlewares that wrap Telegram updates handling for all services. Must be called before the Run
+func Use(middlewares ...Middleware) {
+	globalMiddlewares = append(globalMiddlewares, middlewares...)
+}
+
+// middlewareChain returns the UpdateHandler that passes the update through the global and the service's middlewares to the dispatchUpdate
+func (s *Service) middlewareChain() UpdateHandler {
+	middlewares := append(append([]Middleware{}, globalMiddlewares...), s.Middlewares...)
+
+	handler := UpdateHandler(dispatchUpdate)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		m, next := middlewares[i], handler
+		handler = func(ctx *Context) error {
+			return m(ctx, next)
+		}
+	}
+	return handler
+}
+
+// statsMiddleware counts incoming messages and inline queries with their results
+func statsMiddleware(ctx *Context, next UpdateHandler) error {
+	handlerStarted := time.Now()
+	err := next(ctx)
+
+	if err == errUpdateHandlerNotSet {
+		return err
+	}
+
+	if ctx.Message != nil && !ctx.MessageEdited {
+		if ctx.messageAnsweredAt != nil {
+			ctx.StatIncChat(StatIncomingMessageAnswered)
+		} else {
+			ctx.StatIncChat(StatIncomingMessageNotAnswered)
+		}
+	} else if ctx.InlineQuery != nil {
+		if err != nil {
+			if strings.Contains(err.Error(), "QUERY_ID_INVALID") {
+				ctx.StatIncUser(StatInlineQueryTimeouted)
+			} else if !strings.Contains(err.Error(), "context canceled") {
+				ctx.StatIncUser(StatInlineQueryCanceled)
+			}
+			ctx.StatIncUser(StatInlineQueryProcessingError)
+		} else if ctx.inlineQueryAnsweredAt == nil {
+			ctx.StatIncUser(StatInlineQueryNotAnswered)
+
+			ctx.Log().Error("BotUpdateHandler InlineQuery not answered")
+		} else {
+			ctx.StatIncUser(StatInlineQueryAnswered)
+
+			secsSpent := ctx.inlineQueryAnsweredAt.Sub(ctx.updateReceivedAt).Seconds()
+			if secsSpent > 10 {
+				ctx.Log().Errorf("BotUpdateHandler InlineQuery 10 sec exceeded: %.1f sec spent after update, %.1f sec after the handle", secsSpent, time.Now().Sub(handlerStarted).Seconds())
+			}
+		}
+	} else if ctx.ChosenInlineResult != nil {
+		ctx.StatIncUser(StatInlineQueryChosen)
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+package integram
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestService_MiddlewareChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(ctx *Context, next UpdateHandler) error {
+			calls = append(calls, name)
+			return next(ctx)
+		}
+	}
+
+	defer func(m []Middleware) { globalMiddlewares = m }(globalMiddlewares)
+	Use(record("global"))
+
+	errBlocked := errors.New("blocked")
+	service := &Service{
+		Name: "servicewithmiddlewares",
+		Middlewares: []Middleware{
+			record("service"),
+			func(ctx *Context, next UpdateHandler) error {
+				if ctx.User.ID == 2 {
+					return errBlocked
+				}
+				ctx.User.Lang = "ru"
+				return next(ctx)
+			},
+		},
+		TGNewMessageHandler: func(ctx *Context) error {
+			calls = append(calls, "handler "+ctx.User.Lang)
+			return nil
+		},
+	}
+	services[service.Name] = service
+	defer delete(services, service.Name)
+
+	tests := []struct {
+		userID  int64
+		wantErr error
+		want    []string
+	}{
+		{1, nil, []string{"global", "service", "handler ru"}},
+		{2, errBlocked, []string{"global", "service"}},
+	}
+	for _, tt := range tests {
+		calls = nil
+		ctx := &Context{ServiceName: service.Name, User: User{ID: tt.userID}, Chat: Chat{ID: tt.userID}, Message: &IncomingMessage{Message: Message{Text: "text"}}}
+		ctx.SetStorage(NewMemoryStorage())
+
+		if err := service.middlewareChain()(ctx); err != tt.wantErr {
+			t.Errorf("%d. middlewareChain() error = %v, want %v", tt.userID, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%d. middlewareChain() calls = %v, want %v", tt.userID, calls, tt.want)
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
-func migrations(db *mgo.Database, serviceName string) error {
+func migrations(db Storage, serviceName string) error {
 	err := migrateMissingOAuthStores(db, serviceName)
 	if err != nil {
 		return err
@@ -16,7 +16,7 @@ func migrations(db *mgo.Database, serviceName string) error {
 	return nil
 }
 
-func migrateMissingOAuthStores(db *mgo.Database, serviceName string) error {
+func migrateMissingOAuthStores(db Storage, serviceName string) error {
 	name := "MissingOAuthStores"
 	n, _ := db.C("migrations").FindId(serviceName + "_" + name).Count()
 	if n > 0 {
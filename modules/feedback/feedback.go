@@ -17,16 +17,22 @@ var FeedbackModule = integram.Module{
 		askForFeedbackReplied,
 		feedbackEdited,
 	},
+	Translations: integram.Translations{
+		"en": {
+			"feedback.ask":       "Tell what we can improve to make this bot better",
+			"feedback.ok":        "Thanks for your feedback 👍 It was forwarded to developers. If you have something to add you can just edit your message",
+			"feedback.only_text": "For now only the text feedback is accepted. If you want to send some screenshots, please note this in the text",
+		},
+		"ru": {
+			"feedback.ask":       "Расскажите, что нам улучшить, чтобы сделать этого бота лучше",
+			"feedback.ok":        "Спасибо за отзыв 👍 Он передан разработчикам. Если хотите что-то добавить, просто отредактируйте своё сообщение",
+			"feedback.only_text": "Пока принимаются только текстовые отзывы. Если хотите отправить скриншоты, пожалуйста, упомяните это в тексте",
+		},
+	},
 }
 
 var m = integram.HTMLRichText{}
 
-const (
-	langFeedbackCmdText               = "Tell what we can improve to make this Youtube bot better"
-	langFeedbackOkText                = "Thanks for your feedback 👍 It was forwarded to developers. If you have something to add you can just edit your message"
-	langFeedbackOnlyTextSupportedText = "For now only the text feedback is accepted. If you want to send some screenshots, please note this in the text"
-)
-
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz1234567890-_")
 
 type FeedbackConfig struct {
@@ -110,7 +116,7 @@ func askForFeedbackReplied(c *integram.Context) error {
 	if c.Message.Text == "" {
 		return c.NewMessage().
 			SetReplyToMsgID(c.Message.MsgID).
-			SetText(langFeedbackOnlyTextSupportedText).
+			SetText(c.T("feedback.only_text")).
 			EnableForceReply().
 			SetReplyAction(askForFeedbackReplied).
 			Send()
@@ -145,7 +151,7 @@ func askForFeedbackReplied(c *integram.Context) error {
 		}
 	}
 
-	c.NewMessage().SetReplyToMsgID(c.Message.MsgID).SetText(langFeedbackOkText).Send()
+	c.NewMessage().SetReplyToMsgID(c.Message.MsgID).SetText(c.T("feedback.ok")).Send()
 	c.Message.SetEditAction(feedbackEdited, feedbackID)
 
 	if len(texts) == 1 {
@@ -164,5 +170,5 @@ func SendAskForFeedbackMessage(c *integram.Context) error {
 	if config.ChatID == 0 {
 		return errors.New("Received /feedback but env FEEDBACK_CHAT_ID not set")
 	}
-	return c.NewMessage().SetText(langFeedbackCmdText).EnableForceReply().SetReplyAction(askForFeedbackReplied).Send()
+	return c.NewMessage().SetText(c.T("feedback.ask")).EnableForceReply().SetReplyAction(askForFeedbackReplied).Send()
 }
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"golang.org/x/oauth2"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -222,7 +221,7 @@ func (user *User) AuthTempToken() string {
 	return rnd
 }
 
-func findOauthProviderByID(db *mgo.Database, id string) (*OAuthProvider, error) {
+func findOauthProviderByID(db Storage, id string) (*OAuthProvider, error) {
 	oap := OAuthProvider{}
 
 	if s, _ := serviceByName(id); s != nil {
@@ -237,7 +236,7 @@ func findOauthProviderByID(db *mgo.Database, id string) (*OAuthProvider, error)
 	return &oap, nil
 }
 
-func findOauthProviderByHost(db *mgo.Database, host string) (*OAuthProvider, error) {
+func findOauthProviderByHost(db Storage, host string) (*OAuthProvider, error) {
 	oap := OAuthProvider{}
 	err := db.C("oauth_providers").Find(bson.M{"baseurl.host": strings.ToLower(host)}).One(&oap)
 	if err != nil {
@@ -89,7 +89,7 @@ func MigrateOAuthFromTo(c *Context, oldTS OAuthTokenStore, newTS OAuthTokenStore
 			continue
 		}
 
-		err = c.db.C("users").UpdateId(user.ID, bson.M{"$set": bson.M{keyPrefix + ".oauthstore": newTS.Name(), keyPrefix + ".oauthvalid": true}})
+		err = c.Storage().C("users").UpdateId(user.ID, bson.M{"$set": bson.M{keyPrefix + ".oauthstore": newTS.Name(), keyPrefix + ".oauthvalid": true}})
 		if err != nil {
 			c.Log().Errorf("MigrateOAuthFromTo got error: %s", err.Error())
 			continue
@@ -0,0 +1,165 @@
+package integram
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetFileURL sets the remote file to send. Telegram downloads it by itself, so it must be publicly available.
+// fileType is one of "document", "image", "audio", "video", "voice", "animation" or "sticker"
+func (m *OutgoingMessage) SetFileURL(fileType string, fileURL string) *OutgoingMessage {
+	m.resetFile()
+	m.FileURL = fileURL
+	m.FileType = fileType
+	return m
+}
+
+// SetFileID sets the file already uploaded to Telegram, e.g. received within the incoming message
+func (m *OutgoingMessage) SetFileID(fileType string, fileID string) *OutgoingMessage {
+	m.resetFile()
+	m.FileID = fileID
+	m.FileType = fileType
+	return m
+}
+
+// SetFileReader sets the file to read from r. It is saved into the spool dir on Send, so r is not used after Send returns
+func (m *OutgoingMessage) SetFileReader(fileType string, r io.Reader, fileName string) *OutgoingMessage {
+	m.resetFile()
+	m.fileReader = r
+	m.FileName = fileName
+	m.FileType = fileType
+	return m
+}
+
+// SetFileBytes sets the file content. It is saved into the spool dir on Send
+func (m *OutgoingMessage) SetFileBytes(fileType string, data []byte, fileName string) *OutgoingMessage {
+	return m.SetFileReader(fileType, bytes.NewReader(data), fileName)
+}
+
+func (m *OutgoingMessage) resetFile() {
+	m.FilePath = ""
+	m.FileName = ""
+	m.FileURL = ""
+	m.FileID = ""
+	m.fileReader = nil
+}
+
+func (m *OutgoingMessage) hasFile() bool {
+	return m.FilePath != "" || m.FileURL != "" || m.FileID != "" || m.fileReader != nil
+}
+
+// spoolFileMaxAge is the period after the message's send time when its spooled file is removed by sweepSpoolDir even if it wasn't sent.
+// It covers all the retries of the sendMessage job
+const spoolFileMaxAge = 72 * time.Hour
+
+// spoolFilePrefix is followed by the unix time when the file expires
+const spoolFilePrefix = "file"
+
+func spoolDir() string {
+	if Config.SpoolDir != "" {
+		return Config.SpoolDir
+	}
+	return filepath.Join(Config.ConfigDir, "spool")
+}
+
+// spoolFileReader saves the file set with SetFileReader, so it can be sent from the queued job. Spooled file is removed after it was sent
+func (m *OutgoingMessage) spoolFileReader() error {
+	if m.fileReader == nil {
+		return nil
+	}
+
+	dir := spoolDir()
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now()
+	if m.SendAfter != nil && m.SendAfter.After(expiresAt) {
+		expiresAt = *m.SendAfter
+	}
+
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("%s%d-", spoolFilePrefix, expiresAt.Add(spoolFileMaxAge).Unix()))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, m.fileReader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	m.FilePath = f.Name()
+	m.FileRemoveAfter = true
+	m.fileReader = nil
+	return nil
+}
+
+// removeSpooledFile removes the file saved by spoolFileReader if the message won't be sent
+func (m *OutgoingMessage) removeSpooledFile() {
+	if !m.FileRemoveAfter || m.FilePath == "" || filepath.Dir(m.FilePath) != filepath.Clean(spoolDir()) {
+		return
+	}
+
+	err := os.Remove(m.FilePath)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", m.FilePath).Error("Can't remove the spooled file")
+	}
+}
+
+// sweepSpoolDir removes the expired spooled files of the messages that were never sent, e.g. when the sendMessage job ran out of retries
+func sweepSpoolDir() {
+	dir := spoolDir()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Error("Can't read the spool dir")
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), spoolFilePrefix) {
+			continue
+		}
+
+		expiresAt := f.ModTime().Add(spoolFileMaxAge)
+		if i := strings.IndexByte(f.Name(), '-'); i > 0 {
+			if ts, err := strconv.ParseInt(f.Name()[len(spoolFilePrefix):i], 10, 64); err == nil {
+				expiresAt = time.Unix(ts, 0)
+			}
+		}
+
+		if expiresAt.After(now) {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(dir, f.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", f.Name()).Error("Can't remove the expired spooled file")
+		}
+	}
+}
+
+// sweepSpoolDirPeriodically runs sweepSpoolDir every hour
+func sweepSpoolDirPeriodically() {
+	for {
+		sweepSpoolDir()
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,130 @@
+package integram
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/requilence/integram/tgtest"
+)
+
+func TestSendMessage_FileSources(t *testing.T) {
+	service := &Service{Name: "servicewithfiles"}
+	server, _ := newTestBot(t, service, "files_bot")
+
+	db, _ := newTestSendQueue(t)
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(spoolDir string) { Config.SpoolDir = spoolDir }(Config.SpoolDir)
+	Config.SpoolDir = dir
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 400}}
+	ctx.SetStorage(db)
+
+	// spooled file is sent and removed
+	m := ctx.NewMessage().SetFileReader("document", strings.NewReader("report"), "report.txt").SetText("report")
+	if err := m.spoolFileReader(); err != nil {
+		t.Fatalf("spoolFileReader() error = %v", err)
+	}
+	if !strings.HasPrefix(m.FilePath, dir) || !m.FileRemoveAfter {
+		t.Errorf("spoolFileReader() FilePath = %q, FileRemoveAfter = %v, want the file within the spool dir", m.FilePath, m.FileRemoveAfter)
+	}
+	if err := sendMessage(m); err != nil {
+		t.Fatalf("sendMessage() error = %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spool dir contains %d files after sending, want 0", len(files))
+	}
+
+	msgs := server.Messages(400)
+	if len(msgs) != 1 || msgs[0].Document == nil || string(msgs[0].Document.Data) != "report" || msgs[0].Document.Name != "report.txt" {
+		t.Fatalf("sendMessage() sent %+v, want report.txt", msgs)
+	}
+	fileID := msgs[0].Document.ID
+
+	tests := []struct {
+		name  string
+		m     *OutgoingMessage
+		check func(msg tgtest.Message) bool
+	}{
+		{"file_id", ctx.NewMessage().SetFileID("document", fileID), func(msg tgtest.Message) bool {
+			return msg.Document != nil && msg.Document.ID == fileID
+		}},
+		{"url", ctx.NewMessage().SetFileURL("image", "https://example.com/img.png").SetText("img"), func(msg tgtest.Message) bool {
+			return msg.Photo != nil && msg.Photo.Name == "https://example.com/img.png" && msg.Text == "img"
+		}},
+		{"bytes", ctx.NewMessage().SetFileBytes("video", []byte("video"), "video.mp4"), func(msg tgtest.Message) bool {
+			return msg.Video != nil && string(msg.Video.Data) == "video" && msg.Video.Name == "video.mp4"
+		}},
+	}
+	for _, tt := range tests {
+		if err := tt.m.spoolFileReader(); err != nil {
+			t.Errorf("%q. spoolFileReader() error = %v", tt.name, err)
+			continue
+		}
+
+		if err := sendMessage(tt.m); err != nil {
+			t.Errorf("%q. sendMessage() error = %v", tt.name, err)
+			continue
+		}
+
+		msgs := server.Messages(400)
+		if !tt.check(msgs[len(msgs)-1]) {
+			t.Errorf("%q. sendMessage() sent %+v", tt.name, msgs[len(msgs)-1])
+		}
+	}
+}
+
+func TestSweepSpoolDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(spoolDir string) { Config.SpoolDir = spoolDir }(Config.SpoolDir)
+	Config.SpoolDir = dir
+
+	// messages that can't be queued don't leave their files
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error { return ErrorFlood }}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	err = (&OutgoingMessage{Message: Message{ChatID: 1, BotID: 1}}).SetFileReader("document", strings.NewReader("data"), "a.txt").Send()
+	if err != ErrorFlood {
+		t.Errorf("Send() error = %v, want %v", err, ErrorFlood)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spool dir contains %d files after the failed Send, want 0", len(files))
+	}
+
+	later := time.Now().Add(24 * time.Hour)
+	pending := &OutgoingMessage{}
+	pending.SetSendAfter(later).SetFileReader("document", strings.NewReader("data"), "b.txt")
+	if err := pending.spoolFileReader(); err != nil {
+		t.Fatalf("spoolFileReader() error = %v", err)
+	}
+
+	expired := filepath.Join(dir, fmt.Sprintf("%s%d-1", spoolFilePrefix, time.Now().Add(-time.Minute).Unix()))
+	ioutil.WriteFile(expired, []byte("data"), 0600)
+
+	legacy := filepath.Join(dir, spoolFilePrefix+"123")
+	ioutil.WriteFile(legacy, []byte("data"), 0600)
+	old := time.Now().Add(-spoolFileMaxAge - time.Hour)
+	os.Chtimes(legacy, old, old)
+
+	sweepSpoolDir()
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || filepath.Join(dir, files[0].Name()) != pending.FilePath {
+		t.Errorf("spool dir contains %v after sweepSpoolDir(), want only %s", files, pending.FilePath)
+	}
+}
@@ -0,0 +1,400 @@
+package integram
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+
+	tg "github.com/requilence/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Telegram's limits for the number of poll options
+const (
+	pollMinOptions = 2
+	pollMaxOptions = 10
+)
+
+// Venue is the place with the title and address
+type Venue struct {
+	Latitude     float64
+	Longitude    float64
+	Title        string
+	Address      string
+	FoursquareID string `bson:",omitempty"`
+}
+
+// Contact is the phone contact
+type Contact struct {
+	PhoneNumber string
+	FirstName   string
+	LastName    string `bson:",omitempty"`
+}
+
+// Poll is the native Telegram poll. Answers for the non-anonymous polls are passed to the service's TGPollAnswerHandler
+type Poll struct {
+	ID              string `bson:",omitempty"` // set by Telegram after the poll was sent
+	Question        string
+	Options         []string
+	Anonymous       bool `bson:",omitempty"`
+	MultipleAnswers bool `bson:",omitempty"`
+	Quiz            bool `bson:",omitempty"`
+	CorrectOption   int  `bson:",omitempty"` // index of the correct option for the quiz
+}
+
+// PollAnswer is the user's answer on the non-anonymous poll sent by the bot
+type PollAnswer struct {
+	PollID    string
+	OptionIDs []int            // indexes of the chosen options. Empty if the vote was retracted
+	Message   *OutgoingMessage // message with the poll
+}
+
+type tgPollAnswer struct {
+	PollID    string  `json:"poll_id"`
+	User      tg.User `json:"user"`
+	OptionIDs []int   `json:"option_ids"`
+}
+
+// tgPollAnswerUpdate is used to decode the poll answer that is not supported by tg.Update
+type tgPollAnswerUpdate struct {
+	PollAnswer *tgPollAnswer `json:"poll_answer"`
+}
+
+// tgSentMessage is used to decode the poll that is not supported by tg.Message
+type tgSentMessage struct {
+	tg.Message
+	Poll *struct {
+		ID string `json:"id"`
+	} `json:"poll"`
+}
+
+// SetAudio adds the audio file located at localPath with name fileName to the message. Telegram will show it in the music player
+func (m *OutgoingMessage) SetAudio(localPath string, fileName string) *OutgoingMessage {
+	m.FilePath = localPath
+	m.FileName = fileName
+	m.FileType = "audio"
+	return m
+}
+
+// SetVideo adds the video file located at localPath with name fileName to the message
+func (m *OutgoingMessage) SetVideo(localPath string, fileName string) *OutgoingMessage {
+	m.FilePath = localPath
+	m.FileName = fileName
+	m.FileType = "video"
+	return m
+}
+
+// SetVoice adds the voice note located at localPath to the message. File must be in OGG format encoded with OPUS
+func (m *OutgoingMessage) SetVoice(localPath string, fileName string) *OutgoingMessage {
+	m.FilePath = localPath
+	m.FileName = fileName
+	m.FileType = "voice"
+	return m
+}
+
+// SetAnimation adds the GIF or H.264/MPEG-4 AVC video without sound located at localPath to the message
+func (m *OutgoingMessage) SetAnimation(localPath string, fileName string) *OutgoingMessage {
+	m.FilePath = localPath
+	m.FileName = fileName
+	m.FileType = "animation"
+	return m
+}
+
+// SetSticker adds the WEBP sticker located at localPath to the message. Message's text is ignored
+func (m *OutgoingMessage) SetSticker(localPath string) *OutgoingMessage {
+	m.FilePath = localPath
+	m.FileType = "sticker"
+	return m
+}
+
+// SetVenue set the venue. Message's text is ignored
+func (m *OutgoingMessage) SetVenue(latitude, longitude float64, title, address string) *OutgoingMessage {
+	m.Venue = &Venue{Latitude: latitude, Longitude: longitude, Title: title, Address: address}
+	return m
+}
+
+// SetContact set the phone contact. Message's text is ignored
+func (m *OutgoingMessage) SetContact(phoneNumber, firstName, lastName string) *OutgoingMessage {
+	m.Contact = &Contact{PhoneNumber: phoneNumber, FirstName: firstName, LastName: lastName}
+	return m
+}
+
+// SetPoll set the poll. Message's text is ignored, use the poll's Question instead
+func (m *OutgoingMessage) SetPoll(poll Poll) *OutgoingMessage {
+	m.Poll = &poll
+	return m
+}
+
+// validatePoll checks the Telegram's restrictions for polls
+func (m *OutgoingMessage) validatePoll() error {
+	if m.Poll.Question == "" {
+		return errors.New("poll question is empty")
+	}
+
+	if len(m.Poll.Options) < pollMinOptions || len(m.Poll.Options) > pollMaxOptions {
+		return errors.New("poll must contain 2-10 options")
+	}
+
+	if m.Poll.Quiz && (m.Poll.MultipleAnswers || m.Poll.CorrectOption < 0 || m.Poll.CorrectOption >= len(m.Poll.Options)) {
+		return errors.New("quiz must have the single correct option")
+	}
+	return nil
+}
+
+// tgReplyMarkup returns the keyboard to attach to the message or nil
+func (m *OutgoingMessage) tgReplyMarkup() interface{} {
+	// keyboard is attached to the last part of the long text
+	if len(m.TextParts) > 0 {
+		return nil
+	}
+
+	var markup interface{}
+	if m.KeyboardHide {
+		markup = tg.ReplyKeyboardRemove{RemoveKeyboard: true, Selective: m.Selective}
+	}
+
+	if m.ForceReply {
+		markup = tg.ForceReply{ForceReply: true, Selective: m.Selective}
+	}
+	// Keyboard will overridde HideKeyboard
+	if m.KeyboardMarkup != nil && len(m.KeyboardMarkup) > 0 {
+		markup = tg.ReplyKeyboardMarkup{Keyboard: m.KeyboardMarkup.tg(), OneTimeKeyboard: m.OneTimeKeyboard, Selective: m.Selective, ResizeKeyboard: m.ResizeKeyboard}
+	}
+
+	if len(m.InlineKeyboardMarkup.Buttons) > 0 {
+		markup = tg.InlineKeyboardMarkup{InlineKeyboard: m.InlineKeyboardMarkup.tg()}
+	}
+	return markup
+}
+
+// tgParams returns the params common for all send methods
+func (m *OutgoingMessage) tgParams() (map[string]string, error) {
+	params := map[string]string{
+		"chat_id":              strconv.FormatInt(m.ChatID, 10),
+		"disable_notification": strconv.FormatBool(m.Silent),
+	}
+
+	if m.ReplyToMsgID != 0 {
+		params["reply_to_message_id"] = strconv.Itoa(m.ReplyToMsgID)
+	}
+
+	if markup := m.tgReplyMarkup(); markup != nil {
+		data, err := json.Marshal(markup)
+		if err != nil {
+			return nil, err
+		}
+		params["reply_markup"] = string(data)
+	}
+	return params, nil
+}
+
+// tgFileMethod returns the Bot API method and the field name for the message's FileType
+func tgFileMethod(fileType string) (method string, field string) {
+	switch fileType {
+	case "image":
+		return "sendPhoto", "photo"
+	case "audio":
+		return "sendAudio", "audio"
+	case "video":
+		return "sendVideo", "video"
+	case "voice":
+		return "sendVoice", "voice"
+	case "animation":
+		return "sendAnimation", "animation"
+	case "sticker":
+		return "sendSticker", "sticker"
+	}
+	return "sendDocument", "document"
+}
+
+// sendFile sends the message's file with the caption using the method for its FileType.
+// Local file is uploaded only if its content wasn't uploaded by the bot before, file URL and file_id are passed to Telegram as is
+func sendFile(db Storage, api *tg.BotAPI, m *OutgoingMessage) (tg.Message, error) {
+	params, err := m.tgParams()
+	if err != nil {
+		return tg.Message{}, err
+	}
+
+	// stickers can't have the caption
+	if m.Text != "" && m.FileType != "sticker" {
+		params["caption"] = m.Text
+		if m.ParseMode != "" {
+			params["parse_mode"] = m.ParseMode
+		}
+	}
+
+	method, field := tgFileMethod(m.FileType)
+
+	if m.FilePath != "" {
+		return uploadFile(db, api, m, method, field, params)
+	}
+
+	if m.FileURL != "" {
+		params[field] = m.FileURL
+	} else {
+		params[field] = m.FileID
+	}
+
+	resp, err := api.MakeRequest(method, tgValues(params))
+	if err != nil {
+		return tg.Message{}, err
+	}
+
+	return decodeSentMessage(resp, m)
+}
+
+func tgValues(params map[string]string) url.Values {
+	v := url.Values{}
+	for key, value := range params {
+		v.Set(key, value)
+	}
+	return v
+}
+
+// uploadFile reuses the file_id cached for the file's content or uploads the file and caches the returned file_id
+func uploadFile(db Storage, api *tg.BotAPI, m *OutgoingMessage, method string, field string, params map[string]string) (tg.Message, error) {
+	hash, err := fileHash(m.FilePath)
+	if err != nil {
+		log.WithError(err).WithField("path", m.FilePath).Error("Can't hash the file, sending without the cache")
+	}
+
+	cacheID := tgFileCacheID(m.BotID, m.FileType, m.FileName, hash)
+	if hash != "" {
+		if fileID := cachedFileID(db, cacheID); fileID != "" {
+			params[field] = fileID
+			resp, err := api.MakeRequest(method, tgValues(params))
+			if err == nil {
+				fileCacheStat(db, m.BotID, StatFileCacheHit)
+				return decodeSentMessage(resp, m)
+			}
+
+			if !isWrongFileIDError(err) {
+				return tg.Message{}, err
+			}
+
+			log.WithError(err).WithField("bot", m.BotID).Warn("Cached file_id rejected, uploading the file")
+			db.C("tg_files").RemoveId(cacheID)
+			delete(params, field)
+		}
+		fileCacheStat(db, m.BotID, StatFileCacheMiss)
+	}
+
+	if m.FileName != "" {
+		params["filename"] = m.FileName
+	}
+
+	resp, err := api.UploadFile(method, params, field, m.FilePath)
+	if err != nil {
+		return tg.Message{}, err
+	}
+
+	msg, err := decodeSentMessage(resp, m)
+	if err == nil && hash != "" {
+		cacheFileID(db, cacheID, sentFileID(msg))
+	}
+	return msg, err
+}
+
+// sendMedia sends the message's venue, contact or poll
+func sendMedia(api *tg.BotAPI, m *OutgoingMessage) (tg.Message, error) {
+	params, err := m.tgParams()
+	if err != nil {
+		return tg.Message{}, err
+	}
+
+	v := tgValues(params)
+
+	var method string
+	switch {
+	case m.Venue != nil:
+		method = "sendVenue"
+		v.Set("latitude", strconv.FormatFloat(m.Venue.Latitude, 'f', 6, 64))
+		v.Set("longitude", strconv.FormatFloat(m.Venue.Longitude, 'f', 6, 64))
+		v.Set("title", m.Venue.Title)
+		v.Set("address", m.Venue.Address)
+		if m.Venue.FoursquareID != "" {
+			v.Set("foursquare_id", m.Venue.FoursquareID)
+		}
+	case m.Contact != nil:
+		method = "sendContact"
+		v.Set("phone_number", m.Contact.PhoneNumber)
+		v.Set("first_name", m.Contact.FirstName)
+		if m.Contact.LastName != "" {
+			v.Set("last_name", m.Contact.LastName)
+		}
+	case m.Poll != nil:
+		method = "sendPoll"
+		options, err := json.Marshal(m.Poll.Options)
+		if err != nil {
+			return tg.Message{}, err
+		}
+
+		v.Set("question", m.Poll.Question)
+		v.Set("options", string(options))
+		v.Set("is_anonymous", strconv.FormatBool(m.Poll.Anonymous))
+		if m.Poll.Quiz {
+			v.Set("type", "quiz")
+			v.Set("correct_option_id", strconv.Itoa(m.Poll.CorrectOption))
+		} else {
+			v.Set("allows_multiple_answers", strconv.FormatBool(m.Poll.MultipleAnswers))
+		}
+	default:
+		return tg.Message{}, errors.New("venue, contact and poll are empty")
+	}
+
+	resp, err := api.MakeRequest(method, v)
+	if err != nil {
+		return tg.Message{}, err
+	}
+
+	return decodeSentMessage(resp, m)
+}
+
+// decodeSentMessage decodes the sent message and stores the poll's ID, so the answers can be routed to the service
+func decodeSentMessage(resp tg.APIResponse, m *OutgoingMessage) (tg.Message, error) {
+	var msg tgSentMessage
+	err := json.Unmarshal(resp.Result, &msg)
+	if err != nil {
+		return tg.Message{}, err
+	}
+
+	if m.Poll != nil && msg.Poll != nil {
+		m.Poll.ID = msg.Poll.ID
+	}
+	return msg.Message, nil
+}
+
+// tgPollAnswerHandler finds the poll's message and creates the context for the service's TGPollAnswerHandler
+func tgPollAnswerHandler(pa *tgPollAnswer, b *Bot, db Storage) (*Service, *Context) {
+	var om OutgoingMessage
+	err := db.C("messages").Find(bson.M{"botid": b.ID, "poll.id": pa.PollID}).One(&om)
+	if err != nil {
+		log.WithError(err).WithField("bot", b.ID).WithField("poll", pa.PollID).Error("tgPollAnswerHandler can't find the poll's message")
+		return nil, nil
+	}
+
+	service, err := detectServiceByBot(b.ID)
+	if err != nil {
+		log.WithError(err).WithField("bot", b.ID).Error("Can't detect service")
+		return nil, nil
+	}
+
+	ctx := &Context{
+		ServiceName: service.Name,
+		User:        tgUser(&pa.User),
+		storage:     db,
+		PollAnswer:  &PollAnswer{PollID: pa.PollID, OptionIDs: pa.OptionIDs, Message: &om},
+	}
+
+	chatData, err := ctx.FindChat(bson.M{"_id": om.ChatID})
+	if err != nil {
+		chatData.Chat = Chat{ID: om.ChatID}
+	}
+	ctx.Chat = chatData.Chat
+	ctx.User.ctx = ctx
+	ctx.Chat.ctx = ctx
+
+	return service, ctx
+}
@@ -0,0 +1,116 @@
+package integram
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/requilence/integram/tgtest"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOutgoingMessage_validatePoll(t *testing.T) {
+	tests := []struct {
+		name    string
+		poll    Poll
+		wantErr bool
+	}{
+		{"poll", Poll{Question: "?", Options: []string{"a", "b"}}, false},
+		{"quiz", Poll{Question: "?", Options: []string{"a", "b"}, Quiz: true, CorrectOption: 1}, false},
+		{"no question", Poll{Options: []string{"a", "b"}}, true},
+		{"single option", Poll{Question: "?", Options: []string{"a"}}, true},
+		{"quiz without correct option", Poll{Question: "?", Options: []string{"a", "b"}, Quiz: true, CorrectOption: 2}, true},
+		{"quiz with multiple answers", Poll{Question: "?", Options: []string{"a", "b"}, Quiz: true, MultipleAnswers: true}, true},
+	}
+	for _, tt := range tests {
+		if err := (&OutgoingMessage{}).SetPoll(tt.poll).validatePoll(); (err != nil) != tt.wantErr {
+			t.Errorf("%q. validatePoll() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSendMessage_Media(t *testing.T) {
+	var answer *PollAnswer
+	service := &Service{Name: "servicewithmedia", TGPollAnswerHandler: func(c *Context) error {
+		answer = c.PollAnswer
+		return nil
+	}}
+	server, _ := newTestBot(t, service, "media_bot")
+
+	db, _ := newTestSendQueue(t)
+
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, []byte("data"), 0644)
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 300}}
+	ctx.SetStorage(db)
+
+	tests := []struct {
+		name  string
+		m     *OutgoingMessage
+		check func(msg tgtest.Message) bool
+	}{
+		{"audio", ctx.NewMessage().SetAudio(path, "song.mp3").SetText("<b>song</b>").EnableHTML().SetSilent(true), func(msg tgtest.Message) bool {
+			return msg.Audio != nil && msg.Audio.Name == "song.mp3" && msg.Text == "<b>song</b>" && msg.ParseMode == "HTML" && msg.Silent
+		}},
+		{"video", ctx.NewMessage().SetVideo(path, "video.mp4").SetText("video").SetReplyToMsgID(1), func(msg tgtest.Message) bool {
+			return msg.Video != nil && msg.Text == "video" && msg.ReplyToID == 1
+		}},
+		{"voice", ctx.NewMessage().SetVoice(path, "voice.ogg"), func(msg tgtest.Message) bool {
+			return msg.Voice != nil
+		}},
+		{"animation", ctx.NewMessage().SetAnimation(path, "anim.gif").SetText("gif").SetInlineKeyboard(InlineButton{Text: "btn", Data: "data"}), func(msg tgtest.Message) bool {
+			return msg.Animation != nil && len(msg.InlineKeyboard()) == 1
+		}},
+		{"sticker", ctx.NewMessage().SetSticker(path).SetText("ignored"), func(msg tgtest.Message) bool {
+			return msg.Sticker != nil && msg.Text == ""
+		}},
+		{"image with caption", ctx.NewMessage().SetImage(path, "img.png").SetText("*img*").EnableMarkdown(), func(msg tgtest.Message) bool {
+			return msg.Photo != nil && msg.Text == "*img*" && msg.ParseMode == "Markdown"
+		}},
+		{"venue", ctx.NewMessage().SetVenue(1.5, 2.5, "Cafe", "Street 1"), func(msg tgtest.Message) bool {
+			return msg.Venue != nil && msg.Venue.Title == "Cafe" && msg.Venue.Location.Longitude == 2.5
+		}},
+		{"contact", ctx.NewMessage().SetContact("+1000", "John", ""), func(msg tgtest.Message) bool {
+			return msg.Contact != nil && msg.Contact.PhoneNumber == "+1000"
+		}},
+		{"poll", ctx.NewMessage().SetPoll(Poll{Question: "Deploy?", Options: []string{"yes", "no"}}), func(msg tgtest.Message) bool {
+			return msg.Poll != nil && msg.Poll.Question == "Deploy?" && len(msg.Poll.Options) == 2 && !msg.Poll.Anonymous
+		}},
+	}
+	for _, tt := range tests {
+		err := sendMessage(tt.m)
+		if err != nil {
+			t.Errorf("%q. sendMessage() error = %v", tt.name, err)
+			continue
+		}
+
+		msgs := server.Messages(300)
+		if len(msgs) == 0 || !tt.check(msgs[len(msgs)-1]) || msgs[len(msgs)-1].MessageID != tt.m.MsgID {
+			t.Errorf("%q. sendMessage() sent unexpected message", tt.name)
+		}
+	}
+
+	var om OutgoingMessage
+	err = db.C("messages").Find(bson.M{"botid": service.Bot().ID, "poll": bson.M{"$ne": nil}}).One(&om)
+	if err != nil || om.Poll == nil || om.Poll.ID == "" {
+		t.Fatalf("poll message stored = %+v, %v, want with poll ID", om.Poll, err)
+	}
+
+	_, pollCtx := tgPollAnswerHandler(&tgPollAnswer{PollID: om.Poll.ID, OptionIDs: []int{1}}, service.Bot(), db)
+	if pollCtx == nil {
+		t.Fatalf("tgPollAnswerHandler() returned nil context")
+	}
+	dispatchUpdate(pollCtx)
+
+	if answer == nil || answer.Message.MsgID != om.MsgID || answer.OptionIDs[0] != 1 || pollCtx.Chat.ID != 300 {
+		t.Errorf("TGPollAnswerHandler received %+v, want the answer on the poll message", answer)
+	}
+}
@@ -0,0 +1,276 @@
+package integram
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QuietHours is the time of the day when the chat's notifications are sent silently or deferred. Evaluated in the chat's time zone
+type QuietHours struct {
+	From  int  // minutes since the midnight
+	To    int  // minutes since the midnight. Window passes the midnight if it is less than From
+	Defer bool `bson:",omitempty"` // deliver notifications when the window ends instead of sending them silently
+}
+
+const quietHoursCommandName = "quiet"
+
+// QuietHoursCommand lets chat's admins set the quiet hours, add it to the service's Commands to enable.
+// Usage: /quiet 23:00-08:00 [silent|defer] [time zone], /quiet off
+var QuietHoursCommand = Command{
+	Name:        quietHoursCommandName,
+	Description: "Quiet hours for notifications",
+	AdminOnly:   true,
+	Handler:     quietHoursCommand,
+}
+
+func minutesOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// Contains returns true if t is within the window. t must be in the chat's time zone
+func (q *QuietHours) Contains(t time.Time) bool {
+	m := minutesOfDay(t)
+	if q.From < q.To {
+		return m >= q.From && m < q.To
+	}
+	if q.From > q.To {
+		return m >= q.From || m < q.To
+	}
+	return false
+}
+
+// End returns the nearest end of the window after t
+func (q *QuietHours) End(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.To/60, q.To%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// String returns the window in the 23:00-08:00 format
+func (q *QuietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.From/60, q.From%60, q.To/60, q.To%60)
+}
+
+// parseClock parses the time of the day in the 23:00 or 23 format to the minutes since the midnight
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("bad hour in %q", s)
+	}
+
+	m := 0
+	if len(parts) == 2 {
+		m, err = strconv.Atoi(parts[1])
+		if err != nil || m < 0 || m > 59 || h == 24 && m > 0 {
+			return 0, fmt.Errorf("bad minutes in %q", s)
+		}
+	}
+	return (h*60 + m) % (24 * 60), nil
+}
+
+// ParseQuietHours parses the window in the 23:00-08:00 format
+func ParseQuietHours(s string) (*QuietHours, error) {
+	parts := strings.Split(strings.Replace(s, "–", "-", -1), "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("quiet hours must be in the 23:00-08:00 format, got %q", s)
+	}
+
+	from, err := parseClock(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := parseClock(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if from == to {
+		return nil, errors.New("quiet hours must not be empty")
+	}
+
+	return &QuietHours{From: from, To: to}, nil
+}
+
+// QuietHours returns the chat's quiet hours for the service or nil if they are not set
+func (chat *Chat) QuietHours() *QuietHours {
+	ps, _ := chat.protectedSettings()
+	if ps == nil {
+		return nil
+	}
+	return ps.QuietHours
+}
+
+// SetQuietHours saves the chat's quiet hours for the service. Nil turns them off
+func (chat *Chat) SetQuietHours(q *QuietHours) error {
+	ps, err := chat.protectedSettings()
+	if err != nil {
+		return err
+	}
+
+	ps.QuietHours = q
+	key := "protected." + chat.ctx.getServiceID() + ".quiethours"
+
+	if q == nil {
+		_, err = chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$unset": bson.M{key: ""}})
+		return err
+	}
+
+	_, err = chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$set": bson.M{key: q}})
+	return err
+}
+
+// SetTz saves the chat's time zone, e.g. Europe/Berlin
+func (chat *Chat) SetTz(tz string) error {
+	if _, err := time.LoadLocation(tz); err != nil {
+		return err
+	}
+
+	data, err := chat.getData()
+	if err != nil {
+		return err
+	}
+
+	chat.Tz = tz
+	data.Tz = tz
+	_, err = chat.ctx.Storage().C("chats").UpsertId(chat.ID, bson.M{"$set": bson.M{"tz": tz}})
+	return err
+}
+
+// isNotification returns false if message is the response to the user's action in the same chat
+func (m *OutgoingMessage) isNotification() bool {
+	c := m.ctx
+	if m.ChatID != c.Chat.ID {
+		return true
+	}
+	return c.Message == nil && c.Callback == nil && c.InlineQuery == nil && c.ChosenInlineResult == nil
+}
+
+// applyQuietHours makes the message silent or defers it if it is going to be sent within the quiet hours
+func (m *OutgoingMessage) applyQuietHours(q *QuietHours, loc *time.Location, now time.Time) {
+	if m.Urgent || q == nil {
+		return
+	}
+
+	at := now
+	if m.SendAfter != nil && m.SendAfter.After(now) {
+		at = *m.SendAfter
+	}
+	at = at.In(loc)
+
+	if !q.Contains(at) {
+		return
+	}
+
+	if q.Defer {
+		end := q.End(at)
+		m.SendAfter = &end
+		return
+	}
+	m.Silent = true
+}
+
+// checkQuietHours applies the quiet hours of the message's chat to the notifications
+func (m *OutgoingMessage) checkQuietHours() {
+	if m.Urgent || m.ctx == nil || !m.isNotification() {
+		return
+	}
+
+	chat, err := m.ctx.FindChat(bson.M{"_id": m.ChatID})
+	if err != nil {
+		// chat is not stored yet
+		return
+	}
+
+	ps := chat.Protected[m.ctx.getServiceID()]
+	if ps == nil || ps.QuietHours == nil {
+		return
+	}
+
+	m.applyQuietHours(ps.QuietHours, chat.TzLocation(), time.Now())
+}
+
+// quietHoursText describes the chat's quiet hours
+func (c *Context) quietHoursText() string {
+	q := c.Chat.QuietHours()
+	if q == nil {
+		return c.T("quiet.off")
+	}
+
+	tz := c.Chat.Tz
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	if q.Defer {
+		return c.T("quiet.defer", q.String(), tz)
+	}
+	return c.T("quiet.silent", q.String(), tz)
+}
+
+func quietHoursCommand(c *Context, args string) error {
+	// load the chat's time zone
+	if _, err := c.Chat.getData(); err != nil {
+		return err
+	}
+
+	fields := strings.Fields(args)
+
+	if len(fields) == 0 {
+		return c.NewMessage().SetText(c.quietHoursText() + "\n\n" + c.T("quiet.usage", quietHoursCommandName)).Send()
+	}
+
+	if strings.EqualFold(fields[0], "off") {
+		err := c.Chat.SetQuietHours(nil)
+		if err != nil {
+			return err
+		}
+		return c.NewMessage().SetText(c.quietHoursText()).Send()
+	}
+
+	q, err := ParseQuietHours(fields[0])
+	if err != nil {
+		return c.NewMessage().SetText(c.T("quiet.usage", quietHoursCommandName)).Send()
+	}
+
+	tz := c.Chat.Tz
+	if tz == "" && c.Chat.IsPrivate() {
+		tz = c.User.Tz
+	}
+
+	for _, field := range fields[1:] {
+		switch strings.ToLower(field) {
+		case "defer":
+			q.Defer = true
+		case "silent":
+			q.Defer = false
+		default:
+			if _, err := time.LoadLocation(field); err != nil || field == "Local" {
+				return c.NewMessage().SetText(c.T("quiet.unknown_tz", field)).Send()
+			}
+			tz = field
+		}
+	}
+
+	if tz != "" && tz != c.Chat.Tz {
+		err = c.Chat.SetTz(tz)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Chat.SetQuietHours(q)
+	if err != nil {
+		return err
+	}
+
+	return c.NewMessage().SetText(c.quietHoursText()).Send()
+}
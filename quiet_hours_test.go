@@ -0,0 +1,148 @@
+package integram
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"23:00-08:00", "23:00-08:00", false},
+		{"22-7:30", "22:00-07:30", false},
+		{"9:15–18:00", "09:15-18:00", false},
+		{"0-24", "00:00-00:00", true},
+		{"23:60-08:00", "", true},
+		{"25-08", "", true},
+		{"23:00", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuietHours(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseQuietHours(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParseQuietHours(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestOutgoingMessage_applyQuietHours(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tz database")
+	}
+
+	night := &QuietHours{From: 23 * 60, To: 8 * 60}
+	nightDefer := &QuietHours{From: 23 * 60, To: 8 * 60, Defer: true}
+	day := &QuietHours{From: 12 * 60, To: 14 * 60, Defer: true}
+
+	// 23:30 in Berlin
+	now := time.Date(2018, 1, 1, 22, 30, 0, 0, time.UTC)
+	later := now.Add(10 * time.Hour)
+	lunch := now.Add(13*time.Hour + 30*time.Minute)
+	morning := time.Date(2018, 1, 2, 8, 0, 0, 0, berlin)
+	noon := time.Date(2018, 1, 2, 14, 0, 0, 0, berlin)
+
+	tests := []struct {
+		name       string
+		q          *QuietHours
+		msg        OutgoingMessage
+		wantSilent bool
+		wantAfter  *time.Time
+	}{
+		{"silent", night, OutgoingMessage{}, true, nil},
+		{"deferred", nightDefer, OutgoingMessage{}, false, &morning},
+		{"urgent", nightDefer, OutgoingMessage{Urgent: true}, false, nil},
+		{"outside", day, OutgoingMessage{}, false, nil},
+		{"scheduled outside", nightDefer, OutgoingMessage{SendAfter: &later}, false, &later},
+		{"scheduled inside", day, OutgoingMessage{SendAfter: &lunch}, false, &noon},
+	}
+	for _, tt := range tests {
+		m := tt.msg
+		m.applyQuietHours(tt.q, berlin, now)
+		if m.Silent != tt.wantSilent {
+			t.Errorf("%q. applyQuietHours() Silent = %v, want %v", tt.name, m.Silent, tt.wantSilent)
+		}
+		if (m.SendAfter == nil) != (tt.wantAfter == nil) || m.SendAfter != nil && !m.SendAfter.Equal(*tt.wantAfter) {
+			t.Errorf("%q. applyQuietHours() SendAfter = %v, want %v", tt.name, m.SendAfter, tt.wantAfter)
+		}
+	}
+}
+
+func TestQuietHoursCommand(t *testing.T) {
+	service := &Service{Name: "servicewithquiethours", Commands: []Command{QuietHoursCommand}}
+	server, _ := newTestBot(t, service, "quiet_bot")
+	server.SetChatAdmin(-90, 2)
+
+	defer func(s Storage) { memoryStorageInstance = s }(memoryStorageInstance)
+	memoryStorageInstance = NewMemoryStorage()
+
+	var sent []string
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error {
+		sent = append(sent, m.Text)
+		return nil
+	}}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	newContext := func(user User, text string) *Context {
+		ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: -90, Type: "group", Title: "Group"}, User: user}
+		if text != "" {
+			ctx.Message = &IncomingMessage{Message: Message{Text: text}}
+		}
+		ctx.SetStorage(memoryStorageInstance)
+		ctx.User.ctx = ctx
+		ctx.Chat.ctx = ctx
+		return ctx
+	}
+
+	user := User{ID: 1, FirstName: "Jo"}
+	admin := User{ID: 2, FirstName: "Admin"}
+
+	// window that contains the current time
+	now := time.Now().In(tzLocation("Asia/Tokyo"))
+	window := (&QuietHours{From: (minutesOfDay(now) + 23*60) % (24 * 60), To: (minutesOfDay(now) + 60) % (24 * 60)}).String()
+
+	tests := []struct {
+		name       string
+		user       User
+		text       string
+		sent       string
+		wantSilent bool
+		wantDefer  bool
+	}{
+		{"not set", admin, "/quiet", "Quiet hours are off\n\n/quiet 23:00-08:00 [silent|defer] [time zone, e.g. Europe/Berlin] – set the quiet hours\n/quiet off – turn them off", false, false},
+		{"not admin", user, "/quiet " + window, "/quiet is available only for the chat administrators", false, false},
+		{"bad tz", admin, "/quiet " + window + " Mars/Base", "Unknown time zone: Mars/Base", false, false},
+		{"silent", admin, "/quiet " + window + " Asia/Tokyo", "Quiet hours: " + window + " (Asia/Tokyo). Notifications are sent silently", true, false},
+		{"defer", admin, "/quiet " + window + " defer", "Quiet hours: " + window + " (Asia/Tokyo). Notifications are delivered when they end", false, true},
+		{"off", admin, "/quiet off", "Quiet hours are off", false, false},
+	}
+	for _, tt := range tests {
+		sent = nil
+		newContext(tt.user, tt.text).handleCommand()
+		if len(sent) != 1 || sent[0] != tt.sent {
+			t.Errorf("%q. handleCommand() sent %q, want %q", tt.name, sent, tt.sent)
+		}
+
+		// notification from the webhook
+		m := newContext(User{}, "").NewMessage().SetText("notification")
+		m.checkQuietHours()
+		if m.Silent != tt.wantSilent || (m.SendAfter != nil) != tt.wantDefer {
+			t.Errorf("%q. checkQuietHours() Silent = %v, SendAfter = %v, want %v, %v", tt.name, m.Silent, m.SendAfter, tt.wantSilent, tt.wantDefer)
+		}
+
+		// reply to the user and urgent notification are not affected
+		reply := newContext(admin, "/start").NewMessage().SetText("reply")
+		reply.checkQuietHours()
+		urgent := newContext(User{}, "").NewMessage().SetText("urgent").SetUrgent(true)
+		urgent.checkQuietHours()
+		if reply.Silent || reply.SendAfter != nil || urgent.Silent || urgent.SendAfter != nil {
+			t.Errorf("%q. checkQuietHours() affected the reply or the urgent message", tt.name)
+		}
+	}
+}
@@ -5,13 +5,101 @@ import (
 	"strings"
 )
 
+// Parse modes of the message's text
+const (
+	ParseModeHTML       = "HTML"
+	ParseModeMarkdown   = "Markdown"
+	ParseModeMarkdownV2 = "MarkdownV2"
+)
+
+// tgHTMLTags are the tags supported by Telegram. Other tags are removed from the HTML texts before sending
+var tgHTMLTags = []string{"a", "b", "strong", "i", "em", "u", "ins", "s", "strike", "del", "span", "tg-spoiler", "code", "pre", "blockquote"}
+
+// tgHTMLAttributes are the attributes supported by Telegram: href for links, class for spoilers and languages of code blocks
+var tgHTMLAttributes = []string{"href", "class"}
+
+// RichText produce the formatted text for one of the Telegram's parse modes
+// Formatting that is not supported by the parse mode falls back to the escaped text
+type RichText interface {
+	// ParseMode to set for the message
+	ParseMode() string
+	// Esc escapes the text, so it will be shown as is
+	Esc(s string) string
+	Bold(text string) string
+	Italic(text string) string
+	Underline(text string) string
+	Strikethrough(text string) string
+	Spoiler(text string) string
+	Fixed(text string) string
+	Pre(text string) string
+	URL(text string, url string) string
+	Blockquote(text string) string
+}
+
+// NewRichText returns the RichText for the parse mode. Plain text is returned for the empty or unknown one
+func NewRichText(parseMode string) RichText {
+	switch parseMode {
+	case ParseModeHTML:
+		return HTMLRichText{}
+	case ParseModeMarkdown:
+		return MarkdownRichText{}
+	case ParseModeMarkdownV2:
+		return MarkdownV2RichText{}
+	}
+	return PlainRichText{}
+}
+
 // MarkdownRichText produce Markdown that can be sent to Telegram. Not recommended to use because of tricky escaping
-// Use HTMLRichText instead
+// Use HTMLRichText or MarkdownV2RichText instead
 type MarkdownRichText struct{}
 
+// MarkdownV2RichText produce MarkdownV2 that can be sent to Telegram
+type MarkdownV2RichText struct{}
+
 // HTMLRichText produce HTML that can be sent to Telegram
 type HTMLRichText struct{}
 
+// PlainRichText produce the text without formatting
+type PlainRichText struct{}
+
+// ParseMode returns "HTML"
+func (hrt HTMLRichText) ParseMode() string {
+	return ParseModeHTML
+}
+
+// Esc encodes '<', '>'
+func (hrt HTMLRichText) Esc(s string) string {
+	return hrt.EncodeEntities(s)
+}
+
+// Underline generates <u>text</u>
+func (hrt HTMLRichText) Underline(text string) string {
+	return hrt.wrap("u", text)
+}
+
+// Strikethrough generates <s>text</s>
+func (hrt HTMLRichText) Strikethrough(text string) string {
+	return hrt.wrap("s", text)
+}
+
+// Spoiler generates <tg-spoiler>text</tg-spoiler>
+func (hrt HTMLRichText) Spoiler(text string) string {
+	return hrt.wrap("tg-spoiler", text)
+}
+
+// Blockquote generates <blockquote>text</blockquote>
+func (hrt HTMLRichText) Blockquote(text string) string {
+	return hrt.wrap("blockquote", text)
+}
+
+func (hrt HTMLRichText) wrap(tag string, text string) string {
+	if text == "" {
+		return ""
+	}
+
+	return "<" + tag + ">" + hrt.EncodeEntities(text) + "</" + tag + ">"
+}
+
 // Pre generates <pre>text</pre>
 func (hrt HTMLRichText) Pre(s string) string {
 	return "<pre>" + hrt.EncodeEntities(s) + "</pre>"
@@ -102,3 +190,173 @@ func (mrt MarkdownRichText) Italic(text string) string {
 	repalcer := strings.NewReplacer("_", "＿")
 	return "_" + repalcer.Replace(text) + "_"
 }
+
+// ParseMode returns "Markdown"
+func (mrt MarkdownRichText) ParseMode() string {
+	return ParseModeMarkdown
+}
+
+// Underline is not supported by Markdown, escaped text is returned
+func (mrt MarkdownRichText) Underline(text string) string {
+	return mrt.Esc(text)
+}
+
+// Strikethrough is not supported by Markdown, escaped text is returned
+func (mrt MarkdownRichText) Strikethrough(text string) string {
+	return mrt.Esc(text)
+}
+
+// Spoiler is not supported by Markdown, escaped text is returned
+func (mrt MarkdownRichText) Spoiler(text string) string {
+	return mrt.Esc(text)
+}
+
+// Blockquote is not supported by Markdown, escaped text is returned
+func (mrt MarkdownRichText) Blockquote(text string) string {
+	return mrt.Esc(text)
+}
+
+// ParseMode returns "MarkdownV2"
+func (mrt MarkdownV2RichText) ParseMode() string {
+	return ParseModeMarkdownV2
+}
+
+// Esc escapes all the MarkdownV2 reserved characters with \
+func (mrt MarkdownV2RichText) Esc(s string) string {
+	repalcer := strings.NewReplacer("\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)", "~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=", "|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!")
+	return repalcer.Replace(s)
+}
+
+// escCode escapes the characters reserved within the code entities
+func (mrt MarkdownV2RichText) escCode(s string) string {
+	repalcer := strings.NewReplacer("\\", "\\\\", "`", "\\`")
+	return repalcer.Replace(s)
+}
+
+func (mrt MarkdownV2RichText) wrap(marker string, text string) string {
+	if text == "" {
+		return ""
+	}
+
+	return marker + mrt.Esc(text) + marker
+}
+
+// Bold generates *text*
+func (mrt MarkdownV2RichText) Bold(text string) string {
+	return mrt.wrap("*", text)
+}
+
+// Italic generates _text_
+func (mrt MarkdownV2RichText) Italic(text string) string {
+	return mrt.wrap("_", text)
+}
+
+// Underline generates __text__
+func (mrt MarkdownV2RichText) Underline(text string) string {
+	return mrt.wrap("__", text)
+}
+
+// Strikethrough generates ~text~
+func (mrt MarkdownV2RichText) Strikethrough(text string) string {
+	return mrt.wrap("~", text)
+}
+
+// Spoiler generates ||text||
+func (mrt MarkdownV2RichText) Spoiler(text string) string {
+	return mrt.wrap("||", text)
+}
+
+// Fixed generates `text`
+func (mrt MarkdownV2RichText) Fixed(text string) string {
+	if text == "" {
+		return ""
+	}
+
+	return "`" + mrt.escCode(text) + "`"
+}
+
+// Pre generates ```text```
+func (mrt MarkdownV2RichText) Pre(text string) string {
+	if text == "" {
+		return ""
+	}
+
+	return "```\n" + mrt.escCode(text) + "\n```"
+}
+
+// URL generates [text](URL)
+func (mrt MarkdownV2RichText) URL(text string, url string) string {
+	repalcer := strings.NewReplacer("\\", "\\\\", ")", "\\)")
+	return "[" + mrt.Esc(text) + "](" + repalcer.Replace(url) + ")"
+}
+
+// Blockquote generates >text for every line
+func (mrt MarkdownV2RichText) Blockquote(text string) string {
+	if text == "" {
+		return ""
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = ">" + mrt.Esc(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseMode returns the empty string
+func (prt PlainRichText) ParseMode() string {
+	return ""
+}
+
+// Esc returns the text as is
+func (prt PlainRichText) Esc(s string) string {
+	return s
+}
+
+// Bold returns the text as is
+func (prt PlainRichText) Bold(text string) string {
+	return text
+}
+
+// Italic returns the text as is
+func (prt PlainRichText) Italic(text string) string {
+	return text
+}
+
+// Underline returns the text as is
+func (prt PlainRichText) Underline(text string) string {
+	return text
+}
+
+// Strikethrough returns the text as is
+func (prt PlainRichText) Strikethrough(text string) string {
+	return text
+}
+
+// Spoiler returns the text as is
+func (prt PlainRichText) Spoiler(text string) string {
+	return text
+}
+
+// Fixed returns the text as is
+func (prt PlainRichText) Fixed(text string) string {
+	return text
+}
+
+// Pre returns the text as is
+func (prt PlainRichText) Pre(text string) string {
+	return text
+}
+
+// URL generates text (URL)
+func (prt PlainRichText) URL(text string, url string) string {
+	if text == "" || text == url {
+		return url
+	}
+	return text + " (" + url + ")"
+}
+
+// Blockquote returns the text as is
+func (prt PlainRichText) Blockquote(text string) string {
+	return text
+}
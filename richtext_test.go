@@ -1,6 +1,9 @@
 package integram
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestHTMLRichText_Pre(t *testing.T) {
 	type args struct {
@@ -253,3 +256,95 @@ func TestMarkdownRichText_Italic(t *testing.T) {
 		}
 	}
 }
+
+func TestMarkdownV2RichText(t *testing.T) {
+	mrt := MarkdownV2RichText{}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Esc", mrt.Esc("1.5 + (a_b) - [c]! \\"), "1\\.5 \\+ \\(a\\_b\\) \\- \\[c\\]\\! \\\\"},
+		{"Bold", mrt.Bold("a*b"), "*a\\*b*"},
+		{"Bold empty", mrt.Bold(""), ""},
+		{"Italic", mrt.Italic("a_b"), "_a\\_b_"},
+		{"Underline", mrt.Underline("text"), "__text__"},
+		{"Strikethrough", mrt.Strikethrough("a~b"), "~a\\~b~"},
+		{"Spoiler", mrt.Spoiler("a|b"), "||a\\|b||"},
+		{"Fixed", mrt.Fixed("a.`b`"), "`a.\\`b\\``"},
+		{"Pre", mrt.Pre("f(x) \\ g"), "```\nf(x) \\\\ g\n```"},
+		{"URL", mrt.URL("a.b", "https://integram.org/(x)"), "[a\\.b](https://integram.org/(x\\))"},
+		{"Blockquote", mrt.Blockquote("line 1\nline-2"), ">line 1\n>line\\-2"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%q. MarkdownV2RichText.%s() = %v, want %v", tt.name, tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestHTMLRichText_Telegram(t *testing.T) {
+	hrt := HTMLRichText{}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Underline", hrt.Underline("<u>"), "<u>&lt;u&gt;</u>"},
+		{"Strikethrough", hrt.Strikethrough("text"), "<s>text</s>"},
+		{"Spoiler", hrt.Spoiler("text"), "<tg-spoiler>text</tg-spoiler>"},
+		{"Blockquote", hrt.Blockquote("a\nb"), "<blockquote>a\nb</blockquote>"},
+		{"Blockquote empty", hrt.Blockquote(""), ""},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%q. HTMLRichText.%s() = %v, want %v", tt.name, tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestNewRichText(t *testing.T) {
+	tests := []struct {
+		parseMode string
+		want      RichText
+	}{
+		{"HTML", HTMLRichText{}},
+		{"Markdown", MarkdownRichText{}},
+		{"MarkdownV2", MarkdownV2RichText{}},
+		{"", PlainRichText{}},
+		{"unknown", PlainRichText{}},
+	}
+	for _, tt := range tests {
+		if got := NewRichText(tt.parseMode); got != tt.want {
+			t.Errorf("%q. NewRichText() = %T, want %T", tt.parseMode, got, tt.want)
+		}
+		if got := (&OutgoingMessage{ParseMode: tt.parseMode}).RichText(); got != tt.want {
+			t.Errorf("%q. OutgoingMessage.RichText() = %T, want %T", tt.parseMode, got, tt.want)
+		}
+	}
+}
+
+func TestSendMessage_MarkdownV2(t *testing.T) {
+	service := &Service{Name: "servicewithmarkdown"}
+	server, _ := newTestBot(t, service, "markdown_bot")
+
+	db, _ := newTestSendQueue(t)
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 700}}
+	ctx.SetStorage(db)
+
+	mrt := MarkdownV2RichText{}
+	text := mrt.Bold("a > b") + "\n" + mrt.Esc("1. <item>") + "\n" + mrt.Blockquote("quote\nline 2")
+
+	if err := ctx.NewMessage().EnableMarkdownV2().SetText(text).Send(); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); len(server.Messages(700)) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+
+	msgs := server.Messages(700)
+	if len(msgs) != 1 || msgs[0].Text != text {
+		t.Errorf("Send() sent %v, want the text %q", msgs, text)
+	}
+}
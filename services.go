@@ -15,12 +15,10 @@ import (
 	"time"
 
 	"github.com/mrjones/oauth"
-	"github.com/requilence/jobs"
 	"github.com/requilence/url"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 
-	"gopkg.in/mgo.v2"
 )
 
 const standAloneServicesFileName = "standAloneServices.json"
@@ -29,7 +27,7 @@ var serviceMapMutex = sync.RWMutex{}
 var services = make(map[string]*Service)
 
 // Mapping job.Type by job alias names specified in service's config
-type jobTypePerJobName map[string]*jobs.Type
+type jobTypePerJobName map[string]JobType
 
 var jobsPerService = make(map[string]jobTypePerJobName)
 
@@ -40,8 +38,9 @@ var actionFuncs = make(map[string]interface{})
 var tgUpdatesRevoltChan = make(chan *Bot)
 
 type Module struct {
-	Jobs    []Job
-	Actions []interface{}
+	Jobs         []Job
+	Actions      []interface{}
+	Translations Translations // module's texts, see Context's T
 }
 
 // Service configuration
@@ -67,9 +66,39 @@ type Service struct {
 	// F.e. when using action with onReply triggered with context of replied message (user, chat, bot).
 	Actions []interface{}
 
+	// Middlewares wrap every Telegram update handling after the global ones added with Use
+	Middlewares []Middleware
+
+	// Commands are routed automatically and pushed to the Telegram's commands menu. /help is answered with the list of them
+	Commands []Command
+
+	// Multi-step dialogs. While conversation is active incoming messages are passed to the current state's Handler instead of TGNewMessageHandler
+	// Use context's StartConversation to begin
+	Conversations []Conversation
+
+	// Message templates in text/template syntax by name, see RenderTemplate and Context's NewTemplateMessage
+	// Can be overridden with the <name>.tmpl files within the INTEGRAM_TEMPLATES_DIR/<service name> dir
+	Templates map[string]string
+
+	// Texts by locale and key, see Context's T. Users can choose one of the locales with /language command
+	Translations Translations
+
 	// Handler to produce the user/chat search query based on the http request. Set queryChat to true to perform chat search
 	TokenHandler func(ctx *Context, request *WebhookContext) (queryChat bool, bsonQuery map[string]interface{}, err error)
 
+	// Verifier to check the webhooks signature with the hook's secret before the WebhookHandler. Requests that fail are rejected with 401
+	// Show the secret to the user along with the hook URL, see ServiceHookSecret
+	WebhookVerifier WebhookVerifier
+
+	// Secret for the WebhookVerifier to check the webhooks resolved with TokenHandler. Hooks created with ServiceHookURL have their own secrets
+	WebhookSecret string
+
+	// Func to get the webhook's delivery ID, e.g. GitHubDeliveryID. Retries with the same ID are acknowledged with 200 without calling the WebhookHandler, or answered with 503 while the first attempt is processing
+	WebhookDeliveryID WebhookDeliveryIDFunc
+
+	// Period to remember the delivery IDs. Default to DefaultWebhookDedupeWindow
+	WebhookDedupeWindow time.Duration
+
 	// Handler to receive webhooks from outside
 	WebhookHandler func(ctx *Context, request *WebhookContext) error
 
@@ -91,8 +120,12 @@ type Service struct {
 	// Handler to receive chosen inline results from Telegram
 	TGChosenInlineResultHandler func(ctx *Context) error
 
+	// Handler to receive answers on the non-anonymous polls sent by the bot
+	TGPollAnswerHandler func(ctx *Context) error
+
 	OAuthSuccessful func(ctx *Context) error
 	// Can be used for services with tiny load
+	// Telegram will POST updates to Config.BaseURL/tg/<bot_id>/<token_hash>
 	UseWebhookInsteadOfLongPolling bool
 
 	// Can be used to automatically clean up old messages metadata from database
@@ -104,7 +137,7 @@ type Service struct {
 }
 
 const (
-	// JobRetryLinear specify jobs retry politic as retry after fail
+	// JobRetryLinear specify jobs retry politic as delay after fail growing linearly: 1s, 2s, 3s...
 	JobRetryLinear = iota
 	// JobRetryFibonacci specify jobs retry politic as delay after fail using fibonacci sequence
 	JobRetryFibonacci
@@ -147,12 +180,12 @@ func servicesHealthChecker() {
 			servicesHealthChecker()
 		}
 	}()
-	s := mongoSession.Clone()
+	s := cloneStorage()
 	defer s.Close()
 
 	for true {
 
-		err := healthCheck(s.DB(mongo.Database))
+		err := healthCheck(s)
 
 		if err != nil {
 			log.Errorf("HealthChecker main, error: %s", err.Error())
@@ -189,19 +222,17 @@ func servicesHealthChecker() {
 	}
 }
 
-func healthCheck(db *mgo.Database) error {
+func healthCheck(db Storage) error {
 
-	err := db.Session.Ping()
+	err := db.Ping()
 	if err != nil {
 		return fmt.Errorf("DB fault: %s", err)
 
 	}
 
-	_, err = jobs.FindById("fake")
+	err = jobBackend.Ping()
 	if err != nil {
-		if _, isThisNotFoundError := err.(jobs.ErrorJobNotFound); !isThisNotFoundError {
-			return fmt.Errorf("Redis fault: %s", err)
-		}
+		return fmt.Errorf("Jobs backend fault: %s", err)
 	}
 
 	if int(time.Now().Sub(startedAt).Seconds()) < Config.HealthcheckIntervalInSecond {
@@ -213,7 +244,10 @@ func healthCheck(db *mgo.Database) error {
 
 func init() {
 
-	jobs.Config.Db.Address = Config.RedisURL
+	if jobBackend == nil {
+		jobBackend = defaultJobBackend()
+	}
+
 	if Config.IsMainInstance() {
 		err := loadStandAloneServicesFromFile()
 		if err != nil {
@@ -234,7 +268,7 @@ func init() {
 	}
 }
 
-func afterJob(job *jobs.Job) {
+func afterJob(job ScheduledJob) {
 	// remove successed tasks from Redis
 	err := job.Error()
 
@@ -250,15 +284,23 @@ func afterJob(job *jobs.Job) {
 	}
 }
 
-func beforeJob(ch chan bool, job *jobs.Job, args *[]reflect.Value) {
-	s := mongoSession.Clone()
+// afterJobInPool returns the afterJob that also counts the job results for the pool's metrics
+func afterJobInPool(poolKey string) func(ScheduledJob) {
+	return func(job ScheduledJob) {
+		observeJob(poolKey, job)
+		afterJob(job)
+	}
+}
+
+func beforeJob(ch chan bool, job ScheduledJob, args *[]reflect.Value) {
+	s := cloneStorage()
 
 	for i := 0; i < len(*args); i++ {
 
 		if (*args)[i].Kind() == reflect.Ptr && (*args)[i].Type().String() == "*integram.Context" {
 			ctx := (*args)[i].Interface().(*Context)
 
-			ctx.db = s.DB(mongo.Database)
+			ctx.SetStorage(s)
 			ctx.User.ctx = ctx
 			ctx.Chat.ctx = ctx
 
@@ -400,11 +442,18 @@ func (s *Service) trimFuncPath(fullPath string) string{
 	return fullPath
 }
 
+// reservedServiceNames are routed by the framework itself, see serviceHookHandler
+var reservedServiceNames = []string{"tg", "metrics", "stats", "a", "tz", "auth", "oauth1", "healthcheck"}
+
 // Register the service's config and corresponding botToken
 func Register(servicer Servicer, botToken string) {
 	//jobs.Config.Db.Address="192.168.1.101:6379"
-	db := mongoSession.Clone().DB(mongo.Database)
 	service := servicer.Service()
+	if SliceContainsString(reservedServiceNames, service.Name) {
+		panic(fmt.Sprintf("Service name '%s' is reserved for the framework's routes\n", service.Name))
+	}
+
+	db := cloneStorage()
 	err := migrations(db, service.Name)
 	if err != nil {
 		log.Fatalf("failed to apply migrations: %s", err.Error())
@@ -421,6 +470,22 @@ func Register(servicer Servicer, botToken string) {
 	} else if service.DefaultOAuth2 != nil {
 		service.DefaultBaseURL = *URLMustParse(service.DefaultOAuth2.Endpoint.AuthURL)
 	}
+	if service.TokenHandler != nil && service.WebhookVerifier != nil && service.WebhookSecret == "" {
+		panic(fmt.Sprintf("%s need the WebhookSecret to verify the webhooks resolved with TokenHandler\n", service.Name))
+	}
+
+	for _, cv := range service.Conversations {
+		if len(cv.States) == 0 {
+			panic(fmt.Sprintf("Conversation '%s' of %s need at least one state\n", cv.Name, service.Name))
+		}
+	}
+
+	for _, cmd := range service.Commands {
+		if !commandNameRE.MatchString(cmd.Name) || cmd.Handler == nil {
+			panic(fmt.Sprintf("Command '%s' of %s need a lowercase name up to 32 chars and the Handler\n", cmd.Name, service.Name))
+		}
+	}
+
 	service.DefaultBaseURL.Path = ""
 	service.DefaultBaseURL.RawPath = ""
 	service.DefaultBaseURL.RawQuery = ""
@@ -431,21 +496,17 @@ func Register(servicer Servicer, botToken string) {
 		if service.JobsPool == 0 {
 			service.JobsPool = 1
 		}
-		pool, err := jobs.NewPool(&jobs.PoolConfig{
-			Key:        "_" + service.Name,
-			NumWorkers: service.JobsPool,
-			BatchSize:  Config.TGPoolBatchSize,
-		})
+		pool, err := jobBackend.NewPool("_"+service.Name, service.JobsPool, Config.TGPoolBatchSize)
 		if err != nil {
 			log.Panicf("Can't create jobs pool: %v\n", err)
 		} else {
 			pool.SetMiddleware(beforeJob)
-			pool.SetAfterFunc(afterJob)
+			pool.SetAfterFunc(afterJobInPool("_" + service.Name))
 		}
 
 		//log.Infof("%s: workers pool [%d] is ready", service.Name, service.JobsPool)
 
-		jobsPerService[service.Name] = make(map[string]*jobs.Type)
+		jobsPerService[service.Name] = make(jobTypePerJobName)
 
 		if service.OAuthSuccessful != nil {
 			service.Jobs = append(service.Jobs, Job{
@@ -481,9 +542,9 @@ func Register(servicer Servicer, botToken string) {
 
 			jobName := service.getShortFuncPath(job.HandlerFunc)
 
-			jobType, err := jobs.RegisterTypeWithPoolKey(jobName, "_"+service.Name, job.Retries, job.HandlerFunc)
+			jobType, err := jobBackend.RegisterType(jobName, "_"+service.Name, job.Retries, job.RetryType, job.HandlerFunc)
 			if err != nil {
-				fmt.Errorf("RegisterTypeWithPoolKey '%s', for %s: %s", jobName, service.Name, err.Error() )
+				log.WithError(err).Errorf("RegisterType '%s' for %s failed", jobName, service.Name)
 			} else {
 				jobsPerService[service.Name][jobName] = jobType
 			}
@@ -495,7 +556,7 @@ func Register(servicer Servicer, botToken string) {
 
 		log.Debugf("RootPackagePath of %s is %s", service.Name, rootPackagePath)
 
-		go func(pool *jobs.Pool, service *Service) {
+		go func(pool JobPool, service *Service) {
 			time.Sleep(time.Second * 5)
 
 			err = pool.Start()
@@ -591,12 +652,12 @@ func (s *Service) DefaultOAuthProvider() *OAuthProvider {
 }
 
 // DoJob queues the job to run. The job must be registred in Service's config (Jobs field). Arguments must be identically types with hudlerFunc's input args
-func (s *Service) DoJob(handlerFunc interface{}, data ...interface{}) (*jobs.Job, error) {
+func (s *Service) DoJob(handlerFunc interface{}, data ...interface{}) (ScheduledJob, error) {
 	return s.SheduleJob(handlerFunc, 0, time.Now(), data...)
 }
 
 // SheduleJob schedules the job for specific time with specific priority. The job must be registred in Service's config (Jobs field). Arguments must be identically types with hudlerFunc's input args
-func (s *Service) SheduleJob(handlerFunc interface{}, priority int, time time.Time, data ...interface{}) (*jobs.Job, error) {
+func (s *Service) SheduleJob(handlerFunc interface{}, priority int, time time.Time, data ...interface{}) (ScheduledJob, error) {
 	if jobsPerName, ok := jobsPerService[s.Name]; ok {
 		if jobType, ok := jobsPerName[s.getShortFuncPath(handlerFunc)]; ok {
 			return jobType.Schedule(priority, time, data...)
@@ -608,9 +669,9 @@ func (s *Service) SheduleJob(handlerFunc interface{}, priority int, time time.Ti
 
 // EmptyContext returns context on behalf of service without user/chat relation
 func (s *Service) EmptyContext() *Context {
-	db := mongoSession.Clone().DB(mongo.Database)
+	db := cloneStorage()
 
-	ctx := &Context{db: db, ServiceName: s.Name}
+	ctx := &Context{storage: db, ServiceName: s.Name}
 	return ctx
 }
 
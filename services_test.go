@@ -98,6 +98,23 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+func TestRegister_ReservedName(t *testing.T) {
+	for _, name := range []string{"tg", "metrics", "stats"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register() with the %q name must panic", name)
+				}
+			}()
+			Register(serviceTestConfig{&Service{Name: name}}, "")
+		}()
+
+		if _, exists := services[name]; exists {
+			t.Errorf("Register() registered the service with the reserved %q name", name)
+		}
+	}
+}
+
 func registerServices() {
 
 	if len(services) == 0 {
@@ -274,3 +291,13 @@ func TestService_DoJob(t *testing.T) {
 	}
 
 }
+
+func TestRegister_ConversationWithoutStates(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() with the conversation without states must panic")
+		}
+		delete(services, "servicewithemptyconversation")
+	}()
+	Register(serviceTestConfig{&Service{Name: "servicewithemptyconversation", Conversations: []Conversation{{Name: "empty"}}}}, "")
+}
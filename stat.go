@@ -20,11 +20,16 @@ const (
 	StatWebhookHandled               StatKey = "wh_handled"
 	StatWebhookProducedMessageToChat StatKey = "wh_message"
 	StatWebhookProcessingError       StatKey = "wh_error"
+	StatWebhookUnauthorized          StatKey = "wh_unauthorized"
+	StatWebhookDuplicate             StatKey = "wh_duplicate"
 
 	StatIncomingMessageAnswered    StatKey = "im_replied"
 	StatIncomingMessageNotAnswered StatKey = "im_not_replied"
 
 	StatOAuthSuccess StatKey = "oauth_success"
+
+	StatFileCacheHit  StatKey = "file_cache_hit"  // file sent with the file_id cached for its content
+	StatFileCacheMiss StatKey = "file_cache_miss" // file uploaded
 )
 
 type stat struct {
@@ -50,6 +55,7 @@ type uniqueStat struct {
 }
 
 func (c *Context) StatIncBy(key StatKey, uniqueID int64, inc int) error {
+	metricStats.add(float64(inc), c.ServiceName, string(key))
 
 	if !Config.MongoStatistic {
 		return nil
@@ -77,7 +83,7 @@ func (c *Context) StatIncBy(key StatKey, uniqueID int64, inc int) error {
 	if uniqueID != 0 {
 		// check the ID uniqueness for the current day
 
-		ci, err := c.Db().C("stats_unique").Upsert(
+		ci, err := c.Storage().C("stats_unique").Upsert(
 			bson.M{"s": c.ServiceName, "k": key, "d": unixDay, "p": -1, "u": bson.M{"$ne": uniqueID}},
 			bson.M{
 				"$push": bson.M{
@@ -93,7 +99,7 @@ func (c *Context) StatIncBy(key StatKey, uniqueID int64, inc int) error {
 		}
 
 		// check the ID uniqueness for the current 5min period
-		ci, err = c.Db().C("stats_unique").Upsert(
+		ci, err = c.Storage().C("stats_unique").Upsert(
 			bson.M{"s": c.ServiceName, "k": key, "d": unixDay, "p": periodN, "u": bson.M{"$ne": uniqueID}},
 			bson.M{
 				"$push": bson.M{
@@ -109,7 +115,7 @@ func (c *Context) StatIncBy(key StatKey, uniqueID int64, inc int) error {
 		}
 	}
 
-	_, err := c.Db().C("stats").Upsert(bson.M{"s": c.ServiceName, "k": key, "d": unixDay}, bson.M{
+	_, err := c.Storage().C("stats").Upsert(bson.M{"s": c.ServiceName, "k": key, "d": unixDay}, bson.M{
 		"$inc":         updateInc,
 		"$setOnInsert": bson.M{"s": c.ServiceName, "d": unixDay, "k": key},
 	})
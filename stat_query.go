@@ -0,0 +1,281 @@
+package integram
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const statPeriod = 5 * time.Minute
+const statDay = 24 * time.Hour
+
+// maxStatPoints limits the size of time series returned by the Stats
+const maxStatPoints = 10000
+
+var (
+	// ErrStatGranularity returned when granularity is not a multiple of 5 minutes
+	ErrStatGranularity = errors.New("stats granularity must be a multiple of 5 minutes")
+
+	// ErrStatPeriod returned when period is empty or too long for the granularity
+	ErrStatPeriod = fmt.Errorf("stats period must be positive and contain at most %d points", maxStatPoints)
+)
+
+// StatsReportKeys are included in the daily and weekly summaries
+var StatsReportKeys = []StatKey{
+	StatIncomingMessageAnswered,
+	StatIncomingMessageNotAnswered,
+	StatInlineQueryAnswered,
+	StatInlineQueryTimeouted,
+	StatOAuthSuccess,
+	StatWebhookHandled,
+	StatWebhookProcessingError,
+	StatFileCacheHit,
+	StatFileCacheMiss,
+}
+
+var statTitles = map[StatKey]string{
+	StatIncomingMessageAnswered:    "Messages answered",
+	StatIncomingMessageNotAnswered: "Messages not answered",
+	StatInlineQueryAnswered:        "Inline queries answered",
+	StatInlineQueryTimeouted:       "Inline queries timed out",
+	StatOAuthSuccess:               "OAuth successes",
+	StatWebhookHandled:             "Webhooks handled",
+	StatWebhookProcessingError:     "Webhook errors",
+	StatFileCacheHit:               "Files sent from cache",
+	StatFileCacheMiss:              "Files uploaded",
+}
+
+// StatPoint is the counter's value within the period started at Time
+type StatPoint struct {
+	Time   time.Time `json:"time"`
+	Count  uint32    `json:"count"`
+	Unique uint32    `json:"unique"` // number of unique users/chats. For periods longer than the 5 minutes or the day it is the sum of the unique values of these shorter periods
+}
+
+// Stats returns the time series of the counter. Granularity must be a multiple of 5 minutes. Unique counts are precise for 5 minutes and 1 day granularity.
+// Stats are collected only when INTEGRAM_MONGO_STATISTIC is enabled
+func (s *Service) Stats(key StatKey, from, to time.Time, granularity time.Duration) ([]StatPoint, error) {
+	db := cloneStorage()
+	defer db.Close()
+
+	return statsSeries(db, s.Name, key, from, to, granularity)
+}
+
+// StatsSummary returns total counters for the StatsReportKeys within the days between from and to
+func (s *Service) StatsSummary(from, to time.Time) (map[StatKey]StatPoint, error) {
+	db := cloneStorage()
+	defer db.Close()
+
+	return statsSummary(db, s.Name, from, to)
+}
+
+func statsSeries(db Storage, service string, key StatKey, from, to time.Time, granularity time.Duration) ([]StatPoint, error) {
+	if granularity < statPeriod || granularity%statPeriod != 0 {
+		return nil, ErrStatGranularity
+	}
+
+	start := from.UTC().Truncate(granularity)
+	if to.Before(start) || to.Sub(start)/granularity >= maxStatPoints {
+		return nil, ErrStatPeriod
+	}
+
+	points := make([]StatPoint, int(to.Sub(start)/granularity)+1)
+	for i := range points {
+		points[i].Time = start.Add(time.Duration(i) * granularity)
+	}
+
+	var stats []stat
+	err := db.C("stats").Find(bson.M{"s": service, "k": key, "d": bson.M{"$gte": statDayN(start), "$lte": statDayN(to)}}).All(&stats)
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(t time.Time, count, unique uint32) {
+		if t.Before(start) || t.After(to) {
+			return
+		}
+		i := int(t.Sub(start) / granularity)
+		points[i].Count += count
+		points[i].Unique += unique
+	}
+
+	for _, st := range stats {
+		dayStart := time.Unix(int64(st.DayN)*int64(statDay/time.Second), 0).UTC()
+
+		if granularity%statDay == 0 {
+			add(dayStart, st.Counter, st.UniqueCounter)
+			continue
+		}
+
+		for periodN, count := range st.Series5m {
+			n, err := strconv.Atoi(periodN)
+			if err != nil {
+				continue
+			}
+			add(dayStart.Add(time.Duration(n)*statPeriod), count, st.UniqueSeries5m[periodN])
+		}
+	}
+
+	return points, nil
+}
+
+func statsSummary(db Storage, service string, from, to time.Time) (map[StatKey]StatPoint, error) {
+	summary := make(map[StatKey]StatPoint)
+	for _, key := range StatsReportKeys {
+		points, err := statsSeries(db, service, key, from, to, statDay)
+		if err != nil {
+			return nil, err
+		}
+
+		total := StatPoint{Time: from}
+		for _, p := range points {
+			total.Count += p.Count
+			total.Unique += p.Unique
+		}
+		summary[key] = total
+	}
+	return summary, nil
+}
+
+// statDayN returns the number of the day since the Unix epoch as it's stored within the stats
+func statDayN(t time.Time) uint16 {
+	return uint16(t.Unix() / int64(statDay/time.Second))
+}
+
+// statsReportText returns the summary of all services for the days between from and to
+func statsReportText(db Storage, from, to time.Time) (string, error) {
+	var names []string
+	serviceMapMutex.RLock()
+	for name := range services {
+		names = append(names, name)
+	}
+	serviceMapMutex.RUnlock()
+	sort.Strings(names)
+
+	text := fmt.Sprintf("<b>Stats for %s – %s (UTC)</b>\n", from.Format("02 Jan"), to.Format("02 Jan"))
+	for _, name := range names {
+		summary, err := statsSummary(db, name, from, to)
+		if err != nil {
+			return "", err
+		}
+
+		text += "\n<b>" + html.EscapeString(name) + "</b>\n"
+		for _, key := range StatsReportKeys {
+			text += fmt.Sprintf("%s: %d\n", statTitles[key], summary[key].Count)
+		}
+	}
+
+	if !Config.MongoStatistic {
+		text += "\n<i>INTEGRAM_MONGO_STATISTIC is disabled on this instance</i>"
+	}
+	return text, nil
+}
+
+// statsCommandHandler prints the summary for today or for the last 7 days with "/admin stats week"
+func statsCommandHandler(c *Context, args string) error {
+	to := time.Now().UTC()
+	from := to.Truncate(statDay)
+
+	if strings.TrimSpace(args) == "week" {
+		from = from.AddDate(0, 0, -6)
+	}
+
+	text, err := statsReportText(c.Storage(), from, to)
+	if err != nil {
+		return err
+	}
+
+	return c.NewMessage().SetText(text).EnableHTML().Send()
+}
+
+// parseStatsTime accepts RFC3339, "2006-01-02" or the Unix time in seconds
+func parseStatsTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// statsHandler returns the service's stats as JSON. Requires "Authorization: Bearer <INTEGRAM_ADMIN_TOKEN>"
+//
+// /stats/service_name?key=im_replied&from=2006-01-02&to=2006-01-03&granularity=1h – time series of the counter
+// /stats/service_name?from=2006-01-02 – summary of the StatsReportKeys
+func statsHandler(c *gin.Context, serviceName string) {
+	if !adminTokenValid(c) {
+		c.String(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	s, _ := serviceByName(serviceName)
+	if s == nil {
+		c.String(http.StatusNotFound, "Service not found")
+		return
+	}
+
+	now := time.Now().UTC()
+	to, err := parseStatsTime(c.Query("to"), now)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Wrong to: %s", err.Error())
+		return
+	}
+
+	from, err := parseStatsTime(c.Query("from"), to.Add(-statDay))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Wrong from: %s", err.Error())
+		return
+	}
+
+	db := c.MustGet("storage").(Storage)
+
+	key := c.Query("key")
+	if key == "" {
+		summary, err := statsSummary(db, s.Name, from, to)
+		if err == ErrStatPeriod {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"service": s.Name, "from": from, "to": to, "summary": summary})
+		return
+	}
+
+	granularity := time.Hour
+	if g := c.Query("granularity"); g != "" {
+		granularity, err = time.ParseDuration(g)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Wrong granularity: %s", err.Error())
+			return
+		}
+	}
+
+	points, err := statsSeries(db, s.Name, StatKey(key), from, to, granularity)
+	if err == ErrStatGranularity || err == ErrStatPeriod {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"service": s.Name, "key": key, "granularity": granularity.String(), "points": points})
+}
@@ -0,0 +1,59 @@
+package integram
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsSeries(t *testing.T) {
+	defer func(enabled bool) { Config.MongoStatistic = enabled }(Config.MongoStatistic)
+	Config.MongoStatistic = true
+
+	db := NewMemoryStorage()
+	ensureIndexes(db)
+
+	ctx := &Context{ServiceName: "servicewithstats"}
+	ctx.SetStorage(db)
+
+	for _, userID := range []int64{1, 2, 1} {
+		ctx.User.ID = userID
+		ctx.StatIncUser(StatIncomingMessageAnswered)
+	}
+
+	now := time.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+	period := now.Truncate(5 * time.Minute)
+
+	tests := []struct {
+		name        string
+		from        time.Time
+		granularity time.Duration
+		want        []StatPoint
+		wantErr     error
+	}{
+		{"5m", period, 5 * time.Minute, []StatPoint{{period, 3, 2}}, nil},
+		{"1h", now.Truncate(time.Hour), time.Hour, []StatPoint{{now.Truncate(time.Hour), 3, 2}}, nil},
+		{"day", day.Add(-24 * time.Hour), 24 * time.Hour, []StatPoint{{day.Add(-24 * time.Hour), 0, 0}, {day, 3, 2}}, nil},
+		{"wrong granularity", day, time.Minute, nil, ErrStatGranularity},
+		{"too many points", day.AddDate(-1, 0, 0), 5 * time.Minute, nil, ErrStatPeriod},
+	}
+	for _, tt := range tests {
+		got, err := statsSeries(db, ctx.ServiceName, StatIncomingMessageAnswered, tt.from, now, tt.granularity)
+		if err != tt.wantErr {
+			t.Errorf("%q. statsSeries() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q. statsSeries() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	summary, err := statsSummary(db, ctx.ServiceName, day, now)
+	if err != nil {
+		t.Fatalf("statsSummary() error = %v", err)
+	}
+	if summary[StatIncomingMessageAnswered].Count != 3 || summary[StatOAuthSuccess].Count != 0 {
+		t.Errorf("statsSummary() = %v, want 3 answered messages", summary)
+	}
+}
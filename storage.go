@@ -0,0 +1,134 @@
+package integram
+
+import (
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	StorageMongo  = "mongo"  // MongoDB storage, default one
+	StorageMemory = "memory" // in-memory storage, useful for tests and small deployments. All the data will be lost on restart
+)
+
+// Storage is used to persist users, chats, hooks, settings, caches, messages, previews and stats.
+// Collections and queries follow the MongoDB semantic, so the same bson queries work with every backend
+type Storage interface {
+	// C returns the collection with specific name, e.g. "users", "chats", "messages"
+	C(name string) Collection
+
+	// Ping checks if storage is available
+	Ping() error
+
+	// Clone returns the Storage with a separate connection. Need to be closed after use
+	Clone() Storage
+
+	// Close releases the Storage's connection
+	Close()
+}
+
+// Collection represents the set of documents within the Storage
+type Collection interface {
+	Find(query interface{}) Query
+	FindId(id interface{}) Query
+
+	Insert(docs ...interface{}) error
+
+	Update(selector interface{}, update interface{}) error
+	UpdateId(id interface{}, update interface{}) error
+	UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error)
+
+	Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error)
+	UpsertId(id interface{}, update interface{}) (info *mgo.ChangeInfo, err error)
+
+	Remove(selector interface{}) error
+	RemoveId(id interface{}) error
+	RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error)
+
+	EnsureIndex(index mgo.Index) error
+	DropIndex(key ...string) error
+}
+
+// Query is used to fetch or modify the documents found within the Collection
+type Query interface {
+	Select(selector interface{}) Query
+	Sort(fields ...string) Query
+	Limit(n int) Query
+	Skip(n int) Query
+
+	One(result interface{}) error
+	All(result interface{}) error
+	Count() (n int, err error)
+	Apply(change mgo.Change, result interface{}) (info *mgo.ChangeInfo, err error)
+}
+
+// memoryStorageInstance is used when Config.Storage set to StorageMemory
+var memoryStorageInstance Storage
+
+// NewMongoStorage returns the Storage for MongoDB database
+func NewMongoStorage(db *mgo.Database) Storage {
+	return &mongoStorage{db: db}
+}
+
+// cloneStorage returns the Storage with a separate connection according to Config.Storage
+func cloneStorage() Storage {
+	if memoryStorageInstance != nil {
+		return memoryStorageInstance
+	}
+
+	return &mongoStorage{db: mongoSession.Clone().DB(mongo.Database)}
+}
+
+type mongoStorage struct {
+	db *mgo.Database
+}
+
+func (s *mongoStorage) C(name string) Collection {
+	return &mongoCollection{s.db.C(name)}
+}
+
+func (s *mongoStorage) Ping() error {
+	return s.db.Session.Ping()
+}
+
+func (s *mongoStorage) Clone() Storage {
+	return &mongoStorage{db: s.db.With(s.db.Session.Clone())}
+}
+
+func (s *mongoStorage) Close() {
+	s.db.Session.Close()
+}
+
+type mongoCollection struct {
+	*mgo.Collection
+}
+
+func (c *mongoCollection) Find(query interface{}) Query {
+	return &mongoQuery{c.Collection.Find(query)}
+}
+
+func (c *mongoCollection) FindId(id interface{}) Query {
+	return &mongoQuery{c.Collection.FindId(id)}
+}
+
+type mongoQuery struct {
+	*mgo.Query
+}
+
+func (q *mongoQuery) Select(selector interface{}) Query {
+	q.Query.Select(selector)
+	return q
+}
+
+func (q *mongoQuery) Sort(fields ...string) Query {
+	q.Query.Sort(fields...)
+	return q
+}
+
+func (q *mongoQuery) Limit(n int) Query {
+	q.Query.Limit(n)
+	return q
+}
+
+func (q *mongoQuery) Skip(n int) Query {
+	q.Query.Skip(n)
+	return q
+}
@@ -0,0 +1,1519 @@
+package integram
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NewMemoryStorage returns the Storage that keeps all the data in memory.
+// It supports the subset of MongoDB queries, updates and projections used by Integram and the services
+func NewMemoryStorage() Storage {
+	return &memoryStorage{collections: make(map[string]*memoryCollection)}
+}
+
+type memoryStorage struct {
+	mu          sync.Mutex
+	collections map[string]*memoryCollection
+}
+
+func (s *memoryStorage) C(name string) Collection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, exists := s.collections[name]
+	if !exists {
+		c = &memoryCollection{name: name}
+		s.collections[name] = c
+	}
+
+	return c
+}
+
+func (s *memoryStorage) Ping() error {
+	return nil
+}
+
+func (s *memoryStorage) Clone() Storage {
+	return s
+}
+
+func (s *memoryStorage) Close() {
+}
+
+type memoryCollection struct {
+	name    string
+	mu      sync.Mutex
+	docs    []bson.M
+	indexes []mgo.Index
+}
+
+func (c *memoryCollection) Find(query interface{}) Query {
+	return &memoryQuery{c: c, query: query}
+}
+
+func (c *memoryCollection) FindId(id interface{}) Query {
+	return c.Find(bson.M{"_id": id})
+}
+
+func (c *memoryCollection) Insert(docs ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+
+	for _, d := range docs {
+		doc, err := toDoc(d)
+		if err != nil {
+			return err
+		}
+
+		if isEmptyID(doc["_id"]) {
+			doc["_id"] = bson.NewObjectId()
+		}
+
+		err = c.checkUnique(doc, -1)
+		if err != nil {
+			return err
+		}
+
+		c.docs = append(c.docs, doc)
+	}
+
+	return nil
+}
+
+func (c *memoryCollection) Update(selector interface{}, update interface{}) error {
+	q, u, err := toQueryAndUpdate(selector, update)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+
+	for i, doc := range c.docs {
+		if matchDoc(doc, q) {
+			return c.updateAt(i, u, q)
+		}
+	}
+
+	return mgo.ErrNotFound
+}
+
+func (c *memoryCollection) UpdateId(id interface{}, update interface{}) error {
+	return c.Update(bson.M{"_id": id}, update)
+}
+
+func (c *memoryCollection) UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	q, u, err := toQueryAndUpdate(selector, update)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+
+	info := &mgo.ChangeInfo{}
+	for i, doc := range c.docs {
+		if !matchDoc(doc, q) {
+			continue
+		}
+
+		err = c.updateAt(i, u, q)
+		if err != nil {
+			return info, err
+		}
+		info.Matched++
+		info.Updated++
+	}
+
+	return info, nil
+}
+
+func (c *memoryCollection) Upsert(selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	q, u, err := toQueryAndUpdate(selector, update)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+
+	for i, doc := range c.docs {
+		if matchDoc(doc, q) {
+			err = c.updateAt(i, u, q)
+			if err != nil {
+				return nil, err
+			}
+			return &mgo.ChangeInfo{Matched: 1, Updated: 1}, nil
+		}
+	}
+
+	doc, err := c.insertFromQuery(q, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mgo.ChangeInfo{UpsertedId: doc["_id"]}, nil
+}
+
+func (c *memoryCollection) UpsertId(id interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	return c.Upsert(bson.M{"_id": id}, update)
+}
+
+func (c *memoryCollection) Remove(selector interface{}) error {
+	q, err := toDoc(selector)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+
+	for i, doc := range c.docs {
+		if matchDoc(doc, q) {
+			c.docs = append(c.docs[:i], c.docs[i+1:]...)
+			return nil
+		}
+	}
+
+	return mgo.ErrNotFound
+}
+
+func (c *memoryCollection) RemoveId(id interface{}) error {
+	return c.Remove(bson.M{"_id": id})
+}
+
+func (c *memoryCollection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	q, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired()
+
+	info := &mgo.ChangeInfo{}
+	docs := c.docs[:0]
+	for _, doc := range c.docs {
+		if matchDoc(doc, q) {
+			info.Matched++
+			info.Removed++
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	c.docs = docs
+
+	return info, nil
+}
+
+func (c *memoryCollection) EnsureIndex(index mgo.Index) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, existing := range c.indexes {
+		if reflect.DeepEqual(indexFields(existing.Key), indexFields(index.Key)) {
+			c.indexes[i] = index
+			return nil
+		}
+	}
+
+	c.indexes = append(c.indexes, index)
+
+	return nil
+}
+
+func (c *memoryCollection) DropIndex(key ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, existing := range c.indexes {
+		if reflect.DeepEqual(indexFields(existing.Key), indexFields(key)) {
+			c.indexes = append(c.indexes[:i], c.indexes[i+1:]...)
+			return nil
+		}
+	}
+
+	return storageError("index not found")
+}
+
+// updateAt applies the update to the copy of the document, so it stays untouched in case of error
+func (c *memoryCollection) updateAt(i int, update bson.M, query bson.M) error {
+	doc, err := toDoc(c.docs[i])
+	if err != nil {
+		return err
+	}
+
+	err = applyUpdate(doc, update, query, false)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkUnique(doc, i)
+	if err != nil {
+		return err
+	}
+
+	c.docs[i] = doc
+
+	return nil
+}
+
+// insertFromQuery creates the new document for upsert using the query's equality conditions
+func (c *memoryCollection) insertFromQuery(query bson.M, update bson.M) (bson.M, error) {
+	doc := bson.M{}
+	for key, cond := range query {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+
+		if _, isOperator := operatorDoc(cond); isOperator {
+			continue
+		}
+
+		_, err := setValue(doc, strings.Split(key, "."), cond)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := applyUpdate(doc, update, query, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if isEmptyID(doc["_id"]) {
+		doc["_id"] = bson.NewObjectId()
+	}
+
+	err = c.checkUnique(doc, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	c.docs = append(c.docs, doc)
+
+	return doc, nil
+}
+
+// checkUnique returns mgo compatible duplicate error in case the document violates _id or unique indexes
+func (c *memoryCollection) checkUnique(doc bson.M, skip int) error {
+	for i, existing := range c.docs {
+		if i == skip {
+			continue
+		}
+
+		if valuesEqual(existing["_id"], doc["_id"]) {
+			return duplicateError(c.name, "_id")
+		}
+
+		for _, index := range c.indexes {
+			if !index.Unique {
+				continue
+			}
+
+			if indexKeysIntersect(index, existing, doc) {
+				return duplicateError(c.name, strings.Join(index.Key, "_"))
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeExpired removes the documents expired according to the TTL indexes
+func (c *memoryCollection) removeExpired() {
+	now := time.Now()
+
+	for _, index := range c.indexes {
+		if index.ExpireAfter == 0 || len(index.Key) != 1 {
+			continue
+		}
+
+		parts := strings.Split(indexFields(index.Key)[0], ".")
+		docs := c.docs[:0]
+		for _, doc := range c.docs {
+			if t, ok := getValue(doc, parts).(time.Time); ok && now.After(t.Add(index.ExpireAfter)) {
+				continue
+			}
+			docs = append(docs, doc)
+		}
+		c.docs = docs
+	}
+}
+
+type memoryQuery struct {
+	c        *memoryCollection
+	query    interface{}
+	selector interface{}
+	sort     []string
+	limit    int
+	skip     int
+}
+
+func (q *memoryQuery) Select(selector interface{}) Query {
+	q.selector = selector
+	return q
+}
+
+func (q *memoryQuery) Sort(fields ...string) Query {
+	q.sort = fields
+	return q
+}
+
+func (q *memoryQuery) Limit(n int) Query {
+	q.limit = n
+	return q
+}
+
+func (q *memoryQuery) Skip(n int) Query {
+	q.skip = n
+	return q
+}
+
+func (q *memoryQuery) One(result interface{}) error {
+	q.c.mu.Lock()
+	defer q.c.mu.Unlock()
+
+	found, query, err := q.find()
+	if err != nil {
+		return err
+	}
+
+	if len(found) == 0 {
+		return mgo.ErrNotFound
+	}
+
+	return q.bind(q.c.docs[found[0]], query, result)
+}
+
+func (q *memoryQuery) All(result interface{}) error {
+	q.c.mu.Lock()
+	defer q.c.mu.Unlock()
+
+	found, query, err := q.find()
+	if err != nil {
+		return err
+	}
+
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return storageError("result argument must be a slice address")
+	}
+
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), 0, len(found))
+	elemt := slicev.Type().Elem()
+
+	for _, i := range found {
+		elemp := reflect.New(elemt)
+		err = q.bind(q.c.docs[i], query, elemp.Interface())
+		if err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+
+	resultv.Elem().Set(slicev)
+
+	return nil
+}
+
+func (q *memoryQuery) Count() (int, error) {
+	q.c.mu.Lock()
+	defer q.c.mu.Unlock()
+
+	found, _, err := q.find()
+
+	return len(found), err
+}
+
+func (q *memoryQuery) Apply(change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	var update bson.M
+	var err error
+
+	if change.Update != nil {
+		update, err = toDoc(change.Update)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.c.mu.Lock()
+	defer q.c.mu.Unlock()
+
+	q.limit = 1
+	found, query, err := q.find()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		if !change.Upsert || change.Remove || update == nil {
+			return nil, mgo.ErrNotFound
+		}
+
+		doc, err := q.c.insertFromQuery(query, update)
+		if err != nil {
+			return nil, err
+		}
+
+		if change.ReturnNew {
+			err = q.bind(doc, query, result)
+		}
+
+		return &mgo.ChangeInfo{UpsertedId: doc["_id"]}, err
+	}
+
+	i := found[0]
+	old := q.c.docs[i]
+
+	if change.Remove {
+		q.c.docs = append(q.c.docs[:i], q.c.docs[i+1:]...)
+		return &mgo.ChangeInfo{Matched: 1, Removed: 1}, q.bind(old, query, result)
+	}
+
+	if update != nil {
+		err = q.c.updateAt(i, update, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if change.ReturnNew {
+		return &mgo.ChangeInfo{Matched: 1, Updated: 1}, q.bind(q.c.docs[i], query, result)
+	}
+
+	return &mgo.ChangeInfo{Matched: 1, Updated: 1}, q.bind(old, query, result)
+}
+
+// find returns the positions of matched documents. Collection must be locked
+func (q *memoryQuery) find() ([]int, bson.M, error) {
+	query, err := toDoc(q.query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q.c.removeExpired()
+
+	var found []int
+	for i, doc := range q.c.docs {
+		if matchDoc(doc, query) {
+			found = append(found, i)
+		}
+	}
+
+	if len(q.sort) > 0 {
+		sort.SliceStable(found, func(a, b int) bool {
+			for _, field := range q.sort {
+				desc := strings.HasPrefix(field, "-")
+				parts := strings.Split(strings.TrimLeft(field, "+-"), ".")
+
+				r := compareValues(firstValue(q.c.docs[found[a]], parts), firstValue(q.c.docs[found[b]], parts))
+				if r == 0 {
+					continue
+				}
+
+				if desc {
+					return r > 0
+				}
+				return r < 0
+			}
+			return false
+		})
+	}
+
+	if q.skip > 0 {
+		if q.skip >= len(found) {
+			found = nil
+		} else {
+			found = found[q.skip:]
+		}
+	}
+
+	if q.limit > 0 && len(found) > q.limit {
+		found = found[:q.limit]
+	}
+
+	return found, query, nil
+}
+
+func (q *memoryQuery) bind(doc bson.M, query bson.M, result interface{}) error {
+	if result == nil {
+		return nil
+	}
+
+	selector, err := toDoc(q.selector)
+	if err != nil {
+		return err
+	}
+
+	doc, err = projectDoc(doc, selector)
+	if err != nil {
+		return err
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(data, result)
+}
+
+type storageError string
+
+func (e storageError) Error() string {
+	return "memory storage: " + string(e)
+}
+
+func duplicateError(collection string, index string) error {
+	return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s", collection, index)}
+}
+
+// toDoc converts struct or map to bson.M the same way it would be stored by MongoDB
+func toDoc(in interface{}) (bson.M, error) {
+	doc := bson.M{}
+	if in == nil {
+		return doc, nil
+	}
+
+	data, err := bson.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bson.Unmarshal(data, &doc)
+
+	return doc, err
+}
+
+func toQueryAndUpdate(selector interface{}, update interface{}) (bson.M, bson.M, error) {
+	q, err := toDoc(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := toDoc(update)
+
+	return q, u, err
+}
+
+func isEmptyID(id interface{}) bool {
+	if id == nil {
+		return true
+	}
+
+	if oid, ok := id.(bson.ObjectId); ok && oid == "" {
+		return true
+	}
+
+	return false
+}
+
+func indexFields(key []string) []string {
+	fields := make([]string, len(key))
+	for i, k := range key {
+		fields[i] = strings.TrimLeft(k, "+-")
+	}
+	return fields
+}
+
+// indexKeysIntersect checks if 2 documents have the same values for all the index's fields. Arrays checked for any common element
+func indexKeysIntersect(index mgo.Index, a bson.M, b bson.M) bool {
+	aExists := false
+	bExists := false
+
+	for _, field := range indexFields(index.Key) {
+		parts := strings.Split(field, ".")
+		av := expandValues(lookupValues(a, parts))
+		bv := expandValues(lookupValues(b, parts))
+
+		if len(av) > 0 {
+			aExists = true
+		} else {
+			av = []interface{}{nil}
+		}
+
+		if len(bv) > 0 {
+			bExists = true
+		} else {
+			bv = []interface{}{nil}
+		}
+
+		intersect := false
+		for _, v := range av {
+			if matchEq(bv, v) {
+				intersect = true
+				break
+			}
+		}
+
+		if !intersect {
+			return false
+		}
+	}
+
+	if index.Sparse && (!aExists || !bExists) {
+		return false
+	}
+
+	return true
+}
+
+// operatorDoc returns the document if all of its keys are operators, e.g. {"$in": [1, 2]}
+func operatorDoc(v interface{}) (bson.M, bool) {
+	m, ok := v.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+
+	return m, true
+}
+
+// lookupValues returns all the values found by the path, descending into arrays like MongoDB does
+func lookupValues(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+
+	switch t := v.(type) {
+	case bson.M:
+		next, exists := t[parts[0]]
+		if !exists {
+			return nil
+		}
+		return lookupValues(next, parts[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i >= 0 && i < len(t) {
+				return lookupValues(t[i], parts[1:])
+			}
+			return nil
+		}
+
+		var values []interface{}
+		for _, el := range t {
+			if _, isDoc := el.(bson.M); isDoc {
+				values = append(values, lookupValues(el, parts)...)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+func firstValue(doc bson.M, parts []string) interface{} {
+	values := lookupValues(doc, parts)
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// expandValues adds arrays' elements to the values, so condition can match both the array itself or any of its elements
+func expandValues(values []interface{}) []interface{} {
+	var expanded []interface{}
+	for _, v := range values {
+		expanded = append(expanded, v)
+		if arr, ok := v.([]interface{}); ok {
+			expanded = append(expanded, arr...)
+		}
+	}
+	return expanded
+}
+
+func toList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case nil:
+		return false
+	}
+
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+func matchDoc(doc bson.M, query bson.M) bool {
+	for key, cond := range query {
+		switch key {
+		case "$or":
+			matched := false
+			for _, sub := range toList(cond) {
+				if subQuery, ok := sub.(bson.M); ok && matchDoc(doc, subQuery) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$and":
+			for _, sub := range toList(cond) {
+				if subQuery, ok := sub.(bson.M); !ok || !matchDoc(doc, subQuery) {
+					return false
+				}
+			}
+		case "$nor":
+			for _, sub := range toList(cond) {
+				if subQuery, ok := sub.(bson.M); ok && matchDoc(doc, subQuery) {
+					return false
+				}
+			}
+		default:
+			if !matchField(lookupValues(doc, strings.Split(key, ".")), cond) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func matchField(values []interface{}, cond interface{}) bool {
+	ops, isOperator := operatorDoc(cond)
+	if !isOperator {
+		return matchEq(values, cond)
+	}
+
+	for op, arg := range ops {
+		switch op {
+		case "$eq":
+			if !matchEq(values, arg) {
+				return false
+			}
+		case "$ne":
+			if matchEq(values, arg) {
+				return false
+			}
+		case "$in", "$nin":
+			matched := false
+			for _, el := range toList(arg) {
+				if matchEq(values, el) {
+					matched = true
+					break
+				}
+			}
+			if matched != (op == "$in") {
+				return false
+			}
+		case "$all":
+			for _, el := range toList(arg) {
+				if !matchEq(values, el) {
+					return false
+				}
+			}
+		case "$exists":
+			if (len(values) > 0) != truthy(arg) {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !matchCompare(values, op, arg) {
+				return false
+			}
+		case "$size":
+			matched := false
+			for _, v := range values {
+				if arr, ok := v.([]interface{}); ok && valuesEqual(len(arr), arg) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$elemMatch":
+			sub, _ := arg.(bson.M)
+			matched := false
+			for _, v := range values {
+				if arr, ok := v.([]interface{}); ok {
+					for _, el := range arr {
+						if matchElem(el, sub) {
+							matched = true
+							break
+						}
+					}
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$regex":
+			if !matchRegex(values, arg, ops["$options"]) {
+				return false
+			}
+		case "$options":
+			// used with $regex
+		case "$not":
+			if matchField(values, arg) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchElem(el interface{}, cond bson.M) bool {
+	if _, isOperator := operatorDoc(cond); isOperator {
+		return matchField([]interface{}{el}, cond)
+	}
+
+	doc, ok := el.(bson.M)
+	if !ok {
+		return false
+	}
+
+	return matchDoc(doc, cond)
+}
+
+func matchEq(values []interface{}, expected interface{}) bool {
+	if expected == nil && len(values) == 0 {
+		return true
+	}
+
+	if re, ok := expected.(bson.RegEx); ok {
+		return matchRegex(values, re, nil)
+	}
+
+	for _, v := range expandValues(values) {
+		if valuesEqual(v, expected) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchCompare(values []interface{}, op string, arg interface{}) bool {
+	for _, v := range expandValues(values) {
+		if typeRank(v) != typeRank(arg) {
+			continue
+		}
+
+		r := compareValues(v, arg)
+		switch {
+		case op == "$gt" && r > 0, op == "$gte" && r >= 0, op == "$lt" && r < 0, op == "$lte" && r <= 0:
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchRegex(values []interface{}, pattern interface{}, options interface{}) bool {
+	var expr string
+
+	switch t := pattern.(type) {
+	case bson.RegEx:
+		expr = t.Pattern
+		if options == nil {
+			options = t.Options
+		}
+	case string:
+		expr = t
+	default:
+		return false
+	}
+
+	if opts, ok := options.(string); ok && strings.Contains(opts, "i") {
+		expr = "(?i)" + expr
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return false
+	}
+
+	for _, v := range expandValues(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	}
+	return 0, false
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			return ai == bi
+		}
+	}
+
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+
+	switch av := a.(type) {
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Equal(bv)
+	case []byte:
+		bv, ok := b.([]byte)
+		return ok && bytes.Equal(av, bv)
+	case bson.M:
+		bv, ok := b.(bson.M)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if other, exists := bv[k]; !exists || !valuesEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !valuesEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// typeRank follows the MongoDB comparison order for the different BSON types
+func typeRank(v interface{}) int {
+	if _, ok := toFloat(v); ok {
+		return 2
+	}
+
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case bson.M:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+	return 10
+}
+
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			switch {
+			case ai < bi:
+				return -1
+			case ai > bi:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	if af, ok := toFloat(a); ok {
+		bf, _ := toFloat(b)
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(av, b.(string))
+	case bson.ObjectId:
+		return strings.Compare(string(av), string(b.(bson.ObjectId)))
+	case []byte:
+		return bytes.Compare(av, b.([]byte))
+	case bool:
+		bv := b.(bool)
+		if av == bv {
+			return 0
+		}
+		if !av {
+			return -1
+		}
+		return 1
+	case time.Time:
+		bv := b.(time.Time)
+		switch {
+		case av.Before(bv):
+			return -1
+		case av.After(bv):
+			return 1
+		}
+		return 0
+	}
+
+	return 0
+}
+
+// getValue returns the value by exact path without descending into arrays' documents
+func getValue(v interface{}, parts []string) interface{} {
+	for _, part := range parts {
+		switch t := v.(type) {
+		case bson.M:
+			v = t[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// setValue sets the value by path creating the missing documents. Returns the modified v
+func setValue(v interface{}, parts []string, val interface{}) (interface{}, error) {
+	if len(parts) == 0 {
+		return val, nil
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return setValue(bson.M{}, parts, val)
+	case bson.M:
+		next, err := setValue(t[parts[0]], parts[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		t[parts[0]] = next
+		return t, nil
+	case []interface{}:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 {
+			return nil, storageError(fmt.Sprintf("can't use the field '%s' to traverse the array", parts[0]))
+		}
+		for len(t) <= i {
+			t = append(t, nil)
+		}
+		next, err := setValue(t[i], parts[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = next
+		return t, nil
+	}
+
+	return nil, storageError(fmt.Sprintf("can't create the field '%s' in the non-document element", parts[0]))
+}
+
+// unsetValue removes the value by path. Array elements are set to null like MongoDB does
+func unsetValue(v interface{}, parts []string) {
+	parent := getValue(v, parts[:len(parts)-1])
+	last := parts[len(parts)-1]
+
+	switch t := parent.(type) {
+	case bson.M:
+		delete(t, last)
+	case []interface{}:
+		if i, err := strconv.Atoi(last); err == nil && i >= 0 && i < len(t) {
+			t[i] = nil
+		}
+	}
+}
+
+// resolvePositional replaces the positional $ operator in the path with the index of the first array element matched by the query
+func resolvePositional(doc bson.M, path string, query bson.M) (string, error) {
+	parts := strings.Split(path, ".")
+
+	for i, part := range parts {
+		if part != "$" {
+			continue
+		}
+
+		prefix := strings.Join(parts[:i], ".")
+		arr, ok := getValue(doc, parts[:i]).([]interface{})
+		if !ok {
+			return "", storageError("the positional operator did not find the match needed from the query")
+		}
+
+		var elemCond interface{}
+		hasElemCond := false
+		sub := bson.M{}
+		for key, cond := range query {
+			if key == prefix {
+				elemCond = cond
+				hasElemCond = true
+			} else if strings.HasPrefix(key, prefix+".") {
+				sub[key[len(prefix)+1:]] = cond
+			}
+		}
+
+		for j, el := range arr {
+			if hasElemCond && !matchField([]interface{}{el}, elemCond) {
+				continue
+			}
+
+			if len(sub) > 0 {
+				elDoc, isDoc := el.(bson.M)
+				if !isDoc || !matchDoc(elDoc, sub) {
+					continue
+				}
+			}
+
+			parts[i] = strconv.Itoa(j)
+			return strings.Join(parts, "."), nil
+		}
+
+		return "", storageError("the positional operator did not find the match needed from the query")
+	}
+
+	return path, nil
+}
+
+func applyUpdate(doc bson.M, update bson.M, query bson.M, isInsert bool) error {
+	if _, isOperator := operatorDoc(update); !isOperator {
+		// replacement document
+		id := doc["_id"]
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, val := range update {
+			doc[key] = val
+		}
+		if isEmptyID(doc["_id"]) && !isEmptyID(id) {
+			doc["_id"] = id
+		}
+		return nil
+	}
+
+	for op, fieldsVal := range update {
+		fields, ok := fieldsVal.(bson.M)
+		if !ok {
+			return storageError(fmt.Sprintf("%s argument must be a document", op))
+		}
+
+		for path, val := range fields {
+			path, err := resolvePositional(doc, path, query)
+			if err != nil {
+				return err
+			}
+
+			parts := strings.Split(path, ".")
+			cur := getValue(doc, parts)
+
+			switch op {
+			case "$set":
+			case "$setOnInsert":
+				if !isInsert {
+					continue
+				}
+			case "$unset":
+				unsetValue(doc, parts)
+				continue
+			case "$inc":
+				val, err = addNumbers(cur, val)
+			case "$min":
+				if cur != nil && compareValues(val, cur) >= 0 {
+					continue
+				}
+			case "$max":
+				if cur != nil && compareValues(val, cur) <= 0 {
+					continue
+				}
+			case "$currentDate":
+				val = time.Now()
+			case "$push", "$addToSet":
+				var arr []interface{}
+				arr, err = arrayValue(cur, path)
+				if err != nil {
+					break
+				}
+
+				items := []interface{}{val}
+				if each, isEach := val.(bson.M); isEach && each["$each"] != nil {
+					items = toList(each["$each"])
+				}
+
+				for _, item := range items {
+					if op == "$addToSet" && matchEq(arr, item) {
+						continue
+					}
+					arr = append(arr, item)
+				}
+				val = arr
+			case "$pull", "$pullAll":
+				var arr []interface{}
+				arr, err = arrayValue(cur, path)
+				if err != nil {
+					break
+				}
+
+				remaining := []interface{}{}
+				for _, el := range arr {
+					if (op == "$pull" && matchPull(el, val)) || (op == "$pullAll" && matchEq(toList(val), el)) {
+						continue
+					}
+					remaining = append(remaining, el)
+				}
+
+				if cur == nil {
+					continue
+				}
+				val = remaining
+			default:
+				return storageError(fmt.Sprintf("unsupported update operator %s", op))
+			}
+
+			if err != nil {
+				return err
+			}
+
+			_, err = setValue(doc, parts, val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func arrayValue(v interface{}, path string) ([]interface{}, error) {
+	if v == nil {
+		return []interface{}{}, nil
+	}
+
+	if arr, ok := v.([]interface{}); ok {
+		return arr, nil
+	}
+
+	return nil, storageError(fmt.Sprintf("the field '%s' must be an array", path))
+}
+
+func matchPull(el interface{}, cond interface{}) bool {
+	if condDoc, ok := cond.(bson.M); ok {
+		return matchElem(el, condDoc)
+	}
+
+	return valuesEqual(el, cond)
+}
+
+func addNumbers(a, b interface{}) (interface{}, error) {
+	if a == nil {
+		return b, nil
+	}
+
+	if _, ok := toFloat(a); !ok {
+		return nil, storageError("can't apply $inc to a non-numeric value")
+	}
+
+	ai, aIsInt := toInt64(a)
+	bi, bIsInt := toInt64(b)
+
+	if aIsInt && bIsInt {
+		_, aIsInt64 := a.(int64)
+		_, bIsInt64 := b.(int64)
+		if aIsInt64 || bIsInt64 {
+			return ai + bi, nil
+		}
+		return int(ai + bi), nil
+	}
+
+	af, _ := toFloat(a)
+	bf, ok := toFloat(b)
+	if !ok {
+		return nil, storageError("can't $inc with a non-numeric value")
+	}
+
+	return af + bf, nil
+}
+
+// projectDoc applies the MongoDB projection to the document
+func projectDoc(doc bson.M, selector bson.M) (bson.M, error) {
+	if len(selector) == 0 {
+		return doc, nil
+	}
+
+	inclusion := false
+	for key, v := range selector {
+		if key == "_id" {
+			continue
+		}
+		if _, isDoc := v.(bson.M); isDoc || truthy(v) {
+			inclusion = true
+			break
+		}
+	}
+
+	if !inclusion {
+		res, err := toDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, v := range selector {
+			if !truthy(v) {
+				unsetValue(res, strings.Split(key, "."))
+			}
+		}
+		return res, nil
+	}
+
+	res := bson.M{}
+	if idSel, exists := selector["_id"]; !exists || truthy(idSel) {
+		if id, exists := doc["_id"]; exists {
+			res["_id"] = id
+		}
+	}
+
+	for key, v := range selector {
+		if key == "_id" {
+			continue
+		}
+
+		if ops, isDoc := v.(bson.M); isDoc {
+			sub, _ := ops["$elemMatch"].(bson.M)
+			arr, _ := doc[key].([]interface{})
+			for _, el := range arr {
+				if matchElem(el, sub) {
+					res[key] = []interface{}{el}
+					break
+				}
+			}
+			continue
+		}
+
+		if truthy(v) {
+			copyPath(doc, res, strings.Split(key, "."))
+		}
+	}
+
+	return res, nil
+}
+
+func copyPath(src bson.M, dst bson.M, parts []string) {
+	v, exists := src[parts[0]]
+	if !exists {
+		return
+	}
+
+	if len(parts) == 1 {
+		dst[parts[0]] = v
+		return
+	}
+
+	switch t := v.(type) {
+	case bson.M:
+		sub, ok := dst[parts[0]].(bson.M)
+		if !ok {
+			sub = bson.M{}
+			dst[parts[0]] = sub
+		}
+		copyPath(t, sub, parts[1:])
+	case []interface{}:
+		existing, _ := dst[parts[0]].([]interface{})
+		arr := make([]interface{}, 0, len(t))
+		for i, el := range t {
+			elDoc, isDoc := el.(bson.M)
+			if !isDoc {
+				continue
+			}
+
+			var sub bson.M
+			if i < len(existing) {
+				sub, _ = existing[i].(bson.M)
+			}
+			if sub == nil {
+				sub = bson.M{}
+			}
+			copyPath(elDoc, sub, parts[1:])
+			arr = append(arr, sub)
+		}
+		dst[parts[0]] = arr
+	}
+}
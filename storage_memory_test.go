@@ -0,0 +1,180 @@
+package integram
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryCollection_Find(t *testing.T) {
+	c := NewMemoryStorage().C("users")
+	c.Insert(
+		bson.M{"_id": 1, "username": "alice", "age": 30, "hooks": []bson.M{{"token": "u1", "services": []string{"trello"}, "chats": []int64{10, 20}}}},
+		bson.M{"_id": 2, "username": "bob", "age": 25, "tags": []string{"a", "b"}},
+		bson.M{"_id": 3, "username": "carol", "age": 35},
+	)
+
+	tests := []struct {
+		name  string
+		query bson.M
+		want  []int
+	}{
+		{"equality", bson.M{"username": "bob"}, []int{2}},
+		{"array element", bson.M{"tags": "b"}, []int{2}},
+		{"nested array of docs", bson.M{"hooks.chats": int64(20)}, []int{1}},
+		{"nested array equality", bson.M{"hooks.services": []string{"trello"}}, []int{1}},
+		{"$in", bson.M{"_id": bson.M{"$in": []int{1, 3}}}, []int{1, 3}},
+		{"$gt and $lte", bson.M{"age": bson.M{"$gt": 25, "$lte": 35}}, []int{1, 3}},
+		{"$exists false", bson.M{"tags": bson.M{"$exists": false}}, []int{1, 3}},
+		{"$ne", bson.M{"username": bson.M{"$ne": "alice"}}, []int{2, 3}},
+		{"$or", bson.M{"$or": []bson.M{{"username": "alice"}, {"age": 25}}}, []int{1, 2}},
+		{"null matches missing", bson.M{"tags": nil}, []int{1, 3}},
+	}
+	for _, tt := range tests {
+		var res []struct {
+			ID int `bson:"_id"`
+		}
+		err := c.Find(tt.query).Sort("_id").All(&res)
+		if err != nil {
+			t.Errorf("%q. memoryQuery.All() error = %v", tt.name, err)
+			continue
+		}
+
+		got := []int{}
+		for _, r := range res {
+			got = append(got, r.ID)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q. memoryQuery.All() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryCollection_Update(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    bson.M
+		query  bson.M
+		update bson.M
+		want   bson.M
+	}{
+		{"$set nested", bson.M{"_id": 1}, bson.M{"_id": 1}, bson.M{"$set": bson.M{"settings.trello.key": "val"}}, bson.M{"_id": 1, "settings": bson.M{"trello": bson.M{"key": "val"}}}},
+		{"$unset", bson.M{"_id": 1, "a": 1, "b": 2}, bson.M{"_id": 1}, bson.M{"$unset": bson.M{"a": ""}}, bson.M{"_id": 1, "b": 2}},
+		{"$inc", bson.M{"_id": 1, "v": 1}, bson.M{"_id": 1}, bson.M{"$inc": bson.M{"v": 2, "v5m.3": 1}}, bson.M{"_id": 1, "v": 3, "v5m": bson.M{"3": 1}}},
+		{"$push $each", bson.M{"_id": 1, "e": []string{"a"}}, bson.M{"_id": 1}, bson.M{"$push": bson.M{"e": bson.M{"$each": []string{"b", "c"}}}}, bson.M{"_id": 1, "e": []interface{}{"a", "b", "c"}}},
+		{"$addToSet", bson.M{"_id": 1, "e": []int{1, 2}}, bson.M{"_id": 1}, bson.M{"$addToSet": bson.M{"e": 2}}, bson.M{"_id": 1, "e": []interface{}{1, 2}}},
+		{"$pull by condition", bson.M{"_id": 1, "kb": []bson.M{{"chatid": 1}, {"chatid": 2}}}, bson.M{"_id": 1}, bson.M{"$pull": bson.M{"kb": bson.M{"chatid": 1}}}, bson.M{"_id": 1, "kb": []interface{}{bson.M{"chatid": 2}}}},
+		{"positional", bson.M{"_id": 1, "hooks": []bson.M{{"token": "a", "chats": []int{1}}, {"token": "b", "chats": []int{2}}}}, bson.M{"_id": 1, "hooks.token": "b"}, bson.M{"$addToSet": bson.M{"hooks.$.chats": 3}}, bson.M{"_id": 1, "hooks": []interface{}{bson.M{"token": "a", "chats": []interface{}{1}}, bson.M{"token": "b", "chats": []interface{}{2, 3}}}}},
+	}
+	for _, tt := range tests {
+		c := NewMemoryStorage().C("test")
+		c.Insert(tt.doc)
+
+		err := c.Update(tt.query, tt.update)
+		if err != nil {
+			t.Errorf("%q. memoryCollection.Update() error = %v", tt.name, err)
+			continue
+		}
+
+		got := bson.M{}
+		c.FindId(1).One(&got)
+
+		want, _ := toDoc(tt.want)
+		if !valuesEqual(got, want) {
+			t.Errorf("%q. memoryCollection.Update() = %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestMemoryCollection_Upsert(t *testing.T) {
+	c := NewMemoryStorage().C("stats")
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Upsert(bson.M{"s": "trello", "k": "msg", "d": 1}, bson.M{"$inc": bson.M{"v": 1}, "$setOnInsert": bson.M{"created": true}})
+		if err != nil {
+			t.Errorf("memoryCollection.Upsert() error = %v", err)
+		}
+	}
+
+	var res []bson.M
+	c.Find(bson.M{"s": "trello"}).Select(bson.M{"_id": 0, "v": 1, "created": 1}).All(&res)
+
+	want := []bson.M{{"v": 2, "created": true}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("memoryCollection.Upsert() = %v, want %v", res, want)
+	}
+}
+
+func TestMemoryCollection_UniqueAndTTL(t *testing.T) {
+	c := NewMemoryStorage().C("users_cache")
+	c.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second})
+	c.EnsureIndex(mgo.Index{Key: []string{"key", "userid"}, Unique: true})
+
+	err := c.Insert(bson.M{"key": "a", "userid": 1, "expiresat": time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Errorf("memoryCollection.Insert() error = %v", err)
+	}
+
+	// the previous one is expired, so there is no duplicate
+	err = c.Insert(bson.M{"key": "a", "userid": 1, "expiresat": time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Errorf("memoryCollection.Insert() expired doc error = %v", err)
+	}
+
+	err = c.Insert(bson.M{"key": "a", "userid": 1, "expiresat": time.Now().Add(time.Minute)})
+	if !mgo.IsDup(err) {
+		t.Errorf("memoryCollection.Insert() duplicate error = %v, want E11000", err)
+	}
+
+	n, _ := c.Find(nil).Count()
+	if n != 1 {
+		t.Errorf("memoryCollection.Count() = %d, want 1", n)
+	}
+}
+
+func TestContext_MemoryStorage(t *testing.T) {
+	ctx := &Context{ServiceName: "servicewithactions", User: User{ID: 9999999998, FirstName: "Test"}, Chat: Chat{ID: 9999999998}}
+	ctx.SetStorage(NewMemoryStorage())
+	ctx.User.ctx = ctx
+	ctx.Chat.ctx = ctx
+
+	err := ctx.User.SetCache("key", "val", time.Hour)
+	if err != nil {
+		t.Errorf("User.SetCache() error = %v", err)
+	}
+
+	var val string
+	if exists := ctx.User.Cache("key", &val); !exists || val != "val" {
+		t.Errorf("User.Cache() = %v, %q, want true, %q", exists, val, "val")
+	}
+
+	err = ctx.User.SaveSetting("lang", "en")
+	if err != nil {
+		t.Errorf("User.SaveSetting() error = %v", err)
+	}
+
+	user, err := ctx.FindUser(bson.M{"_id": ctx.User.ID})
+	if err != nil {
+		t.Errorf("Context.FindUser() error = %v", err)
+	}
+
+	user.ctx = ctx
+	if setting, _ := user.Setting("lang"); setting != "en" {
+		t.Errorf("User.Setting() = %v, want %q", setting, "en")
+	}
+
+	m := &Message{MsgID: 1, ChatID: ctx.Chat.ID, BotID: 1, Text: "text"}
+	err = m.saveToDB(ctx.Storage())
+	if err != nil {
+		t.Errorf("Message.saveToDB() error = %v", err)
+	}
+
+	found, err := findMessage(ctx.Storage(), ctx.Chat.ID, 1, 1)
+	if err != nil || found == nil || found.TextHash != m.TextHash {
+		t.Errorf("findMessage() = %v, %v, want message with hash %q", found, err, m.TextHash)
+	}
+}
@@ -0,0 +1,117 @@
+package integram
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	tg "github.com/requilence/telegram-bot-api"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tgFileCacheTTL is prolonged on every hit
+const tgFileCacheTTL = 30 * 24 * time.Hour
+
+// tgCachedFile is the file_id returned by Telegram for the uploaded content. file_id is valid only for the bot uploaded it
+type tgCachedFile struct {
+	ID        string `bson:"_id"` // botID:fileType:sha256[:fileName]
+	FileID    string
+	ExpiresAt time.Time
+}
+
+// tgFileCacheID includes the file name for documents because Telegram shows the name the document was uploaded with
+func tgFileCacheID(botID int64, fileType string, fileName string, hash string) string {
+	if fileType == "document" {
+		return fmt.Sprintf("%d:%s:%s:%s", botID, fileType, hash, fileName)
+	}
+	return fmt.Sprintf("%d:%s:%s", botID, fileType, hash)
+}
+
+// fileHash returns the sha256 of the file's content
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedFileID returns the file_id of the content uploaded before or empty string
+func cachedFileID(db Storage, id string) string {
+	var f tgCachedFile
+	err := db.C("tg_files").FindId(id).One(&f)
+	if err != nil || f.ExpiresAt.Before(time.Now()) {
+		return ""
+	}
+
+	db.C("tg_files").UpdateId(id, bson.M{"$set": bson.M{"expiresat": time.Now().Add(tgFileCacheTTL)}})
+	return f.FileID
+}
+
+func cacheFileID(db Storage, id string, fileID string) {
+	if fileID == "" {
+		return
+	}
+
+	_, err := db.C("tg_files").UpsertId(id, tgCachedFile{ID: id, FileID: fileID, ExpiresAt: time.Now().Add(tgFileCacheTTL)})
+	if err != nil {
+		log.WithError(err).Error("Can't cache the uploaded file_id")
+	}
+}
+
+// sentFileID returns the file_id of the file within the sent message
+func sentFileID(msg tg.Message) string {
+	switch {
+	case msg.Photo != nil && len(*msg.Photo) > 0:
+		// the largest size is the last one
+		photos := *msg.Photo
+		return photos[len(photos)-1].FileID
+	case msg.Document != nil:
+		// animations are also returned as documents
+		return msg.Document.FileID
+	case msg.Audio != nil:
+		return msg.Audio.FileID
+	case msg.Video != nil:
+		return msg.Video.FileID
+	case msg.Voice != nil:
+		return msg.Voice.FileID
+	case msg.Sticker != nil:
+		return msg.Sticker.FileID
+	}
+	return ""
+}
+
+// isWrongFileIDError returns true if Telegram rejected the file_id, e.g. the file was removed
+func isWrongFileIDError(err error) bool {
+	tgErr, ok := err.(tg.Error)
+	if !ok || tgErr.Code != 400 {
+		return false
+	}
+
+	desc := strings.ToLower(tgErr.Description)
+	return strings.Contains(desc, "wrong file identifier") || strings.Contains(desc, "wrong remote file")
+}
+
+// fileCacheStat counts the hit or miss for the service of the bot
+func fileCacheStat(db Storage, botID int64, key StatKey) {
+	service, err := detectServiceByBot(botID)
+	if err != nil || service == nil {
+		return
+	}
+
+	ctx := &Context{ServiceName: service.Name, storage: db}
+	ctx.StatInc(key)
+}
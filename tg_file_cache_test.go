@@ -0,0 +1,130 @@
+package integram
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tg "github.com/requilence/telegram-bot-api"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func statCounter(service string, key StatKey) float64 {
+	metricStats.mu.Lock()
+	defer metricStats.mu.Unlock()
+
+	if cv, exists := metricStats.values[service+"\xff"+string(key)]; exists {
+		return cv.value
+	}
+	return 0
+}
+
+func TestSendMessage_FileCache(t *testing.T) {
+	service := &Service{Name: "servicewithfilecache"}
+	server, _ := newTestBot(t, service, "cache_bot")
+
+	db, _ := newTestSendQueue(t)
+
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logo := filepath.Join(dir, "logo.png")
+	ioutil.WriteFile(logo, []byte("logo"), 0644)
+	sameLogo := filepath.Join(dir, "logo_copy.png")
+	ioutil.WriteFile(sameLogo, []byte("logo"), 0644)
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 500}}
+	ctx.SetStorage(db)
+
+	cacheID := func() string {
+		hash, _ := fileHash(logo)
+		return tgFileCacheID(service.Bot().ID, "image", "logo.png", hash)
+	}()
+
+	tests := []struct {
+		name       string
+		path       string
+		fileID     string // replaces the cached file_id before sending
+		wantUpload bool
+	}{
+		{"first upload", logo, "", true},
+		{"same file", logo, "", false},
+		{"same content", sameLogo, "", false},
+		{"rejected file_id", logo, "removed", true},
+		{"after re-upload", logo, "", false},
+	}
+	for _, tt := range tests {
+		if tt.fileID != "" {
+			db.C("tg_files").UpdateId(cacheID, bson.M{"$set": bson.M{"fileid": tt.fileID}})
+		}
+
+		uploadsBefore := len(server.Requests("sendPhoto"))
+		err := sendMessage(ctx.NewMessage().SetImage(tt.path, "logo.png"))
+		if err != nil {
+			t.Errorf("%q. sendMessage() error = %v", tt.name, err)
+			continue
+		}
+
+		var uploaded bool
+		for _, req := range server.Requests("sendPhoto")[uploadsBefore:] {
+			if _, exists := req.Files["photo"]; exists {
+				uploaded = true
+			}
+		}
+		if uploaded != tt.wantUpload {
+			t.Errorf("%q. sendMessage() uploaded the file = %v, want %v", tt.name, uploaded, tt.wantUpload)
+		}
+	}
+
+	msgs := server.Messages(500)
+	if len(msgs) != len(tests) || msgs[0].Photo.ID != msgs[1].Photo.ID {
+		t.Errorf("sendMessage() sent %d messages, want %d with the same photo", len(msgs), len(tests))
+	}
+
+	if hits, misses := statCounter(service.Name, StatFileCacheHit), statCounter(service.Name, StatFileCacheMiss); hits != 3 || misses != 2 {
+		t.Errorf("file cache stats = %v hits, %v misses, want 3 and 2", hits, misses)
+	}
+}
+
+func TestTGFileCacheID(t *testing.T) {
+	tests := []struct {
+		fileType string
+		fileName string
+		want     string
+	}{
+		{"image", "a.png", "1:image:abc"},
+		{"image", "b.png", "1:image:abc"},
+		{"document", "a.txt", "1:document:abc:a.txt"},
+		{"document", "b.txt", "1:document:abc:b.txt"},
+	}
+	for _, tt := range tests {
+		if got := tgFileCacheID(1, tt.fileType, tt.fileName, "abc"); got != tt.want {
+			t.Errorf("tgFileCacheID(1, %q, %q, \"abc\") = %q, want %q", tt.fileType, tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestIsWrongFileIDError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("wrong file identifier"), false},
+		{tg.Error{Code: 400, Description: "Bad Request: wrong file identifier/HTTP URL specified"}, true},
+		{tg.Error{Code: 400, Description: "Bad Request: wrong remote file identifier specified: Wrong padding in the string"}, true},
+		{tg.Error{Code: 400, Description: "Bad Request: file is too big"}, false},
+		{tg.Error{Code: 400, Description: "Bad Request: failed to get HTTP URL content"}, false},
+		{tg.Error{Code: 403, Description: "Forbidden: bot was blocked by the user"}, false},
+	}
+	for _, tt := range tests {
+		if got := isWrongFileIDError(tt.err); got != tt.want {
+			t.Errorf("isWrongFileIDError(%#v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package integram
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// storageGCRAStore implements throttled.GCRAStore on top of the Storage. It allows to share the outgoing limits between all the processes using the same DB
+type storageGCRAStore struct {
+	db Storage
+}
+
+type gcraValue struct {
+	Key       string `bson:"_id"`
+	Value     int64  `bson:"v"`
+	ExpiresAt time.Time
+}
+
+// GetWithTime returns the value of the key or -1 if it doesn't exist or expired
+func (s storageGCRAStore) GetWithTime(key string) (int64, time.Time, error) {
+	now := time.Now()
+
+	v := gcraValue{}
+	err := s.db.C("tg_ratelimit").FindId(key).One(&v)
+	if err == mgo.ErrNotFound || err == nil && v.ExpiresAt.Before(now) {
+		return -1, now, nil
+	} else if err != nil {
+		return 0, now, err
+	}
+
+	return v.Value, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value if the key doesn't exist or expired but not yet removed by the TTL index
+func (s storageGCRAStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	err := s.db.C("tg_ratelimit").Insert(gcraValue{Key: key, Value: value, ExpiresAt: now.Add(ttl)})
+	if err == nil {
+		return true, nil
+	} else if !mgo.IsDup(err) {
+		return false, err
+	}
+
+	err = s.db.C("tg_ratelimit").Update(bson.M{"_id": key, "expiresat": bson.M{"$lt": now}}, bson.M{"$set": bson.M{"v": value, "expiresat": now.Add(ttl)}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CompareAndSwapWithTTL sets the new value only if the current one equals to the old
+func (s storageGCRAStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	err := s.db.C("tg_ratelimit").Update(bson.M{"_id": key, "v": old, "expiresat": bson.M{"$gte": now}}, bson.M{"$set": bson.M{"v": new, "expiresat": now.Add(ttl)}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// gcraReserve reserves the first slot of the GCRA limit with zero burst that starts not before notBefore and returns its time.
+// Slots are reserved one after another, so the later reservation never gets the earlier slot
+func gcraReserve(store storageGCRAStore, key string, interval time.Duration, notBefore time.Time) (time.Time, error) {
+	for {
+		tatVal, now, err := store.GetWithTime(key)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		// with zero burst the next slot starts at the theoretical arrival time
+		slot := notBefore
+		if tat := time.Unix(0, tatVal); tatVal != -1 && tat.After(slot) {
+			slot = tat
+		}
+
+		newTat := slot.Add(interval)
+
+		var reserved bool
+		if tatVal == -1 {
+			reserved, err = store.SetIfNotExistsWithTTL(key, newTat.UnixNano(), newTat.Sub(now))
+		} else {
+			reserved, err = store.CompareAndSwapWithTTL(key, tatVal, newTat.UnixNano(), newTat.Sub(now))
+		}
+
+		if err != nil {
+			return time.Time{}, err
+		} else if reserved {
+			return slot, nil
+		}
+		// the slot was reserved by another process, try the next one
+	}
+}
+
+// tgRateLimitDelay reserves the slot for the message within Telegram's limits: per private chat or group and per bot.
+// Returns how long the message should wait for its slot, 0 if it can be sent right now.
+// Limited messages keep their order because the later message always gets the later slot. The slot is saved into the message,
+// so the rescheduled message is sent at its slot without the reservation of another one
+func tgRateLimitDelay(db Storage, m *OutgoingMessage) (time.Duration, error) {
+	if m.RateLimitSlot != nil {
+		delay := time.Until(*m.RateLimitSlot)
+		if delay > 0 {
+			return delay, nil
+		}
+
+		// follow-up messages must reserve their own slots
+		m.RateLimitSlot = nil
+		return 0, nil
+	}
+
+	type limit struct {
+		kind     string
+		key      string
+		interval time.Duration
+	}
+
+	// the chat's limit goes first as it is the stricter one
+	var limits []limit
+	chatKey := fmt.Sprintf("%d:%d", m.BotID, m.ChatID)
+	if m.ChatID > 0 && Config.TGRateLimitPrivatePerSecond > 0 {
+		limits = append(limits, limit{"private", chatKey, time.Second / time.Duration(Config.TGRateLimitPrivatePerSecond)})
+	} else if m.ChatID < 0 && Config.TGRateLimitGroupPerMinute > 0 {
+		limits = append(limits, limit{"group", chatKey, time.Minute / time.Duration(Config.TGRateLimitGroupPerMinute)})
+	}
+
+	if Config.TGRateLimitPerSecond > 0 {
+		limits = append(limits, limit{"bot", strconv.FormatInt(m.BotID, 10), time.Second / time.Duration(Config.TGRateLimitPerSecond)})
+	}
+
+	store := storageGCRAStore{db}
+
+	now := time.Now()
+	slot := now
+	for _, l := range limits {
+		var err error
+		slot, err = gcraReserve(store, l.key, l.interval, slot)
+		if err != nil {
+			return 0, err
+		}
+
+		if slot.After(now) {
+			metricTGRateLimited.inc(l.kind)
+		}
+	}
+
+	if !slot.After(now) {
+		return 0, nil
+	}
+
+	m.RateLimitSlot = &slot
+	return slot.Sub(now), nil
+}
+
+// checkTGRateLimit returns the delay the message should be rescheduled with, 0 if it can be sent right now.
+// Workers don't wait by themselves, so the limited chat doesn't block the others
+func checkTGRateLimit(db Storage, m *OutgoingMessage) time.Duration {
+	delay, err := tgRateLimitDelay(db, m)
+	if err != nil {
+		// don't block the sending because of the limiter's storage
+		log.WithError(err).WithField("bot", m.BotID).Error("Outgoing rate limiter error")
+		return 0
+	}
+	return delay
+}
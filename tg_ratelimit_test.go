@@ -0,0 +1,131 @@
+package integram
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTGRateLimitDelay(t *testing.T) {
+	defer func(perSecond, private, group int) {
+		Config.TGRateLimitPerSecond, Config.TGRateLimitPrivatePerSecond, Config.TGRateLimitGroupPerMinute = perSecond, private, group
+	}(Config.TGRateLimitPerSecond, Config.TGRateLimitPrivatePerSecond, Config.TGRateLimitGroupPerMinute)
+
+	Config.TGRateLimitPerSecond = 2
+	Config.TGRateLimitPrivatePerSecond = 1
+	Config.TGRateLimitGroupPerMinute = 20
+
+	db := NewMemoryStorage()
+
+	tests := []struct {
+		name    string
+		botID   int64
+		chatID  int64
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"private", 1, 10, 0, 0},
+		{"private again", 1, 10, 900 * time.Millisecond, time.Second},
+		// bot's slots up to 1.5s are reserved by the previous messages
+		{"bot limit", 1, 11, 1400 * time.Millisecond, 1500 * time.Millisecond},
+		{"bot limit again", 1, 11, 1900 * time.Millisecond, 2 * time.Second},
+		{"private after bot limit", 1, 10, 2400 * time.Millisecond, 2500 * time.Millisecond},
+		{"group", 2, -10, 0, 0},
+		{"group again", 2, -10, 2900 * time.Millisecond, 3 * time.Second},
+		{"another bot", 3, 10, 0, 0},
+	}
+	for _, tt := range tests {
+		m := &OutgoingMessage{Message: Message{BotID: tt.botID, ChatID: tt.chatID}}
+		got, err := tgRateLimitDelay(db, m)
+		if err != nil {
+			t.Errorf("%q. tgRateLimitDelay() error = %v", tt.name, err)
+			continue
+		}
+		if got < tt.wantMin || got > tt.wantMax {
+			t.Errorf("%q. tgRateLimitDelay() = %v, want between %v and %v", tt.name, got, tt.wantMin, tt.wantMax)
+		}
+		if (m.RateLimitSlot != nil) != (got > 0) {
+			t.Errorf("%q. tgRateLimitDelay() RateLimitSlot = %v, want it set only for the limited message", tt.name, m.RateLimitSlot)
+		}
+	}
+
+	// rescheduled message is sent at its slot without taking another one
+	slot := time.Now().Add(-time.Millisecond)
+	m := &OutgoingMessage{Message: Message{BotID: 1, ChatID: 10}, RateLimitSlot: &slot}
+	if got, err := tgRateLimitDelay(db, m); got != 0 || err != nil || m.RateLimitSlot != nil {
+		t.Errorf("tgRateLimitDelay() at the reserved slot = %v, %v, RateLimitSlot = %v, want 0 and the slot reset", got, err, m.RateLimitSlot)
+	}
+}
+
+func TestSendMessage_RateLimitOrder(t *testing.T) {
+	service := &Service{Name: "servicewithratelimit"}
+	server, _ := newTestBot(t, service, "ratelimit_bot")
+
+	db, _ := newTestSendQueue(t)
+	Config.TGRateLimitPrivatePerSecond = 20
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 800}}
+	ctx.SetStorage(db)
+
+	var want []string
+	for i := 1; i <= 5; i++ {
+		text := strconv.Itoa(i)
+		if err := ctx.NewMessage().SetText(text).Send(); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+		want = append(want, text)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); len(server.Messages(800)) < len(want) && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+
+	var got []string
+	for _, msg := range server.Messages(800) {
+		got = append(got, msg.Text)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Send() sent %v, want %v", got, want)
+	}
+}
+
+func TestStorageGCRAStore(t *testing.T) {
+	db := NewMemoryStorage()
+	store := storageGCRAStore{db}
+
+	if v, _, err := store.GetWithTime("k"); err != nil || v != -1 {
+		t.Errorf("GetWithTime() of missing key = %v, %v, want -1", v, err)
+	}
+
+	if ok, err := store.SetIfNotExistsWithTTL("k", 1, time.Minute); err != nil || !ok {
+		t.Errorf("SetIfNotExistsWithTTL() = %v, %v, want true", ok, err)
+	}
+	if ok, err := store.SetIfNotExistsWithTTL("k", 2, time.Minute); err != nil || ok {
+		t.Errorf("SetIfNotExistsWithTTL() of existing key = %v, %v, want false", ok, err)
+	}
+
+	if ok, err := store.CompareAndSwapWithTTL("k", 2, 3, time.Minute); err != nil || ok {
+		t.Errorf("CompareAndSwapWithTTL() with wrong old value = %v, %v, want false", ok, err)
+	}
+	if ok, err := store.CompareAndSwapWithTTL("k", 1, 3, time.Minute); err != nil || !ok {
+		t.Errorf("CompareAndSwapWithTTL() = %v, %v, want true", ok, err)
+	}
+	if v, _, err := store.GetWithTime("k"); err != nil || v != 3 {
+		t.Errorf("GetWithTime() = %v, %v, want 3", v, err)
+	}
+
+	// expired keys may be still present until removed by the TTL index
+	db.C("tg_ratelimit").UpdateId("k", bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Second)}})
+
+	if v, _, err := store.GetWithTime("k"); err != nil || v != -1 {
+		t.Errorf("GetWithTime() of expired key = %v, %v, want -1", v, err)
+	}
+	if ok, err := store.CompareAndSwapWithTTL("k", 3, 4, time.Minute); err != nil || ok {
+		t.Errorf("CompareAndSwapWithTTL() of expired key = %v, %v, want false", ok, err)
+	}
+	if ok, err := store.SetIfNotExistsWithTTL("k", 5, time.Minute); err != nil || !ok {
+		t.Errorf("SetIfNotExistsWithTTL() of expired key = %v, %v, want true", ok, err)
+	}
+}
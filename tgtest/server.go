@@ -0,0 +1,959 @@
+// Package tgtest provides the fake Telegram Bot API server to run the end-to-end tests of Integram services without the real Telegram.
+//
+// Start the server, register the bot token and point the Bot API client at it:
+//
+//	s := tgtest.NewServer()
+//	defer s.Close()
+//	s.AddBot("123:secret", "test_bot")
+//	integram.TGHTTPClient = s.Client()
+//
+// Then inject the updates with SendText/PressButton and check the messages the service has sent with WaitMessages
+package tgtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tg "github.com/requilence/telegram-bot-api"
+)
+
+// maxLongPollingTimeout limits the getUpdates timeout, so the server can be closed fast
+const maxLongPollingTimeout = 5 * time.Second
+
+// APIError is the error returned by the Bot API
+type APIError struct {
+	Code            int
+	Description     string
+	RetryAfter      int   // for 429 Too Many Requests
+	MigrateToChatID int64 // for the group upgraded to supergroup
+}
+
+var (
+	ErrBotBlocked     = APIError{Code: 403, Description: "Forbidden: bot was blocked by the user"}
+	ErrBotKicked      = APIError{Code: 403, Description: "Forbidden: bot was kicked from the group chat"}
+	ErrChatNotFound   = APIError{Code: 400, Description: "Bad Request: chat not found"}
+	ErrMsgNotFound    = APIError{Code: 400, Description: "Bad Request: message not found"}
+	ErrMsgNotModified = APIError{Code: 400, Description: "Bad Request: message is not modified"}
+)
+
+// Request is the Bot API method call received by the server
+type Request struct {
+	Method string
+	Token  string
+	Params url.Values
+	Files  map[string]File // uploaded files per field name
+}
+
+// File is the file uploaded to the server
+type File struct {
+	ID   string
+	Name string
+	Data []byte
+}
+
+// Message is the message sent by the bot
+type Message struct {
+	ChatID          int64
+	MessageID       int
+	InlineMessageID string
+	Date            time.Time
+	Edited          bool
+
+	Text        string // text or the caption of media
+	ParseMode   string
+	ReplyMarkup string // JSON encoded reply_markup
+	ReplyToID   int
+	Silent      bool
+
+	Photo        *File
+	Video        *File
+	Document     *File
+	Audio        *File
+	Voice        *File
+	Animation    *File
+	Sticker      *File
+	Venue        *tg.Venue
+	Contact      *tg.Contact
+	Poll         *Poll
+	MediaGroupID string // set for the messages sent with sendMediaGroup
+}
+
+// Poll is the native poll sent by the bot
+type Poll struct {
+	ID              string   `json:"id"`
+	Question        string   `json:"question"`
+	Options         []string `json:"-"`
+	Anonymous       bool     `json:"is_anonymous"`
+	MultipleAnswers bool     `json:"allows_multiple_answers"`
+	Type            string   `json:"type"`
+}
+
+// PollAnswer is the user's answer on the non-anonymous poll. tg.Update doesn't support it
+type PollAnswer struct {
+	PollID    string  `json:"poll_id"`
+	User      tg.User `json:"user"`
+	OptionIDs []int   `json:"option_ids"`
+}
+
+// update is tg.Update with the poll answer
+type update struct {
+	tg.Update
+	PollAnswer *PollAnswer `json:"poll_answer,omitempty"`
+}
+
+// sentPoll is the result of sendPoll. tg.Message doesn't have the poll field
+type sentPoll struct {
+	*tg.Message
+	Poll *Poll `json:"poll"`
+}
+
+// InlineKeyboard decodes the inline keyboard attached to the message
+func (m Message) InlineKeyboard() [][]tg.InlineKeyboardButton {
+	var markup tg.InlineKeyboardMarkup
+	json.Unmarshal([]byte(m.ReplyMarkup), &markup)
+	return markup.InlineKeyboard
+}
+
+// Keyboard decodes the reply keyboard attached to the message
+func (m Message) Keyboard() [][]tg.KeyboardButton {
+	var markup tg.ReplyKeyboardMarkup
+	json.Unmarshal([]byte(m.ReplyMarkup), &markup)
+	return markup.Keyboard
+}
+
+// Server is the fake Telegram Bot API server
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	bots     map[string]*bot
+	requests []Request
+
+	messages   map[int64][]*Message
+	inlineMsgs map[string]*Message
+	lastMsgID  map[int64]int
+	files      map[string]File
+
+	chatAdmins map[int64]map[int64]bool
+
+	chatErrors map[int64]APIError // returned until cleared
+	nextErrors map[int64]APIError // returned once
+
+	changed chan struct{} // closed and replaced on every change
+	lastID  int
+}
+
+type bot struct {
+	user       tg.User
+	updates    []update
+	lastUpdate int
+	webhook    string
+	commands   map[string][]BotCommand // by language_code, empty one is the default
+}
+
+// BotCommand is the command set with setMyCommands
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// NewServer starts the fake Bot API server. Close it after use
+func NewServer() *Server {
+	s := &Server{
+		bots:       make(map[string]*bot),
+		messages:   make(map[int64][]*Message),
+		inlineMsgs: make(map[string]*Message),
+		lastMsgID:  make(map[int64]int),
+		files:      make(map[string]File),
+		chatAdmins: make(map[int64]map[int64]bool),
+		chatErrors: make(map[int64]APIError),
+		nextErrors: make(map[int64]APIError),
+		changed:    make(chan struct{}),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns the http.Client that routes all requests to the api.telegram.org to the server
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &rewriteTransport{target: target}}
+}
+
+// BotAPI returns the Bot API client connected to the server
+func (s *Server) BotAPI(token string) (*tg.BotAPI, error) {
+	return tg.NewBotAPIWithClient(token, s.Client())
+}
+
+// AddBot registers the bot with token in form of "<id>:<secret>". Requests with unknown tokens will fail with 401 Unauthorized
+func (s *Server) AddBot(token string, username string) error {
+	id, err := strconv.ParseInt(strings.SplitN(token, ":", 2)[0], 10, 64)
+	if err != nil || !strings.Contains(token, ":") {
+		return fmt.Errorf("bad token %q", token)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bots[token] = &bot{user: tg.User{ID: id, FirstName: username, UserName: username, IsBot: true}, commands: make(map[string][]BotCommand)}
+	return nil
+}
+
+// InjectUpdate queues the update for the bot's getUpdates. UpdateID is assigned automatically
+func (s *Server) InjectUpdate(token string, u tg.Update) (tg.Update, error) {
+	queued, err := s.inject(token, update{Update: u})
+	return queued.Update, err
+}
+
+// AnswerPoll injects the answer of user on the non-anonymous poll sent by the bot
+func (s *Server) AnswerPoll(token string, from tg.User, pollID string, optionIDs []int) error {
+	_, err := s.inject(token, update{PollAnswer: &PollAnswer{PollID: pollID, User: from, OptionIDs: optionIDs}})
+	return err
+}
+
+func (s *Server) inject(token string, u update) (update, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, exists := s.bots[token]
+	if !exists {
+		return u, errors.New("bot not found")
+	}
+
+	b.lastUpdate++
+	u.UpdateID = b.lastUpdate
+	b.updates = append(b.updates, u)
+	s.notify()
+
+	return u, nil
+}
+
+// SendText injects the text message from user to chat
+func (s *Server) SendText(token string, chat tg.Chat, from tg.User, text string) (tg.Update, error) {
+	s.mu.Lock()
+	s.lastMsgID[chat.ID]++
+	msg := &tg.Message{MessageID: s.lastMsgID[chat.ID], From: &from, Chat: &chat, Date: int(time.Now().Unix()), Text: text}
+	s.mu.Unlock()
+
+	return s.InjectUpdate(token, tg.Update{Message: msg})
+}
+
+// PressButton injects the callback query for the inline button with data pressed by user
+func (s *Server) PressButton(token string, from tg.User, msg Message, data string) (tg.Update, error) {
+	s.mu.Lock()
+	s.lastID++
+	cq := &tg.CallbackQuery{ID: strconv.Itoa(s.lastID), From: &from, Data: data, ChatInstance: strconv.FormatInt(msg.ChatID, 10)}
+	s.mu.Unlock()
+
+	if msg.InlineMessageID != "" {
+		cq.InlineMessageID = msg.InlineMessageID
+	} else {
+		cq.Message = &tg.Message{MessageID: msg.MessageID, Chat: &tg.Chat{ID: msg.ChatID, Type: chatType(msg.ChatID)}, Date: int(msg.Date.Unix()), Text: msg.Text}
+	}
+
+	return s.InjectUpdate(token, tg.Update{CallbackQuery: cq})
+}
+
+// SendInlineQuery injects the inline query from user
+func (s *Server) SendInlineQuery(token string, from tg.User, query string) (tg.Update, error) {
+	s.mu.Lock()
+	s.lastID++
+	iq := &tg.InlineQuery{ID: strconv.Itoa(s.lastID), From: &from, Query: query}
+	s.mu.Unlock()
+
+	return s.InjectUpdate(token, tg.Update{InlineQuery: iq})
+}
+
+// AddFile stores the file that can be downloaded with getFile, e.g. to inject the message with document
+func (s *Server) AddFile(name string, data []byte) File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addFile(name, data)
+}
+
+// SetChatAdmin makes getChatMember return the "administrator" status for the user within the chat
+func (s *Server) SetChatAdmin(chatID int64, userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chatAdmins[chatID] == nil {
+		s.chatAdmins[chatID] = make(map[int64]bool)
+	}
+	s.chatAdmins[chatID][userID] = true
+}
+
+// Commands returns the bot's default commands set with setMyCommands
+func (s *Server) Commands(token string) []BotCommand {
+	return s.LanguageCommands(token, "")
+}
+
+// LanguageCommands returns the bot's commands set with setMyCommands for the users with specific language_code
+func (s *Server) LanguageCommands(token string, languageCode string) []BotCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, exists := s.bots[token]; exists {
+		return append([]BotCommand{}, b.commands[languageCode]...)
+	}
+	return nil
+}
+
+// BlockBot makes all requests to the chat fail as if the user has blocked the bot
+func (s *Server) BlockBot(chatID int64) {
+	s.SetChatError(chatID, ErrBotBlocked)
+}
+
+// MigrateChat makes all requests to the group fail as if it was upgraded to the supergroup with toChatID
+func (s *Server) MigrateChat(chatID int64, toChatID int64) {
+	s.SetChatError(chatID, APIError{Code: 400, Description: "Bad Request: group chat was upgraded to a supergroup chat", MigrateToChatID: toChatID})
+}
+
+// RetryAfter makes the next request to the chat fail with 429 Too Many Requests
+func (s *Server) RetryAfter(chatID int64, seconds int) {
+	s.FailNext(chatID, APIError{Code: 429, Description: fmt.Sprintf("Too Many Requests: retry after %d", seconds), RetryAfter: seconds})
+}
+
+// SetChatError makes all requests to the chat fail with err until ClearChatError is called
+func (s *Server) SetChatError(chatID int64, err APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.chatErrors[chatID] = err
+}
+
+// ClearChatError removes the error set with SetChatError, BlockBot or MigrateChat
+func (s *Server) ClearChatError(chatID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chatErrors, chatID)
+}
+
+// FailNext makes the next request to the chat fail with err
+func (s *Server) FailNext(chatID int64, err APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextErrors[chatID] = err
+}
+
+// Requests returns the calls of method received by the server. Empty method returns all of them
+func (s *Server) Requests(method string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var requests []Request
+	for _, r := range s.requests {
+		if method == "" || r.Method == method {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// Messages returns the current state of messages sent by bots to the chat: edits are applied and deleted messages are removed
+func (s *Server) Messages(chatID int64) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]Message, len(s.messages[chatID]))
+	for i, m := range s.messages[chatID] {
+		messages[i] = *m
+	}
+	return messages
+}
+
+// WaitMessages waits for at least n messages sent to the chat. Useful because messages are sent asynchronously from the jobs queue
+func (s *Server) WaitMessages(chatID int64, n int, timeout time.Duration) ([]Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		count := len(s.messages[chatID])
+		s.mu.Unlock()
+
+		if count >= n {
+			return s.Messages(chatID), nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return s.Messages(chatID), fmt.Errorf("got %d messages in chat %d, want %d", count, chatID, n)
+		}
+	}
+}
+
+// WaitRequest waits for the n-th call of method
+func (s *Server) WaitRequest(method string, n int, timeout time.Duration) (Request, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		if requests := s.Requests(method); len(requests) >= n {
+			return requests[n-1], nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Request{}, fmt.Errorf("%s was called less than %d times", method, n)
+		}
+	}
+}
+
+// notify must be called with s.mu locked
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// addFile must be called with s.mu locked
+func (s *Server) addFile(name string, data []byte) File {
+	s.lastID++
+	f := File{ID: fmt.Sprintf("file%d", s.lastID), Name: name, Data: data}
+	s.files[f.ID] = f
+	return f
+}
+
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != "api.telegram.org" {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Scheme = t.target.Scheme
+	u.Host = t.target.Host
+	r2.URL = &u
+	r2.Host = t.target.Host
+
+	return http.DefaultTransport.RoundTrip(r2)
+}
+
+type apiResponse struct {
+	Ok          bool                   `json:"ok"`
+	Result      interface{}            `json:"result,omitempty"`
+	ErrorCode   int                    `json:"error_code,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  *tg.ResponseParameters `json:"parameters,omitempty"`
+}
+
+func writeResponse(w http.ResponseWriter, result interface{}, apiErr *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if apiErr != nil {
+		resp := apiResponse{ErrorCode: apiErr.Code, Description: apiErr.Description}
+		if apiErr.RetryAfter > 0 || apiErr.MigrateToChatID != 0 {
+			resp.Parameters = &tg.ResponseParameters{RetryAfter: apiErr.RetryAfter, MigrateToChatID: apiErr.MigrateToChatID}
+		}
+
+		w.WriteHeader(apiErr.Code)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	json.NewEncoder(w).Encode(apiResponse{Ok: true, Result: result})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// /file/bot<token>/<path>
+	if strings.HasPrefix(r.URL.Path, "/file/bot") {
+		s.serveFile(w, r)
+		return
+	}
+
+	// /bot<token>/<method>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/bot"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(r.URL.Path, "/bot") {
+		writeResponse(w, nil, &APIError{Code: 404, Description: "Not Found"})
+		return
+	}
+
+	token, method := parts[0], parts[1]
+
+	req := Request{Method: method, Token: token, Files: make(map[string]File)}
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		writeResponse(w, nil, &APIError{Code: 400, Description: "Bad Request: " + err.Error()})
+		return
+	}
+	req.Params = r.Form
+
+	s.mu.Lock()
+	b, exists := s.bots[token]
+	if !exists {
+		s.mu.Unlock()
+		writeResponse(w, nil, &APIError{Code: 401, Description: "Unauthorized"})
+		return
+	}
+
+	if r.MultipartForm != nil {
+		for field, headers := range r.MultipartForm.File {
+			if len(headers) == 0 {
+				continue
+			}
+			f, err := headers[0].Open()
+			if err != nil {
+				continue
+			}
+			data, _ := ioutil.ReadAll(f)
+			f.Close()
+			req.Files[field] = s.addFile(headers[0].Filename, data)
+		}
+	}
+
+	s.requests = append(s.requests, req)
+	s.notify()
+	s.mu.Unlock()
+
+	if method == "getUpdates" {
+		s.getUpdates(w, b, req.Params)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, apiErr := s.call(b, req)
+	writeResponse(w, result, apiErr)
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	s.mu.Lock()
+	f, exists := s.files[path]
+	s.mu.Unlock()
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Write(f.Data)
+}
+
+func (s *Server) getUpdates(w http.ResponseWriter, b *bot, params url.Values) {
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	timeout, _ := strconv.Atoi(params.Get("timeout"))
+	wait := time.Duration(timeout) * time.Second
+	if wait > maxLongPollingTimeout {
+		wait = maxLongPollingTimeout
+	}
+	deadline := time.After(wait)
+
+	for {
+		s.mu.Lock()
+
+		// updates with ID less than offset are confirmed
+		var pending []update
+		for _, u := range b.updates {
+			if u.UpdateID >= offset {
+				pending = append(pending, u)
+			}
+		}
+		b.updates = pending
+
+		if len(pending) > limit {
+			pending = pending[:limit]
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(pending) > 0 {
+			writeResponse(w, pending, nil)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			writeResponse(w, []tg.Update{}, nil)
+			return
+		}
+	}
+}
+
+// call must be called with s.mu locked
+func (s *Server) call(b *bot, req Request) (interface{}, *APIError) {
+	p := req.Params
+
+	switch req.Method {
+	case "getMe":
+		return b.user, nil
+	case "getWebhookInfo":
+		return tg.WebhookInfo{URL: b.webhook, PendingUpdateCount: len(b.updates)}, nil
+	case "setWebhook":
+		b.webhook = p.Get("url")
+		return true, nil
+	case "deleteWebhook":
+		b.webhook = ""
+		return true, nil
+	case "answerCallbackQuery", "answerInlineQuery":
+		return true, nil
+	case "setMyCommands":
+		var commands []BotCommand
+		if err := json.Unmarshal([]byte(p.Get("commands")), &commands); err != nil {
+			return nil, &APIError{Code: 400, Description: "Bad Request: can't parse commands JSON object"}
+		}
+		b.commands[p.Get("language_code")] = commands
+		return true, nil
+	case "getMyCommands":
+		return b.commands[p.Get("language_code")], nil
+	case "getFile":
+		f, exists := s.files[p.Get("file_id")]
+		if !exists {
+			return nil, &APIError{Code: 400, Description: "Bad Request: invalid file id"}
+		}
+		return tg.File{FileID: f.ID, FileSize: len(f.Data), FilePath: f.ID}, nil
+	}
+
+	chatID, _ := strconv.ParseInt(p.Get("chat_id"), 10, 64)
+
+	if apiErr := s.chatError(chatID); apiErr != nil {
+		return nil, apiErr
+	}
+
+	switch req.Method {
+	case "getChatMember":
+		userID, _ := strconv.ParseInt(p.Get("user_id"), 10, 64)
+		status := "member"
+		if s.chatAdmins[chatID][userID] {
+			status = "administrator"
+		}
+		return tg.ChatMember{User: &tg.User{ID: userID}, Status: status}, nil
+	case "sendMessage", "sendPhoto", "sendDocument", "sendAudio", "sendVideo", "sendVoice", "sendAnimation", "sendSticker", "sendVenue", "sendContact", "sendPoll":
+		if chatID == 0 {
+			return nil, &APIError{Code: 400, Description: "Bad Request: chat_id is empty"}
+		}
+
+		msg := &Message{ChatID: chatID, Date: time.Now(), Text: p.Get("text"), ParseMode: p.Get("parse_mode"), ReplyMarkup: p.Get("reply_markup"), Silent: p.Get("disable_notification") == "true"}
+		msg.ReplyToID, _ = strconv.Atoi(p.Get("reply_to_message_id"))
+
+		switch req.Method {
+		case "sendMessage":
+			if msg.Text == "" {
+				return nil, &APIError{Code: 400, Description: "Bad Request: message text is empty"}
+			}
+		case "sendVenue":
+			lat, _ := strconv.ParseFloat(p.Get("latitude"), 64)
+			lng, _ := strconv.ParseFloat(p.Get("longitude"), 64)
+			if p.Get("title") == "" || p.Get("address") == "" {
+				return nil, &APIError{Code: 400, Description: "Bad Request: venue title and address are required"}
+			}
+			msg.Venue = &tg.Venue{Location: tg.Location{Latitude: lat, Longitude: lng}, Title: p.Get("title"), Address: p.Get("address"), FoursquareID: p.Get("foursquare_id")}
+		case "sendContact":
+			if p.Get("phone_number") == "" || p.Get("first_name") == "" {
+				return nil, &APIError{Code: 400, Description: "Bad Request: contact phone_number and first_name are required"}
+			}
+			msg.Contact = &tg.Contact{PhoneNumber: p.Get("phone_number"), FirstName: p.Get("first_name"), LastName: p.Get("last_name")}
+		case "sendPoll":
+			poll := &Poll{Question: p.Get("question"), Anonymous: p.Get("is_anonymous") != "false", MultipleAnswers: p.Get("allows_multiple_answers") == "true", Type: p.Get("type")}
+			json.Unmarshal([]byte(p.Get("options")), &poll.Options)
+			if poll.Question == "" || len(poll.Options) < 2 || len(poll.Options) > 10 {
+				return nil, &APIError{Code: 400, Description: "Bad Request: poll must have the question and 2-10 options"}
+			}
+			if poll.Type == "" {
+				poll.Type = "regular"
+			}
+
+			s.lastID++
+			poll.ID = strconv.Itoa(s.lastID)
+			msg.Poll = poll
+		default:
+			field := strings.ToLower(strings.TrimPrefix(req.Method, "send"))
+			f := s.fileParam(req, field)
+			if f == nil && p.Get(field) != "" {
+				return nil, &APIError{Code: 400, Description: "Bad Request: wrong file identifier/HTTP URL specified"}
+			} else if f == nil {
+				return nil, &APIError{Code: 400, Description: "Bad Request: there is no " + field + " in the request"}
+			}
+
+			msg.Text = p.Get("caption")
+			switch field {
+			case "photo":
+				msg.Photo = f
+			case "document":
+				msg.Document = f
+			case "audio":
+				msg.Audio = f
+			case "video":
+				msg.Video = f
+			case "voice":
+				msg.Voice = f
+			case "animation":
+				msg.Animation = f
+			case "sticker":
+				msg.Text = ""
+				msg.Sticker = f
+			}
+		}
+
+		s.lastMsgID[chatID]++
+		msg.MessageID = s.lastMsgID[chatID]
+		s.messages[chatID] = append(s.messages[chatID], msg)
+
+		if msg.Poll != nil {
+			return sentPoll{s.tgMessage(b, msg), msg.Poll}, nil
+		}
+		return s.tgMessage(b, msg), nil
+	case "sendMediaGroup":
+		if chatID == 0 {
+			return nil, &APIError{Code: 400, Description: "Bad Request: chat_id is empty"}
+		}
+
+		var media []struct {
+			Type      string `json:"type"`
+			Media     string `json:"media"`
+			Caption   string `json:"caption"`
+			ParseMode string `json:"parse_mode"`
+		}
+		if err := json.Unmarshal([]byte(p.Get("media")), &media); err != nil || len(media) < 2 || len(media) > 10 {
+			return nil, &APIError{Code: 400, Description: "Bad Request: media must contain 2-10 items"}
+		}
+
+		var msgs []*Message
+		s.lastID++
+		groupID := strconv.Itoa(s.lastID)
+		for _, item := range media {
+			var f *File
+			if strings.HasPrefix(item.Media, "attach://") {
+				f = s.fileParam(req, strings.TrimPrefix(item.Media, "attach://"))
+			} else if existing, exists := s.files[item.Media]; exists {
+				f = &existing
+			}
+
+			if f == nil {
+				return nil, &APIError{Code: 400, Description: "Bad Request: wrong file identifier/HTTP URL specified"}
+			}
+
+			msg := &Message{ChatID: chatID, Date: time.Now(), Text: item.Caption, ParseMode: item.ParseMode, MediaGroupID: groupID}
+			switch item.Type {
+			case "photo":
+				msg.Photo = f
+			case "video":
+				msg.Video = f
+			case "document":
+				msg.Document = f
+			default:
+				return nil, &APIError{Code: 400, Description: "Bad Request: unsupported media type " + item.Type}
+			}
+			msgs = append(msgs, msg)
+		}
+
+		var result []*tg.Message
+		for _, msg := range msgs {
+			s.lastMsgID[chatID]++
+			msg.MessageID = s.lastMsgID[chatID]
+			s.messages[chatID] = append(s.messages[chatID], msg)
+			result = append(result, s.tgMessage(b, msg))
+		}
+
+		return result, nil
+	case "editMessageText", "editMessageReplyMarkup", "editMessageCaption":
+		msg := s.findMessage(chatID, p)
+		if msg == nil {
+			return nil, &APIError{Code: 400, Description: "Bad Request: message to edit not found"}
+		}
+
+		text, markup := msg.Text, p.Get("reply_markup")
+		if req.Method == "editMessageText" {
+			text = p.Get("text")
+		} else if req.Method == "editMessageCaption" {
+			text = p.Get("caption")
+		}
+
+		if text == msg.Text && markup == msg.ReplyMarkup {
+			apiErr := ErrMsgNotModified
+			return nil, &apiErr
+		}
+
+		msg.Text, msg.ReplyMarkup, msg.Edited = text, markup, true
+		if req.Method == "editMessageText" {
+			msg.ParseMode = p.Get("parse_mode")
+		}
+
+		if msg.InlineMessageID != "" {
+			return true, nil
+		}
+		return s.tgMessage(b, msg), nil
+	case "deleteMessage":
+		msgID, _ := strconv.Atoi(p.Get("message_id"))
+		for i, m := range s.messages[chatID] {
+			if m.MessageID == msgID {
+				s.messages[chatID] = append(s.messages[chatID][:i], s.messages[chatID][i+1:]...)
+				return true, nil
+			}
+		}
+		return nil, &APIError{Code: 400, Description: "Bad Request: message to delete not found"}
+	}
+
+	return nil, &APIError{Code: 404, Description: "Not Found"}
+}
+
+// AddInlineMessage stores the message sent via inline mode, so it can be edited by inline_message_id
+func (s *Server) AddInlineMessage(inlineMessageID string, text string) Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := &Message{InlineMessageID: inlineMessageID, Date: time.Now(), Text: text}
+	s.inlineMsgs[inlineMessageID] = msg
+	return *msg
+}
+
+// InlineMessage returns the current state of the message sent via inline mode
+func (s *Server) InlineMessage(inlineMessageID string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.inlineMsgs[inlineMessageID]
+	if !exists {
+		return Message{}, false
+	}
+	return *msg, true
+}
+
+// chatError must be called with s.mu locked
+func (s *Server) chatError(chatID int64) *APIError {
+	if chatID == 0 {
+		return nil
+	}
+
+	if apiErr, exists := s.nextErrors[chatID]; exists {
+		delete(s.nextErrors, chatID)
+		return &apiErr
+	}
+
+	if apiErr, exists := s.chatErrors[chatID]; exists {
+		return &apiErr
+	}
+
+	return nil
+}
+
+// findMessage must be called with s.mu locked
+func (s *Server) findMessage(chatID int64, p url.Values) *Message {
+	if id := p.Get("inline_message_id"); id != "" {
+		return s.inlineMsgs[id]
+	}
+
+	msgID, _ := strconv.Atoi(p.Get("message_id"))
+	for _, m := range s.messages[chatID] {
+		if m.MessageID == msgID {
+			return m
+		}
+	}
+	return nil
+}
+
+// fileParam returns the uploaded file, the one referenced by file_id or the remote file URL. Must be called with s.mu locked
+func (s *Server) fileParam(req Request, field string) *File {
+	if f, exists := req.Files[field]; exists {
+		return &f
+	}
+
+	if f, exists := s.files[req.Params.Get(field)]; exists {
+		return &f
+	}
+
+	if v := req.Params.Get(field); strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+		// remote files are not downloaded, URL is kept as the file name
+		f := s.addFile(v, nil)
+		return &f
+	}
+
+	return nil
+}
+
+func (s *Server) tgMessage(b *bot, msg *Message) *tg.Message {
+	m := &tg.Message{
+		MessageID: msg.MessageID,
+		From:      &b.user,
+		Date:      int(msg.Date.Unix()),
+		Chat:      &tg.Chat{ID: msg.ChatID, Type: chatType(msg.ChatID)},
+		Text:      msg.Text,
+	}
+
+	if msg.Edited {
+		m.EditDate = int(time.Now().Unix())
+	}
+
+	if msg.Photo != nil {
+		m.Text = ""
+		m.Caption = msg.Text
+		m.Photo = &[]tg.PhotoSize{{FileID: msg.Photo.ID, FileSize: len(msg.Photo.Data)}}
+	}
+
+	if msg.Video != nil {
+		m.Text = ""
+		m.Caption = msg.Text
+		m.Video = &tg.Video{FileID: msg.Video.ID, FileSize: len(msg.Video.Data)}
+	}
+
+	if msg.Document != nil {
+		m.Text = ""
+		m.Caption = msg.Text
+		m.Document = &tg.Document{FileID: msg.Document.ID, FileName: msg.Document.Name, FileSize: len(msg.Document.Data)}
+	}
+
+	if msg.Animation != nil {
+		// animations are sent with the document field for the backward compatibility
+		m.Text = ""
+		m.Caption = msg.Text
+		m.Document = &tg.Document{FileID: msg.Animation.ID, FileName: msg.Animation.Name, FileSize: len(msg.Animation.Data)}
+	}
+
+	if msg.Audio != nil {
+		m.Text = ""
+		m.Caption = msg.Text
+		m.Audio = &tg.Audio{FileID: msg.Audio.ID, FileSize: len(msg.Audio.Data)}
+	}
+
+	if msg.Voice != nil {
+		m.Text = ""
+		m.Caption = msg.Text
+		m.Voice = &tg.Voice{FileID: msg.Voice.ID, FileSize: len(msg.Voice.Data)}
+	}
+
+	if msg.Sticker != nil {
+		m.Sticker = &tg.Sticker{FileID: msg.Sticker.ID, FileSize: len(msg.Sticker.Data)}
+	}
+
+	m.Venue = msg.Venue
+	m.Contact = msg.Contact
+
+	return m
+}
+
+func chatType(chatID int64) string {
+	if chatID > 0 {
+		return "private"
+	} else if chatID < -1000000000000 {
+		return "supergroup"
+	}
+	return "group"
+}
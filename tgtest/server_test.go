@@ -0,0 +1,188 @@
+package tgtest
+
+import (
+	"io/ioutil"
+	"testing"
+
+	tg "github.com/requilence/telegram-bot-api"
+)
+
+const testToken = "123:secret"
+
+func newTestServer(t *testing.T) (*Server, *tg.BotAPI) {
+	s := NewServer()
+	s.AddBot(testToken, "test_bot")
+
+	api, err := s.BotAPI(testToken)
+	if err != nil {
+		s.Close()
+		t.Fatalf("BotAPI() error = %v", err)
+	}
+
+	return s, api
+}
+
+func TestServer_GetMe(t *testing.T) {
+	s, api := newTestServer(t)
+	defer s.Close()
+
+	if api.Self.ID != 123 || api.Self.UserName != "test_bot" {
+		t.Errorf("getMe = %+v, want test_bot with id 123", api.Self)
+	}
+
+	if _, err := s.BotAPI("456:unknown"); err == nil {
+		t.Error("BotAPI() with unknown token must return an error")
+	}
+}
+
+func TestServer_Messages(t *testing.T) {
+	s, api := newTestServer(t)
+	defer s.Close()
+
+	msg := tg.NewMessage(1, "hello")
+	msg.ReplyMarkup = tg.NewInlineKeyboardMarkup(tg.NewInlineKeyboardRow(tg.NewInlineKeyboardButtonData("Yes", "yes")))
+	sent, err := api.Send(msg)
+	if err != nil {
+		t.Fatalf("sendMessage error = %v", err)
+	}
+
+	messages := s.Messages(1)
+	if len(messages) != 1 || messages[0].Text != "hello" || messages[0].MessageID != sent.MessageID {
+		t.Fatalf("Messages() = %+v, want 1 message 'hello'", messages)
+	}
+
+	if kb := messages[0].InlineKeyboard(); len(kb) != 1 || kb[0][0].Text != "Yes" || *kb[0][0].CallbackData != "yes" {
+		t.Errorf("InlineKeyboard() = %+v, want [[Yes]]", kb)
+	}
+
+	_, err = api.Send(tg.NewEditMessageText(1, sent.MessageID, "edited"))
+	if err != nil {
+		t.Errorf("editMessageText error = %v", err)
+	}
+
+	if messages = s.Messages(1); messages[0].Text != "edited" || !messages[0].Edited {
+		t.Errorf("Messages() after edit = %+v, want edited text", messages)
+	}
+
+	_, err = api.DeleteMessage(tg.DeleteMessageConfig{ChatID: 1, MessageID: sent.MessageID})
+	if err != nil {
+		t.Errorf("deleteMessage error = %v", err)
+	}
+
+	_, err = api.DeleteMessage(tg.DeleteMessageConfig{ChatID: 1, MessageID: sent.MessageID})
+	if err == nil {
+		t.Error("deleteMessage of already deleted message must return an error")
+	}
+
+	if messages = s.Messages(1); len(messages) != 0 {
+		t.Errorf("Messages() after delete = %+v, want none", messages)
+	}
+
+	_, err = api.AnswerCallbackQuery(tg.NewCallback("1", "done"))
+	if err != nil {
+		t.Errorf("answerCallbackQuery error = %v", err)
+	}
+
+	if r := s.Requests("answerCallbackQuery"); len(r) != 1 || r[0].Params.Get("text") != "done" {
+		t.Errorf("Requests(answerCallbackQuery) = %+v, want 1 with text 'done'", r)
+	}
+}
+
+func TestServer_Updates(t *testing.T) {
+	s, api := newTestServer(t)
+	defer s.Close()
+
+	s.SendText(testToken, tg.Chat{ID: 1, Type: "private"}, tg.User{ID: 1, FirstName: "User"}, "/start")
+	s.PressButton(testToken, tg.User{ID: 1}, Message{ChatID: 1, MessageID: 10}, "yes")
+
+	updates, err := api.GetUpdates(tg.UpdateConfig{Timeout: 1})
+	if err != nil {
+		t.Fatalf("getUpdates error = %v", err)
+	}
+
+	if len(updates) != 2 || updates[0].Message.Text != "/start" || updates[1].CallbackQuery.Data != "yes" || updates[1].CallbackQuery.Message.MessageID != 10 {
+		t.Fatalf("getUpdates = %+v, want message and callback query", updates)
+	}
+
+	// confirm received updates
+	updates, err = api.GetUpdates(tg.UpdateConfig{Offset: updates[1].UpdateID + 1})
+	if err != nil || len(updates) != 0 {
+		t.Errorf("getUpdates with offset = %+v, %v, want no updates", updates, err)
+	}
+}
+
+func TestServer_Files(t *testing.T) {
+	s, api := newTestServer(t)
+	defer s.Close()
+
+	upload := tg.NewDocumentUpload(1, tg.FileBytes{Name: "doc.txt", Bytes: []byte("content")})
+	upload.Caption = "caption"
+	sent, err := api.Send(upload)
+	if err != nil {
+		t.Fatalf("sendDocument error = %v", err)
+	}
+
+	if sent.Document == nil || sent.Caption != "caption" {
+		t.Fatalf("sendDocument = %+v, want document with caption", sent)
+	}
+
+	// resend by file_id
+	_, err = api.Send(tg.NewPhotoShare(2, sent.Document.FileID))
+	if err != nil {
+		t.Errorf("sendPhoto by file_id error = %v", err)
+	}
+
+	if messages := s.Messages(2); len(messages) != 1 || messages[0].Photo == nil || messages[0].Photo.Name != "doc.txt" {
+		t.Errorf("Messages() = %+v, want photo", messages)
+	}
+
+	link, err := api.GetFileDirectURL(sent.Document.FileID)
+	if err != nil {
+		t.Fatalf("getFile error = %v", err)
+	}
+
+	resp, err := s.Client().Get(link)
+	if err != nil {
+		t.Fatalf("file download error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if data, _ := ioutil.ReadAll(resp.Body); string(data) != "content" {
+		t.Errorf("downloaded file = %q, want %q", data, "content")
+	}
+}
+
+func TestServer_Errors(t *testing.T) {
+	s, api := newTestServer(t)
+	defer s.Close()
+
+	s.BlockBot(1)
+	s.RetryAfter(2, 5)
+	s.MigrateChat(-3, -1000000000003)
+
+	tests := []struct {
+		name   string
+		chatID int64
+		check  func(tg.Error) bool
+	}{
+		{"blocked", 1, func(e tg.Error) bool { return e.BotStoppedForUser() }},
+		{"retry after", 2, func(e tg.Error) bool { return e.TooManyRequests() && e.Parameters.RetryAfter == 5 }},
+		{"migrated", -3, func(e tg.Error) bool { return e.ChatMigrated() && e.Parameters.MigrateToChatID == -1000000000003 }},
+	}
+	for _, tt := range tests {
+		_, err := api.Send(tg.NewMessage(tt.chatID, "text"))
+		if tgErr, ok := err.(tg.Error); !ok || !tt.check(tgErr) {
+			t.Errorf("%q. sendMessage error = %v", tt.name, err)
+		}
+	}
+
+	// RetryAfter fails only once
+	if _, err := api.Send(tg.NewMessage(2, "text")); err != nil {
+		t.Errorf("sendMessage after 429 error = %v", err)
+	}
+
+	s.ClearChatError(1)
+	if _, err := api.Send(tg.NewMessage(1, "text")); err != nil {
+		t.Errorf("sendMessage after ClearChatError error = %v", err)
+	}
+}
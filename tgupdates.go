@@ -1,8 +1,10 @@
 package integram
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -74,7 +76,7 @@ func updateRoutine(b *Bot, u *tg.Update) {
 
 	}
 
-	db := mongoSession.Clone().DB(mongo.Database)
+	db := cloneStorage()
 
 	defer func() {
 		m.Unlock()
@@ -85,7 +87,7 @@ func updateRoutine(b *Bot, u *tg.Update) {
 			}
 		}()
 
-		db.Session.Close()
+		db.Close()
 	}()
 
 	service, context := tgUpdateHandler(u, b, db)
@@ -94,8 +96,55 @@ func updateRoutine(b *Bot, u *tg.Update) {
 		return
 	}
 
-	if context.Message != nil && !context.MessageEdited {
+	context.updateReceivedAt = updateReceivedAt
 
+	err := service.middlewareChain()(context)
+	if err != nil && err != errUpdateHandlerNotSet {
+		context.Log().WithError(err).WithField("secSpentSinceUpdate", time.Now().Sub(updateReceivedAt).Seconds()).Error("BotUpdateHandler error")
+	}
+}
+
+// pollAnswerRoutine processes the poll answer. It is not supported by tg.Update so it is decoded separately
+func pollAnswerRoutine(b *Bot, pa *tgPollAnswer) {
+	if !Config.Debug {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := stack(3)
+				log.Errorf("Panic recovery at pollAnswerRoutine -> %s\n%s\n", r, stack)
+			}
+		}()
+	}
+	updateReceivedAt := time.Now()
+
+	db := cloneStorage()
+	defer db.Close()
+
+	service, context := tgPollAnswerHandler(pa, b, db)
+
+	if service == nil || context == nil {
+		return
+	}
+
+	context.updateReceivedAt = updateReceivedAt
+
+	err := service.middlewareChain()(context)
+	if err != nil && err != errUpdateHandlerNotSet {
+		context.Log().WithError(err).WithField("secSpentSinceUpdate", time.Now().Sub(updateReceivedAt).Seconds()).Error("BotUpdateHandler error")
+	}
+}
+
+// dispatchUpdate passes the update to the service's handlers and actions. It is the last handler of the middleware chain
+func dispatchUpdate(context *Context) error {
+	service := context.Service()
+
+	if context.Callback != nil {
+		context.callCallbackAction()
+		return nil
+	} else if context.Message != nil && context.MessageEdited {
+		context.callEditAction()
+		return nil
+	} else if context.Message != nil {
+		var handlerErr error
 		replyActionProcessed := false
 		if context.Message.ReplyToMessage != nil {
 			rm := context.Message.ReplyToMessage
@@ -142,115 +191,174 @@ func updateRoutine(b *Bot, u *tg.Update) {
 
 		}
 
+		if !replyActionProcessed {
+			replyActionProcessed = context.handleCommand()
+		}
+
+		if !replyActionProcessed {
+			replyActionProcessed = context.handleConversation()
+		}
+
 		if !replyActionProcessed {
 			if service.TGNewMessageHandler == nil {
 				context.Log().Warn("Received Message but TGNewMessageHandler not set for service")
-				return
+				return errUpdateHandlerNotSet
 			}
 
-			err := service.TGNewMessageHandler(context)
-			if err != nil {
-				context.Log().WithError(err).Error("BotUpdateHandler error")
-			}
+			handlerErr = service.TGNewMessageHandler(context)
 		}
 
 		// Save incoming message metadata(text and files are excluded) in case it has onReply/onEdit actions or have associated event
 		if context.Message.OnEditAction != "" || context.Message.OnReplyAction != "" || len(context.Message.EventID) > 0 {
-			err := context.Message.Message.saveToDB(db)
+			err := context.Message.Message.saveToDB(context.Storage())
 			if err != nil {
 				log.WithError(err).Error("can't add incoming message to db")
 			}
 		}
 
-		if context.messageAnsweredAt != nil {
-			context.StatIncChat(StatIncomingMessageAnswered)
-		} else {
-			context.StatIncChat(StatIncomingMessageNotAnswered)
+		// If this message is keyboard answer - remove that keyboard from user/chat
+		if context.Message.ReplyToMessage != nil && context.Message.ReplyToMessage.om != nil && context.Message.ReplyToMessage.om.OneTimeKeyboard {
+			key, _ := context.KeyboardAnswer()
+
+			if key != "" {
+				var err error
+				// if received reply is result of button pressed
+				// TODO: fix for non-selective one_time_keyboard in group chat
+				_, err = context.Storage().C("users").UpdateAll(bson.M{}, bson.M{"$pull": bson.M{"keyboardperchat": bson.M{"chatid": context.Chat.ID, "msgid": context.Message.ReplyToMessage.ID}}})
+				if err != nil {
+					log.WithError(err).Debugf("can't remove onetime keyboard from user")
+				}
+
+				if context.Chat.IsGroup() {
+					err = context.Storage().C("chats").Update(bson.M{"_id": context.Chat.ID, "keyboard.msgid": context.Message.ReplyToMessage.ID}, bson.M{"$unset": bson.M{"keyboard": true}})
+				} else {
+					_, err = context.Storage().C("chats").UpdateAll(bson.M{"_id": context.Chat.ID}, bson.M{"$pull": bson.M{"keyboardperbot": bson.M{"botid": context.Message.BotID, "msgid": context.Message.ReplyToMessage.ID}}})
+				}
+				if err != nil {
+					log.WithError(err).Debugf("can't remove onetime keyboard from chat")
+				}
+			}
+
 		}
+
+		return handlerErr
 	} else if context.InlineQuery != nil {
 		if service.TGInlineQueryHandler == nil {
 			context.Log().Warn("Received InlineQuery but TGInlineQueryHandler not set for service")
-			return
+			return errUpdateHandlerNotSet
 		}
 
-		queryHandlerStarted := time.Now()
-		err := service.TGInlineQueryHandler(context)
-		if err != nil {
-			if strings.Contains(err.Error(), "QUERY_ID_INVALID") {
-				context.StatIncUser(StatInlineQueryTimeouted)
-			} else if !strings.Contains(err.Error(), "context canceled") {
-				context.StatIncUser(StatInlineQueryCanceled)
-			}
-			context.Log().WithError(err).WithField("secSpent", time.Now().Sub(queryHandlerStarted).Seconds()).WithField("secSpentSinceUpdate", time.Now().Sub(updateReceivedAt).Seconds()).Error("BotUpdateHandler InlineQuery error")
-			context.StatIncUser(StatInlineQueryProcessingError)
-		} else {
-			if context.inlineQueryAnsweredAt == nil {
-				context.StatIncUser(StatInlineQueryNotAnswered)
-
-				context.Log().WithError(err).Error("BotUpdateHandler InlineQuery not answered")
-			} else {
-				context.StatIncUser(StatInlineQueryAnswered)
-
-				secsSpent := context.inlineQueryAnsweredAt.Sub(updateReceivedAt).Seconds()
-				if secsSpent > 10 {
-					context.Log().WithError(err).Errorf("BotUpdateHandler InlineQuery 10 sec exceeded: %.1f sec spent after update, %.1f sec after the handle", secsSpent, time.Now().Sub(queryHandlerStarted).Seconds())
-				}
-			}
-		}
-		return
+		return service.TGInlineQueryHandler(context)
 	} else if context.ChosenInlineResult != nil {
-
 		if service.TGChosenInlineResultHandler == nil {
 			context.Log().Warn("Received ChosenInlineResult but TGChosenInlineResultHandler not set for service")
-			return
+			return errUpdateHandlerNotSet
 		}
 
-		err := service.TGChosenInlineResultHandler(context)
-		context.StatIncUser(StatInlineQueryChosen)
+		return service.TGChosenInlineResultHandler(context)
+	} else if context.PollAnswer != nil {
+		if service.TGPollAnswerHandler == nil {
+			context.Log().Warn("Received PollAnswer but TGPollAnswerHandler not set for service")
+			return errUpdateHandlerNotSet
+		}
 
-		if err != nil {
-			context.Log().WithError(err).Error("BotUpdateHandler error")
+		return service.TGPollAnswerHandler(context)
+	}
+
+	return nil
+}
+
+// tgUpdate is tg.Update with the poll answer that tg.Update doesn't support
+type tgUpdate struct {
+	tg.Update
+	tgPollAnswerUpdate
+}
+
+// getTGUpdates works like tg.BotAPI's GetUpdates, but also decodes the poll answers
+func getTGUpdates(api *tg.BotAPI, config tg.UpdateConfig) ([]tgUpdate, error) {
+	v := url.Values{}
+	if config.Offset != 0 {
+		v.Add("offset", strconv.Itoa(config.Offset))
+	}
+	if config.Limit > 0 {
+		v.Add("limit", strconv.Itoa(config.Limit))
+	}
+	if config.Timeout > 0 {
+		v.Add("timeout", strconv.Itoa(config.Timeout))
+	}
+
+	resp, err := api.MakeRequest("getUpdates", v)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []tgUpdate
+	err = json.Unmarshal(resp.Result, &updates)
+	return updates, err
+}
+
+// correlateChosenInlineResults sets the chat's message sent with the inline result to the chosen inline result update from the same batch.
+// Returns the indexes of the correlated message updates that should be skipped
+func correlateChosenInlineResults(updates []tgUpdate) map[int]struct{} {
+	messageFrom := map[int64]int{}
+	for i, u := range updates {
+		if u.Message != nil && u.Message.From != nil {
+			messageFrom[u.Message.From.ID] = i
 		}
-		return
 	}
 
-	// If this message is keyboard answer - remove that keyboard from user/chat
-	if context.Message.ReplyToMessage != nil && context.Message.ReplyToMessage.om != nil && context.Message.ReplyToMessage.om.OneTimeKeyboard {
-		key, _ := context.KeyboardAnswer()
+	skip := map[int]struct{}{}
+	for i, u := range updates {
+		if u.ChosenInlineResult == nil || u.ChosenInlineResult.From == nil {
+			continue
+		}
 
-		if key != "" {
-			var err error
-			// if received reply is result of button pressed
-			// TODO: fix for non-selective one_time_keyboard in group chat
-			_, err = db.C("users").UpdateAll(bson.M{}, bson.M{"$pull": bson.M{"keyboardperchat": bson.M{"chatid": context.Chat.ID, "msgid": context.Message.ReplyToMessage.ID}}})
-			if err != nil {
-				log.WithError(err).Debugf("can't remove onetime keyboard from user")
+		if j, exists := messageFrom[u.ChosenInlineResult.From.ID]; exists {
+			// update IDs of the chosen result and the message are close to each other
+			if diff := updates[j].UpdateID - u.UpdateID; diff > -10 && diff < 10 {
+				msg := *updates[j].Message
+				updates[i].Message = &msg
+				skip[j] = struct{}{}
 			}
+		}
+	}
+	return skip
+}
 
-			if context.Chat.IsGroup() {
-				err = db.C("chats").Update(bson.M{"_id": context.Chat.ID, "keyboard.msgid": context.Message.ReplyToMessage.ID}, bson.M{"$unset": bson.M{"keyboard": true}})
-			} else {
-				_, err = db.C("chats").UpdateAll(bson.M{"_id": context.Chat.ID}, bson.M{"$pull": bson.M{"keyboardperbot": bson.M{"botid": context.Message.BotID, "msgid": context.Message.ReplyToMessage.ID}}})
-			}
+// getTGUpdatesChan long polls the updates the same way as tg.BotAPI's GetUpdatesChan does
+func getTGUpdatesChan(api *tg.BotAPI, config tg.UpdateConfig) <-chan tgUpdate {
+	ch := make(chan tgUpdate, api.Buffer)
+
+	go func() {
+		for {
+			updates, err := getTGUpdates(api, config)
 			if err != nil {
-				log.WithError(err).Debugf("can't remove onetime keyboard from chat")
+				log.WithError(err).Error("Failed to get updates, retrying in 3 seconds...")
+				time.Sleep(time.Second * 3)
+				continue
 			}
-		}
 
-	}
+			skip := correlateChosenInlineResults(updates)
 
+			for i, u := range updates {
+				config.Offset = u.UpdateID + 1
+				if _, skipped := skip[i]; skipped {
+					continue
+				}
+
+				ch <- u
+			}
+		}
+	}()
+
+	return ch
 }
 
 func (bot *Bot) listen() {
-	api := bot.API
 	if bot.updatesChan == nil {
-		var err error
-		bot.updatesChan, err = api.GetUpdatesChan(tg.UpdateConfig{Timeout: randomInRange(10, 20), Limit: 100})
-		if err != nil {
-			log.WithField("bot", bot.ID).WithError(err).Panic("Can't get updatesChan")
-		}
+		bot.updatesChan = getTGUpdatesChan(bot.API, tg.UpdateConfig{Timeout: randomInRange(10, 20), Limit: 100})
 	}
-	go func(c <-chan tg.Update, b *Bot) {
+	go func(c <-chan tgUpdate, b *Bot) {
 		var context Context
 
 		defer func() {
@@ -265,7 +373,11 @@ func (bot *Bot) listen() {
 
 		for {
 			u := <-c
-			go updateRoutine(b, &u)
+			if u.PollAnswer != nil {
+				go pollAnswerRoutine(b, u.PollAnswer)
+			} else {
+				go updateRoutine(b, &u.Update)
+			}
 		}
 
 	}(bot.updatesChan, bot)
@@ -359,7 +471,7 @@ func incomingMessageFromTGMessage(m *tg.Message) IncomingMessage {
 	return im
 
 }
-func tgCallbackHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context) {
+func tgCallbackHandler(u *tg.Update, b *Bot, db Storage) (*Service, *Context) {
 	var rm *Message
 	var err error
 	if u.CallbackQuery.Message != nil {
@@ -391,7 +503,7 @@ func tgCallbackHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Conte
 			}
 		}
 		ctx := &Context{
-			db:          db,
+			storage:     db,
 			ServiceName: service.Name,
 			User:        tgUser(u.CallbackQuery.From),
 			Callback:    &callback{ID: u.CallbackQuery.ID, Data: cbData, Message: rm.om, State: cbState}}
@@ -414,12 +526,71 @@ func tgCallbackHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Conte
 		ctx.User.ctx = ctx
 		ctx.Chat.ctx = ctx
 
-		if rm.OnCallbackAction != "" {
-			log.Debugf("CallbackAction found %s", rm.OnCallbackAction)
+		return service, ctx
+	}
+
+	return nil, nil
+
+}
+
+// callCallbackAction calls the action set with SetCallbackAction for the message where inline button was pressed
+func (c *Context) callCallbackAction() {
+	rm := c.Callback.Message
+	if rm.OnCallbackAction != "" {
+		log.Debugf("CallbackAction found %s", rm.OnCallbackAction)
+		// Instantiate a new variable to hold this argument
+		if handler, ok := actionFuncs[c.Service().trimFuncPath(rm.OnCallbackAction)]; ok {
+			handlerType := reflect.TypeOf(handler)
+			log.Debugf("handler %v: %v %v\n", rm.OnCallbackAction, handlerType.String(), handlerType.Kind().String())
+			handlerArgsInterfaces := make([]interface{}, handlerType.NumIn()-1)
+			handlerArgs := make([]reflect.Value, handlerType.NumIn())
+
+			for i := 1; i < handlerType.NumIn(); i++ {
+				dataVal := reflect.New(handlerType.In(i))
+				handlerArgsInterfaces[i-1] = dataVal.Interface()
+			}
+			if err := decode(rm.OnCallbackData, &handlerArgsInterfaces); err != nil {
+				c.Log().WithField("handler", rm.OnCallbackAction).WithError(err).Error("Can't decode replyHandler's args")
+			}
+			handlerArgs[0] = reflect.ValueOf(c)
+			for i := 0; i < len(handlerArgsInterfaces); i++ {
+				handlerArgs[i+1] = reflect.ValueOf(handlerArgsInterfaces[i])
+			}
+
+			if len(handlerArgs) > 0 {
+				handlerVal := reflect.ValueOf(handler)
+				returnVals := handlerVal.Call(handlerArgs)
+
+				if !returnVals[0].IsNil() {
+					err := returnVals[0].Interface().(error)
+					// NOTE: panics will be caught by the recover statement above
+					c.Log().WithField("handler", rm.OnCallbackAction).WithError(err).Error("callbackAction failed")
+					c.AnswerCallbackQuery(c.T("callback.failed"), false)
+				} else {
+					if c.Callback.AnsweredAt == nil {
+						c.AnswerCallbackQuery("", false)
+					}
+				}
+			}
+		} else {
+			c.Log().WithField("handler", rm.OnCallbackAction).Error("Callback handler not registered")
+		}
+
+	}
+}
+
+// callEditAction calls the action set with SetEditAction for the edited message
+func (c *Context) callEditAction() {
+	rm, _ := findMessage(c.Storage(), c.Message.ChatID, c.Message.BotID, c.Message.MsgID)
+	if rm != nil {
+		log.Debugf("Received edit for message %d", rm.MsgID)
+
+		if rm.OnEditAction != "" {
+			log.Debugf("onEditHandler found %s", rm.OnEditAction)
 			// Instantiate a new variable to hold this argument
-			if handler, ok := actionFuncs[service.trimFuncPath(rm.OnCallbackAction)]; ok {
+			if handler, ok := actionFuncs[c.Service().trimFuncPath(rm.OnEditAction)]; ok {
 				handlerType := reflect.TypeOf(handler)
-				log.Debugf("handler %v: %v %v\n", rm.OnCallbackAction, handlerType.String(), handlerType.Kind().String())
+				log.Debugf("handler %v: %v %v\n", rm.OnEditAction, handlerType.String(), handlerType.Kind().String())
 				handlerArgsInterfaces := make([]interface{}, handlerType.NumIn()-1)
 				handlerArgs := make([]reflect.Value, handlerType.NumIn())
 
@@ -427,10 +598,10 @@ func tgCallbackHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Conte
 					dataVal := reflect.New(handlerType.In(i))
 					handlerArgsInterfaces[i-1] = dataVal.Interface()
 				}
-				if err := decode(rm.OnCallbackData, &handlerArgsInterfaces); err != nil {
-					ctx.Log().WithField("handler", rm.OnCallbackAction).WithError(err).Error("Can't decode replyHandler's args")
+				if err := decode(rm.OnEditData, &handlerArgsInterfaces); err != nil {
+					log.WithField("handler", rm.OnEditAction).WithError(err).Error("Can't decode editHandler's args")
 				}
-				handlerArgs[0] = reflect.ValueOf(ctx)
+				handlerArgs[0] = reflect.ValueOf(c)
 				for i := 0; i < len(handlerArgsInterfaces); i++ {
 					handlerArgs[i+1] = reflect.ValueOf(handlerArgsInterfaces[i])
 				}
@@ -442,37 +613,30 @@ func tgCallbackHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Conte
 					if !returnVals[0].IsNil() {
 						err := returnVals[0].Interface().(error)
 						// NOTE: panics will be caught by the recover statement above
-						ctx.Log().WithField("handler", rm.OnCallbackAction).WithError(err).Error("callbackAction failed")
-						ctx.AnswerCallbackQuery("Oops! Please try again", false)
-					} else {
-						if ctx.Callback.AnsweredAt == nil {
-							ctx.AnswerCallbackQuery("", false)
-						}
+						log.WithField("handler", rm.OnEditAction).WithError(err).Error("editHandler failed")
 					}
 				}
 			} else {
-				ctx.Log().WithField("handler", rm.OnCallbackAction).Error("Callback handler not registered")
+				log.WithField("handler", rm.OnEditAction).Error("Edit handler not registered")
 			}
 
 		}
-		return nil, ctx
-	}
-
-	return nil, nil
 
+	}
 }
-func tgInlineQueryHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context) {
+
+func tgInlineQueryHandler(u *tg.Update, b *Bot, db Storage) (*Service, *Context) {
 	service, err := detectServiceByBot(b.ID)
 	if err != nil {
 		log.WithError(err).WithField("bot", b.ID).Error("Can't detect service")
 	}
 	user := tgUser(u.InlineQuery.From)
-	ctx := &Context{ServiceName: service.Name, User: user, db: db, InlineQuery: u.InlineQuery}
+	ctx := &Context{ServiceName: service.Name, User: user, storage: db, InlineQuery: u.InlineQuery}
 	ctx.User.ctx = ctx
 
 	return service, ctx
 }
-func tgChosenInlineResultHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context) {
+func tgChosenInlineResultHandler(u *tg.Update, b *Bot, db Storage) (*Service, *Context) {
 
 	service, err := detectServiceByBot(b.ID)
 	if err != nil {
@@ -480,7 +644,7 @@ func tgChosenInlineResultHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Servi
 	}
 
 	user := tgUser(u.ChosenInlineResult.From)
-	ctx := &Context{ServiceName: service.Name, User: user, db: db, ChosenInlineResult: &chosenInlineResult{ChosenInlineResult: *u.ChosenInlineResult}}
+	ctx := &Context{ServiceName: service.Name, User: user, storage: db, ChosenInlineResult: &chosenInlineResult{ChosenInlineResult: *u.ChosenInlineResult}}
 	ctx.User.ctx = ctx
 	if u.Message != nil {
 		// in case we corellated chosen update and chat message
@@ -524,7 +688,7 @@ func tgChosenInlineResultHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Servi
 	return service, ctx
 }
 
-func tgEditedMessageHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context) {
+func tgEditedMessageHandler(u *tg.Update, b *Bot, db Storage) (*Service, *Context) {
 	im := incomingMessageFromTGMessage(u.EditedMessage)
 	im.BotID = b.ID
 	service, err := detectServiceByBot(b.ID)
@@ -532,7 +696,7 @@ func tgEditedMessageHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *
 	if err != nil {
 		log.WithError(err).WithField("bot", b.ID).Error("Can't detect service")
 	}
-	ctx := &Context{ServiceName: service.Name, Chat: im.Chat, db: db}
+	ctx := &Context{ServiceName: service.Name, Chat: im.Chat, storage: db}
 	if im.From.ID != 0 {
 		ctx.User = im.From
 		ctx.User.ctx = ctx
@@ -541,53 +705,10 @@ func tgEditedMessageHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *
 
 	ctx.Message = &im
 	ctx.MessageEdited = true
-	rm, _ := findMessage(db, im.ChatID, b.ID, im.MsgID)
-	if rm != nil {
-		log.Debugf("Received edit for message %d", rm.MsgID)
-
-		if rm.OnEditAction != "" {
-			log.Debugf("onEditHandler found %s", rm.OnEditAction)
-			// Instantiate a new variable to hold this argument
-			if handler, ok := actionFuncs[service.trimFuncPath(rm.OnEditAction)]; ok {
-				handlerType := reflect.TypeOf(handler)
-				log.Debugf("handler %v: %v %v\n", rm.OnEditAction, handlerType.String(), handlerType.Kind().String())
-				handlerArgsInterfaces := make([]interface{}, handlerType.NumIn()-1)
-				handlerArgs := make([]reflect.Value, handlerType.NumIn())
-
-				for i := 1; i < handlerType.NumIn(); i++ {
-					dataVal := reflect.New(handlerType.In(i))
-					handlerArgsInterfaces[i-1] = dataVal.Interface()
-				}
-				if err := decode(rm.OnEditData, &handlerArgsInterfaces); err != nil {
-					log.WithField("handler", rm.OnEditAction).WithError(err).Error("Can't decode editHandler's args")
-				}
-				handlerArgs[0] = reflect.ValueOf(ctx)
-				for i := 0; i < len(handlerArgsInterfaces); i++ {
-					handlerArgs[i+1] = reflect.ValueOf(handlerArgsInterfaces[i])
-				}
-
-				if len(handlerArgs) > 0 {
-					handlerVal := reflect.ValueOf(handler)
-					returnVals := handlerVal.Call(handlerArgs)
-
-					if !returnVals[0].IsNil() {
-						err := returnVals[0].Interface().(error)
-						// NOTE: panics will be caught by the recover statement above
-						log.WithField("handler", rm.OnEditAction).WithError(err).Error("editHandler failed")
-					}
-				}
-			} else {
-				log.WithField("handler", rm.OnEditAction).Error("Edit handler not registered")
-			}
-
-		}
-
-	}
-
 	return service, ctx
 }
 
-func tgIncomingMessageHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context) {
+func tgIncomingMessageHandler(u *tg.Update, b *Bot, db Storage) (*Service, *Context) {
 	im := incomingMessageFromTGMessage(u.Message)
 	im.BotID = b.ID
 
@@ -596,7 +717,7 @@ func tgIncomingMessageHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service,
 	if err != nil {
 		log.WithError(err).WithField("bot", b.ID).Error("Can't detect service")
 	}
-	ctx := &Context{ServiceName: service.Name, Chat: im.Chat, db: db}
+	ctx := &Context{ServiceName: service.Name, Chat: im.Chat, storage: db}
 	if im.From.ID != 0 {
 		ctx.User = im.From
 		ctx.User.ctx = ctx
@@ -661,7 +782,7 @@ func tgIncomingMessageHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service,
 
 }
 
-func removeHooksForChat(db *mgo.Database, serviceName string, chatID int64) {
+func removeHooksForChat(db Storage, serviceName string, chatID int64) {
 	err := db.C("users").Update(bson.M{"hooks.services": []string{serviceName}, "hooks.chats": chatID}, bson.M{"$pull": bson.M{"hooks.$.chats": chatID}})
 	if err != nil {
 		if err != nil {
@@ -670,7 +791,7 @@ func removeHooksForChat(db *mgo.Database, serviceName string, chatID int64) {
 	}
 }
 
-func migrateToSuperGroup(db *mgo.Database, fromChatID int64, toChatID int64) {
+func migrateToSuperGroup(db Storage, fromChatID int64, toChatID int64) {
 	if fromChatID == toChatID {
 		return
 	}
@@ -704,7 +825,7 @@ func migrateToSuperGroup(db *mgo.Database, fromChatID int64, toChatID int64) {
 		log.WithError(err).Error("migrateToSuperGroup remove outdated hook chats")
 	}
 }
-func tgUpdateHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context) {
+func tgUpdateHandler(u *tg.Update, b *Bot, db Storage) (*Service, *Context) {
 
 	if u.Message != nil && u.ChosenInlineResult == nil {
 		if u.Message.LeftChatMember != nil {
@@ -743,7 +864,7 @@ func tgUpdateHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context
 
 }
 
-/*func (im *IncomingMessage) ButtonAnswer(db *mgo.Database) (key string, text string) {
+/*func (im *IncomingMessage) ButtonAnswer(db Storage) (key string, text string) {
 	if im.Message.ReplyToMsgID == 0 {
 		return
 	}
@@ -759,7 +880,7 @@ func tgUpdateHandler(u *tg.Update, b *Bot, db *mgo.Database) (*Service, *Context
 }*/
 
 // saveToDB stores incoming message metadata to the database
-func (m *Message) saveToDB(db *mgo.Database) error {
+func (m *Message) saveToDB(db Storage) error {
 	// text is excluded, instead saving textHash
 	m.TextHash = m.GetTextHash()
 	return db.C("messages").Insert(m)
@@ -809,7 +930,7 @@ func detectServiceByBot(botID int64) (*Service, error) {
 	return &Service{}, errors.New("Unknown service: " + serviceName)
 
 }
-func (m *Message) detectService(db *mgo.Database) (*Service, error) {
+func (m *Message) detectService(db Storage) (*Service, error) {
 	serviceName := ""
 
 	if m.BotID > 0 {
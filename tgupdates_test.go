@@ -179,3 +179,27 @@ func TestIncomingMessage_GetCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestGetTGUpdates(t *testing.T) {
+	service := &Service{Name: "servicewithpolling"}
+	server, token := newTestBot(t, service, "polling_bot")
+
+	user := tg.User{ID: 7, FirstName: "Jo"}
+	server.SendText(token, tg.Chat{ID: 7, Type: "private"}, user, "hello")
+	server.AnswerPoll(token, user, "poll1", []int{1})
+
+	updates, err := getTGUpdates(service.Bot().API, tg.UpdateConfig{Limit: 100})
+	if err != nil {
+		t.Fatalf("getTGUpdates() error = %v", err)
+	}
+
+	if len(updates) != 2 {
+		t.Fatalf("getTGUpdates() returned %d updates, want 2", len(updates))
+	}
+	if updates[0].Message == nil || updates[0].Message.Text != "hello" || updates[0].PollAnswer != nil {
+		t.Errorf("getTGUpdates()[0] = %+v, want the message", updates[0])
+	}
+	if pa := updates[1].PollAnswer; pa == nil || pa.PollID != "poll1" || pa.User.ID != 7 || len(pa.OptionIDs) != 1 || pa.OptionIDs[0] != 1 {
+		t.Errorf("getTGUpdates()[1] poll answer = %+v, want poll1 answered with option 1 by user 7", pa)
+	}
+}
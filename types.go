@@ -102,6 +102,7 @@ type serviceHook struct {
 	Token    string
 	Services []string // For backward compatibility with universal hook
 	Chats    []int64  `bson:",omitempty"` // Chats that will receive notifications on this hook
+	Secret   string   `bson:",omitempty"` // Used by the service's WebhookVerifier to check the requests
 }
 
 // Struct for user's data. Used to store in MongoDB
@@ -124,11 +125,15 @@ type userProtected struct {
 
 	AfterAuthHandler string // Used to store function that will be called after successful auth. F.e. in case of interactive reply in chat for non-authed user
 	AfterAuthData    []byte // Gob encoded arg's
+
+	Locale string `bson:",omitempty"` // chosen with /language, overrides the Telegram's language
 }
 
 // Core settings for Telegram Chat behavior per Service
 type chatProtected struct {
-	BotStoppedOrKickedAt *time.Time `bson:",omitempty"`  // when we informed that bot was stopped by user
+	BotStoppedOrKickedAt *time.Time  `bson:",omitempty"` // when we informed that bot was stopped by user
+	Locale               string      `bson:",omitempty"` // chosen with /language by the chat's admin, overrides the locales of members
+	QuietHours           *QuietHours `bson:",omitempty"` // notifications are sent silently or deferred within this time
 }
 
 // Struct for chat's data. Used to store in MongoDB
@@ -207,6 +212,11 @@ func (u *User) TzLocation() *time.Location {
 	return tzLocation(u.Tz)
 }
 
+// TzLocation retrieve Chat's timezone if stored in DB
+func (c *Chat) TzLocation() *time.Location {
+	return tzLocation(c.Tz)
+}
+
 // IsGroup returns true if chat is a group chat
 func (c *Chat) IsGroup() bool {
 	if c.ID < 0 {
@@ -0,0 +1,143 @@
+package integram
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultWebhookDedupeWindow is used when Service's WebhookDedupeWindow is not set
+const DefaultWebhookDedupeWindow = 24 * time.Hour
+
+// webhookInFlightTimeout limits how long the delivery ID is held by the request that is still processing it, in case the process died before finishing
+const webhookInFlightTimeout = 5 * time.Minute
+
+// WebhookDeliveryIDFunc returns the unique ID of the webhook delivery that is kept the same for the retries. Empty ID disables the dedupe for this request
+type WebhookDeliveryIDFunc func(wc *WebhookContext) string
+
+var (
+	// GitHubDeliveryID uses X-GitHub-Delivery header
+	GitHubDeliveryID = DeliveryIDHeader("X-GitHub-Delivery")
+
+	// RequestIDHeader uses X-Request-Id header
+	RequestIDHeader = DeliveryIDHeader("X-Request-Id")
+)
+
+// DeliveryIDHeader returns the WebhookDeliveryIDFunc that uses the value of specific header
+func DeliveryIDHeader(header string) WebhookDeliveryIDFunc {
+	return func(wc *WebhookContext) string {
+		return wc.Header(header)
+	}
+}
+
+// PayloadHashDeliveryID uses the SHA1 of the request's body. Useful when the service doesn't provide any delivery ID but retries with the same payload
+func PayloadHashDeliveryID(wc *WebhookContext) string {
+	body, err := wc.RAW()
+	if err != nil || len(*body) == 0 {
+		return ""
+	}
+
+	hash := sha1.Sum(*body)
+	return hex.EncodeToString(hash[:])
+}
+
+type webhookDedupe struct {
+	ID        string `bson:"_id"`
+	InFlight  bool   `bson:",omitempty"` // the first attempt is still processing
+	ExpiresAt time.Time
+}
+
+func (s *Service) webhookDedupeWindow() time.Duration {
+	if s.WebhookDedupeWindow == 0 {
+		return DefaultWebhookDedupeWindow
+	}
+	return s.WebhookDedupeWindow
+}
+
+// isDuplicateWebhook claims the delivery ID of the request. Returns true if the same delivery for this hook was already accepted within the service's WebhookDedupeWindow
+// or is still processing. In the latter case it responds with 503 so the retry will be repeated later.
+// Storage is shared between the processes so the retry is detected in the multi-process mode as well
+func isDuplicateWebhook(ctx *Context, wc *WebhookContext, hookToken string) bool {
+	s := ctx.Service()
+	if s == nil || s.WebhookDeliveryID == nil {
+		return false
+	}
+
+	// replays from the deliveries log are intended to be processed again
+	if _, replay := wc.gin.Get(webhookReplayKey); replay {
+		return false
+	}
+
+	deliveryID := s.WebhookDeliveryID(wc)
+	if deliveryID == "" {
+		return false
+	}
+
+	id := s.Name + ":" + hookToken + ":" + deliveryID
+	now := time.Now()
+	db := ctx.Storage().C("webhook_dedupe")
+
+	err := db.Insert(webhookDedupe{ID: id, InFlight: true, ExpiresAt: now.Add(webhookInFlightTimeout)})
+	if err == nil {
+		wc.dedupeID = id
+		return false
+	}
+
+	if !mgo.IsDup(err) {
+		// better to process the retry than to lose the webhook because of DB fault
+		ctx.Log().WithError(err).Error("Can't save the webhook delivery ID")
+		return false
+	}
+
+	// expired records are removed by the TTL monitor with a delay
+	err = db.Update(bson.M{"_id": id, "expiresat": bson.M{"$lt": now}}, bson.M{"$set": bson.M{"inflight": true, "expiresat": now.Add(webhookInFlightTimeout)}})
+	if err == nil {
+		wc.dedupeID = id
+		return false
+	}
+
+	if err != mgo.ErrNotFound {
+		ctx.Log().WithError(err).Error("Can't update the webhook delivery ID")
+	}
+
+	ctx.StatInc(StatWebhookDuplicate)
+
+	if n, _ := db.Find(bson.M{"_id": id, "inflight": true}).Count(); n > 0 {
+		// the first attempt can still fail, so the retry must not be acknowledged
+		ctx.Log().WithField("delivery", deliveryID).Debug("Webhook delivery is still processing")
+		wc.gin.Header("Retry-After", "30")
+		wc.gin.String(http.StatusServiceUnavailable, "Delivery is still processing")
+		return true
+	}
+
+	ctx.Log().WithField("delivery", deliveryID).Debug("Duplicate webhook delivery skipped")
+	wc.gin.String(http.StatusOK, "Duplicate delivery")
+
+	return true
+}
+
+// releaseWebhookDeliveryID finishes the delivery ID claimed by isDuplicateWebhook. It is removed if the processing failed, so the retry will be processed
+func releaseWebhookDeliveryID(ctx *Context, wc *WebhookContext, status int) {
+	if wc.dedupeID == "" {
+		return
+	}
+
+	db := ctx.Storage().C("webhook_dedupe")
+
+	if status < 300 {
+		err := db.UpdateId(wc.dedupeID, bson.M{"$set": bson.M{"inflight": false, "expiresat": time.Now().Add(ctx.Service().webhookDedupeWindow())}})
+		if err != nil {
+			ctx.Log().WithError(err).Error("Can't update the webhook delivery ID")
+		}
+		return
+	}
+
+	err := db.RemoveId(wc.dedupeID)
+	if err != nil && err != mgo.ErrNotFound {
+		ctx.Log().WithError(err).Error("Can't remove the webhook delivery ID")
+	}
+}
@@ -0,0 +1,81 @@
+package integram
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsDuplicateWebhook(t *testing.T) {
+	calls := 0
+	var handlerErr error
+	service := &Service{
+		Name:              "servicewithdedupe",
+		WebhookDeliveryID: GitHubDeliveryID,
+		TokenHandler: func(c *Context, wc *WebhookContext) (bool, map[string]interface{}, error) {
+			return true, bson.M{"_id": int64(10)}, nil
+		},
+		WebhookHandler: func(c *Context, wc *WebhookContext) error {
+			calls++
+			return handlerErr
+		},
+	}
+	services[service.Name] = service
+	defer delete(services, service.Name)
+
+	db := NewMemoryStorage()
+	db.C("chats").Insert(bson.M{"_id": int64(10)})
+	// the first attempt of delivery 4 is still processing
+	db.C("webhook_dedupe").Insert(webhookDedupe{ID: service.Name + ":token:4", InFlight: true, ExpiresAt: time.Now().Add(time.Minute)})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("storage", db)
+		if c.Query("replay") != "" {
+			c.Set(webhookReplayKey, bson.NewObjectId())
+		}
+		c.Next()
+	})
+	router.POST("/:param1/:param2", serviceHookHandler)
+
+	tests := []struct {
+		name       string
+		deliveryID string
+		query      string
+		handlerErr error
+		wantStatus int
+		wantCalls  int
+	}{
+		{"first", "1", "", nil, http.StatusAccepted, 1},
+		{"retry", "1", "", nil, http.StatusOK, 0},
+		{"another", "2", "", nil, http.StatusAccepted, 1},
+		{"replay", "2", "?replay=1", nil, http.StatusAccepted, 1},
+		{"without id", "", "", nil, http.StatusAccepted, 1},
+		{"failed", "3", "", ErrorFlood, http.StatusTooManyRequests, 1},
+		{"retry after fail", "3", "", nil, http.StatusAccepted, 1},
+		{"retry after success", "3", "", nil, http.StatusOK, 0},
+		{"retry while processing", "4", "", nil, http.StatusServiceUnavailable, 0},
+	}
+	for _, tt := range tests {
+		calls, handlerErr = 0, tt.handlerErr
+
+		req := httptest.NewRequest("POST", "/"+service.Name+"/token"+tt.query, bytes.NewBufferString("{}"))
+		if tt.deliveryID != "" {
+			req.Header.Set("X-GitHub-Delivery", tt.deliveryID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q. status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("%q. WebhookHandler calls = %d, want %d", tt.name, calls, tt.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package integram
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxWebhookDeliveryBodySize limits the stored body. Deliveries with bigger body can't be replayed
+const maxWebhookDeliveryBodySize = 512 * 1024
+
+// webhookReplayKey is set within the gin.Context when the delivery is replayed
+const webhookReplayKey = "webhookReplayOf"
+
+const webhookDeliveriesCommandName = "webhooks"
+
+// ErrWebhookDeliveryNotReplayable returned when delivery's body was truncated
+var ErrWebhookDeliveryNotReplayable = errors.New("delivery body is too big to be replayed")
+
+// WebhookDeliveriesCommand lists the recent webhook deliveries within the chat and replays them with "/webhooks replay <id>". Add it to the service's Commands to enable
+var WebhookDeliveriesCommand = Command{
+	Name:        webhookDeliveriesCommandName,
+	Description: "Recent webhook deliveries",
+	AdminOnly:   true,
+	Handler:     webhookDeliveriesCommandHandler,
+}
+
+// WebhookDelivery is the stored incoming webhook request with the result of its processing
+type WebhookDelivery struct {
+	ID        bson.ObjectId `bson:"_id"`
+	RequestID string
+	Service   string
+	HookToken string
+	ReplayOf  bson.ObjectId `bson:",omitempty"`
+
+	Method    string
+	Path      string
+	Headers   http.Header // without the secrets and signatures, see redactWebhookHeaders
+	Body      []byte
+	Truncated bool // body exceeded the maxWebhookDeliveryBodySize and wasn't stored
+
+	Status       int      // HTTP status code of the response
+	Errors       []string `bson:",omitempty"` // WebhookHandler errors per chat
+	Chats        []int64  `bson:",omitempty"` // Chats the webhook was dispatched to
+	MessageChats []int64  `bson:",omitempty"` // Chats that received messages
+
+	ReceivedAt time.Time
+	ExpiresAt  time.Time
+}
+
+// startWebhookDelivery reads the request to store it after the processing. Returns nil if deliveries log is disabled
+func startWebhookDelivery(c *gin.Context, wc *WebhookContext, hookToken string) *WebhookDelivery {
+	if Config.WebhookLogSize == 0 || Config.IsMainInstance() || c.Request.Method != "POST" {
+		return nil
+	}
+
+	d := &WebhookDelivery{
+		ID:         bson.NewObjectId(),
+		RequestID:  wc.RequestID(),
+		HookToken:  hookToken,
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.RequestURI(),
+		Headers:    redactWebhookHeaders(c.Request.Header),
+		ReceivedAt: time.Now(),
+	}
+
+	if id, exists := c.Get(webhookReplayKey); exists {
+		d.ReplayOf = id.(bson.ObjectId)
+	}
+
+	body, err := wc.RAW()
+	if err != nil {
+		d.Errors = append(d.Errors, "can't read body: "+err.Error())
+	} else if len(*body) > maxWebhookDeliveryBodySize {
+		d.Truncated = true
+	} else {
+		d.Body = *body
+	}
+
+	// restore the body so it can be parsed with Form()
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(wc.body))
+
+	wc.delivery = d
+	return d
+}
+
+// redactWebhookHeaders returns the copy of headers without the ones that can contain secrets or signatures
+func redactWebhookHeaders(headers http.Header) http.Header {
+	res := http.Header{}
+	for key, values := range headers {
+		lower := strings.ToLower(key)
+		if lower == "authorization" || lower == "cookie" || strings.Contains(lower, "token") || strings.Contains(lower, "secret") || strings.Contains(lower, "signature") {
+			continue
+		}
+		res[key] = values
+	}
+	return res
+}
+
+// addResult stores the WebhookHandler's result for the chat
+func (d *WebhookDelivery) addResult(chatID int64, messageProduced bool, err error) {
+	if d == nil {
+		return
+	}
+
+	d.Chats = append(d.Chats, chatID)
+
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Sprintf("%d: %s", chatID, err.Error()))
+	} else if messageProduced {
+		d.MessageChats = append(d.MessageChats, chatID)
+	}
+}
+
+// save stores the delivery and removes the old ones above Config.WebhookLogSize for the same hook
+func (d *WebhookDelivery) save(ctx *Context, status int) {
+	if d == nil || ctx.ServiceName == "" || status == http.StatusNotFound {
+		return
+	}
+
+	d.Service = ctx.ServiceName
+	d.Status = status
+	d.ExpiresAt = d.ReceivedAt.Add(time.Duration(Config.WebhookLogTTLInHours) * time.Hour)
+
+	db := ctx.Storage()
+	err := db.C("webhook_deliveries").Insert(d)
+	if err != nil {
+		ctx.Log().WithError(err).Error("Can't save the webhook delivery")
+		return
+	}
+
+	var outdated []WebhookDelivery
+	err = db.C("webhook_deliveries").Find(bson.M{"service": d.Service, "hooktoken": d.HookToken}).Sort("-receivedat", "-_id").Skip(Config.WebhookLogSize).Select(bson.M{"_id": 1}).All(&outdated)
+	if err != nil || len(outdated) == 0 {
+		return
+	}
+
+	ids := make([]bson.ObjectId, len(outdated))
+	for i, od := range outdated {
+		ids[i] = od.ID
+	}
+	db.C("webhook_deliveries").RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+}
+
+// webhookDeliveriesQuery returns the query for deliveries of the chat's own hooks or the user's hooks dispatched to this chat
+func (c *Context) webhookDeliveriesQuery() bson.M {
+	or := []bson.M{{"chats": c.Chat.ID}}
+
+	if data, _ := c.Chat.getData(); data != nil {
+		var tokens []string
+		for _, hook := range data.Hooks {
+			tokens = append(tokens, hook.Token)
+		}
+
+		if len(tokens) > 0 {
+			or = append(or, bson.M{"hooktoken": bson.M{"$in": tokens}})
+		}
+	}
+	return bson.M{"service": c.ServiceName, "$or": or}
+}
+
+// WebhookDeliveries returns the recent webhook deliveries within the current chat, newest first
+func (c *Context) WebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := c.Storage().C("webhook_deliveries").Find(c.webhookDeliveriesQuery()).Sort("-receivedat", "-_id").Limit(limit).All(&deliveries)
+	return deliveries, err
+}
+
+// ReplayWebhookDelivery runs the delivery with specific ID through the webhook handling again. Returns the response HTTP status code
+func (c *Context) ReplayWebhookDelivery(id string) (int, error) {
+	if !bson.IsObjectIdHex(id) {
+		return 0, errors.New("wrong delivery ID")
+	}
+
+	query := c.webhookDeliveriesQuery()
+	query["_id"] = bson.ObjectIdHex(id)
+
+	d := WebhookDelivery{}
+	err := c.Storage().C("webhook_deliveries").Find(query).One(&d)
+	if err != nil {
+		return 0, err
+	}
+
+	if d.Truncated {
+		return 0, ErrWebhookDeliveryNotReplayable
+	}
+
+	req := httptest.NewRequest(d.Method, d.Path, bytes.NewReader(d.Body))
+	for key, values := range d.Headers {
+		req.Header[key] = values
+	}
+
+	db := c.Storage()
+	router := gin.New()
+	router.Use(func(gc *gin.Context) {
+		gc.Set("storage", db)
+		gc.Set(webhookReplayKey, d.ID)
+		gc.Next()
+	})
+	router.POST("/:param1/:param2", serviceHookHandler)
+	router.POST("/:param1", serviceHookHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w.Code, nil
+}
+
+func webhookDeliveriesCommandHandler(c *Context, args string) error {
+	args = strings.TrimSpace(args)
+
+	if strings.HasPrefix(args, "replay") {
+		id := strings.TrimSpace(strings.TrimPrefix(args, "replay"))
+		status, err := c.ReplayWebhookDelivery(id)
+		if err != nil {
+			return c.NewMessage().SetText(c.T("webhooks.replay_failed", err.Error())).Send()
+		}
+		return c.NewMessage().SetText(c.T("webhooks.replayed", status)).Send()
+	}
+
+	deliveries, err := c.WebhookDeliveries(10)
+	if err != nil {
+		return err
+	}
+
+	if len(deliveries) == 0 {
+		return c.NewMessage().SetText(c.T("webhooks.empty")).Send()
+	}
+
+	text := html.EscapeString(c.T("webhooks.title")) + "\n"
+	for _, d := range deliveries {
+		text += fmt.Sprintf("<code>%s</code> %s – %d", d.ID.Hex(), d.ReceivedAt.In(c.User.TzLocation()).Format("02 Jan 15:04:05"), d.Status)
+		if len(d.MessageChats) > 0 {
+			text += fmt.Sprintf(", %d msg", len(d.MessageChats))
+		}
+		if len(d.Errors) > 0 {
+			text += ", error: " + html.EscapeString(d.Errors[0])
+		}
+		text += "\n"
+	}
+	text += "\n" + html.EscapeString(c.T("webhooks.replay", webhookDeliveriesCommandName))
+
+	return c.NewMessage().SetText(text).EnableHTML().Send()
+}
@@ -0,0 +1,191 @@
+package integram
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestContext_ReplayWebhookDelivery(t *testing.T) {
+	var payloads []string
+	service := &Service{
+		Name: "servicewithwebhookslog",
+		TokenHandler: func(c *Context, wc *WebhookContext) (bool, map[string]interface{}, error) {
+			return true, bson.M{"_id": int64(10)}, nil
+		},
+		WebhookHandler: func(c *Context, wc *WebhookContext) error {
+			body, err := wc.RAW()
+			if err != nil {
+				return err
+			}
+			payloads = append(payloads, string(*body))
+			return nil
+		},
+	}
+	services[service.Name] = service
+	defer delete(services, service.Name)
+
+	defer func(size int) { Config.WebhookLogSize = size }(Config.WebhookLogSize)
+	Config.WebhookLogSize = 2
+
+	db := NewMemoryStorage()
+	db.C("chats").Insert(bson.M{"_id": int64(10)})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("storage", db)
+		c.Next()
+	})
+	router.POST("/:param1/:param2", serviceHookHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/"+service.Name+"/token", bytes.NewBufferString(`{"n":1}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("serviceHookHandler() status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 10}}
+	ctx.Chat.ctx = ctx
+	ctx.SetStorage(db)
+
+	deliveries, err := ctx.WebhookDeliveries(10)
+	if err != nil {
+		t.Fatalf("WebhookDeliveries() error = %v", err)
+	}
+	if len(deliveries) != 1 || string(deliveries[0].Body) != `{"n":1}` || deliveries[0].Status != http.StatusAccepted {
+		t.Fatalf("WebhookDeliveries() = %+v, want 1 delivery with the request body", deliveries)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, err := ctx.ReplayWebhookDelivery(deliveries[0].ID.Hex())
+		if err != nil || status != http.StatusAccepted {
+			t.Fatalf("ReplayWebhookDelivery() = %d, %v, want %d", status, err, http.StatusAccepted)
+		}
+	}
+
+	if len(payloads) != 3 || payloads[2] != `{"n":1}` {
+		t.Errorf("WebhookHandler payloads = %v, want the same payload 3 times", payloads)
+	}
+
+	replayed, err := ctx.WebhookDeliveries(10)
+	if err != nil {
+		t.Fatalf("WebhookDeliveries() error = %v", err)
+	}
+	if len(replayed) != Config.WebhookLogSize {
+		t.Fatalf("WebhookDeliveries() returned %d deliveries, want %d", len(replayed), Config.WebhookLogSize)
+	}
+	for _, d := range replayed {
+		if d.ReplayOf != deliveries[0].ID {
+			t.Errorf("WebhookDeliveries() delivery ReplayOf = %v, want %v", d.ReplayOf, deliveries[0].ID)
+		}
+	}
+
+	other := &Context{ServiceName: service.Name, Chat: Chat{ID: 11}}
+	other.Chat.ctx = other
+	other.SetStorage(db)
+	if _, err := other.ReplayWebhookDelivery(deliveries[0].ID.Hex()); err == nil {
+		t.Errorf("ReplayWebhookDelivery() from the other chat error = nil, want not found")
+	}
+}
+
+func TestContext_ReplayWebhookDelivery_Verified(t *testing.T) {
+	calls := 0
+	service := &Service{
+		Name:            "servicewithverifiedwebhookslog",
+		WebhookVerifier: GitlabToken,
+		WebhookSecret:   "secret",
+		TokenHandler: func(c *Context, wc *WebhookContext) (bool, map[string]interface{}, error) {
+			return true, bson.M{"_id": int64(10)}, nil
+		},
+		WebhookHandler: func(c *Context, wc *WebhookContext) error {
+			calls++
+			return nil
+		},
+	}
+	services[service.Name] = service
+	defer delete(services, service.Name)
+
+	db := NewMemoryStorage()
+	db.C("chats").Insert(bson.M{"_id": int64(10)})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("storage", db)
+		c.Next()
+	})
+	router.POST("/:param1/:param2", serviceHookHandler)
+
+	for _, token := range []string{"wrong", "secret"} {
+		req := httptest.NewRequest("POST", "/"+service.Name+"/token", bytes.NewBufferString(`{}`))
+		req.Header.Set("X-Gitlab-Token", token)
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 10}}
+	ctx.Chat.ctx = ctx
+	ctx.SetStorage(db)
+
+	deliveries, err := ctx.WebhookDeliveries(10)
+	if err != nil {
+		t.Fatalf("WebhookDeliveries() error = %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != http.StatusAccepted {
+		t.Fatalf("WebhookDeliveries() = %+v, want only the verified delivery", deliveries)
+	}
+	if deliveries[0].Headers.Get("X-Gitlab-Token") != "" || deliveries[0].Headers.Get("X-Gitlab-Event") != "Push Hook" {
+		t.Errorf("WebhookDeliveries() headers = %v, want X-Gitlab-Token redacted", deliveries[0].Headers)
+	}
+
+	status, err := ctx.ReplayWebhookDelivery(deliveries[0].ID.Hex())
+	if err != nil || status != http.StatusAccepted {
+		t.Errorf("ReplayWebhookDelivery() = %d, %v, want %d", status, err, http.StatusAccepted)
+	}
+	if calls != 2 {
+		t.Errorf("WebhookHandler calls = %d, want 2", calls)
+	}
+}
+
+func TestWebhookDeliveriesCommandHandler_Translated(t *testing.T) {
+	service := &Service{
+		Name:         "servicewithtranslatedwebhookslog",
+		Translations: Translations{"ru": {"hello": "Привет"}},
+	}
+	newTestBot(t, service, "translated_webhooks_log_bot")
+
+	var sent []string
+	activeMessageSender = fakeMessageSender{sendFunc: func(m *OutgoingMessage) error {
+		sent = append(sent, m.Text)
+		return nil
+	}}
+	defer func() { activeMessageSender = scheduleMessageSender{} }()
+
+	tests := []struct {
+		lang string
+		args string
+		want string
+	}{
+		{"en", "", "No webhook deliveries yet"},
+		{"ru", "", "Вебхуков пока не было"},
+		{"ru", "replay 1", "Не удалось повторить вебхук: wrong delivery ID"},
+	}
+	for _, tt := range tests {
+		sent = nil
+		ctx := &Context{ServiceName: service.Name, Chat: Chat{ID: 12, Type: "private"}, User: User{ID: 12, Lang: tt.lang}}
+		ctx.SetStorage(NewMemoryStorage())
+		ctx.User.ctx = ctx
+		ctx.Chat.ctx = ctx
+
+		err := webhookDeliveriesCommandHandler(ctx, tt.args)
+		if err != nil {
+			t.Errorf("%q. webhookDeliveriesCommandHandler() error = %v", tt.args, err)
+		}
+		if len(sent) != 1 || sent[0] != tt.want {
+			t.Errorf("%q. webhookDeliveriesCommandHandler() sent %q, want %q", tt.args, sent, tt.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package integram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultWebhookReplayWindow is used when TimestampedHMACSignature's Window is not set
+const DefaultWebhookReplayWindow = 5 * time.Minute
+
+var (
+	// ErrWebhookSignature returned when the request's signature or secret doesn't match
+	ErrWebhookSignature = errors.New("webhook signature mismatch")
+
+	// ErrWebhookTimestamp returned when the request's timestamp is outside of the replay window
+	ErrWebhookTimestamp = errors.New("webhook timestamp is outside of the replay window")
+)
+
+var (
+	// HubSignatureSHA1 verifies X-Hub-Signature: sha1=<hex> (GitHub legacy)
+	HubSignatureSHA1 = HMACSignature{Header: "X-Hub-Signature", Prefix: "sha1=", Hash: sha1.New}
+
+	// HubSignatureSHA256 verifies X-Hub-Signature: sha256=<hex> (Bitbucket)
+	HubSignatureSHA256 = HMACSignature{Header: "X-Hub-Signature", Prefix: "sha256=", Hash: sha256.New}
+
+	// GitHubSignatureSHA256 verifies X-Hub-Signature-256: sha256=<hex> (GitHub)
+	GitHubSignatureSHA256 = HMACSignature{Header: "X-Hub-Signature-256", Prefix: "sha256=", Hash: sha256.New}
+
+	// GitlabToken verifies X-Gitlab-Token
+	GitlabToken = SecretHeader{Header: "X-Gitlab-Token"}
+)
+
+// WebhookVerifier checks that the incoming webhook was sent by the party that knows the hook's secret
+type WebhookVerifier interface {
+	Verify(wc *WebhookContext, secret string) error
+}
+
+// HMACSignature verifies the hex encoded HMAC of the request's body sent within the Header
+type HMACSignature struct {
+	Header string
+	Prefix string           // e.g. "sha256="
+	Hash   func() hash.Hash // sha1.New or sha256.New
+}
+
+// SecretHeader verifies the secret sent as is within the Header
+type SecretHeader struct {
+	Header string
+}
+
+// TimestampedHMACSignature verifies the hex encoded HMAC of the timestamp and the request's body.
+// Requests with timestamp outside of the Window are rejected to prevent replays
+type TimestampedHMACSignature struct {
+	Header          string
+	Prefix          string           // e.g. "v0="
+	TimestampHeader string           // Unix time in seconds
+	Format          string           // Format of the signed payload with timestamp and body args, e.g. "v0:%s:%s". Default to "%s.%s"
+	Window          time.Duration    // Default to DefaultWebhookReplayWindow
+	Hash            func() hash.Hash // Default to sha256.New
+}
+
+// Verify implements WebhookVerifier
+func (v HMACSignature) Verify(wc *WebhookContext, secret string) error {
+	body, err := wc.RAW()
+	if err != nil {
+		return err
+	}
+
+	return verifyHMAC(v.Hash, secret, *body, strings.TrimPrefix(wc.Header(v.Header), v.Prefix))
+}
+
+// Verify implements WebhookVerifier
+func (v SecretHeader) Verify(wc *WebhookContext, secret string) error {
+	if subtle.ConstantTimeCompare([]byte(wc.Header(v.Header)), []byte(secret)) != 1 {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+// Verify implements WebhookVerifier
+func (v TimestampedHMACSignature) Verify(wc *WebhookContext, secret string) error {
+	timestamp := wc.Header(v.TimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookTimestamp
+	}
+
+	window := v.Window
+	if window == 0 {
+		window = DefaultWebhookReplayWindow
+	}
+
+	if diff := time.Since(time.Unix(ts, 0)); diff > window || diff < -window {
+		return ErrWebhookTimestamp
+	}
+
+	body, err := wc.RAW()
+	if err != nil {
+		return err
+	}
+
+	format := v.Format
+	if format == "" {
+		format = "%s.%s"
+	}
+
+	h := v.Hash
+	if h == nil {
+		h = sha256.New
+	}
+
+	return verifyHMAC(h, secret, []byte(fmt.Sprintf(format, timestamp, *body)), strings.TrimPrefix(wc.Header(v.Header), v.Prefix))
+}
+
+func verifyHMAC(h func() hash.Hash, secret string, payload []byte, signature string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return ErrWebhookSignature
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(payload)
+
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+// verifyWebhook checks the request with the service's WebhookVerifier. Responds with 401 and returns false if verification failed
+func verifyWebhook(ctx *Context, wc *WebhookContext, secret string) bool {
+	s := ctx.Service()
+	if s == nil || s.WebhookVerifier == nil {
+		return true
+	}
+
+	if _, replay := wc.gin.Get(webhookReplayKey); replay {
+		// deliveries replayed from the log were verified when received. Their secret headers aren't stored
+		return true
+	}
+
+	if secret == "" {
+		// hooks created before the secrets were introduced can't be verified until the user sets up the secret, see ServiceHookSecret
+		ctx.StatInc(StatWebhookUnauthorized)
+		ctx.Log().Error("Webhook rejected: the hook has no secret to verify the request. Show the user ServiceHookSecret to set it up")
+		wc.gin.String(http.StatusUnauthorized, "Webhook secret is not set up")
+		return false
+	}
+
+	err := s.WebhookVerifier.Verify(wc, secret)
+
+	// restore the body so it can be parsed with Form()
+	if wc.body != nil {
+		wc.gin.Request.Body = ioutil.NopCloser(bytes.NewReader(wc.body))
+	}
+
+	if err != nil {
+		ctx.StatInc(StatWebhookUnauthorized)
+		ctx.Log().WithError(err).Warn("Webhook verification failed")
+		wc.gin.String(http.StatusUnauthorized, "Webhook verification failed")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package integram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func testHMAC(h func() hash.Hash, secret string, payload string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerifier_Verify(t *testing.T) {
+	body := `{"action":"opened"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	slack := TimestampedHMACSignature{Header: "X-Slack-Signature", Prefix: "v0=", TimestampHeader: "X-Slack-Request-Timestamp", Format: "v0:%s:%s"}
+
+	tests := []struct {
+		name     string
+		verifier WebhookVerifier
+		headers  map[string]string
+		wantErr  error
+	}{
+		{"sha1", HubSignatureSHA1, map[string]string{"X-Hub-Signature": "sha1=" + testHMAC(sha1.New, "secret", body)}, nil},
+		{"sha1 wrong secret", HubSignatureSHA1, map[string]string{"X-Hub-Signature": "sha1=" + testHMAC(sha1.New, "wrong", body)}, ErrWebhookSignature},
+		{"sha256", GitHubSignatureSHA256, map[string]string{"X-Hub-Signature-256": "sha256=" + testHMAC(sha256.New, "secret", body)}, nil},
+		{"sha256 missing", HubSignatureSHA256, nil, ErrWebhookSignature},
+		{"gitlab", GitlabToken, map[string]string{"X-Gitlab-Token": "secret"}, nil},
+		{"gitlab wrong", GitlabToken, map[string]string{"X-Gitlab-Token": "secret2"}, ErrWebhookSignature},
+		{"timestamped", slack, map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + testHMAC(sha256.New, "secret", "v0:"+now+":"+body)}, nil},
+		{"timestamped replay", slack, map[string]string{"X-Slack-Request-Timestamp": old, "X-Slack-Signature": "v0=" + testHMAC(sha256.New, "secret", "v0:"+old+":"+body)}, ErrWebhookTimestamp},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewBufferString(body))}
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+
+		wc := &WebhookContext{gin: &gin.Context{Request: req}}
+		if err := tt.verifier.Verify(wc, "secret"); err != tt.wantErr {
+			t.Errorf("%q. Verify() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServiceHookHandler_Verify(t *testing.T) {
+	calls := 0
+	handler := func(c *Context, wc *WebhookContext) error {
+		calls++
+		return nil
+	}
+	tokenService := &Service{
+		Name:            "servicewithverifiedtokens",
+		WebhookVerifier: GitlabToken,
+		WebhookSecret:   "secret",
+		TokenHandler: func(c *Context, wc *WebhookContext) (bool, map[string]interface{}, error) {
+			return true, bson.M{"_id": int64(10)}, nil
+		},
+		WebhookHandler: handler,
+	}
+	hookService := &Service{Name: "servicewithverifiedhooks", WebhookVerifier: GitlabToken, WebhookHandler: handler}
+	for _, s := range []*Service{tokenService, hookService} {
+		services[s.Name] = s
+		defer delete(services, s.Name)
+	}
+
+	db := NewMemoryStorage()
+	db.C("chats").Insert(bson.M{"_id": int64(10), "hooks": []bson.M{
+		{"token": "cwithsecret", "services": []string{hookService.Name}, "secret": "secret"},
+		{"token": "cwithoutsecret", "services": []string{hookService.Name}},
+	}})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("storage", db)
+		c.Next()
+	})
+	router.POST("/:param1/:param2", serviceHookHandler)
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		wantCalls  int
+	}{
+		{"TokenHandler", "/" + tokenService.Name + "/token", "secret", http.StatusAccepted, 1},
+		{"TokenHandler wrong secret", "/" + tokenService.Name + "/token", "wrong", http.StatusUnauthorized, 0},
+		{"hook", "/" + hookService.Name + "/cwithsecret", "secret", http.StatusOK, 1},
+		{"hook wrong secret", "/" + hookService.Name + "/cwithsecret", "wrong", http.StatusUnauthorized, 0},
+		{"hook without secret", "/" + hookService.Name + "/cwithoutsecret", "", http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		calls = 0
+
+		req := httptest.NewRequest("POST", tt.path, bytes.NewBufferString("{}"))
+		if tt.token != "" {
+			req.Header.Set("X-Gitlab-Token", tt.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q. status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("%q. WebhookHandler calls = %d, want %d", tt.name, calls, tt.wantCalls)
+		}
+	}
+}